@@ -0,0 +1,314 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/bots"
+	"github.com/go-park-mail-ru/2019_1_HotCode/games"
+	"github.com/go-park-mail-ru/2019_1_HotCode/media"
+	"github.com/go-park-mail-ru/2019_1_HotCode/testutils"
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/jackc/pgx/pgtype"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// чтобы не заваливать всё логами
+	log.SetLevel(log.PanicLevel)
+}
+
+// моки реализуют только то, что нужно этому пакету, остальное упадёт на nil интерфейсе
+
+type UsersTest struct {
+	users.UserAccessObject
+	users map[int64]users.UserModel
+}
+
+func (ut *UsersTest) GetUserByID(id int64) (*users.UserModel, error) {
+	u, ok := ut.users[id]
+	if !ok {
+		return nil, utils.ErrNotExists
+	}
+
+	return &u, nil
+}
+
+func (ut *UsersTest) CheckPassword(u *users.UserModel, password string) bool {
+	return *u.Password == password
+}
+
+func (ut *UsersTest) Delete(userID int64) error {
+	if _, ok := ut.users[userID]; !ok {
+		return utils.ErrNotExists
+	}
+
+	delete(ut.users, userID)
+	return nil
+}
+
+type SessionsTest struct {
+	users.SessionAccessObject
+	sessions map[int64][]*users.Session
+}
+
+func (st *SessionsTest) GetUserSessions(userID int64) ([]*users.Session, error) {
+	return st.sessions[userID], nil
+}
+
+func (st *SessionsTest) DeleteUserSessions(userID int64) error {
+	delete(st.sessions, userID)
+	return nil
+}
+
+type BotsTest struct {
+	bots.BotAccessObject
+	bots []*bots.BotModel
+}
+
+func (bt *BotsTest) GetBotsByAuthorID(authorID int64) ([]*bots.BotModel, error) {
+	return bt.bots, nil
+}
+
+type GamesTest struct {
+	games.GameAccessObject
+	nextFail error
+}
+
+func (gt *GamesTest) GetUserScores(userID int64) ([]*games.UserScoreModel, error) {
+	if gt.nextFail != nil {
+		err := gt.nextFail
+		gt.nextFail = nil
+		return nil, err
+	}
+
+	return []*games.UserScoreModel{
+		{
+			GameSlug:  pgtype.Text{String: "pong", Status: pgtype.Present},
+			GameTitle: pgtype.Text{String: "Pong", Status: pgtype.Present},
+			Score:     pgtype.Int4{Int: 1337, Status: pgtype.Present},
+		},
+	}, nil
+}
+
+type APITokensTest struct {
+	users.APITokenAccessObject
+}
+
+func (at *APITokensTest) GetTokensByUserID(userID int64) ([]*users.APITokenModel, error) {
+	return []*users.APITokenModel{
+		{
+			ID:     pgtype.Int8{Int: 1, Status: pgtype.Present},
+			Name:   pgtype.Text{String: "ci", Status: pgtype.Present},
+			Hash:   pgtype.Bytea{Bytes: []byte("secret hash"), Status: pgtype.Present},
+			Scopes: []string{"bots:write"},
+		},
+	}, nil
+}
+
+type StorageTest struct {
+	media.Storage
+	deleted []string
+}
+
+func (st *StorageTest) Delete(name string) error {
+	st.deleted = append(st.deleted, name)
+	return nil
+}
+
+// newTestHandler хендлер на свежих заглушках, у каждого теста свой
+func newTestHandler() *Handler {
+	password := "dsadasd_dsa"
+	auth := &users.Handler{}
+	auth.Users = &UsersTest{
+		users: map[int64]users.UserModel{
+			1: {
+				ID:        pgtype.Int8{Int: 1, Status: pgtype.Present},
+				Username:  pgtype.Varchar{String: "GDVFox", Status: pgtype.Present},
+				Password:  &password,
+				Active:    pgtype.Bool{Bool: true, Status: pgtype.Present},
+				Role:      pgtype.Varchar{String: "user", Status: pgtype.Present},
+				PhotoUUID: pgtype.UUID{Bytes: [16]byte{1, 2, 3}, Status: pgtype.Present},
+			},
+		},
+	}
+
+	auth.Sessions = &SessionsTest{
+		sessions: map[int64][]*users.Session{
+			1: {
+				{Token: "current", UserID: 1, ExpiresAfter: time.Hour},
+				{Token: "phone", UserID: 1, ExpiresAfter: 2 * time.Hour},
+			},
+		},
+	}
+
+	botsTest := &BotsTest{
+		bots: []*bots.BotModel{
+			{
+				ID:         pgtype.Int8{Int: 1, Status: pgtype.Present},
+				Code:       pgtype.Text{String: "print(1)", Status: pgtype.Present},
+				Language:   pgtype.Varchar{String: "JS", Status: pgtype.Present},
+				IsVerified: pgtype.Bool{Bool: false, Status: pgtype.Present},
+				GameSlug:   pgtype.Varchar{String: "pong", Status: pgtype.Present},
+			},
+			{
+				ID:         pgtype.Int8{Int: 2, Status: pgtype.Present},
+				Code:       pgtype.Text{String: "print(2)", Status: pgtype.Present},
+				Language:   pgtype.Varchar{String: "JS", Status: pgtype.Present},
+				IsVerified: pgtype.Bool{Bool: true, Status: pgtype.Present},
+				GameSlug:   pgtype.Varchar{String: "pong", Status: pgtype.Present},
+			},
+		},
+	}
+
+	auth.APITokens = &APITokensTest{}
+
+	return &Handler{
+		Auth:  auth,
+		Bots:  botsTest,
+		Games: &GamesTest{},
+		Media: &media.Handler{Files: &StorageTest{}},
+	}
+}
+
+func readExport(t *testing.T, body []byte) map[string]string {
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("export is not a zip: %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, f := range archive.File {
+		rc, openErr := f.Open()
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		content, readErr := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		files[f.Name] = string(content)
+	}
+
+	return files
+}
+
+func TestExportAccount(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	ctx := context.WithValue(context.Background(), users.SessionInfoKey, &users.SessionPayload{ID: 1})
+	cookies := []*http.Cookie{{Name: "JSESSIONID", Value: "current"}}
+	resp := testutils.MakeRequest(ctx, http.HandlerFunc(h.ExportAccount), "GET", "/users/me/export", cookies, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("unexpected content type %q", resp.Header().Get("Content-Type"))
+	}
+
+	files := readExport(t, resp.Body.Bytes())
+	for _, name := range []string{"profile.json", "bots.json", "scores.json", "api_tokens.json", "sessions.json",
+		"bots/pong/1.js", "bots/pong/2.js"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("export must contain %s, got %v", name, files)
+		}
+	}
+
+	if files["bots/pong/2.js"] != "print(2)" {
+		t.Fatalf("unexpected bot code %q", files["bots/pong/2.js"])
+	}
+
+	profile := &Profile{}
+	if err := json.Unmarshal([]byte(files["profile.json"]), profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Username != "GDVFox" || profile.PhotoUUID == "" {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+
+	sessions := make([]*Session, 0)
+	if err := json.Unmarshal([]byte(files["sessions.json"]), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || !sessions[0].Current || sessions[1].Current {
+		t.Fatalf("unexpected sessions %s", files["sessions.json"])
+	}
+
+	// секреты сессий и токенов в выгрузку не попадают
+	for name, content := range files {
+		if strings.Contains(content, "phone") || strings.Contains(content, "secret hash") {
+			t.Fatalf("%s leaks secrets: %s", name, content)
+		}
+	}
+
+	// пока ничего не отправили, ошибка уходит обычным ответом
+	h.Games.(*GamesTest).nextFail = utils.ErrInternal
+	resp = testutils.MakeRequest(ctx, http.HandlerFunc(h.ExportAccount), "GET", "/users/me/export", cookies, nil)
+	if resp.Code != http.StatusInternalServerError {
+		t.Fatalf("export with db error: %d", resp.Code)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	ctx := context.WithValue(context.Background(), users.SessionInfoKey, &users.SessionPayload{ID: 1})
+	cases := []*testutils.Case{
+		{ // без пароля
+			Payload:      []byte(`{}`),
+			ExpectedCode: 400,
+			ExpectedBody: `{"password":"required"}`,
+			Method:       "DELETE",
+			Pattern:      "/users/me",
+			Function:     h.DeleteAccount,
+			Context:      ctx,
+		},
+		{ // неверный пароль
+			Payload:      []byte(`{"password":"lol_cheburek"}`),
+			ExpectedCode: 400,
+			ExpectedBody: `{"password":"invalid"}`,
+			Method:       "DELETE",
+			Pattern:      "/users/me",
+			Function:     h.DeleteAccount,
+			Context:      ctx,
+		},
+	}
+	for i, c := range cases {
+		testutils.RunAPITest(t, i, c)
+	}
+
+	if _, err := h.Auth.Users.GetUserByID(1); err != nil {
+		t.Fatal("user must not be deleted with wrong password")
+	}
+
+	resp := testutils.MakeRequest(ctx, http.HandlerFunc(h.DeleteAccount), "DELETE", "/users/me", nil,
+		strings.NewReader(`{"password":"dsadasd_dsa"}`))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", resp.Code, resp.Body.String())
+	}
+
+	if _, err := h.Auth.Users.GetUserByID(1); err != utils.ErrNotExists {
+		t.Fatal("user must be deleted")
+	}
+	if len(h.Auth.Sessions.(*SessionsTest).sessions[1]) != 0 {
+		t.Fatal("sessions must be revoked")
+	}
+	if deleted := h.Media.Files.(*StorageTest).deleted; len(deleted) != 3 {
+		t.Fatalf("photo must be deleted in all sizes, deleted %v", deleted)
+	}
+	if cookie := resp.Header().Get("Set-Cookie"); !strings.Contains(cookie, "JSESSIONID=;") {
+		t.Fatalf("session cookie must be cleared, got %q", cookie)
+	}
+}
@@ -0,0 +1,68 @@
+// Package account выгрузка всех данных юзера и удаление аккаунта.
+//
+// Что происходит при удалении:
+//   - сессии отзываются до удаления, чтобы ни один запрос не прошёл от имени удалённого;
+//   - боты со всеми версиями кода удаляются каскадом: код -- данные автора,
+//     а боты без автора в матчах никому не нужны;
+//   - очки в таблицах лидеров удаляются каскадом, места остальных считаются запросом и сдвигаются сами;
+//   - API токены, привязки к внешним провайдерам и коды восстановления 2FA удаляются каскадом;
+//   - подписки в обе стороны и его события в лентах подписчиков удаляются каскадом;
+//   - история смены ролей самого юзера удаляется, а в записях, где он менял роли другим,
+//     остаётся actor_id = NULL: история модерации сохраняется, но уже без него;
+//   - аватар удаляется из хранилища картинок во всех размерах;
+//   - юзернейм и почта освобождаются сразу.
+package account
+
+import (
+	"net/http"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+)
+
+// DeleteAccount удаляет аккаунт текущего юзера, требует текущий пароль
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "DeleteAccount")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := users.SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	user, err := h.Auth.CheckCurrentPassword(info, r)
+	if err == nil {
+		err = h.Auth.Sessions.DeleteUserSessions(info.ID)
+	}
+	if err == nil {
+		err = h.Auth.Users.Delete(info.ID)
+	}
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "delete account error"))
+		}
+		return
+	}
+
+	// юзера уже нет, так что ошибку только логируем: картинку без ссылок на неё никто не найдёт
+	if user.PhotoUUID.Status == pgtype.Present {
+		if err = h.Media.DeleteImage(uuid.UUID(user.PhotoUUID.Bytes)); err != nil {
+			logger.Errorf("delete photo of user %d error: %+v", info.ID, err)
+		}
+	}
+
+	logger.Infof("user %d deleted account", info.ID)
+	h.Auth.ClearSessionCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,232 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/bots"
+	"github.com/go-park-mail-ru/2019_1_HotCode/games"
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+)
+
+// расширения файлов с кодом ботов
+var languageExt = map[string]string{
+	"JS": ".js",
+}
+
+// export всё, что попадёт в архив. Собираем заранее: пока в ответ
+// ничего не записано, об ошибке ещё можно сообщить статусом
+type export struct {
+	profile   *Profile
+	bots      []*bots.BotModel
+	scores    []*games.UserScoreModel
+	tokens    []*users.APITokenModel
+	sessions  []*Session // nil, если хранилище сессий не умеет их перечислять
+	createdAt time.Time
+}
+
+// ExportAccount отдаёт zip со всеми данными текущего юзера
+func (h *Handler) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "ExportAccount")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := users.SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	data, err := h.collectExport(info.ID, sessionToken(r))
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "collect export error"))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="warscript-`+strconv.FormatInt(info.ID, 10)+`.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	// статус уже ушёл, клиент получит битый архив
+	if err = writeExport(w, data); err != nil {
+		logger.Errorf("write export error: %+v", err)
+		return
+	}
+
+	logger.Infof("user %d exported account", info.ID)
+}
+
+func sessionToken(r *http.Request) string {
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+func (h *Handler) collectExport(userID int64, current string) (*export, error) {
+	user, err := h.Auth.Users.GetUserByID(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get user error")
+	}
+
+	data := &export{
+		profile:   newProfile(user),
+		createdAt: time.Now(),
+	}
+	data.profile.ExportedAt = data.createdAt
+
+	if data.bots, err = h.Bots.GetBotsByAuthorID(userID); err != nil {
+		return nil, errors.Wrap(err, "get bots error")
+	}
+
+	if data.scores, err = h.Games.GetUserScores(userID); err != nil {
+		return nil, errors.Wrap(err, "get scores error")
+	}
+
+	if data.tokens, err = h.Auth.APITokens.GetTokensByUserID(userID); err != nil {
+		return nil, errors.Wrap(err, "get api tokens error")
+	}
+
+	if lister, ok := h.Auth.Sessions.(users.SessionLister); ok {
+		sessions, listErr := lister.GetUserSessions(userID)
+		if listErr != nil {
+			return nil, errors.Wrap(listErr, "get sessions error")
+		}
+
+		data.sessions = make([]*Session, len(sessions))
+		for i, s := range sessions {
+			data.sessions[i] = &Session{
+				Current:   s.Token == current,
+				ExpiresAt: data.createdAt.Add(s.ExpiresAfter).Truncate(time.Second),
+			}
+		}
+	}
+
+	return data, nil
+}
+
+func newProfile(user *users.UserModel) *Profile {
+	p := &Profile{
+		ID:            user.ID.Int,
+		Username:      user.Username.String,
+		Email:         user.Email.String,
+		EmailVerified: user.EmailVerified.Bool,
+		Role:          users.Role(user.Role.String),
+		Active:        user.Active.Bool,
+		BanReason:     user.BanReason.String,
+		TOTPEnabled:   user.TOTPEnabled.Bool,
+	}
+	if user.PhotoUUID.Status == pgtype.Present {
+		p.PhotoUUID = uuid.UUID(user.PhotoUUID.Bytes).String()
+	}
+	if user.BannedUntil.Status == pgtype.Present {
+		p.BannedUntil = &user.BannedUntil.Time
+	}
+
+	return p
+}
+
+func writeExport(w io.Writer, data *export) error {
+	archive := zip.NewWriter(w)
+
+	botFiles := make([]*Bot, 0, len(data.bots))
+	for _, b := range data.bots {
+		file := "bots/" + b.GameSlug.String + "/" + strconv.FormatInt(b.ID.Int, 10) + botExt(b.Language.String)
+		if err := writeFile(archive, file, data.createdAt, strings.NewReader(b.Code.String)); err != nil {
+			return err
+		}
+
+		botFiles = append(botFiles, &Bot{
+			ID:         b.ID.Int,
+			GameSlug:   b.GameSlug.String,
+			Language:   b.Language.String,
+			IsActive:   b.IsActive.Bool,
+			IsVerified: b.IsVerified.Bool,
+			File:       file,
+		})
+	}
+
+	scores := make([]*Score, len(data.scores))
+	for i, s := range data.scores {
+		scores[i] = &Score{GameSlug: s.GameSlug.String, GameTitle: s.GameTitle.String, Score: s.Score.Int}
+	}
+
+	tokens := make([]users.APIToken, len(data.tokens))
+	for i, t := range data.tokens {
+		tokens[i] = users.APITokenFromModel(t)
+	}
+
+	files := []jsonFile{
+		{"profile.json", data.profile},
+		{"bots.json", botFiles},
+		{"scores.json", scores},
+		{"api_tokens.json", tokens},
+	}
+	if data.sessions != nil {
+		files = append(files, jsonFile{"sessions.json", data.sessions})
+	}
+
+	for _, f := range files {
+		if err := writeJSONFile(archive, f.name, data.createdAt, f.value); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(archive.Close(), "zip close error")
+}
+
+type jsonFile struct {
+	name  string
+	value interface{}
+}
+
+func botExt(language string) string {
+	if ext, ok := languageExt[language]; ok {
+		return ext
+	}
+
+	return ".txt"
+}
+
+func writeFile(archive *zip.Writer, name string, modified time.Time, content io.Reader) error {
+	f, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "zip create %s error", name)
+	}
+
+	if _, err = io.Copy(f, content); err != nil {
+		return errors.Wrapf(err, "zip write %s error", name)
+	}
+
+	return nil
+}
+
+func writeJSONFile(archive *zip.Writer, name string, modified time.Time, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "marshal %s error", name)
+	}
+
+	return writeFile(archive, name, modified, bytes.NewReader(content))
+}
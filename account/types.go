@@ -0,0 +1,59 @@
+package account
+
+import (
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/bots"
+	"github.com/go-park-mail-ru/2019_1_HotCode/games"
+	"github.com/go-park-mail-ru/2019_1_HotCode/media"
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+)
+
+// Handler ручки аккаунта, собирается в main.
+// Данные аккаунта разбросаны по пакетам, поэтому и зависимости у него чужие
+type Handler struct {
+	// Auth юзеры, сессии и токены
+	Auth  *users.Handler
+	Bots  bots.BotAccessObject
+	Games games.GameAccessObject
+	// Media хранилище аватаров
+	Media *media.Handler
+}
+
+// Profile профиль в выгрузке, в отличие от публичного -- со всеми полями
+type Profile struct {
+	ID            int64      `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email,omitempty"`
+	EmailVerified bool       `json:"email_verified"`
+	PhotoUUID     string     `json:"photo_uuid,omitempty"`
+	Role          users.Role `json:"role"`
+	Active        bool       `json:"active"`
+	BanReason     string     `json:"ban_reason,omitempty"`
+	BannedUntil   *time.Time `json:"banned_until,omitempty"`
+	TOTPEnabled   bool       `json:"totp_enabled"`
+	ExportedAt    time.Time  `json:"exported_at"`
+}
+
+// Bot версия бота в выгрузке, сам код лежит рядом в File
+type Bot struct {
+	ID         int64  `json:"id"`
+	GameSlug   string `json:"game_slug"`
+	Language   string `json:"lang"`
+	IsActive   bool   `json:"is_active"`
+	IsVerified bool   `json:"is_verified"`
+	File       string `json:"file"`
+}
+
+// Score очки в игре, других результатов матчей мы не храним
+type Score struct {
+	GameSlug  string `json:"game_slug"`
+	GameTitle string `json:"game_title"`
+	Score     int32  `json:"score"`
+}
+
+// Session активная сессия, сам токен не выгружаем
+type Session struct {
+	Current   bool      `json:"current"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
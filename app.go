@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-redis/redis"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/account"
+	"github.com/go-park-mail-ru/2019_1_HotCode/bots"
+	"github.com/go-park-mail-ru/2019_1_HotCode/bruteforce"
+	"github.com/go-park-mail-ru/2019_1_HotCode/config"
+	"github.com/go-park-mail-ru/2019_1_HotCode/database"
+	"github.com/go-park-mail-ru/2019_1_HotCode/games"
+	"github.com/go-park-mail-ru/2019_1_HotCode/health"
+	"github.com/go-park-mail-ru/2019_1_HotCode/mailer"
+	"github.com/go-park-mail-ru/2019_1_HotCode/media"
+	"github.com/go-park-mail-ru/2019_1_HotCode/notify"
+	"github.com/go-park-mail-ru/2019_1_HotCode/password"
+	"github.com/go-park-mail-ru/2019_1_HotCode/queue"
+	"github.com/go-park-mail-ru/2019_1_HotCode/social"
+	"github.com/go-park-mail-ru/2019_1_HotCode/storage"
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+)
+
+// App соединения приложения и собранные поверх них хендлеры.
+// У пакетов своего состояния нет, всё, что им нужно, приходит отсюда
+type App struct {
+	Config *config.Config
+
+	DB    *pgx.ConnPool
+	Redis *redis.Client
+	// Queue nil, пока тестирующая система не подключена
+	Queue *queue.Queue
+	Hub   *notify.Hub
+
+	broker *notify.RedisBroker
+
+	// ClientIP откуда брать адрес клиента лимитеру, защите входа и логам
+	ClientIP utils.ClientIPResolver
+
+	Users   *users.Handler
+	Games   *games.Handler
+	Bots    *bots.Handler
+	Media   *media.Handler
+	Social  *social.Handler
+	Account *account.Handler
+	Health  *health.Handler
+}
+
+// NewApp подключается к базе и redis и собирает хендлеры по конфигу.
+// Закрывает всё App.Close
+func NewApp(cfg *config.Config) (*App, error) {
+	app := &App{
+		Config:   cfg,
+		ClientIP: utils.ClientIPResolver{TrustProxy: cfg.TrustProxy},
+	}
+	if err := app.connect(); err != nil {
+		app.Close()
+		return nil, err
+	}
+
+	if err := app.wire(); err != nil {
+		app.Close()
+		return nil, err
+	}
+
+	return app, nil
+}
+
+func (app *App) connect() error {
+	var err error
+	db := app.Config.DB
+	app.DB, err = database.Connect(db.User, db.Pass, db.Host, db.Port, db.Name)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to db")
+	}
+
+	st := app.Config.Storage
+	app.Redis, err = storage.Connect(st.User, st.Pass, st.Host)
+	if err != nil {
+		return errors.Wrap(err, "cant connect to session storage")
+	}
+
+	// q := app.Config.Queue
+	// app.Queue, err = queue.Connect(q.User, q.Pass, q.Host, q.Port)
+	// if err != nil {
+	// 	return errors.Wrap(err, "can not connect to queue processor")
+	// }
+
+	return nil
+}
+
+func (app *App) wire() error {
+	// экземпляров может быть несколько, уведомления между ними ходят через redis
+	app.broker = notify.NewRedisBroker(app.Redis)
+	app.Hub = notify.NewHub(app.broker)
+	app.Hub.History = notify.NewRedisHistory(app.Redis)
+	if err := configureHub(app.Hub, app.Config.Notify); err != nil {
+		return errors.Wrap(err, "wrong notify config")
+	}
+
+	files, err := media.NewLocalStorage(app.Config.MediaRoot)
+	if err != nil {
+		return errors.Wrap(err, "cant open media storage")
+	}
+	app.Media = &media.Handler{Files: files}
+
+	if app.Users, err = app.newUsersHandler(); err != nil {
+		return err
+	}
+
+	gamesDAO := &games.AccessObject{DB: app.DB}
+	app.Games = &games.Handler{Games: gamesDAO}
+
+	tester := &bots.AMQPTester{}
+	if app.Queue != nil {
+		tester.Channel = app.Queue.Channel
+	}
+	app.Bots = &bots.Handler{
+		Bots:   &bots.AccessObject{DB: app.DB, Games: gamesDAO},
+		Games:  gamesDAO,
+		Tester: tester,
+		Hub:    app.Hub,
+	}
+	app.Games.OnBotCodeChange(app.Bots.OnBotCodeChange)
+
+	app.Social = &social.Handler{
+		Follows: &social.AccessObject{DB: app.DB},
+		Feed:    &social.RedisFeedCache{Redis: app.Redis, TTL: social.FeedCacheTTL},
+	}
+	app.Account = &account.Handler{
+		Auth:  app.Users,
+		Bots:  app.Bots.Bots,
+		Games: gamesDAO,
+		Media: app.Media,
+	}
+
+	app.Health = app.newHealthHandler()
+
+	go app.Hub.Run()
+	return nil
+}
+
+// newHealthHandler проверки и отчёты по соединениям App
+func (app *App) newHealthHandler() *health.Handler {
+	h := &health.Handler{
+		Timeout: app.Config.Server.CheckTimeout,
+		Checks: []health.Check{
+			{Name: "postgres", Ping: func(ctx context.Context) error {
+				return database.Ping(ctx, app.DB)
+			}},
+			{Name: "redis", Ping: func(ctx context.Context) error {
+				return storage.Ping(ctx, app.Redis)
+			}},
+		},
+		Reports: map[string]health.Report{
+			"postgres": app.dbStats,
+			"redis":    app.redisStats,
+			"notify": func() (interface{}, error) {
+				return app.Hub.Stats(), nil
+			},
+			"bots": func() (interface{}, error) {
+				return &health.BotsStats{Verifying: app.Bots.Verifying()}, nil
+			},
+			"queues": app.queueStats,
+		},
+	}
+
+	// без тестирующей системы экземпляр всё равно обслуживает всё, кроме проверки ботов
+	if app.Queue != nil {
+		h.Checks = append(h.Checks, health.Check{Name: "rabbitmq", Ping: func(context.Context) error {
+			return app.Queue.Ping()
+		}})
+	}
+
+	return h
+}
+
+func (app *App) dbStats() (interface{}, error) {
+	stat := app.DB.Stat()
+	return &health.DBStats{
+		MaxConnections:       stat.MaxConnections,
+		CurrentConnections:   stat.CurrentConnections,
+		AvailableConnections: stat.AvailableConnections,
+	}, nil
+}
+
+func (app *App) redisStats() (interface{}, error) {
+	stats := app.Redis.PoolStats()
+	return &health.RedisStats{
+		Hits:       stats.Hits,
+		Misses:     stats.Misses,
+		Timeouts:   stats.Timeouts,
+		TotalConns: stats.TotalConns,
+		IdleConns:  stats.IdleConns,
+		StaleConns: stats.StaleConns,
+	}, nil
+}
+
+// queueStats глубина очередей, которые читает тестирующая система
+func (app *App) queueStats() (interface{}, error) {
+	if app.Queue == nil {
+		return nil, errors.New("queue is not connected")
+	}
+
+	stats := make(map[string]*health.QueueStats)
+	for _, name := range []string{bots.TesterQueueName} {
+		q, err := app.Queue.Inspect(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inspect %s", name)
+		}
+		stats[name] = &health.QueueStats{Messages: q.Messages, Consumers: q.Consumers}
+	}
+
+	return stats, nil
+}
+
+// newUsersHandler юзеры, сессии и всё, что нужно для входа
+func (app *App) newUsersHandler() (*users.Handler, error) {
+	cfg := app.Config
+	h := &users.Handler{
+		APITokens:   &users.APITokensDB{DB: app.DB},
+		Tokens:      &users.TokenStore{Secret: []byte(cfg.TokenSecret), Redis: app.Redis},
+		FrontendURL: cfg.FrontendURL,
+		ClientIP:    app.ClientIP,
+		CSRFSecret:  []byte(cfg.CSRFSecret),
+	}
+
+	if smtp := cfg.SMTP; smtp.Host != "" {
+		h.Mail = mailer.NewSMTPMailer(smtp.Host, smtp.Port, smtp.User, smtp.Pass, smtp.From)
+	} else {
+		// локально письма складываем в файл или лог
+		h.Mail = &mailer.LogMailer{Path: cfg.MailFile}
+	}
+
+	var err error
+	if h.Cookie, err = sessionCookieConfig(cfg.Cookie); err != nil {
+		return nil, errors.Wrap(err, "wrong cookie config")
+	}
+	if h.Sessions, err = sessionBackend(app.Redis, cfg.Session); err != nil {
+		return nil, errors.Wrap(err, "wrong session config")
+	}
+	if h.OIDCProviders, err = oidcProviders(cfg.OIDC); err != nil {
+		return nil, errors.Wrap(err, "wrong oidc config")
+	}
+
+	pwdConfig, err := passwordConfig(cfg.Password)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrong password hashing config")
+	}
+	h.Users = &users.AccessObject{DB: app.DB, Hasher: &password.Hasher{Config: pwdConfig}}
+
+	guardConfig, err := loginGuardConfig(cfg.Login)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrong login guard config")
+	}
+	h.LoginGuard = bruteforce.NewGuard(bruteforce.NewRedisStore(app.Redis), guardConfig)
+
+	return h, nil
+}
+
+// Close закрывает соединения в обратном порядке, незакрытые пропускает
+func (app *App) Close() {
+	if app.Users != nil {
+		if closer, ok := app.Users.Sessions.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	if app.broker != nil {
+		app.broker.Close()
+	}
+	if app.Queue != nil {
+		app.Queue.Close()
+	}
+	if app.Redis != nil {
+		app.Redis.Close()
+	}
+	if app.DB != nil {
+		app.DB.Close()
+	}
+}
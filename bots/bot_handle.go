@@ -2,19 +2,31 @@ package bots
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/go-park-mail-ru/2019_1_HotCode/games"
+	"github.com/go-park-mail-ru/2019_1_HotCode/notify"
 	"github.com/go-park-mail-ru/2019_1_HotCode/users"
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-
 	"github.com/jackc/pgx/pgtype"
 	"github.com/pkg/errors"
 )
 
-func CreateBot(w http.ResponseWriter, r *http.Request) {
+// Handler ручки ботов, собирается в main
+type Handler struct {
+	Bots   BotAccessObject
+	Games  games.GameAccessObject
+	Tester Tester
+	// Hub шлюз, через который автор узнаёт статус проверки
+	Hub *notify.Hub
+
+	// verifications проверки, которые ещё ждут ответов тестирующей системы
+	verificationsMu sync.Mutex
+	verifications   map[*verification]struct{}
+}
+
+func (h *Handler) CreateBot(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "CreateBot")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	info := users.SessionInfo(r)
@@ -43,8 +55,8 @@ func CreateBot(w http.ResponseWriter, r *http.Request) {
 		AuthorID: pgtype.Int8{Int: info.ID, Status: pgtype.Present},
 	}
 
-	game, _ := games.Games.GetGameBySlug(form.GameSlug)
-	if err = Bots.Create(bot); err != nil {
+	game, _ := h.Games.GetGameBySlug(form.GameSlug)
+	if err = h.Bots.Create(bot); err != nil {
 		switch errors.Cause(err) {
 		case utils.ErrNotExists:
 			errWriter.WriteValidationError(&utils.ValidationError{
@@ -73,7 +85,7 @@ func CreateBot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// делаем RPC запрос
-	events, err := sendForVerifyRPC(&TestTask{
+	events, err := h.Tester.Verify(&TestTask{
 		Code1:    form.Code,
 		Code2:    game.BotCode.String,
 		GameSlug: game.Slug.String,
@@ -85,12 +97,12 @@ func CreateBot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// запускаем обработчик ответа RPC
-	go processTestingStatus(bot.ID.Int, info.ID, bot.GameSlug.String, h.broadcast, events)
+	h.startVerification(bot.ID.Int, info.ID, bot.GameSlug.String, events)
 	utils.WriteApplicationJSON(w, http.StatusOK, botFull)
 }
 
 // GetBotsList TODO: author_id parameter
-func GetBotsList(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetBotsList(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "GetBotsList")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	info := users.SessionInfo(r)
@@ -103,9 +115,9 @@ func GetBotsList(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var bots []*BotModel
 	if gameSlug == "" {
-		bots, err = Bots.GetBotsByAuthorID(info.ID)
+		bots, err = h.Bots.GetBotsByAuthorID(info.ID)
 	} else {
-		bots, err = Bots.GetBotsByGameSlugAndAuthorID(info.ID, gameSlug)
+		bots, err = h.Bots.GetBotsByGameSlugAndAuthorID(info.ID, gameSlug)
 	}
 	if err != nil {
 		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get bot method error"))
@@ -126,40 +138,20 @@ func GetBotsList(w http.ResponseWriter, r *http.Request) {
 	utils.WriteApplicationJSON(w, http.StatusOK, respBots)
 }
 
-func OpenVerifyWS(w http.ResponseWriter, r *http.Request) {
-	logger := utils.GetLogger(r, "GetBotsList")
-	errWriter := utils.NewErrorResponseWriter(w, logger)
-	info := users.SessionInfo(r)
-	if info == nil {
-		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
-		return
-	}
-
-	gameSlug := r.URL.Query().Get("game_slug")
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // мы уже прошли слой CORS
-		},
-	}
-	c, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "upgrade to websocket error"))
-		return
-	}
-
-	sessionID := uuid.New().String()
-	verifyClient := &BotVerifyClient{
-		SessionID: sessionID,
-		UserID:    info.ID,
-		//UserID:    1,
-		GameSlug: gameSlug,
-
-		h:    h,
-		conn: c,
-		send: make(chan *BotVerifyStatusMessage),
-	}
-	verifyClient.h.register <- verifyClient
+// OpenVerifyWS старый сокет статусов проверки, теперь это подписка на bot_status
+// в шлюзе notify без конверта, чтобы не ломать уже написанных клиентов.
+// С ?since=<seq> сначала придут статусы, пропущенные после этого seq
+func (h *Handler) OpenVerifyWS(w http.ResponseWriter, r *http.Request) {
+	h.Hub.Serve(w, r, []notify.Subscription{{
+		Topic:    notify.TopicBotStatus,
+		GameSlug: r.URL.Query().Get("game_slug"),
+	}}, true)
+}
 
-	go verifyClient.WriteStatusUpdates()
-	go verifyClient.WaitForClose()
+// OpenVerifySSE то же, что OpenVerifyWS, но через Server-Sent Events
+func (h *Handler) OpenVerifySSE(w http.ResponseWriter, r *http.Request) {
+	h.Hub.ServeSSE(w, r, []notify.Subscription{{
+		Topic:    notify.TopicBotStatus,
+		GameSlug: r.URL.Query().Get("game_slug"),
+	}})
 }
@@ -3,7 +3,6 @@ package bots
 import (
 	"crypto/sha1"
 
-	"github.com/go-park-mail-ru/2019_1_HotCode/database"
 	"github.com/go-park-mail-ru/2019_1_HotCode/games"
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
@@ -19,15 +18,16 @@ type BotAccessObject interface {
 	SetBotVerifiedByID(botID int64, isActive bool) error
 	GetBotsByAuthorID(authorID int64) ([]*BotModel, error)
 	GetBotsByGameSlugAndAuthorID(authorID int64, slug string) ([]*BotModel, error)
+	GetPlayingBotsByGameSlug(slug string) ([]*BotModel, error)
+	// SetBotVerificationPending помечает бота, чью проверку прервали, SetBotVerifiedByID метку снимает
+	SetBotVerificationPending(botID int64) error
+	GetPendingBots() ([]*BotModel, error)
 }
 
 // AccessObject implementation of BotAccessObject
-type AccessObject struct{}
-
-var Bots BotAccessObject
-
-func init() {
-	Bots = &AccessObject{}
+type AccessObject struct {
+	DB    *pgx.ConnPool
+	Games games.GameAccessObject
 }
 
 // Bot mode for bots table
@@ -50,13 +50,13 @@ func (bd *AccessObject) Create(b *BotModel) error {
 		Status: pgtype.Present,
 	}
 
-	tx, err := database.Conn.Begin()
+	tx, err := bd.DB.Begin()
 	if err != nil {
 		return errors.Wrap(err, "can not open bot create transaction")
 	}
 	defer tx.Rollback()
 
-	g, err := games.Games.GetGameBySlug(b.GameSlug.String)
+	g, err := bd.Games.GetGameBySlug(b.GameSlug.String)
 	if err != nil {
 		return errors.Wrap(utils.ErrNotExists, errors.Wrap(err, "can not get game with this slug").Error())
 	}
@@ -84,7 +84,7 @@ func (bd *AccessObject) Create(b *BotModel) error {
 }
 
 func (bd *AccessObject) SetBotVerifiedByID(botID int64, isVerified bool) error {
-	row := database.Conn.QueryRow(`UPDATE bots SET is_verified = $1 
+	row := bd.DB.QueryRow(`UPDATE bots SET is_verified = $1, verification_pending = FALSE
 									WHERE bots.id = $2 RETURNING bots.id;`, isVerified, botID)
 
 	var id int64
@@ -99,6 +99,48 @@ func (bd *AccessObject) SetBotVerifiedByID(botID int64, isVerified bool) error {
 	return nil
 }
 
+// SetBotVerificationPending is_verified не трогаем: прежний результат действует, пока нет нового
+func (bd *AccessObject) SetBotVerificationPending(botID int64) error {
+	row := bd.DB.QueryRow(`UPDATE bots SET verification_pending = TRUE
+									WHERE bots.id = $1 RETURNING bots.id;`, botID)
+
+	var id int64
+	if err := row.Scan(&id); err != nil {
+		if err == pgx.ErrNoRows {
+			return errors.Wrap(utils.ErrNotExists, errors.Wrap(err, "now row to update").Error())
+		}
+
+		return errors.Wrap(err, "can not update bot row")
+	}
+
+	return nil
+}
+
+// GetPendingBots боты, проверку которых прервали
+func (bd *AccessObject) GetPendingBots() ([]*BotModel, error) {
+	rows, err := bd.DB.Query(`SELECT b.id, b.code, b.language,
+	b.is_active, b.is_verified, b.author_id, g.slug
+	FROM bots b JOIN games g on b.game_id = g.id WHERE b.verification_pending;`)
+	if err != nil {
+		return nil, errors.Wrap(err, "get pending bots error")
+	}
+	defer rows.Close()
+
+	bots := make([]*BotModel, 0)
+	for rows.Next() {
+		bot := &BotModel{}
+		err = rows.Scan(&bot.ID, &bot.Code,
+			&bot.Language, &bot.IsActive, &bot.IsVerified,
+			&bot.AuthorID, &bot.GameSlug)
+		if err != nil {
+			return nil, errors.Wrap(err, "get pending bots scan bot error")
+		}
+		bots = append(bots, bot)
+	}
+
+	return bots, nil
+}
+
 func (bd *AccessObject) GetBotsByAuthorID(authorID int64) ([]*BotModel, error) {
 	return bd.getBotsByGameSlugAndAuthorID(authorID, "")
 }
@@ -118,7 +160,7 @@ func (bd *AccessObject) getBotsByGameSlugAndAuthorID(authorID int64, slug string
 	}
 	query += ";"
 
-	rows, err := database.Conn.Query(query, args...)
+	rows, err := bd.DB.Query(query, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "get bots by game slug and author id error")
 	}
@@ -138,3 +180,30 @@ func (bd *AccessObject) getBotsByGameSlugAndAuthorID(authorID int64, slug string
 
 	return bots, nil
 }
+
+// GetPlayingBotsByGameSlug боты игры, которыми авторы сейчас играют: у каждого автора
+// это последний прошедший проверку бот
+func (bd *AccessObject) GetPlayingBotsByGameSlug(slug string) ([]*BotModel, error) {
+	rows, err := bd.DB.Query(`SELECT DISTINCT ON (b.author_id) b.id, b.code, b.language,
+	b.is_active, b.is_verified, b.author_id, g.slug
+	FROM bots b JOIN games g on b.game_id = g.id WHERE g.slug = $1 AND b.is_verified
+	ORDER BY b.author_id, b.id DESC;`, slug)
+	if err != nil {
+		return nil, errors.Wrap(err, "get playing bots by game slug error")
+	}
+	defer rows.Close()
+
+	bots := make([]*BotModel, 0)
+	for rows.Next() {
+		bot := &BotModel{}
+		err = rows.Scan(&bot.ID, &bot.Code,
+			&bot.Language, &bot.IsActive, &bot.IsVerified,
+			&bot.AuthorID, &bot.GameSlug)
+		if err != nil {
+			return nil, errors.Wrap(err, "get playing bots by game slug scan bot error")
+		}
+		bots = append(bots, bot)
+	}
+
+	return bots, nil
+}
@@ -1,13 +1,24 @@
 package bots
 
 import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-park-mail-ru/2019_1_HotCode/database"
 	"github.com/go-park-mail-ru/2019_1_HotCode/games"
+	"github.com/go-park-mail-ru/2019_1_HotCode/notify"
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
 	"github.com/go-park-mail-ru/2019_1_HotCode/testutils"
 
 	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,8 +28,11 @@ func init() {
 }
 
 type BotTest struct {
+	// статус проверки меняет горутина processTestingStatus
+	mu       sync.Mutex
 	ids      int64
 	bots     map[int64]BotModel
+	pending  map[int64]bool
 	nextFail error
 }
 
@@ -27,9 +41,8 @@ func (bt *BotTest) newID() int64 {
 	return bt.ids - 1
 }
 
-// setFailureUser fails next request
-func setFailureBot(err error) {
-	bt := Bots.(*BotTest)
+// setFailure fails next request
+func (bt *BotTest) setFailure(err error) {
 	bt.nextFail = err
 }
 
@@ -40,6 +53,9 @@ func (bt *BotTest) Create(b *BotModel) error {
 		return err
 	}
 
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
 	b.IsActive = pgtype.Bool{Bool: false, Status: pgtype.Present}
 	b.ID = pgtype.Int8{Int: bt.newID(), Status: pgtype.Present}
 	bt.bots[b.ID.Int] = *b
@@ -47,9 +63,43 @@ func (bt *BotTest) Create(b *BotModel) error {
 }
 
 func (bt *BotTest) SetBotVerifiedByID(botID int64, isActive bool) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	b := bt.bots[botID]
+	b.IsVerified = pgtype.Bool{Bool: isActive, Status: pgtype.Present}
+	bt.bots[botID] = b
+	delete(bt.pending, botID)
+	return nil
+}
+
+func (bt *BotTest) SetBotVerificationPending(botID int64) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	bt.pending[botID] = true
 	return nil
 }
 
+func (bt *BotTest) GetPendingBots() ([]*BotModel, error) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	pending := make([]*BotModel, 0, len(bt.pending))
+	for botID := range bt.pending {
+		b := bt.bots[botID]
+		pending = append(pending, &b)
+	}
+	return pending, nil
+}
+
+func (bt *BotTest) isPending(botID int64) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	return bt.pending[botID]
+}
+
 func (bt *BotTest) GetBotsByAuthorID(authorID int64) ([]*BotModel, error) {
 	return nil, nil
 }
@@ -58,6 +108,32 @@ func (bt *BotTest) GetBotsByGameSlugAndAuthorID(authorID int64, slug string) ([]
 	return nil, nil
 }
 
+func (bt *BotTest) GetPlayingBotsByGameSlug(slug string) ([]*BotModel, error) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	latest := make(map[int64]BotModel)
+	for _, b := range bt.bots {
+		if b.IsVerified.Bool && b.GameSlug.String == slug && b.ID.Int > latest[b.AuthorID.Int].ID.Int {
+			latest[b.AuthorID.Int] = b
+		}
+	}
+
+	playing := make([]*BotModel, 0, len(latest))
+	for _, b := range latest {
+		b := b
+		playing = append(playing, &b)
+	}
+	return playing, nil
+}
+
+func (bt *BotTest) isVerified(botID int64) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	return bt.bots[botID].IsVerified.Bool
+}
+
 type GameTest struct {
 	games    map[string]games.GameModel
 	nextFail error
@@ -80,21 +156,80 @@ func (gt *GameTest) GetGameLeaderboardBySlug(slug string, limit, offset int) ([]
 	return nil, nil
 }
 
-func initTests() {
-	Bots = &BotTest{
-		ids:      1,
-		bots:     make(map[int64]BotModel),
-		nextFail: nil,
+func (gt *GameTest) GetUserScores(userID int64) ([]*games.UserScoreModel, error) {
+	return nil, nil
+}
+
+func (gt *GameTest) Create(g *games.GameModel) error {
+	return nil
+}
+
+func (gt *GameTest) Update(slug string, patch *games.GameModel) (*games.GameModel, bool, error) {
+	return nil, false, nil
+}
+
+func (gt *GameTest) Delete(slug string) error {
+	return nil
+}
+
+// TesterTest отвечает на каждую задачу заранее заданными событиями
+type TesterTest struct {
+	tasks    chan *TestTask
+	events   []*TesterStatusQueue
+	nextFail error
+	// stream если задан, события в него шлёт сам тест
+	stream chan *TesterStatusQueue
+}
+
+func (tt *TesterTest) Verify(task *TestTask) (<-chan *TesterStatusQueue, error) {
+	if tt.nextFail != nil {
+		err := tt.nextFail
+		tt.nextFail = nil
+		return nil, err
 	}
 
-	games.Games = &GameTest{
-		games: map[string]games.GameModel{
-			"pong": {
-				ID:   pgtype.Int8{Int: 1, Status: pgtype.Present},
-				Slug: pgtype.Text{String: "pong", Status: pgtype.Present},
+	tt.tasks <- task
+	if tt.stream != nil {
+		return tt.stream, nil
+	}
+	events := make(chan *TesterStatusQueue, len(tt.events))
+	for _, e := range tt.events {
+		events <- e
+	}
+	close(events)
+	return events, nil
+}
+
+// newTestHandler хендлер на свежих заглушках, у каждого теста свой
+func newTestHandler() *Handler {
+	hub := notify.NewHub(notify.NewLocalBroker())
+	go hub.Run()
+
+	return &Handler{
+		Bots: &BotTest{
+			ids:      1,
+			bots:     make(map[int64]BotModel),
+			pending:  make(map[int64]bool),
+			nextFail: nil,
+		},
+		Games: &GameTest{
+			games: map[string]games.GameModel{
+				"pong": {
+					ID:      pgtype.Int8{Int: 1, Status: pgtype.Present},
+					Slug:    pgtype.Text{String: "pong", Status: pgtype.Present},
+					BotCode: pgtype.Text{String: "const b=1", Status: pgtype.Present},
+				},
 			},
+			nextFail: nil,
 		},
-		nextFail: nil,
+		Tester: &TesterTest{
+			tasks: make(chan *TestTask, 10),
+			events: []*TesterStatusQueue{
+				{Type: "status", Body: json.RawMessage(`{"new_status":"Testing"}`)},
+				{Type: "result", Body: json.RawMessage(`{"result":1}`)},
+			},
+		},
+		Hub: hub,
 	}
 }
 
@@ -103,112 +238,332 @@ type BotTestCase struct {
 	Failure error
 }
 
-func runTableAPITests(t *testing.T, cases []*BotTestCase) {
+func runTableAPITests(t *testing.T, h *Handler, cases []*BotTestCase) {
 	for i, c := range cases {
-		runAPITest(t, i, c)
+		runAPITest(t, h, i, c)
 	}
 }
 
-func runAPITest(t *testing.T, i int, c *BotTestCase) {
+func runAPITest(t *testing.T, h *Handler, i int, c *BotTestCase) {
 	if c.Failure != nil {
-		setFailureBot(c.Failure)
+		h.Bots.(*BotTest).setFailure(c.Failure)
 	}
 
 	testutils.RunAPITest(t, i, &c.Case)
 }
 
-// Отключены, так как пока что нет мокапа для RabbitMQ
+func sessionContext(userID int64) context.Context {
+	return context.WithValue(context.Background(), users.SessionInfoKey, &users.SessionPayload{ID: userID, PwdVer: 1})
+}
+
 func TestCreateBot(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
 
-	//initTests()
-
-	// cases := []*BotTestCase{
-	// 	{ // Без токена
-	// 		Case: testutils.Case{
-	// 			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"CPP"}`),
-	// 			ExpectedCode: 401,
-	// 			ExpectedBody: `{"message":"session info is not presented"}`,
-	// 			Method:       "POST",
-	// 			Pattern:      "/bots",
-	// 			Function:     CreateBot,
-	// 		},
-	// 	},
-	// 	{ // Неподдерживаемый язык
-	// 		Case: testutils.Case{
-	// 			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"CPP"}`),
-	// 			ExpectedCode: 400,
-	// 			ExpectedBody: `{"lang":"invalid"}`,
-	// 			Method:       "POST",
-	// 			Pattern:      "/bots",
-	// 			Function:     CreateBot,
-	// 			Context: context.WithValue(context.Background(),
-	// 				users.SessionInfoKey, &users.SessionPayload{ID: 1, PwdVer: 1}),
-	// 		},
-	// 	},
-	// 	{ // Кривой JSON (без запятых)
-	// 		Case: testutils.Case{
-	// 			Payload:      []byte(`{"code":"const a=0" "game_slug":"pong" "lang":"CPP"}`),
-	// 			ExpectedCode: 400,
-	// 			ExpectedBody: `{"message":"decode body error: invalid character '\"' after object key:value pair"}`,
-	// 			Method:       "POST",
-	// 			Pattern:      "/bots",
-	// 			Function:     CreateBot,
-	// 			Context: context.WithValue(context.Background(),
-	// 				users.SessionInfoKey, &users.SessionPayload{ID: 1, PwdVer: 1}),
-	// 		},
-	// 	},
-	// 	{ // Создали бота
-	// 		Case: testutils.Case{
-	// 			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
-	// 			ExpectedCode: 200,
-	// 			ExpectedBody: `{"id":1,"game_slug":"pong","author_id":1,"is_active":false,"code":"const a=0","lang":"JS"}`,
-	// 			Method:       "POST",
-	// 			Pattern:      "/bots",
-	// 			Function:     CreateBot,
-	// 			Context: context.WithValue(context.Background(),
-	// 				users.SessionInfoKey, &users.SessionPayload{ID: 1, PwdVer: 1}),
-	// 		},
-	// 	},
-	// 	{ // Создали дубликат
-	// 		Case: testutils.Case{
-	// 			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
-	// 			ExpectedCode: 400,
-	// 			ExpectedBody: `{"code":"taken"}`,
-	// 			Method:       "POST",
-	// 			Pattern:      "/bots",
-	// 			Function:     CreateBot,
-	// 			Context: context.WithValue(context.Background(),
-	// 				users.SessionInfoKey, &users.SessionPayload{ID: 1, PwdVer: 1}),
-	// 		},
-	// 		Failure: utils.ErrTaken,
-	// 	},
-	// 	{ // Сломалась база
-	// 		Case: testutils.Case{
-	// 			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
-	// 			ExpectedCode: 500,
-	// 			ExpectedBody: `{"message":"user create error: internal server error"}`,
-	// 			Method:       "POST",
-	// 			Pattern:      "/bots",
-	// 			Function:     CreateBot,
-	// 			Context: context.WithValue(context.Background(),
-	// 				users.SessionInfoKey, &users.SessionPayload{ID: 1, PwdVer: 1}),
-	// 		},
-	// 		Failure: utils.ErrInternal,
-	// 	},
-	// 	{ // Нет такой игры
-	// 		Case: testutils.Case{
-	// 			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
-	// 			ExpectedCode: 400,
-	// 			ExpectedBody: `{"game_slug":"not_exists"}`,
-	// 			Method:       "POST",
-	// 			Pattern:      "/bots",
-	// 			Function:     CreateBot,
-	// 			Context: context.WithValue(context.Background(),
-	// 				users.SessionInfoKey, &users.SessionPayload{ID: 1, PwdVer: 1}),
-	// 		},
-	// 		Failure: utils.ErrNotExists,
-	// 	},
-	// }
-
-	//runTableAPITests(t, cases)
+	cases := []*BotTestCase{
+		{ // Без токена
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"CPP"}`),
+				ExpectedCode: 401,
+				ExpectedBody: `{"message":"session info is not presented"}`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Function:     h.CreateBot,
+			},
+		},
+		{ // Неподдерживаемый язык
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"CPP"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"lang":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Function:     h.CreateBot,
+				Context:      sessionContext(1),
+			},
+		},
+		{ // Кривой JSON (без запятых)
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"const a=0" "game_slug":"pong" "lang":"CPP"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"message":"decode body error: invalid character '\"' after object key:value pair"}`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Function:     h.CreateBot,
+				Context:      sessionContext(1),
+			},
+		},
+		{ // Создали бота
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
+				ExpectedCode: 200,
+				ExpectedBody: `{"id":1,"game_slug":"pong","author_id":1,"is_active":false,"is_verified":false,` +
+					`"code":"const a=0","lang":"JS"}`,
+				Method:   "POST",
+				Pattern:  "/bots",
+				Function: h.CreateBot,
+				Context:  sessionContext(1),
+			},
+		},
+		{ // Создали дубликат
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"code":"taken"}`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Function:     h.CreateBot,
+				Context:      sessionContext(1),
+			},
+			Failure: utils.ErrTaken,
+		},
+		{ // Сломалась база
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
+				ExpectedCode: 500,
+				ExpectedBody: `{"message":"bot create error: internal server error"}`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Function:     h.CreateBot,
+				Context:      sessionContext(1),
+			},
+			Failure: utils.ErrInternal,
+		},
+		{ // Нет такой игры
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"game_slug":"not_exists"}`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Function:     h.CreateBot,
+				Context:      sessionContext(1),
+			},
+			Failure: utils.ErrNotExists,
+		},
+	}
+
+	runTableAPITests(t, h, cases)
+
+	task := <-h.Tester.(*TesterTest).tasks
+	if task.Code1 != "const a=0" || task.Code2 != "const b=1" || task.GameSlug != "pong" {
+		t.Errorf("wrong tester task: %+v", task)
+	}
+}
+
+func TestCreateBotTesterDown(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	h.Tester.(*TesterTest).nextFail = errors.New("queue is not connected")
+
+	runAPITest(t, h, 0, &BotTestCase{
+		Case: testutils.Case{
+			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
+			ExpectedCode: 500,
+			ExpectedBody: `{"message":"can not call verify rpc: queue is not connected"}`,
+			Method:       "POST",
+			Pattern:      "/bots",
+			Function:     h.CreateBot,
+			Context:      sessionContext(1),
+		},
+	})
+}
+
+// TestReverifyGameBots смена эталонного бота перепроверяет ботов игры и сохраняет результат
+func TestReverifyGameBots(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	tester := h.Tester.(*TesterTest)
+	tester.events = []*TesterStatusQueue{
+		{Type: "result", Body: json.RawMessage(`{"result":2}`)},
+	}
+	bt := h.Bots.(*BotTest)
+	// автор уже заменил этого бота новым: перепроверять незачем
+	bt.bots[7] = BotModel{
+		ID:         pgtype.Int8{Int: 7, Status: pgtype.Present},
+		Code:       pgtype.Text{String: "const a=0", Status: pgtype.Present},
+		AuthorID:   pgtype.Int8{Int: 3, Status: pgtype.Present},
+		GameSlug:   pgtype.Varchar{String: "pong", Status: pgtype.Present},
+		IsVerified: pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	bt.bots[8] = BotModel{
+		ID:         pgtype.Int8{Int: 8, Status: pgtype.Present},
+		Code:       pgtype.Text{String: "const b=1", Status: pgtype.Present},
+		AuthorID:   pgtype.Int8{Int: 3, Status: pgtype.Present},
+		GameSlug:   pgtype.Varchar{String: "pong", Status: pgtype.Present},
+		IsVerified: pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	// ещё не прошёл проверку, играет бот 8
+	bt.bots[9] = BotModel{
+		ID:       pgtype.Int8{Int: 9, Status: pgtype.Present},
+		Code:     pgtype.Text{String: "const d=3", Status: pgtype.Present},
+		AuthorID: pgtype.Int8{Int: 3, Status: pgtype.Present},
+		GameSlug: pgtype.Varchar{String: "pong", Status: pgtype.Present},
+	}
+
+	h.OnBotCodeChange(&games.GameModel{
+		Slug:    pgtype.Text{String: "pong", Status: pgtype.Present},
+		BotCode: pgtype.Text{String: "const c=2", Status: pgtype.Present},
+	})
+
+	task := <-tester.tasks
+	if task.Code1 != "const b=1" || task.Code2 != "const c=2" {
+		t.Errorf("wrong tester task: %+v", task)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for bt.isVerified(8) {
+		if time.Now().After(deadline) {
+			t.Fatal("bot must lose verification after failed reverify")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case task = <-tester.tasks:
+		t.Errorf("only the latest verified bot must be reverified: %+v", task)
+	default:
+	}
+}
+
+// TestGetPlayingBotsByGameSlugDB запрос к живой базе со схемой из */sql, адрес в DB_HOST
+func TestGetPlayingBotsByGameSlugDB(t *testing.T) {
+	t.Parallel()
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	port := os.Getenv("DB_PORT")
+	if port == "" {
+		port = "5432"
+	}
+
+	db, err := database.Connect(os.Getenv("DB_USER"), os.Getenv("DB_PASS"), host, port, os.Getenv("DB_NAME"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	var authorID, gameID int64
+	err = db.QueryRow(`INSERT INTO users (username, password) VALUES ($1, '') RETURNING id;`,
+		"bots_dao_"+suffix).Scan(&authorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec(`DELETE FROM users WHERE id = $1;`, authorID)
+
+	slug := "bots-dao-" + suffix
+	err = db.QueryRow(`INSERT INTO games (slug, title, description, rules, code_example, bot_code,
+		logo_uuid, background_uuid) VALUES ($1, $1, '', '', '', 'const a=0', $2, $2) RETURNING id;`,
+		slug, "00000000-0000-0000-0000-000000000000").Scan(&gameID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec(`DELETE FROM games WHERE id = $1;`, gameID)
+
+	ids := make([]int64, 3)
+	for i, verified := range []bool{true, true, false} {
+		code := "const v=" + strconv.Itoa(i)
+		err = db.QueryRow(`INSERT INTO bots (code, code_hash, language, is_verified, author_id, game_id)
+			VALUES ($1, convert_to($1, 'UTF8'), 'JS', $2, $3, $4) RETURNING id;`,
+			code, verified, authorID, gameID).Scan(&ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bd := &AccessObject{DB: db}
+	bots, err := bd.GetPlayingBotsByGameSlug(slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bots) != 1 {
+		t.Fatalf("expected the latest verified bot of the author, got %d bots", len(bots))
+	}
+	if bots[0].ID.Int != ids[1] || bots[0].GameSlug.String != slug {
+		t.Fatalf("expected bot %d, got %d", ids[1], bots[0].ID.Int)
+	}
+}
+
+func createBot(t *testing.T, h *Handler) {
+	t.Helper()
+	runAPITest(t, h, 0, &BotTestCase{
+		Case: testutils.Case{
+			Payload:      []byte(`{"code":"const a=0","game_slug":"pong", "lang":"JS"}`),
+			ExpectedCode: 200,
+			ExpectedBody: `{"id":1,"game_slug":"pong","author_id":1,"is_active":false,"is_verified":false,` +
+				`"code":"const a=0","lang":"JS"}`,
+			Method:   "POST",
+			Pattern:  "/bots",
+			Function: h.CreateBot,
+			Context:  sessionContext(1),
+		},
+	})
+	<-h.Tester.(*TesterTest).tasks
+}
+
+// TestDrain остановка ждёт результат уже идущей проверки
+func TestDrain(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	tester := h.Tester.(*TesterTest)
+	tester.stream = make(chan *TesterStatusQueue)
+	createBot(t, h)
+
+	drained := make(chan error)
+	go func() {
+		drained <- h.Drain(context.Background())
+	}()
+
+	tester.stream <- &TesterStatusQueue{Type: "result", Body: json.RawMessage(`{"result":1}`)}
+	close(tester.stream)
+	if err := <-drained; err != nil {
+		t.Fatalf("drain error: %s", err)
+	}
+	if !h.Bots.(*BotTest).isVerified(1) {
+		t.Error("result received before shutdown is not saved")
+	}
+	if err := h.Drain(context.Background()); err != nil {
+		t.Errorf("nothing to drain, got %s", err)
+	}
+}
+
+// TestDrainTimeout не дождавшийся ответа бот сохраняет прежний статус и проверяется после рестарта
+func TestDrainTimeout(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	tester := h.Tester.(*TesterTest)
+	tester.stream = make(chan *TesterStatusQueue)
+	bt := h.Bots.(*BotTest)
+	createBot(t, h)
+	// пусть бот был проверен раньше, теперь результат неизвестен
+	if err := bt.SetBotVerifiedByID(1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := h.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if !bt.isVerified(1) || !bt.isPending(1) {
+		t.Error("interrupted bot must keep its status and wait for verification")
+	}
+	close(tester.stream)
+
+	// рестарт: та же база, новый обработчик
+	restarted := newTestHandler()
+	restarted.Bots = bt
+	restarted.ResumeVerifications()
+	task := <-restarted.Tester.(*TesterTest).tasks
+	if task.Code1 != "const a=0" || task.Code2 != "const b=1" {
+		t.Errorf("wrong tester task: %+v", task)
+	}
+	if err := restarted.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bt.isPending(1) {
+		t.Error("finished verification must clear pending mark")
+	}
 }
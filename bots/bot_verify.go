@@ -1,9 +1,11 @@
 package bots
 
 import (
+	"context"
 	"encoding/json"
 
-	"github.com/go-park-mail-ru/2019_1_HotCode/queue"
+	"github.com/go-park-mail-ru/2019_1_HotCode/games"
+	"github.com/go-park-mail-ru/2019_1_HotCode/notify"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -13,7 +15,8 @@ import (
 )
 
 const (
-	testerQueueName = "tester_rpc_queue"
+	// TesterQueueName очередь задач тестирующей системы
+	TesterQueueName = "tester_rpc_queue"
 )
 
 type TesterStatusQueue struct {
@@ -41,8 +44,95 @@ type TestTask struct {
 	Language Lang   `json:"lang"`
 }
 
-func sendForVerifyRPC(task *TestTask) (<-chan *TesterStatusQueue, error) {
-	respQ, err := queue.Channel.QueueDeclare(
+// Tester тестирующая система, которой боты отдаются на проверку
+type Tester interface {
+	// Verify ставит задачу, события проверки приходят в канал, пока он не закроется
+	Verify(task *TestTask) (<-chan *TesterStatusQueue, error)
+}
+
+// AMQPTester implementation of Tester, RPC через очередь RabbitMQ
+type AMQPTester struct {
+	Channel *amqp.Channel
+}
+
+// OnBotCodeChange слушатель games: перепроверяет ботов игры в фоне
+func (h *Handler) OnBotCodeChange(g *games.GameModel) {
+	go h.reverifyGameBots(g)
+}
+
+// reverifyGameBots заново прогоняет играющих ботов игры против нового эталонного бота
+func (h *Handler) reverifyGameBots(g *games.GameModel) {
+	logger := log.WithFields(log.Fields{
+		"game_slug": g.Slug.String,
+		"method":    "reverifyGameBots",
+	})
+
+	bots, err := h.Bots.GetPlayingBotsByGameSlug(g.Slug.String)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "can not get playing bots"))
+		return
+	}
+
+	for _, bot := range bots {
+		events, rpcErr := h.Tester.Verify(&TestTask{
+			Code1:    bot.Code.String,
+			Code2:    g.BotCode.String,
+			GameSlug: g.Slug.String,
+			Language: Lang(bot.Language.String),
+		})
+		if rpcErr != nil {
+			logger.Error(errors.Wrapf(rpcErr, "can not call verify rpc for bot %d", bot.ID.Int))
+			continue
+		}
+
+		h.startVerification(bot.ID.Int, bot.AuthorID.Int, bot.GameSlug.String, events)
+	}
+
+	logger.Infof("%d bots sent for reverification", len(bots))
+}
+
+// ResumeVerifications заново отправляет на проверку ботов, прерванных прошлой остановкой.
+// Вызывается при старте, бот остаётся ожидающим, пока проверка не завершится
+func (h *Handler) ResumeVerifications() {
+	logger := log.WithField("method", "ResumeVerifications")
+
+	bots, err := h.Bots.GetPendingBots()
+	if err != nil {
+		logger.Error(errors.Wrap(err, "can not get pending bots"))
+		return
+	}
+
+	for _, bot := range bots {
+		g, gameErr := h.Games.GetGameBySlug(bot.GameSlug.String)
+		if gameErr != nil {
+			logger.Error(errors.Wrapf(gameErr, "can not get game of bot %d", bot.ID.Int))
+			continue
+		}
+
+		events, rpcErr := h.Tester.Verify(&TestTask{
+			Code1:    bot.Code.String,
+			Code2:    g.BotCode.String,
+			GameSlug: g.Slug.String,
+			Language: Lang(bot.Language.String),
+		})
+		if rpcErr != nil {
+			logger.Error(errors.Wrapf(rpcErr, "can not call verify rpc for bot %d", bot.ID.Int))
+			continue
+		}
+
+		h.startVerification(bot.ID.Int, bot.AuthorID.Int, bot.GameSlug.String, events)
+	}
+
+	logger.Infof("%d interrupted bots sent for verification", len(bots))
+}
+
+// Verify RPC-вызов тестирующей системы
+func (at *AMQPTester) Verify(task *TestTask) (<-chan *TesterStatusQueue, error) {
+	if at.Channel == nil {
+		return nil, errors.New("queue is not connected")
+	}
+
+	respQ, err := at.Channel.QueueDeclare(
 		"", // пакет amqp сам сгенерит
 		false,
 		true,
@@ -55,7 +145,7 @@ func sendForVerifyRPC(task *TestTask) (<-chan *TesterStatusQueue, error) {
 	}
 
 	requestUUID := uuid.New().String()
-	resps, err := queue.Channel.Consume(
+	resps, err := at.Channel.Consume(
 		respQ.Name,
 		requestUUID,
 		true,
@@ -73,9 +163,9 @@ func sendForVerifyRPC(task *TestTask) (<-chan *TesterStatusQueue, error) {
 		return nil, errors.Wrap(err, "can not marshal bot info")
 	}
 
-	err = queue.Channel.Publish(
+	err = at.Channel.Publish(
 		"",
-		testerQueueName,
+		TesterQueueName,
 		false,
 		false,
 		amqp.Publishing{
@@ -99,19 +189,19 @@ func sendForVerifyRPC(task *TestTask) (<-chan *TesterStatusQueue, error) {
 			testerResp := &TesterStatusQueue{}
 			err := json.Unmarshal(resp.Body, testerResp)
 			if err != nil {
-				log.WithField("method", "sendForVerifyRPC goroutine").Error(errors.Wrap(err, "unmarshal tester response error"))
+				log.WithField("method", "Verify goroutine").Error(errors.Wrap(err, "unmarshal tester response error"))
 				break
 			}
 			out <- testerResp
 
 			if testerResp.Type == "result" || testerResp.Type == "error" {
 				// отцепились от очереди -- она удалилась
-				err = queue.Channel.Cancel(
+				err = at.Channel.Cancel(
 					corrID,
 					false,
 				)
 				if err != nil {
-					log.WithField("method", "sendForVerifyRPC goroutine").Error(errors.Wrap(err, "queue cancel error"))
+					log.WithField("method", "Verify goroutine").Error(errors.Wrap(err, "queue cancel error"))
 				}
 			}
 		}
@@ -123,8 +213,103 @@ func sendForVerifyRPC(task *TestTask) (<-chan *TesterStatusQueue, error) {
 	return events, nil
 }
 
-func processTestingStatus(botID, authorID int64, gameSlug string,
-	broadcast chan<- *BotVerifyStatusMessage, events <-chan *TesterStatusQueue) {
+// verification проверка, результат которой ещё не сохранён
+type verification struct {
+	botID    int64
+	authorID int64
+	gameSlug string
+	// done закрывается, когда processTestingStatus вышла
+	done chan struct{}
+}
+
+// startVerification обрабатывает ответы тестирующей системы в фоне, Drain её дождётся
+func (h *Handler) startVerification(botID, authorID int64, gameSlug string, events <-chan *TesterStatusQueue) {
+	v := &verification{
+		botID:    botID,
+		authorID: authorID,
+		gameSlug: gameSlug,
+		done:     make(chan struct{}),
+	}
+
+	h.verificationsMu.Lock()
+	if h.verifications == nil {
+		h.verifications = make(map[*verification]struct{})
+	}
+	h.verifications[v] = struct{}{}
+	h.verificationsMu.Unlock()
+
+	go func() {
+		defer func() {
+			h.verificationsMu.Lock()
+			delete(h.verifications, v)
+			h.verificationsMu.Unlock()
+			close(v.done)
+		}()
+
+		h.processTestingStatus(botID, authorID, gameSlug, events)
+	}()
+}
+
+// Drain ждёт проверки, которые уже идут, вызывается при остановке до закрытия очереди и базы.
+// Не дождавшиеся ответа к ctx.Done боты помечаются ожидающими проверки, прежний статус
+// за ними остаётся, а после старта ResumeVerifications проверит их заново
+func (h *Handler) Drain(ctx context.Context) error {
+	h.verificationsMu.Lock()
+	pending := make([]*verification, 0, len(h.verifications))
+	for v := range h.verifications {
+		pending = append(pending, v)
+	}
+	h.verificationsMu.Unlock()
+
+	for i, v := range pending {
+		select {
+		case <-v.done:
+		case <-ctx.Done():
+			h.interrupt(pending[i:])
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Verifying сколько проверок ждут ответа тестирующей системы
+func (h *Handler) Verifying() int {
+	h.verificationsMu.Lock()
+	defer h.verificationsMu.Unlock()
+
+	return len(h.verifications)
+}
+
+func (h *Handler) interrupt(pending []*verification) {
+	for _, v := range pending {
+		select {
+		case <-v.done:
+			continue
+		default:
+		}
+
+		// сервер останавливается, а не бот плохой: проверим его после рестарта
+		if err := h.Bots.SetBotVerificationPending(v.botID); err != nil {
+			log.WithField("bot_id", v.botID).Error(errors.Wrap(err, "can not save interrupted verification"))
+		}
+		h.publishStatus(&BotVerifyStatusMessage{
+			BotID:     v.botID,
+			AuthorID:  v.authorID,
+			GameSlug:  v.gameSlug,
+			NewStatus: "Interrupted. Will be verified after restart\n",
+		})
+	}
+}
+
+// publishStatus отдаёт статус проверки автору бота через шлюз уведомлений
+func (h *Handler) publishStatus(msg *BotVerifyStatusMessage) {
+	if err := h.Hub.Publish(msg.AuthorID, notify.TopicBotStatus, msg.GameSlug, msg); err != nil {
+		log.WithField("bot_id", msg.BotID).Error(errors.Wrap(err, "publish bot status error"))
+	}
+}
+
+func (h *Handler) processTestingStatus(botID, authorID int64, gameSlug string, events <-chan *TesterStatusQueue) {
 
 	logger := log.WithFields(log.Fields{
 		"bot_id": botID,
@@ -143,12 +328,12 @@ func processTestingStatus(botID, authorID int64, gameSlug string,
 				continue
 			}
 
-			broadcast <- &BotVerifyStatusMessage{
+			h.publishStatus(&BotVerifyStatusMessage{
 				BotID:     botID,
 				AuthorID:  authorID,
 				GameSlug:  gameSlug,
 				NewStatus: upd.NewStatus,
-			}
+			})
 
 			status = upd.NewStatus
 		case "result":
@@ -164,14 +349,14 @@ func processTestingStatus(botID, authorID int64, gameSlug string,
 				newStatus = "Verifyed\n"
 			}
 
-			broadcast <- &BotVerifyStatusMessage{
+			h.publishStatus(&BotVerifyStatusMessage{
 				BotID:     botID,
 				AuthorID:  authorID,
 				GameSlug:  gameSlug,
 				NewStatus: newStatus,
-			}
+			})
 
-			err = Bots.SetBotVerifiedByID(botID, res.Winner == 1)
+			err = h.Bots.SetBotVerifiedByID(botID, res.Winner == 1)
 			if err != nil {
 				logger.Error(errors.Wrap(err, "can update bot active status"))
 				continue
@@ -188,14 +373,14 @@ func processTestingStatus(botID, authorID int64, gameSlug string,
 
 			log.Info(res.Error)
 			newStatus := "Not Verifyed. Error!\n"
-			broadcast <- &BotVerifyStatusMessage{
+			h.publishStatus(&BotVerifyStatusMessage{
 				BotID:     botID,
 				AuthorID:  authorID,
 				GameSlug:  gameSlug,
 				NewStatus: newStatus,
-			}
+			})
 
-			err = Bots.SetBotVerifiedByID(botID, false)
+			err = h.Bots.SetBotVerifiedByID(botID, false)
 			if err != nil {
 				logger.Error(errors.Wrap(err, "can update bot active status"))
 				continue
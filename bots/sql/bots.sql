@@ -11,6 +11,9 @@ CREATE TABLE "bots"
 	code_hash BYTEA NOT NULL CHECK ( code_hash <> '' ),
 	language LANG NOT NULL,
 	is_active BOOLEAN NOT NULL DEFAULT FALSE,
+	is_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	-- проверку прервала остановка сервера, после старта её нужно запустить заново
+	verification_pending BOOLEAN NOT NULL DEFAULT FALSE,
 	author_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
 	game_id BIGINT NOT NULL REFERENCES games (id) ON DELETE CASCADE,
 
@@ -42,8 +42,15 @@ type BotFull struct {
 }
 
 type BotVerifyStatusMessage struct {
+	// Seq номер сообщения автора, его передают в since при переподключении
+	Seq       int64  `json:"seq,omitempty"`
 	BotID     int64  `json:"bot_id"`
 	AuthorID  int64  `json:"author_id"`
 	GameSlug  string `json:"game_slug"`
 	NewStatus string `json:"new_status"`
 }
+
+// SetSeq номер проставляет шлюз уведомлений при публикации
+func (m *BotVerifyStatusMessage) SetSeq(seq int64) {
+	m.Seq = seq
+}
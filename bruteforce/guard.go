@@ -0,0 +1,170 @@
+// Package bruteforce защищает вход от перебора паролей:
+// считает неудачные попытки в скользящем окне и блокирует ключ
+// (юзернейм или IP) на всё большее время
+package bruteforce
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Clock источник времени, в тестах подменяется
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Config настройки защиты
+type Config struct {
+	// Window окно, в котором считаются неудачные попытки
+	Window time.Duration
+	// MaxUsernameAttempts сколько неудачных попыток можно сделать для одного юзернейма
+	MaxUsernameAttempts int64
+	// MaxIPAttempts сколько неудачных попыток можно сделать с одного IP,
+	// больше, чем на юзернейм: за одним IP бывает много людей
+	MaxIPAttempts int64
+	// Lockout длина первой блокировки, каждая следующая в два раза длиннее
+	Lockout time.Duration
+	// MaxLockout максимальная длина блокировки
+	MaxLockout time.Duration
+	// StrikesTTL сколько помним про прошлые блокировки
+	StrikesTTL time.Duration
+}
+
+// DefaultConfig настройки по умолчанию
+func DefaultConfig() Config {
+	return Config{
+		Window:              15 * time.Minute,
+		MaxUsernameAttempts: 5,
+		MaxIPAttempts:       20,
+		Lockout:             time.Minute,
+		MaxLockout:          time.Hour,
+		StrikesTTL:          24 * time.Hour,
+	}
+}
+
+// Guard считает неудачные входы и решает, когда блокировать
+type Guard struct {
+	Config Config
+	Store  Store
+	Clock  Clock
+}
+
+// NewGuard создаёт защиту с настоящими часами
+func NewGuard(store Store, cfg Config) *Guard {
+	return &Guard{
+		Config: cfg,
+		Store:  store,
+		Clock:  realClock{},
+	}
+}
+
+type target struct {
+	key   string
+	limit int64
+}
+
+func (g *Guard) targets(username, ip string) []target {
+	targets := make([]target, 0, 2)
+	if username != "" {
+		// юзернеймы в базе регистронезависимые
+		targets = append(targets, target{"user:" + strings.ToLower(username), g.Config.MaxUsernameAttempts})
+	}
+	if ip != "" {
+		targets = append(targets, target{"ip:" + ip, g.Config.MaxIPAttempts})
+	}
+
+	return targets
+}
+
+// Check возвращает, сколько ещё ждать до следующей попытки; 0 -- можно пробовать
+func (g *Guard) Check(username, ip string) (time.Duration, error) {
+	now := g.Clock.Now()
+	var retryAfter time.Duration
+	for _, t := range g.targets(username, ip) {
+		until, err := g.Store.LockedUntil(t.key)
+		if err != nil {
+			return 0, errors.Wrap(err, "get lock error")
+		}
+
+		if wait := until.Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	return retryAfter, nil
+}
+
+// Failed записывает неудачную попытку и блокирует ключи, превысившие лимит
+func (g *Guard) Failed(username, ip string) error {
+	now := g.Clock.Now()
+	for _, t := range g.targets(username, ip) {
+		count, err := g.Store.AddFailure(t.key, now, g.Config.Window)
+		if err != nil {
+			return errors.Wrap(err, "add failure error")
+		}
+
+		if count < t.limit {
+			continue
+		}
+
+		if err = g.lock(t.key, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *Guard) lock(key string, now time.Time) error {
+	strikes, err := g.Store.Strike(key, g.Config.StrikesTTL)
+	if err != nil {
+		return errors.Wrap(err, "strike error")
+	}
+
+	lockout := g.Config.Lockout
+	for i := int64(1); i < strikes && lockout < g.Config.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > g.Config.MaxLockout {
+		lockout = g.Config.MaxLockout
+	}
+
+	if err = g.Store.Lock(key, now.Add(lockout), lockout); err != nil {
+		return errors.Wrap(err, "lock error")
+	}
+
+	// после блокировки считаем попытки заново
+	if err = g.Store.ClearFailures(key); err != nil {
+		return errors.Wrap(err, "clear failures error")
+	}
+
+	log.WithFields(log.Fields{
+		"method":  "bruteforce.Guard",
+		"key":     key,
+		"strikes": strikes,
+		"lockout": lockout.String(),
+	}).Warn("login locked out")
+
+	return nil
+}
+
+// Succeeded сбрасывает счётчики юзернейма после удачного входа.
+// IP не сбрасываем: иначе перебор можно разбавлять входами в свой аккаунт
+func (g *Guard) Succeeded(username string) error {
+	for _, t := range g.targets(username, "") {
+		if err := g.Store.Reset(t.key); err != nil {
+			return errors.Wrap(err, "reset error")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package bruteforce
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// чтобы не заваливать всё логами
+	log.SetLevel(log.PanicLevel)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+func newTestGuard() (*Guard, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	cfg := Config{
+		Window:              time.Minute,
+		MaxUsernameAttempts: 3,
+		MaxIPAttempts:       5,
+		Lockout:             time.Minute,
+		MaxLockout:          3 * time.Minute,
+		StrikesTTL:          time.Hour,
+	}
+
+	return &Guard{Config: cfg, Store: NewMemoryStore(), Clock: clock}, clock
+}
+
+func expectRetryAfter(t *testing.T, g *Guard, username, ip string, expected time.Duration) {
+	t.Helper()
+	retryAfter, err := g.Check(username, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retryAfter != expected {
+		t.Fatalf("expected retry after %s, got %s", expected, retryAfter)
+	}
+}
+
+func fail(t *testing.T, g *Guard, username, ip string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := g.Failed(username, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	t.Parallel()
+
+	g, clock := newTestGuard()
+
+	fail(t, g, "victim", "", 2)
+	// старые попытки выпадают из окна
+	clock.Advance(time.Minute + time.Second)
+	fail(t, g, "victim", "", 2)
+	expectRetryAfter(t, g, "victim", "", 0)
+
+	fail(t, g, "VICTIM", "", 1)
+	expectRetryAfter(t, g, "victim", "", time.Minute)
+}
+
+func TestProgressiveLockout(t *testing.T) {
+	t.Parallel()
+
+	g, clock := newTestGuard()
+
+	lockouts := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for _, lockout := range lockouts {
+		fail(t, g, "victim", "", 3)
+		expectRetryAfter(t, g, "victim", "", lockout)
+
+		clock.Advance(lockout - time.Second)
+		expectRetryAfter(t, g, "victim", "", time.Second)
+		clock.Advance(time.Second)
+		expectRetryAfter(t, g, "victim", "", 0)
+	}
+
+	// удачный вход прощает прошлые блокировки
+	if err := g.Succeeded("victim"); err != nil {
+		t.Fatal(err)
+	}
+	fail(t, g, "victim", "", 3)
+	expectRetryAfter(t, g, "victim", "", time.Minute)
+}
+
+func TestIPLockout(t *testing.T) {
+	t.Parallel()
+
+	g, _ := newTestGuard()
+
+	// перебор юзернеймов с одного адреса
+	for _, username := range []string{"a", "b", "c", "d", "e"} {
+		fail(t, g, username, "10.0.0.1", 1)
+	}
+	expectRetryAfter(t, g, "f", "10.0.0.1", time.Minute)
+	expectRetryAfter(t, g, "f", "10.0.0.2", 0)
+
+	// удачный вход не снимает блокировку адреса
+	if err := g.Succeeded("f"); err != nil {
+		t.Fatal(err)
+	}
+	expectRetryAfter(t, g, "f", "10.0.0.1", time.Minute)
+}
@@ -0,0 +1,211 @@
+package bruteforce
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// Store хранилище счётчиков неудачных попыток и блокировок
+type Store interface {
+	// AddFailure записывает неудачную попытку и возвращает,
+	// сколько их было за последние window
+	AddFailure(key string, now time.Time, window time.Duration) (int64, error)
+	// ClearFailures обнуляет счётчик попыток, но не блокировки
+	ClearFailures(key string) error
+	// Strike увеличивает счётчик блокировок ключа, от него зависит длина следующей
+	Strike(key string, ttl time.Duration) (int64, error)
+	// Lock блокирует ключ до until
+	Lock(key string, until time.Time, ttl time.Duration) error
+	// LockedUntil время окончания блокировки, нулевое, если её нет
+	LockedUntil(key string) (time.Time, error)
+	// Reset забывает про ключ совсем
+	Reset(key string) error
+}
+
+func failuresKey(key string) string {
+	return "bruteforce:failures:" + key
+}
+
+func strikesKey(key string) string {
+	return "bruteforce:strikes:" + key
+}
+
+func lockKey(key string) string {
+	return "bruteforce:lock:" + key
+}
+
+// RedisStore скользящее окно на sorted set: score -- время попытки
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore см. RedisStore
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{
+		client: client,
+	}
+}
+
+// AddFailure записывает неудачную попытку
+func (rs *RedisStore) AddFailure(key string, now time.Time, window time.Duration) (int64, error) {
+	// одновременные попытки не должны схлопнуться в один элемент
+	salt := make([]byte, 4)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, errors.Wrap(err, "salt generate error")
+	}
+	member := strconv.FormatInt(now.UnixNano(), 10) + ":" + hex.EncodeToString(salt)
+
+	k := failuresKey(key)
+	pipe := rs.client.TxPipeline()
+	pipe.ZRemRangeByScore(k, "-inf", "("+strconv.FormatInt(now.Add(-window).UnixNano(), 10))
+	pipe.ZAdd(k, redis.Z{Score: float64(now.UnixNano()), Member: member})
+	count := pipe.ZCard(k)
+	pipe.Expire(k, window)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, errors.Wrap(err, "redis add failure error")
+	}
+
+	return count.Val(), nil
+}
+
+// ClearFailures обнуляет счётчик попыток
+func (rs *RedisStore) ClearFailures(key string) error {
+	if err := rs.client.Del(failuresKey(key)).Err(); err != nil {
+		return errors.Wrap(err, "redis clear failures error")
+	}
+
+	return nil
+}
+
+// Strike увеличивает счётчик блокировок
+func (rs *RedisStore) Strike(key string, ttl time.Duration) (int64, error) {
+	pipe := rs.client.TxPipeline()
+	strikes := pipe.Incr(strikesKey(key))
+	pipe.Expire(strikesKey(key), ttl)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, errors.Wrap(err, "redis strike error")
+	}
+
+	return strikes.Val(), nil
+}
+
+// Lock блокирует ключ до until
+func (rs *RedisStore) Lock(key string, until time.Time, ttl time.Duration) error {
+	err := rs.client.Set(lockKey(key), until.UnixNano(), ttl).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis lock error")
+	}
+
+	return nil
+}
+
+// LockedUntil время окончания блокировки
+func (rs *RedisStore) LockedUntil(key string) (time.Time, error) {
+	until, err := rs.client.Get(lockKey(key)).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return time.Time{}, nil
+		}
+
+		return time.Time{}, errors.Wrap(err, "redis get lock error")
+	}
+
+	return time.Unix(0, until), nil
+}
+
+// Reset забывает про ключ
+func (rs *RedisStore) Reset(key string) error {
+	err := rs.client.Del(failuresKey(key), strikesKey(key), lockKey(key)).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis reset error")
+	}
+
+	return nil
+}
+
+// MemoryStore хранилище в памяти процесса, для тестов и запуска без redis.
+// ttl не соблюдает: время истечения блокировки проверяет Guard
+type MemoryStore struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	strikes  map[string]int64
+	locks    map[string]time.Time
+}
+
+// NewMemoryStore создаёт пустое хранилище
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		failures: make(map[string][]time.Time),
+		strikes:  make(map[string]int64),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+// AddFailure записывает неудачную попытку
+func (ms *MemoryStore) AddFailure(key string, now time.Time, window time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	from := now.Add(-window)
+	actual := ms.failures[key][:0]
+	for _, t := range ms.failures[key] {
+		if !t.Before(from) {
+			actual = append(actual, t)
+		}
+	}
+	ms.failures[key] = append(actual, now)
+
+	return int64(len(ms.failures[key])), nil
+}
+
+// ClearFailures обнуляет счётчик попыток
+func (ms *MemoryStore) ClearFailures(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.failures, key)
+	return nil
+}
+
+// Strike увеличивает счётчик блокировок
+func (ms *MemoryStore) Strike(key string, ttl time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.strikes[key]++
+	return ms.strikes[key], nil
+}
+
+// Lock блокирует ключ до until
+func (ms *MemoryStore) Lock(key string, until time.Time, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.locks[key] = until
+	return nil
+}
+
+// LockedUntil время окончания блокировки
+func (ms *MemoryStore) LockedUntil(key string) (time.Time, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.locks[key], nil
+}
+
+// Reset забывает про ключ
+func (ms *MemoryStore) Reset(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.failures, key)
+	delete(ms.strikes, key)
+	delete(ms.locks, key)
+	return nil
+}
@@ -0,0 +1,481 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config все настройки сервиса.
+// Источники по возрастанию приоритета: default из тегов, файл, окружение, флаги.
+// Нулевые числа в Login, Password и Notify значат "взять умолчание пакета"
+type Config struct {
+	Port        string `yaml:"port" env:"PORT" default:"8080"`
+	CORSHost    string `yaml:"cors_host" env:"CORS_HOST"`
+	FrontendURL string `yaml:"frontend_url" env:"FRONTEND_URL"`
+	TrustProxy  bool   `yaml:"trust_proxy" env:"TRUST_PROXY"`
+	MediaRoot   string `yaml:"media_root" env:"MEDIA_ROOT" default:"media_data"`
+	// MailFile куда складывать письма, если SMTP не настроен; пусто -- в лог
+	MailFile string `yaml:"mail_file" env:"MAIL_FILE"`
+	// LogentriesToken без него логи пишутся только в stdout
+	LogentriesToken string `yaml:"logentries_token" env:"LOGENTRIESRUS_TOKEN" secret:"true"`
+	// TokenSecret и CSRFSecret у всех реплик должны совпадать и переживать рестарт,
+	// иначе ссылки из писем и CSRF-токены перестанут проходить проверку
+	TokenSecret string `yaml:"token_secret" env:"TOKEN_SECRET" required:"true" secret:"true"`
+	CSRFSecret  string `yaml:"csrf_secret" env:"CSRF_SECRET" required:"true" secret:"true"`
+
+	Server   Server   `yaml:"server" env:"SERVER_"`
+	DB       Database `yaml:"db" env:"DB_"`
+	Storage  Storage  `yaml:"storage" env:"STORAGE_"`
+	Queue    Queue    `yaml:"queue" env:"QUEUE_"`
+	SMTP     SMTP     `yaml:"smtp" env:"SMTP_"`
+	Cookie   Cookie   `yaml:"cookie" env:"COOKIE_"`
+	Session  Session  `yaml:"session" env:"SESSION_"`
+	Notify   Notify   `yaml:"notify" env:"NOTIFY_"`
+	Login    Login    `yaml:"login" env:"LOGIN_"`
+	Password Password `yaml:"password" env:""`
+
+	// OIDC провайдеры по имени. Из окружения берутся те, что перечислены
+	// в OIDC_PROVIDERS, с переменными OIDC_<ИМЯ>_*; флагов у них нет
+	OIDC map[string]OIDCProvider `yaml:"oidc,omitempty"`
+}
+
+// Server таймауты http сервера. WriteTimeout нет: он рвал бы SSE-потоки
+type Server struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" default:"10s"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" default:"2m"`
+	// CheckTimeout на каждую проверку зависимости в /readyz
+	CheckTimeout time.Duration `yaml:"check_timeout" env:"CHECK_TIMEOUT" default:"2s"`
+	// ShutdownTimeout сколько после SIGTERM ждать запросы, сокеты и проверки ботов
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"30s"`
+}
+
+// Database postgres
+type Database struct {
+	User string `yaml:"user" env:"USER" required:"true"`
+	Pass string `yaml:"pass" env:"PASS" secret:"true"`
+	Host string `yaml:"host" env:"HOST" required:"true"`
+	Port string `yaml:"port" env:"PORT" default:"5432"`
+	Name string `yaml:"name" env:"NAME" required:"true"`
+}
+
+// Storage redis сессий, лимитов и уведомлений
+type Storage struct {
+	User string `yaml:"user" env:"USER"`
+	Pass string `yaml:"pass" env:"PASS" secret:"true"`
+	Host string `yaml:"host" env:"HOST" required:"true"`
+}
+
+// Queue rabbitmq тестирующей системы
+type Queue struct {
+	User string `yaml:"user" env:"USER"`
+	Pass string `yaml:"pass" env:"PASS" secret:"true"`
+	Host string `yaml:"host" env:"HOST"`
+	Port string `yaml:"port" env:"PORT" default:"5672"`
+}
+
+// SMTP почта; без Host письма уходят в MailFile
+type SMTP struct {
+	Host string `yaml:"host" env:"HOST"`
+	Port string `yaml:"port" env:"PORT"`
+	User string `yaml:"user" env:"USER"`
+	Pass string `yaml:"pass" env:"PASS" secret:"true"`
+	From string `yaml:"from" env:"FROM"`
+}
+
+// Cookie атрибуты куки сессии
+type Cookie struct {
+	Secure bool   `yaml:"secure" env:"SECURE"`
+	Domain string `yaml:"domain" env:"DOMAIN"`
+	// SameSite lax, strict или none
+	SameSite string `yaml:"samesite" env:"SAMESITE" default:"lax"`
+}
+
+// Session хранилище сессий: redis или signed
+type Session struct {
+	Backend string `yaml:"backend" env:"BACKEND" default:"redis"`
+	// Keys пары kid:secret через запятую для signed
+	Keys  string `yaml:"keys" env:"KEYS" secret:"true"`
+	KeyID string `yaml:"key_id" env:"KEY_ID"`
+}
+
+// Notify шлюз уведомлений
+type Notify struct {
+	Buffer int `yaml:"buffer" env:"BUFFER"`
+	// SlowPolicy drop или disconnect
+	SlowPolicy string `yaml:"slow_policy" env:"SLOW_POLICY" default:"drop"`
+}
+
+// Login защита входа от перебора
+type Login struct {
+	Window        time.Duration `yaml:"window" env:"WINDOW"`
+	Lockout       time.Duration `yaml:"lockout" env:"LOCKOUT"`
+	MaxLockout    time.Duration `yaml:"max_lockout" env:"MAX_LOCKOUT"`
+	MaxAttempts   int64         `yaml:"max_attempts" env:"MAX_ATTEMPTS"`
+	MaxAttemptsIP int64         `yaml:"max_attempts_ip" env:"MAX_ATTEMPTS_IP"`
+}
+
+// Password хеширование паролей
+type Password struct {
+	Algorithm     string `yaml:"algorithm" env:"PASSWORD_ALGORITHM"`
+	Argon2Time    uint32 `yaml:"argon2_time" env:"ARGON2_TIME"`
+	Argon2Memory  uint32 `yaml:"argon2_memory" env:"ARGON2_MEMORY"`
+	Argon2Threads uint8  `yaml:"argon2_threads" env:"ARGON2_THREADS"`
+	BcryptCost    int    `yaml:"bcrypt_cost" env:"BCRYPT_COST"`
+}
+
+// OIDCProvider настройки внешнего входа, см. oidc.Config
+type OIDCProvider struct {
+	ClientID      string   `yaml:"client_id" env:"CLIENT_ID"`
+	ClientSecret  string   `yaml:"client_secret" env:"CLIENT_SECRET" secret:"true"`
+	Issuer        string   `yaml:"issuer" env:"ISSUER"`
+	AuthURL       string   `yaml:"auth_url" env:"AUTH_URL"`
+	TokenURL      string   `yaml:"token_url" env:"TOKEN_URL"`
+	UserInfoURL   string   `yaml:"userinfo_url" env:"USERINFO_URL"`
+	RedirectURL   string   `yaml:"redirect_url" env:"REDIRECT_URL"`
+	Scopes        []string `yaml:"scopes" env:"SCOPES"`
+	SubjectClaim  string   `yaml:"subject_claim" env:"SUBJECT_CLAIM"`
+	UsernameClaim string   `yaml:"username_claim" env:"USERNAME_CLAIM"`
+}
+
+// Options флаги запуска, которые сами в конфиг не входят
+type Options struct {
+	// File путь к yaml или toml, можно задать и через CONFIG_FILE
+	File string
+	// PrintConfig напечатать итоговый конфиг без секретов и выйти
+	PrintConfig bool
+}
+
+const redacted = "******"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load собирает конфиг из всех источников. Флаги называются как переменные
+// окружения в нижнем регистре через дефис: DB_HOST -> -db-host.
+// Проверку обязательных полей делает Validate, чтобы -print-config
+// мог показать и неполный конфиг
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, Options, error) {
+	cfg := &Config{}
+	all := fields(reflect.ValueOf(cfg).Elem(), "")
+	for _, f := range all {
+		if f.def == "" {
+			continue
+		}
+		if err := set(f.value, f.def); err != nil {
+			return nil, Options{}, errors.Wrapf(err, "default %s", f.env)
+		}
+	}
+
+	opts, flagged, err := parseFlags(all, args)
+	if err != nil {
+		return nil, opts, err
+	}
+
+	if opts.File == "" {
+		opts.File, _ = lookupEnv("CONFIG_FILE")
+	}
+	if opts.File != "" {
+		if err = readFile(opts.File, cfg); err != nil {
+			return nil, opts, errors.Wrapf(err, "config file %s", opts.File)
+		}
+	}
+
+	if err = loadEnv(all, lookupEnv); err != nil {
+		return nil, opts, err
+	}
+	if err = loadOIDCEnv(cfg, lookupEnv); err != nil {
+		return nil, opts, err
+	}
+
+	if err = applyFlags(all, flagged); err != nil {
+		return nil, opts, err
+	}
+
+	return cfg, opts, nil
+}
+
+// minSecretLen минимальная длина ключей подписи
+const minSecretLen = 32
+
+// Validate проверяет обязательные поля, порт, таймаут остановки и длину секретов
+func (c *Config) Validate() error {
+	var missing []string
+	for _, f := range fields(reflect.ValueOf(c).Elem(), "") {
+		if f.required && f.value.String() == "" {
+			missing = append(missing, f.env)
+		}
+	}
+	if len(missing) != 0 {
+		return errors.Errorf("required settings are not set: %s", strings.Join(missing, ", "))
+	}
+
+	// без этой проверки пустой PORT молча превращался в ":"
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		return errors.Errorf("PORT must be a number in 1..65535, got %q", c.Port)
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		return errors.Errorf("SERVER_SHUTDOWN_TIMEOUT must be positive, got %s", c.Server.ShutdownTimeout)
+	}
+	// короткий ключ HMAC подбирается перебором, как и SESSION_KEYS
+	if len(c.TokenSecret) < minSecretLen {
+		return errors.Errorf("TOKEN_SECRET must be %d+ chars", minSecretLen)
+	}
+	if len(c.CSRFSecret) < minSecretLen {
+		return errors.Errorf("CSRF_SECRET must be %d+ chars", minSecretLen)
+	}
+
+	return nil
+}
+
+// Addr адрес для http.Server
+func (c *Config) Addr() string {
+	return ":" + c.Port
+}
+
+// Redacted копия конфига со скрытыми секретами, её можно печатать и логировать
+func (c *Config) Redacted() *Config {
+	cp := *c
+	redact(reflect.ValueOf(&cp).Elem())
+
+	cp.OIDC = make(map[string]OIDCProvider, len(c.OIDC))
+	for name, p := range c.OIDC {
+		redact(reflect.ValueOf(&p).Elem())
+		cp.OIDC[name] = p
+	}
+
+	return &cp
+}
+
+// String конфиг в yaml без секретов
+func (c *Config) String() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return "config: " + err.Error()
+	}
+	return string(data)
+}
+
+// field лист конфига с полным именем переменной окружения
+type field struct {
+	value    reflect.Value
+	env      string
+	def      string
+	required bool
+	secret   bool
+}
+
+// fields листья структуры; у вложенных структур тег env -- префикс
+func fields(v reflect.Value, prefix string) []field {
+	var out []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		env, ok := sf.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+
+		if sf.Type.Kind() == reflect.Struct {
+			out = append(out, fields(v.Field(i), prefix+env)...)
+			continue
+		}
+		out = append(out, field{
+			value:    v.Field(i),
+			env:      prefix + env,
+			def:      sf.Tag.Get("default"),
+			required: sf.Tag.Get("required") == "true",
+			secret:   sf.Tag.Get("secret") == "true",
+		})
+	}
+
+	return out
+}
+
+func redact(v reflect.Value) {
+	for _, f := range fields(v, "") {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
+	}
+}
+
+// flagValue копит значения флагов, применяются они после файла и окружения
+type flagValue struct {
+	flagged map[string]string
+	env     string
+	isBool  bool
+}
+
+func (v *flagValue) String() string {
+	return ""
+}
+
+func (v *flagValue) Set(s string) error {
+	v.flagged[v.env] = s
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+func flagName(env string) string {
+	return strings.ToLower(strings.Replace(env, "_", "-", -1))
+}
+
+func applyFlags(all []field, flagged map[string]string) error {
+	for _, f := range all {
+		value, ok := flagged[f.env]
+		if !ok {
+			continue
+		}
+		if err := set(f.value, value); err != nil {
+			return errors.Wrapf(err, "flag -%s", flagName(f.env))
+		}
+	}
+
+	return nil
+}
+
+func parseFlags(all []field, args []string) (Options, map[string]string, error) {
+	opts := Options{}
+	flagged := make(map[string]string)
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.StringVar(&opts.File, "config", "", "path to yaml or toml config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print effective config without secrets and exit")
+	for _, f := range all {
+		fs.Var(&flagValue{
+			flagged: flagged,
+			env:     f.env,
+			isBool:  f.value.Kind() == reflect.Bool,
+		}, flagName(f.env), "overrides "+f.env)
+	}
+
+	// flag.ErrHelp отдаём как есть, main по нему просто выходит
+	err := fs.Parse(args)
+	return opts, flagged, err
+}
+
+// readFile формат по расширению. toml перекладываем в yaml, чтобы
+// разбирать одним кодом: длительности строками, неизвестные ключи -- ошибка
+func readFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+	case ".toml":
+		raw := make(map[string]interface{})
+		if _, err = toml.DecodeReader(bytes.NewReader(data), &raw); err != nil {
+			return err
+		}
+		if data, err = yaml.Marshal(raw); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown config format %q, want .yaml, .yml or .toml", ext)
+	}
+
+	return yaml.UnmarshalStrict(data, cfg)
+}
+
+// loadEnv пустая переменная считается незаданной
+func loadEnv(all []field, lookupEnv func(string) (string, bool)) error {
+	for _, f := range all {
+		value, ok := lookupEnv(f.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := set(f.value, value); err != nil {
+			return errors.Wrapf(err, "env %s", f.env)
+		}
+	}
+
+	return nil
+}
+
+func loadOIDCEnv(cfg *Config, lookupEnv func(string) (string, bool)) error {
+	names, _ := lookupEnv("OIDC_PROVIDERS")
+	for _, name := range splitList(names) {
+		if cfg.OIDC == nil {
+			cfg.OIDC = make(map[string]OIDCProvider)
+		}
+
+		p := cfg.OIDC[name]
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		if err := loadEnv(fields(reflect.ValueOf(&p).Elem(), prefix), lookupEnv); err != nil {
+			return err
+		}
+		cfg.OIDC[name] = p
+	}
+
+	return nil
+}
+
+func set(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(splitList(s)))
+	default:
+		return setNumber(v, s)
+	}
+
+	return nil
+}
+
+func setNumber(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		return errors.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// splitList списки через запятую или пробел: "github,university", "openid email"
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
@@ -0,0 +1,282 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env окружение теста вместо os.LookupEnv
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	t.Parallel()
+
+	cfg, opts, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.PrintConfig || opts.File != "" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+	if cfg.Port != "8080" || cfg.Addr() != ":8080" {
+		t.Fatalf("expected default port 8080, got %q", cfg.Port)
+	}
+	if cfg.DB.Port != "5432" || cfg.Session.Backend != "redis" || cfg.Notify.SlowPolicy != "drop" {
+		t.Fatalf("defaults are not applied: %+v", cfg)
+	}
+	if cfg.Server.ShutdownTimeout != 30*time.Second {
+		t.Fatalf("expected default shutdown timeout, got %s", cfg.Server.ShutdownTimeout)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "app.yaml", `
+port: "9000"
+db:
+  host: db.file
+  user: file
+login:
+  window: 5m
+`)
+	cfg, _, err := Load([]string{"-config", path, "-db-user", "flag", "-trust-proxy"}, env(map[string]string{
+		"PORT":    "9100",
+		"DB_USER": "env",
+		// пустая переменная не затирает файл
+		"DB_HOST": "",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != "9100" {
+		t.Fatalf("env must override file, got port %q", cfg.Port)
+	}
+	if cfg.DB.User != "flag" {
+		t.Fatalf("flag must override env, got user %q", cfg.DB.User)
+	}
+	if cfg.DB.Host != "db.file" {
+		t.Fatalf("expected host from file, got %q", cfg.DB.Host)
+	}
+	if cfg.Login.Window != 5*time.Minute {
+		t.Fatalf("expected window from file, got %s", cfg.Login.Window)
+	}
+	if !cfg.TrustProxy {
+		t.Fatal("bool flag without value must be true")
+	}
+}
+
+func TestTOMLFile(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "app.toml", `
+port = "9000"
+
+[storage]
+host = "redis:6379"
+
+[password]
+argon2_time = 4
+
+[oidc.github]
+client_id = "id"
+scopes = ["read:user"]
+`)
+	cfg, _, err := Load(nil, env(map[string]string{"CONFIG_FILE": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != "9000" || cfg.Storage.Host != "redis:6379" || cfg.Password.Argon2Time != 4 {
+		t.Fatalf("toml is not applied: %+v", cfg)
+	}
+	if p := cfg.OIDC["github"]; p.ClientID != "id" || len(p.Scopes) != 1 {
+		t.Fatalf("unexpected oidc provider: %+v", p)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	cases := map[string]string{
+		"unknown.yaml": "prot: 8080\n",
+		"app.json":     "{}",
+		"bad.toml":     "port = ",
+	}
+	for name, content := range cases {
+		path := writeFile(t, dir, name, content)
+		if _, _, err := Load([]string{"-config", path}, env(nil)); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+
+	if _, _, err := Load([]string{"-config", "/nonexistent.yaml"}, env(nil)); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestBadValues(t *testing.T) {
+	t.Parallel()
+
+	if _, _, err := Load(nil, env(map[string]string{"LOGIN_WINDOW": "soon"})); err == nil {
+		t.Fatal("expected error for bad duration")
+	}
+	if _, _, err := Load(nil, env(map[string]string{"ARGON2_THREADS": "1000"})); err == nil {
+		t.Fatal("expected error for overflow")
+	}
+	if _, _, err := Load([]string{"-cookie-secure=maybe"}, env(nil)); err == nil {
+		t.Fatal("expected error for bad bool flag")
+	}
+	if _, _, err := Load([]string{"-no-such-flag"}, env(nil)); err == nil {
+		t.Fatal("expected error for unknown flag")
+	}
+}
+
+func TestOIDCEnv(t *testing.T) {
+	t.Parallel()
+
+	cfg, _, err := Load(nil, env(map[string]string{
+		"OIDC_PROVIDERS":              "github, university",
+		"OIDC_GITHUB_CLIENT_ID":       "gh",
+		"OIDC_GITHUB_SCOPES":          "read:user user:email",
+		"OIDC_UNIVERSITY_ISSUER":      "https://sso.example.com",
+		"OIDC_UNIVERSITY_CLIENT_ID":   "uni",
+		"OIDC_UNLISTED_CLIENT_SECRET": "ignored",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.OIDC) != 2 {
+		t.Fatalf("expected 2 providers, got %+v", cfg.OIDC)
+	}
+	if p := cfg.OIDC["github"]; p.ClientID != "gh" || len(p.Scopes) != 2 {
+		t.Fatalf("unexpected github provider: %+v", p)
+	}
+	if p := cfg.OIDC["university"]; p.Issuer != "https://sso.example.com" {
+		t.Fatalf("unexpected university provider: %+v", p)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	cfg, _, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected missing settings")
+	}
+	for _, name := range []string{"TOKEN_SECRET", "CSRF_SECRET", "DB_USER", "DB_HOST", "DB_NAME", "STORAGE_HOST"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("expected %s in error, got %s", name, err)
+		}
+	}
+
+	cfg.TokenSecret, cfg.CSRFSecret = "token", "csrf"
+	cfg.DB = Database{User: "u", Host: "h", Name: "n", Port: "5432"}
+	cfg.Storage.Host = "h"
+	if err = cfg.Validate(); err == nil || !strings.Contains(err.Error(), "TOKEN_SECRET") {
+		t.Fatalf("expected error for short TOKEN_SECRET, got %v", err)
+	}
+
+	cfg.TokenSecret = strings.Repeat("t", 32)
+	if err = cfg.Validate(); err == nil || !strings.Contains(err.Error(), "CSRF_SECRET") {
+		t.Fatalf("expected error for short CSRF_SECRET, got %v", err)
+	}
+
+	cfg.CSRFSecret = strings.Repeat("c", 32)
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, port := range []string{"", "http", "0", "70000"} {
+		cfg.Port = port
+		if err = cfg.Validate(); err == nil {
+			t.Fatalf("expected error for port %q", port)
+		}
+	}
+
+	cfg.Port = "8080"
+	cfg.Server.ShutdownTimeout = 0
+	if err = cfg.Validate(); err == nil {
+		t.Fatal("expected error for zero shutdown timeout")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	t.Parallel()
+
+	cfg, opts, err := Load([]string{"-print-config"}, env(map[string]string{
+		"DB_PASS":                   "db-secret",
+		"TOKEN_SECRET":              "token-secret",
+		"OIDC_PROVIDERS":            "github",
+		"OIDC_GITHUB_CLIENT_ID":     "gh",
+		"OIDC_GITHUB_CLIENT_SECRET": "oidc-secret",
+		"LOGIN_LOCKOUT":             "2m",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.PrintConfig {
+		t.Fatal("expected print-config option")
+	}
+
+	out := cfg.String()
+	for _, secret := range []string{"db-secret", "token-secret", "oidc-secret"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("secret %s leaked:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{"pass: '******'", "client_id: gh", "lockout: 2m0s"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+	// пустые секреты не маскируем, чтобы было видно, какого обязательного не хватает
+	if !strings.Contains(out, `csrf_secret: ""`) {
+		t.Fatalf("empty secret must stay empty:\n%s", out)
+	}
+
+	// исходный конфиг не тронут
+	if cfg.DB.Pass != "db-secret" || cfg.OIDC["github"].ClientSecret != "oidc-secret" {
+		t.Fatal("Redacted must not modify the original")
+	}
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"strconv"
 
 	"github.com/jackc/pgx"
@@ -11,17 +12,14 @@ type Queryer interface {
 	QueryRow(string, ...interface{}) *pgx.Row
 }
 
-var Conn *pgx.ConnPool
-
-// Connect открывает соединение с базой
-func Connect(dbUser, dbPass, dbHost, dbPort, dbName string) error {
-	var err error
+// Connect открывает пул соединений с базой, закрывает его вызывающий
+func Connect(dbUser, dbPass, dbHost, dbPort, dbName string) (*pgx.ConnPool, error) {
 	port, err := strconv.ParseInt(dbPort, 10, 16)
 	if err != nil {
-		return errors.Wrap(err, "port int parse error")
+		return nil, errors.Wrap(err, "port int parse error")
 	}
 
-	Conn, err = pgx.NewConnPool(pgx.ConnPoolConfig{
+	conn, err := pgx.NewConnPool(pgx.ConnPoolConfig{
 		ConnConfig: pgx.ConnConfig{
 			Host:     dbHost,
 			User:     dbUser,
@@ -31,12 +29,14 @@ func Connect(dbUser, dbPass, dbHost, dbPort, dbName string) error {
 		},
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return conn, nil
 }
 
-func Close() {
-	Conn.Close()
+// Ping пустой запрос через пул, для проверки готовности
+func Ping(ctx context.Context, pool *pgx.ConnPool) error {
+	_, err := pool.ExecEx(ctx, ";", nil)
+	return err
 }
@@ -0,0 +1,32 @@
+package games
+
+import "sync"
+
+// BotCodeListener обработчик смены эталонного бота игры
+type BotCodeListener func(g *GameModel)
+
+// Handler ручки игр, собирается в main
+type Handler struct {
+	Games GameAccessObject
+
+	botCodeListenersMu sync.RWMutex
+	botCodeListeners   []BotCodeListener
+}
+
+// OnBotCodeChange подписывает на смену эталонного бота.
+// Через него bots перепроверяет ботов, не импортируя games по кругу
+func (h *Handler) OnBotCodeChange(l BotCodeListener) {
+	h.botCodeListenersMu.Lock()
+	defer h.botCodeListenersMu.Unlock()
+
+	h.botCodeListeners = append(h.botCodeListeners, l)
+}
+
+func (h *Handler) notifyBotCodeChange(g *GameModel) {
+	h.botCodeListenersMu.RLock()
+	defer h.botCodeListenersMu.RUnlock()
+
+	for _, l := range h.botCodeListeners {
+		l(g)
+	}
+}
@@ -11,16 +11,17 @@ import (
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
 	"github.com/gorilla/mux"
+	"github.com/mailru/easyjson/opt"
 	"github.com/pkg/errors"
 )
 
 // GetGame получает объект игры
-func GetGame(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetGame(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "GetGame")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	vars := mux.Vars(r)
 
-	game, err := Games.GetGameBySlug(vars["game_slug"])
+	game, err := h.Games.GetGameBySlug(vars["game_slug"])
 	if err != nil {
 		if errors.Cause(err) == utils.ErrNotExists {
 			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "game not exists"))
@@ -30,26 +31,15 @@ func GetGame(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utils.WriteApplicationJSON(w, http.StatusOK, &GameFull{
-		Game: Game{
-			Slug:           game.Slug.String,
-			Title:          game.Title.String,
-			BackgroundUUID: uuid.UUID(game.BackgroundUUID.Bytes).String(), // точно 16 байт
-		},
-		Description: game.Description.String,
-		Rules:       game.Rules.String,
-		CodeExample: game.CodeExample.String,
-		BotCode:     game.BotCode.String,
-		LogoUUID:    uuid.UUID(game.LogoUUID.Bytes).String(), // точно 16 байт
-	})
+	utils.WriteApplicationJSON(w, http.StatusOK, newGameFull(game))
 }
 
 // GetGameList gets list of games
-func GetGameList(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetGameList(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "GetGameList")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 
-	games, err := Games.GetGameList()
+	games, err := h.Games.GetGameList()
 	if err != nil {
 		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get game list method error"))
 
@@ -69,7 +59,7 @@ func GetGameList(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetGameLeaderboard gets list of leaders in game
-func GetGameLeaderboard(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetGameLeaderboard(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "GetGameLeaderboard")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	vars := mux.Vars(r)
@@ -84,7 +74,7 @@ func GetGameLeaderboard(w http.ResponseWriter, r *http.Request) {
 		offsetParam = 0
 	}
 
-	leadersModels, err := Games.GetGameLeaderboardBySlug(vars["game_slug"], limitParam, offsetParam)
+	leadersModels, err := h.Games.GetGameLeaderboardBySlug(vars["game_slug"], limitParam, offsetParam)
 	if err != nil {
 		if errors.Cause(err) == utils.ErrNotExists {
 			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "game not exists or offset is large"))
@@ -118,12 +108,12 @@ func GetGameLeaderboard(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetGameTotalPlayers количество юзеров игравших в game_id
-func GetGameTotalPlayers(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetGameTotalPlayers(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "GetGameTotalPlayers")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	vars := mux.Vars(r)
 
-	totalCount, err := Games.GetGameTotalPlayersBySlug(vars["game_slug"])
+	totalCount, err := h.Games.GetGameTotalPlayersBySlug(vars["game_slug"])
 	if err != nil {
 		if errors.Cause(err) == utils.ErrNotExists {
 			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "game not exists"))
@@ -139,3 +129,154 @@ func GetGameTotalPlayers(w http.ResponseWriter, r *http.Request) {
 		Count: totalCount,
 	})
 }
+
+// CreateGame создаёт новую игру
+func (h *Handler) CreateGame(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "CreateGame")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	form := &FormGame{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	if valError := form.Validate(); valError != nil {
+		errWriter.WriteValidationError(valError)
+		return
+	}
+
+	game := &GameModel{
+		Slug:           pgtype.Text{String: form.Slug, Status: pgtype.Present},
+		Title:          pgtype.Text{String: form.Title, Status: pgtype.Present},
+		Description:    pgtype.Text{String: form.Description, Status: pgtype.Present},
+		Rules:          pgtype.Text{String: form.Rules, Status: pgtype.Present},
+		CodeExample:    pgtype.Text{String: form.CodeExample, Status: pgtype.Present},
+		BotCode:        pgtype.Text{String: form.BotCode, Status: pgtype.Present},
+		LogoUUID:       pgtype.UUID{Bytes: uuid.MustParse(form.LogoUUID), Status: pgtype.Present},
+		BackgroundUUID: pgtype.UUID{Bytes: uuid.MustParse(form.BackgroundUUID), Status: pgtype.Present},
+	}
+
+	if err = h.Games.Create(game); err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "game create error"))
+		return
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, newGameFull(game))
+}
+
+// UpdateGame обновляет поля игры, при смене эталонного бота
+// запускается перепроверка ботов этой игры
+func (h *Handler) UpdateGame(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "UpdateGame")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	vars := mux.Vars(r)
+
+	form := &FormGameUpdate{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	game, botCodeChanged, err := h.updateGameImpl(vars["game_slug"], form)
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "game not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "game update error"))
+		}
+		return
+	}
+
+	if botCodeChanged {
+		logger.Infof("bot code of game %s changed, reverify bots", game.Slug.String)
+		h.notifyBotCodeChange(game)
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, newGameFull(game))
+}
+
+func (h *Handler) updateGameImpl(slug string, form *FormGameUpdate) (*GameModel, bool, error) {
+	if err := form.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	text := func(value opt.String) pgtype.Text {
+		if !value.IsDefined() {
+			return pgtype.Text{Status: pgtype.Null}
+		}
+		return pgtype.Text{String: value.V, Status: pgtype.Present}
+	}
+	uuidOf := func(value opt.String) pgtype.UUID {
+		if !value.IsDefined() {
+			return pgtype.UUID{Status: pgtype.Null}
+		}
+		return pgtype.UUID{Bytes: uuid.MustParse(value.V), Status: pgtype.Present}
+	}
+
+	// незаданные поля остаются Null, Update их не трогает
+	game, botCodeChanged, err := h.Games.Update(slug, &GameModel{
+		Slug:           text(form.Slug),
+		Title:          text(form.Title),
+		Description:    text(form.Description),
+		Rules:          text(form.Rules),
+		CodeExample:    text(form.CodeExample),
+		BotCode:        text(form.BotCode),
+		LogoUUID:       uuidOf(form.LogoUUID),
+		BackgroundUUID: uuidOf(form.BackgroundUUID),
+	})
+	if err != nil {
+		if _, ok := err.(*utils.ValidationError); ok {
+			return nil, false, err
+		}
+
+		return nil, false, errors.Wrap(err, "game update error")
+	}
+
+	return game, botCodeChanged, nil
+}
+
+// DeleteGame удаляет игру
+func (h *Handler) DeleteGame(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "DeleteGame")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	vars := mux.Vars(r)
+
+	if err := h.Games.Delete(vars["game_slug"]); err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "game not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "game delete error"))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func newGameFull(game *GameModel) *GameFull {
+	return &GameFull{
+		Game: Game{
+			Slug:           game.Slug.String,
+			Title:          game.Title.String,
+			BackgroundUUID: uuid.UUID(game.BackgroundUUID.Bytes).String(), // точно 16 байт
+		},
+		Description: game.Description.String,
+		Rules:       game.Rules.String,
+		CodeExample: game.CodeExample.String,
+		BotCode:     game.BotCode.String,
+		LogoUUID:    uuid.UUID(game.LogoUUID.Bytes).String(), // точно 16 байт
+	}
+}
@@ -18,15 +18,20 @@ type GameAccessObject interface {
 	GetGameTotalPlayersBySlug(slug string) (int64, error)
 	GetGameList() ([]*GameModel, error)
 	GetGameLeaderboardBySlug(slug string, limit, offset int) ([]*ScoredUserModel, error)
+	// GetUserScores очки юзера во всех играх, где он играл
+	GetUserScores(userID int64) ([]*UserScoreModel, error)
+
+	// Create и Update при конфликте slug или title возвращают *utils.ValidationError
+	Create(g *GameModel) error
+	// Update меняет только не Null поля patch и возвращает игру после изменения
+	// и то, сменился ли эталонный бот
+	Update(slug string, patch *GameModel) (*GameModel, bool, error)
+	Delete(slug string) error
 }
 
 // AccessObject implementation of GameAccessObject
-type AccessObject struct{}
-
-var Games GameAccessObject
-
-func init() {
-	Games = &AccessObject{}
+type AccessObject struct {
+	DB *pgx.ConnPool
 }
 
 // Game модель для таблицы games
@@ -48,8 +53,98 @@ type ScoredUserModel struct {
 	Score pgtype.Int4
 }
 
+// UserScoreModel очки юзера в одной игре
+type UserScoreModel struct {
+	GameSlug  pgtype.Text
+	GameTitle pgtype.Text
+	Score     pgtype.Int4
+}
+
+// Create создаёт новую игру
+func (gs *AccessObject) Create(g *GameModel) error {
+	row := gs.DB.QueryRow(`INSERT INTO games (slug, title, description, rules,
+						code_example, bot_code, logo_uuid, background_uuid)
+						VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;`,
+		&g.Slug, &g.Title, &g.Description, &g.Rules,
+		&g.CodeExample, &g.BotCode, &g.LogoUUID, &g.BackgroundUUID)
+	if err := row.Scan(&g.ID); err != nil {
+		if validErr := takenError(err); validErr != nil {
+			return validErr
+		}
+
+		return errors.Wrap(err, "can not insert game row")
+	}
+
+	return nil
+}
+
+// Update одним запросом: строка заблокирована от чтения старого bot_code до записи,
+// и параллельные правки разных полей не затирают друг друга
+func (gs *AccessObject) Update(slug string, patch *GameModel) (*GameModel, bool, error) {
+	g := &GameModel{}
+	var oldBotCode pgtype.Text
+	row := gs.DB.QueryRow(`UPDATE games g SET slug = COALESCE($2, g.slug), title = COALESCE($3, g.title),
+						description = COALESCE($4, g.description), rules = COALESCE($5, g.rules),
+						code_example = COALESCE($6, g.code_example), bot_code = COALESCE($7, g.bot_code),
+						logo_uuid = COALESCE($8, g.logo_uuid),
+						background_uuid = COALESCE($9, g.background_uuid)
+						FROM (SELECT id, bot_code FROM games WHERE slug = $1 FOR UPDATE) old
+						WHERE g.id = old.id
+						RETURNING g.id, g.slug, g.title, g.description, g.rules, g.code_example,
+						g.bot_code, g.logo_uuid, g.background_uuid, old.bot_code;`,
+		slug, &patch.Slug, &patch.Title, &patch.Description, &patch.Rules,
+		&patch.CodeExample, &patch.BotCode, &patch.LogoUUID, &patch.BackgroundUUID)
+	err := row.Scan(&g.ID, &g.Slug, &g.Title, &g.Description, &g.Rules, &g.CodeExample,
+		&g.BotCode, &g.LogoUUID, &g.BackgroundUUID, &oldBotCode)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, false, utils.ErrNotExists
+		}
+
+		if validErr := takenError(err); validErr != nil {
+			return nil, false, validErr
+		}
+
+		return nil, false, errors.Wrap(err, "can not update game row")
+	}
+
+	return g, oldBotCode.String != g.BotCode.String, nil
+}
+
+// Delete удаляет игру, вместе с ней каскадно удаляются боты и лидерборд
+func (gs *AccessObject) Delete(slug string) error {
+	var id int64
+	row := gs.DB.QueryRow(`DELETE FROM games WHERE slug = $1 RETURNING id;`, slug)
+	if err := row.Scan(&id); err != nil {
+		if err == pgx.ErrNoRows {
+			return utils.ErrNotExists
+		}
+
+		return errors.Wrap(err, "can not delete game row")
+	}
+
+	return nil
+}
+
+// takenError превращает нарушение уникальности в ошибку валидации нужного поля
+func takenError(err error) *utils.ValidationError {
+	pgErr, ok := err.(pgx.PgError)
+	if !ok || pgErr.Code != "23505" {
+		return nil
+	}
+
+	field := "slug"
+	if pgErr.ConstraintName == "unique_title" {
+		field = "title"
+	}
+
+	return &utils.ValidationError{
+		field: utils.ErrTaken.Error(),
+	}
+}
+
 func (gs *AccessObject) GetGameBySlug(slug string) (*GameModel, error) {
-	g, err := gs.getGameImpl(database.Conn, "slug", slug)
+	g, err := gs.getGameImpl(gs.DB, "slug", slug)
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -64,7 +159,7 @@ func (gs *AccessObject) GetGameBySlug(slug string) (*GameModel, error) {
 
 // GetGameTotalPlayersByID получение общего количества игроков
 func (gs *AccessObject) GetGameTotalPlayersBySlug(slug string) (int64, error) {
-	tx, err := database.Conn.Begin()
+	tx, err := gs.DB.Begin()
 	if err != nil {
 		return 0, errors.Wrap(err, "can not open 'GetGameTotalPlayersByID' transaction")
 	}
@@ -80,7 +175,9 @@ func (gs *AccessObject) GetGameTotalPlayersBySlug(slug string) (int64, error) {
 	}
 
 	var totalPlayers int64
-	row := tx.QueryRow(`SELECT count(*) FROM users_games WHERE game_id = $1;`, &g.ID)
+	row := tx.QueryRow(`SELECT count(*) FROM users_games ug
+						JOIN users u ON u.id = ug.user_id AND (u.active OR u.banned_until <= now())
+						WHERE ug.game_id = $1;`, &g.ID)
 	if err = row.Scan(&totalPlayers); err != nil {
 		return 0, errors.Wrap(err, "get game total players error")
 	}
@@ -97,8 +194,9 @@ func (gs *AccessObject) GetGameTotalPlayersBySlug(slug string) (int64, error) {
 func (gs *AccessObject) GetGameLeaderboardBySlug(slug string, limit, offset int) ([]*ScoredUserModel, error) {
 	// узнаём количество
 
-	rows, err := database.Conn.Query(`SELECT u.id, u.username, u.photo_uuid, u.active, ug.score FROM users u
-					LEFT JOIN users_games ug on u.id = ug.user_id
+	// забаненных отсекаем в ON, а не в WHERE: иначе пропадёт строка игры без игроков
+	rows, err := gs.DB.Query(`SELECT u.id, u.username, u.photo_uuid, u.active, ug.score FROM users u
+					LEFT JOIN users_games ug on u.id = ug.user_id AND (u.active OR u.banned_until <= now())
 					RIGHT JOIN games g on ug.game_id = g.id
 					WHERE g.slug = $1 ORDER BY ug.score DESC OFFSET $2 LIMIT $3;`, slug, offset, limit)
 	if err != nil {
@@ -125,9 +223,31 @@ func (gs *AccessObject) GetGameLeaderboardBySlug(slug string, limit, offset int)
 	return leaderboard, nil
 }
 
+// GetUserScores очки юзера по играм
+func (gs *AccessObject) GetUserScores(userID int64) ([]*UserScoreModel, error) {
+	rows, err := gs.DB.Query(`SELECT g.slug, g.title, ug.score FROM users_games ug
+					JOIN games g on ug.game_id = g.id
+					WHERE ug.user_id = $1 ORDER BY g.id;`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get user scores error")
+	}
+	defer rows.Close()
+
+	scores := make([]*UserScoreModel, 0)
+	for rows.Next() {
+		score := &UserScoreModel{}
+		if err = rows.Scan(&score.GameSlug, &score.GameTitle, &score.Score); err != nil {
+			return nil, errors.Wrap(err, "get user scores scan error")
+		}
+		scores = append(scores, score)
+	}
+
+	return scores, nil
+}
+
 // GetGameList returns full list of active games
 func (gs *AccessObject) GetGameList() ([]*GameModel, error) {
-	rows, err := database.Conn.Query(`SELECT g.id, g.slug, g.title, g.description,
+	rows, err := gs.DB.Query(`SELECT g.id, g.slug, g.title, g.description,
 								g.rules, g.code_example, g.bot_code, g.logo_uuid, g.background_uuid
 								FROM games g ORDER BY g.id`)
 	if err != nil {
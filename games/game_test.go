@@ -22,10 +22,9 @@ type GameTest struct {
 	nextFail error
 }
 
-// setFailureUser fails next request
-func setFailureGame(err error) {
-	bt := Games.(*GameTest)
-	bt.nextFail = err
+// setFailure fails next request
+func (gt *GameTest) setFailure(err error) {
+	gt.nextFail = err
 }
 
 func (gt *GameTest) GetGameBySlug(slug string) (*GameModel, error) {
@@ -35,8 +34,14 @@ func (gt *GameTest) GetGameBySlug(slug string) (*GameModel, error) {
 		return nil, err
 	}
 
-	g := gt.games[slug]
-	return g, nil
+	g, ok := gt.games[slug]
+	if !ok {
+		return nil, utils.ErrNotExists
+	}
+
+	// отдаём копию, как это сделала бы база
+	copyG := *g
+	return &copyG, nil
 }
 
 func (gt *GameTest) GetGameTotalPlayersBySlug(slug string) (int64, error) {
@@ -86,24 +91,101 @@ func (gt *GameTest) GetGameLeaderboardBySlug(slug string, limit, offset int) ([]
 	return leaderboard, nil
 }
 
-func initTests() {
-	Games = &GameTest{
-		games: map[string]*GameModel{
-			"pong": {
-				ID:          pgtype.Int8{Int: 1, Status: pgtype.Present},
-				Slug:        pgtype.Text{String: "pong", Status: pgtype.Present},
-				Title:       pgtype.Text{String: "Pong", Status: pgtype.Present},
-				Description: pgtype.Text{String: "Very cool game(net)", Status: pgtype.Present},
-				Rules:       pgtype.Text{String: "Do not cheat, please", Status: pgtype.Present},
-				CodeExample: pgtype.Text{String: "const a = 5;", Status: pgtype.Present},
-				BotCode:     pgtype.Text{String: "const a = 5;", Status: pgtype.Present},
-				LogoUUID: pgtype.UUID{Bytes: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
-					Status: pgtype.Present},
-				BackgroundUUID: pgtype.UUID{Bytes: [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
-					Status: pgtype.Present},
+func (gt *GameTest) GetUserScores(userID int64) ([]*UserScoreModel, error) {
+	if gt.nextFail != nil {
+		err := gt.nextFail
+		gt.nextFail = nil
+		return nil, err
+	}
+
+	return []*UserScoreModel{}, nil
+}
+
+func (gt *GameTest) Create(g *GameModel) error {
+	if gt.nextFail != nil {
+		err := gt.nextFail
+		gt.nextFail = nil
+		return err
+	}
+
+	g.ID = pgtype.Int8{Int: int64(len(gt.games) + 1), Status: pgtype.Present}
+	gt.games[g.Slug.String] = g
+	return nil
+}
+
+func (gt *GameTest) Update(slug string, patch *GameModel) (*GameModel, bool, error) {
+	if gt.nextFail != nil {
+		err := gt.nextFail
+		gt.nextFail = nil
+		return nil, false, err
+	}
+
+	g, ok := gt.games[slug]
+	if !ok {
+		return nil, false, utils.ErrNotExists
+	}
+
+	updated := *g
+	setText := func(field *pgtype.Text, value pgtype.Text) {
+		if value.Status == pgtype.Present {
+			*field = value
+		}
+	}
+	setUUID := func(field *pgtype.UUID, value pgtype.UUID) {
+		if value.Status == pgtype.Present {
+			*field = value
+		}
+	}
+	setText(&updated.Slug, patch.Slug)
+	setText(&updated.Title, patch.Title)
+	setText(&updated.Description, patch.Description)
+	setText(&updated.Rules, patch.Rules)
+	setText(&updated.CodeExample, patch.CodeExample)
+	setText(&updated.BotCode, patch.BotCode)
+	setUUID(&updated.LogoUUID, patch.LogoUUID)
+	setUUID(&updated.BackgroundUUID, patch.BackgroundUUID)
+
+	delete(gt.games, slug)
+	gt.games[updated.Slug.String] = &updated
+	result := updated
+	return &result, g.BotCode.String != updated.BotCode.String, nil
+}
+
+func (gt *GameTest) Delete(slug string) error {
+	if gt.nextFail != nil {
+		err := gt.nextFail
+		gt.nextFail = nil
+		return err
+	}
+
+	if _, ok := gt.games[slug]; !ok {
+		return utils.ErrNotExists
+	}
+	delete(gt.games, slug)
+	return nil
+}
+
+// newTestHandler хендлер на свежей заглушке, у каждого теста свой
+func newTestHandler() *Handler {
+	return &Handler{
+		Games: &GameTest{
+			games: map[string]*GameModel{
+				"pong": {
+					ID:          pgtype.Int8{Int: 1, Status: pgtype.Present},
+					Slug:        pgtype.Text{String: "pong", Status: pgtype.Present},
+					Title:       pgtype.Text{String: "Pong", Status: pgtype.Present},
+					Description: pgtype.Text{String: "Very cool game(net)", Status: pgtype.Present},
+					Rules:       pgtype.Text{String: "Do not cheat, please", Status: pgtype.Present},
+					CodeExample: pgtype.Text{String: "const a = 5;", Status: pgtype.Present},
+					BotCode:     pgtype.Text{String: "const a = 5;", Status: pgtype.Present},
+					LogoUUID: pgtype.UUID{Bytes: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+						Status: pgtype.Present},
+					BackgroundUUID: pgtype.UUID{Bytes: [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+						Status: pgtype.Present},
+				},
 			},
+			nextFail: nil,
 		},
-		nextFail: nil,
 	}
 }
 
@@ -112,22 +194,23 @@ type GameTestCase struct {
 	Failure error
 }
 
-func runTableAPITests(t *testing.T, cases []*GameTestCase) {
+func runTableAPITests(t *testing.T, h *Handler, cases []*GameTestCase) {
 	for i, c := range cases {
-		runAPITest(t, i, c)
+		runAPITest(t, h, i, c)
 	}
 }
 
-func runAPITest(t *testing.T, i int, c *GameTestCase) {
+func runAPITest(t *testing.T, h *Handler, i int, c *GameTestCase) {
 	if c.Failure != nil {
-		setFailureGame(c.Failure)
+		h.Games.(*GameTest).setFailure(c.Failure)
 	}
 
 	testutils.RunAPITest(t, i, &c.Case)
 }
 
 func TestGetGame(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*GameTestCase{
 		{ // Всё ок
@@ -140,7 +223,7 @@ func TestGetGame(t *testing.T) {
 				Method:   "GET",
 				Pattern:  "/games/{game_slug}",
 				Endpoint: "/games/pong",
-				Function: GetGame,
+				Function: h.GetGame,
 			},
 		},
 		{ // Такой игрули нет
@@ -150,7 +233,7 @@ func TestGetGame(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games/{game_slug}",
 				Endpoint:     "/games/not_pong",
-				Function:     GetGame,
+				Function:     h.GetGame,
 			},
 			Failure: utils.ErrNotExists,
 		},
@@ -161,17 +244,18 @@ func TestGetGame(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games/{game_slug}",
 				Endpoint:     "/games/not_pong",
-				Function:     GetGame,
+				Function:     h.GetGame,
 			},
 			Failure: utils.ErrInternal,
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestGetGameList(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*GameTestCase{
 		{ // Всё ок
@@ -181,7 +265,7 @@ func TestGetGameList(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games",
 				Endpoint:     "/games",
-				Function:     GetGameList,
+				Function:     h.GetGameList,
 			},
 		},
 		{ // база сломалась
@@ -191,17 +275,18 @@ func TestGetGameList(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games",
 				Endpoint:     "/games",
-				Function:     GetGameList,
+				Function:     h.GetGameList,
 			},
 			Failure: utils.ErrInternal,
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestGetGameLeaderboard(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*GameTestCase{
 		{ // Всё ок
@@ -212,7 +297,7 @@ func TestGetGameLeaderboard(t *testing.T) {
 				Method:   "GET",
 				Pattern:  "/games/{game_slug}/leaderboard",
 				Endpoint: "/games/pong/leaderboard",
-				Function: GetGameLeaderboard,
+				Function: h.GetGameLeaderboard,
 			},
 		},
 		{ // Такой игрули нет
@@ -222,7 +307,7 @@ func TestGetGameLeaderboard(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games/{game_slug}/leaderboard",
 				Endpoint:     "/games/pong/leaderboard",
-				Function:     GetGameLeaderboard,
+				Function:     h.GetGameLeaderboard,
 			},
 			Failure: utils.ErrNotExists,
 		},
@@ -233,17 +318,18 @@ func TestGetGameLeaderboard(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games/{game_slug}/leaderboard",
 				Endpoint:     "/games/pong/leaderboard",
-				Function:     GetGameLeaderboard,
+				Function:     h.GetGameLeaderboard,
 			},
 			Failure: utils.ErrInternal,
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestGetGameTotalPlayers(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*GameTestCase{
 		{ // Всё ок
@@ -253,7 +339,7 @@ func TestGetGameTotalPlayers(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games/{game_slug}/leaderboard/count",
 				Endpoint:     "/games/pong/leaderboard/count",
-				Function:     GetGameTotalPlayers,
+				Function:     h.GetGameTotalPlayers,
 			},
 		},
 		{ // Такой игрули нет
@@ -263,7 +349,7 @@ func TestGetGameTotalPlayers(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games/{game_slug}/leaderboard/count",
 				Endpoint:     "/games/pong/leaderboard/count",
-				Function:     GetGameTotalPlayers,
+				Function:     h.GetGameTotalPlayers,
 			},
 			Failure: utils.ErrNotExists,
 		},
@@ -274,11 +360,174 @@ func TestGetGameTotalPlayers(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/games/{game_slug}/leaderboard/count",
 				Endpoint:     "/games/pong/leaderboard/count",
-				Function:     GetGameTotalPlayers,
+				Function:     h.GetGameTotalPlayers,
 			},
 			Failure: utils.ErrInternal,
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
+}
+
+func TestCreateGame(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	validGame := `{"slug":"snake","title":"Snake","description":"d","rules":"r",` +
+		`"code_example":"c","bot_code":"b","logo_uuid":"01020304-0506-0708-090a-0b0c0d0e0f10",` +
+		`"background_uuid":"00010203-0405-0607-0809-0a0b0c0d0e0f"}`
+
+	cases := []*GameTestCase{
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(validGame),
+				ExpectedCode: 200,
+				ExpectedBody: `{"slug":"snake","title":"Snake","background_uuid":"00010203-0405-0607-0809-0a0b0c0d0e0f",` +
+					`"description":"d","rules":"r","code_example":"c","bot_code":"b",` +
+					`"logo_uuid":"01020304-0506-0708-090a-0b0c0d0e0f10"}`,
+				Method:   "POST",
+				Pattern:  "/games",
+				Function: h.CreateGame,
+			},
+		},
+		{ // Кривые поля
+			Case: testutils.Case{
+				Payload:      []byte(`{"slug":"snake game","title":"","logo_uuid":"kek"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"background_uuid":"invalid","bot_code":"required","logo_uuid":"invalid",` +
+					`"slug":"invalid","title":"required"}`,
+				Method:   "POST",
+				Pattern:  "/games",
+				Function: h.CreateGame,
+			},
+		},
+		{ // slug занят
+			Case: testutils.Case{
+				Payload:      []byte(validGame),
+				ExpectedCode: 400,
+				ExpectedBody: `{"slug":"taken"}`,
+				Method:       "POST",
+				Pattern:      "/games",
+				Function:     h.CreateGame,
+			},
+			Failure: &utils.ValidationError{"slug": utils.ErrTaken.Error()},
+		},
+		{ // база сломалась
+			Case: testutils.Case{
+				Payload:      []byte(validGame),
+				ExpectedCode: 500,
+				ExpectedBody: `{"message":"game create error: internal server error"}`,
+				Method:       "POST",
+				Pattern:      "/games",
+				Function:     h.CreateGame,
+			},
+			Failure: utils.ErrInternal,
+		},
+	}
+
+	runTableAPITests(t, h, cases)
+}
+
+func TestUpdateGame(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	changed := make(chan string, 1)
+	h.OnBotCodeChange(func(g *GameModel) {
+		changed <- g.BotCode.String
+	})
+
+	cases := []*GameTestCase{
+		{ // Поменяли только заголовок
+			Case: testutils.Case{
+				Payload:      []byte(`{"title":"Pong 2"}`),
+				ExpectedCode: 200,
+				ExpectedBody: `{"slug":"pong","title":"Pong 2","background_uuid":"00010203-0405-0607-0809-0a0b0c0d0e0f",` +
+					`"description":"Very cool game(net)","rules":"Do not cheat, please",` +
+					`"code_example":"const a = 5;","bot_code":"const a = 5;",` +
+					`"logo_uuid":"01020304-0506-0708-090a-0b0c0d0e0f10"}`,
+				Method:   "PUT",
+				Pattern:  "/games/{game_slug}",
+				Endpoint: "/games/pong",
+				Function: h.UpdateGame,
+			},
+		},
+		{ // Пустой title нельзя
+			Case: testutils.Case{
+				Payload:      []byte(`{"title":""}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"title":"invalid"}`,
+				Method:       "PUT",
+				Pattern:      "/games/{game_slug}",
+				Endpoint:     "/games/pong",
+				Function:     h.UpdateGame,
+			},
+		},
+		{ // Такой игры нет
+			Case: testutils.Case{
+				Payload:      []byte(`{"title":"Pong 3"}`),
+				ExpectedCode: 404,
+				ExpectedBody: `{"message":"game not exists: game update error: not_exists"}`,
+				Method:       "PUT",
+				Pattern:      "/games/{game_slug}",
+				Endpoint:     "/games/not_pong",
+				Function:     h.UpdateGame,
+			},
+		},
+	}
+
+	runTableAPITests(t, h, cases)
+	select {
+	case <-changed:
+		t.Fatal("bot code did not change, but listener was called")
+	default:
+	}
+
+	runAPITest(t, h, 0, &GameTestCase{
+		Case: testutils.Case{
+			Payload:      []byte(`{"slug":"pong-2","bot_code":"const b = 6;"}`),
+			ExpectedCode: 200,
+			ExpectedBody: `{"slug":"pong-2","title":"Pong 2","background_uuid":"00010203-0405-0607-0809-0a0b0c0d0e0f",` +
+				`"description":"Very cool game(net)","rules":"Do not cheat, please",` +
+				`"code_example":"const a = 5;","bot_code":"const b = 6;",` +
+				`"logo_uuid":"01020304-0506-0708-090a-0b0c0d0e0f10"}`,
+			Method:   "PUT",
+			Pattern:  "/games/{game_slug}",
+			Endpoint: "/games/pong",
+			Function: h.UpdateGame,
+		},
+	})
+	if code := <-changed; code != "const b = 6;" {
+		t.Fatalf("listener got wrong bot code: %s", code)
+	}
+}
+
+func TestDeleteGame(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	cases := []*GameTestCase{
+		{ // Всё ок
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "DELETE",
+				Pattern:      "/games/{game_slug}",
+				Endpoint:     "/games/pong",
+				Function:     h.DeleteGame,
+			},
+		},
+		{ // Уже удалили
+			Case: testutils.Case{
+				ExpectedCode: 404,
+				ExpectedBody: `{"message":"game not exists: not_exists"}`,
+				Method:       "DELETE",
+				Pattern:      "/games/{game_slug}",
+				Endpoint:     "/games/pong",
+				Function:     h.DeleteGame,
+			},
+		},
+	}
+
+	runTableAPITests(t, h, cases)
 }
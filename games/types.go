@@ -1,6 +1,14 @@
 package games
 
-import "github.com/go-park-mail-ru/2019_1_HotCode/users"
+import (
+	"regexp"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/google/uuid"
+	"github.com/mailru/easyjson/opt"
+)
 
 // ScoredUser инфа о юзере расширенная его баллами
 type ScoredUser struct {
@@ -23,3 +31,89 @@ type GameFull struct {
 	BotCode     string `json:"bot_code"`
 	LogoUUID    string `json:"logo_uuid"`
 }
+
+// slugRegexp повторяет games_slug_check из games.sql
+var slugRegexp = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+
+// FormGame форма создания игры
+type FormGame struct {
+	GameFull
+}
+
+// Validate валидация полей
+func (fg *FormGame) Validate() *utils.ValidationError {
+	err := utils.ValidationError{}
+	if fg.Slug == "" {
+		err["slug"] = utils.ErrRequired.Error()
+	} else if !slugRegexp.MatchString(fg.Slug) {
+		err["slug"] = utils.ErrInvalid.Error()
+	}
+
+	if fg.Title == "" {
+		err["title"] = utils.ErrRequired.Error()
+	}
+
+	if fg.BotCode == "" {
+		err["bot_code"] = utils.ErrRequired.Error()
+	}
+
+	if _, uuidErr := uuid.Parse(fg.LogoUUID); uuidErr != nil {
+		err["logo_uuid"] = utils.ErrInvalid.Error()
+	}
+
+	if _, uuidErr := uuid.Parse(fg.BackgroundUUID); uuidErr != nil {
+		err["background_uuid"] = utils.ErrInvalid.Error()
+	}
+
+	if len(err) == 0 {
+		return nil
+	}
+
+	return &err
+}
+
+// FormGameUpdate форма для обновления полей игры
+type FormGameUpdate struct {
+	Slug           opt.String `json:"slug"`
+	Title          opt.String `json:"title"`
+	Description    opt.String `json:"description"`
+	Rules          opt.String `json:"rules"`
+	CodeExample    opt.String `json:"code_example"`
+	BotCode        opt.String `json:"bot_code"`
+	LogoUUID       opt.String `json:"logo_uuid"`
+	BackgroundUUID opt.String `json:"background_uuid"`
+}
+
+// Validate валидация формы
+func (fg *FormGameUpdate) Validate() *utils.ValidationError {
+	err := utils.ValidationError{}
+	if fg.Slug.IsDefined() && !slugRegexp.MatchString(fg.Slug.V) {
+		err["slug"] = utils.ErrInvalid.Error()
+	}
+
+	if fg.Title.IsDefined() && fg.Title.V == "" {
+		err["title"] = utils.ErrInvalid.Error()
+	}
+
+	if fg.BotCode.IsDefined() && fg.BotCode.V == "" {
+		err["bot_code"] = utils.ErrInvalid.Error()
+	}
+
+	if fg.LogoUUID.IsDefined() {
+		if _, uuidErr := uuid.Parse(fg.LogoUUID.V); uuidErr != nil {
+			err["logo_uuid"] = utils.ErrInvalid.Error()
+		}
+	}
+
+	if fg.BackgroundUUID.IsDefined() {
+		if _, uuidErr := uuid.Parse(fg.BackgroundUUID.V); uuidErr != nil {
+			err["background_uuid"] = utils.ErrInvalid.Error()
+		}
+	}
+
+	if len(err) == 0 {
+		return nil
+	}
+
+	return &err
+}
@@ -3,6 +3,7 @@ module github.com/go-park-mail-ru/2019_1_HotCode
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/bsphere/le_go v0.0.0-20170215134836-7a984a84b549 // indirect
 	github.com/cockroachdb/apd v1.1.0 // indirect
 	github.com/go-redis/redis v6.15.2+incompatible
@@ -22,6 +23,6 @@ require (
 	github.com/sirupsen/logrus v1.4.1
 	github.com/streadway/amqp v0.0.0-20190404075320-75d898a42a94
 	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
-	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
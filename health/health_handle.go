@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+)
+
+// checkTimeout Handler.Timeout по умолчанию
+const checkTimeout = 2 * time.Second
+
+// Handler ручки для балансировщика и админки, собирается в main
+type Handler struct {
+	Checks []Check
+	// Timeout на каждую проверку отдельно, 0 -- checkTimeout
+	Timeout time.Duration
+	// Reports разделы /admin/status по имени
+	Reports map[string]Report
+}
+
+// Live жив ли процесс. Зависимости не трогает, чтобы упавшая база
+// не заставила оркестратор перезапускать все экземпляры разом
+func (h *Handler) Live(w http.ResponseWriter, r *http.Request) {
+	utils.WriteApplicationJSON(w, http.StatusOK, &Readiness{Status: StatusOK})
+}
+
+// Ready может ли экземпляр обслуживать запросы: все Checks параллельно,
+// каждая со своим таймаутом. 503, если хоть одна не прошла
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "Ready")
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = checkTimeout
+	}
+
+	resp := &Readiness{
+		Status: StatusOK,
+		Checks: make(map[string]string, len(h.Checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.Checks {
+		wg.Add(1)
+		go func(c Check) {
+			defer wg.Done()
+			err := ping(r.Context(), c, timeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.Warn(errors.Wrapf(err, "%s is not ready", c.Name))
+				resp.Status = StatusFail
+				resp.Checks[c.Name] = err.Error()
+				return
+			}
+			resp.Checks[c.Name] = StatusOK
+		}(c)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	if resp.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	utils.WriteApplicationJSON(w, code, resp)
+}
+
+// ping не ждёт дольше timeout, даже если клиент зависимости ctx не слушает
+func ping(ctx context.Context, c Check, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Ping(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status отчёт для админов: пулы соединений, сессии хаба, очереди.
+// Не собранный раздел отдаётся с ошибкой, остальные от этого не страдают
+func (h *Handler) Status(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "Status")
+
+	resp := make(map[string]interface{}, len(h.Reports))
+	for name, report := range h.Reports {
+		section, err := report()
+		if err != nil {
+			logger.Error(errors.Wrapf(err, "%s report error", name))
+			resp[name] = &ReportError{Error: err.Error()}
+			continue
+		}
+		resp[name] = section
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,123 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/testutils"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// чтобы не заваливать всё логами
+	log.SetLevel(log.PanicLevel)
+}
+
+func okCheck(name string) Check {
+	return Check{Name: name, Ping: func(context.Context) error {
+		return nil
+	}}
+}
+
+// newTestHandler хендлер с исправными зависимостями, у каждого теста свой
+func newTestHandler() *Handler {
+	return &Handler{
+		Checks:  []Check{okCheck("postgres"), okCheck("redis")},
+		Timeout: 20 * time.Millisecond,
+		Reports: map[string]Report{
+			"bots": func() (interface{}, error) {
+				return &BotsStats{Verifying: 2}, nil
+			},
+		},
+	}
+}
+
+func TestLive(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	// живость от зависимостей не зависит
+	h.Checks = append(h.Checks, Check{Name: "rabbitmq", Ping: func(context.Context) error {
+		return errors.New("connection is closed")
+	}})
+
+	testutils.RunAPITest(t, 0, &testutils.Case{
+		ExpectedCode: 200,
+		ExpectedBody: `{"status":"ok"}`,
+		Method:       "GET",
+		Pattern:      "/healthz",
+		Function:     h.Live,
+	})
+}
+
+func TestReady(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	testutils.RunAPITest(t, 0, &testutils.Case{
+		ExpectedCode: 200,
+		ExpectedBody: `{"status":"ok","checks":{"postgres":"ok","redis":"ok"}}`,
+		Method:       "GET",
+		Pattern:      "/readyz",
+		Function:     h.Ready,
+	})
+
+	h.Checks = append(h.Checks, Check{Name: "rabbitmq", Ping: func(context.Context) error {
+		return errors.New("connection is closed")
+	}})
+	testutils.RunAPITest(t, 1, &testutils.Case{
+		ExpectedCode: 503,
+		ExpectedBody: `{"status":"fail","checks":{"postgres":"ok","rabbitmq":"connection is closed","redis":"ok"}}`,
+		Method:       "GET",
+		Pattern:      "/readyz",
+		Function:     h.Ready,
+	})
+}
+
+// TestReadyTimeout зависшая зависимость не держит ответ дольше своего таймаута
+func TestReadyTimeout(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	hang := make(chan struct{})
+	defer close(hang)
+	h.Checks[1] = Check{Name: "redis", Ping: func(context.Context) error {
+		// не слушает ctx, как redis v6
+		<-hang
+		return nil
+	}}
+
+	start := time.Now()
+	testutils.RunAPITest(t, 0, &testutils.Case{
+		ExpectedCode: 503,
+		ExpectedBody: `{"status":"fail","checks":{"postgres":"ok","redis":"context deadline exceeded"}}`,
+		Method:       "GET",
+		Pattern:      "/readyz",
+		Function:     h.Ready,
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ready took %s", elapsed)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	h.Reports["queues"] = func() (interface{}, error) {
+		return nil, errors.New("queue is not connected")
+	}
+	h.Reports["postgres"] = func() (interface{}, error) {
+		return &DBStats{MaxConnections: 5, CurrentConnections: 2, AvailableConnections: 1}, nil
+	}
+
+	testutils.RunAPITest(t, 0, &testutils.Case{
+		ExpectedCode: 200,
+		ExpectedBody: `{"bots":{"verifying":2},` +
+			`"postgres":{"max_connections":5,"current_connections":2,"available_connections":1},` +
+			`"queues":{"error":"queue is not connected"}}`,
+		Method:   "GET",
+		Pattern:  "/v1/admin/status",
+		Function: h.Status,
+	})
+}
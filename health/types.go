@@ -0,0 +1,59 @@
+package health
+
+import "context"
+
+const (
+	// StatusOK зависимость или весь экземпляр в порядке
+	StatusOK = "ok"
+	// StatusFail хотя бы одна проверка не прошла
+	StatusFail = "fail"
+)
+
+// Check проверка одной зависимости для /readyz
+type Check struct {
+	Name string
+	// Ping должен уважать ctx, но и зависший Ping не задержит ответ дольше таймаута
+	Ping func(ctx context.Context) error
+}
+
+// Report раздел /admin/status: статистика пула, хаба, очередей
+type Report func() (interface{}, error)
+
+// Readiness ответ /readyz, по checks видно, что именно недоступно
+type Readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// ReportError раздел статуса, который не удалось собрать
+type ReportError struct {
+	Error string `json:"error"`
+}
+
+// DBStats пул соединений postgres
+type DBStats struct {
+	MaxConnections       int `json:"max_connections"`
+	CurrentConnections   int `json:"current_connections"`
+	AvailableConnections int `json:"available_connections"`
+}
+
+// RedisStats пул соединений redis
+type RedisStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total_conns"`
+	IdleConns  uint32 `json:"idle_conns"`
+	StaleConns uint32 `json:"stale_conns"`
+}
+
+// QueueStats очередь rabbitmq
+type QueueStats struct {
+	Messages  int `json:"messages"`
+	Consumers int `json:"consumers"`
+}
+
+// BotsStats проверки ботов на этом экземпляре
+type BotsStats struct {
+	Verifying int `json:"verifying"`
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Message письмо
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer отправляет письма
+type Mailer interface {
+	Send(m *Message) error
+}
+
+// SMTPMailer implementation of Mailer, шлёт письма через SMTP сервер
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer создаёт SMTPMailer, без user авторизация не используется
+func NewSMTPMailer(host, port, user, pass, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, pass, host)
+	}
+
+	return &SMTPMailer{
+		Addr: net.JoinHostPort(host, port),
+		From: from,
+		Auth: auth,
+	}
+}
+
+// Send отправляет письмо
+func (sm *SMTPMailer) Send(m *Message) error {
+	err := smtp.SendMail(sm.Addr, sm.Auth, sm.From, []string{m.To}, render(sm.From, m))
+	if err != nil {
+		return errors.Wrap(err, "smtp send error")
+	}
+
+	return nil
+}
+
+// LogMailer implementation of Mailer для локальной разработки:
+// дописывает письма в файл Path, а без него просто пишет их в лог
+type LogMailer struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Send сохраняет письмо в файл или лог
+func (lm *LogMailer) Send(m *Message) error {
+	if lm.Path == "" {
+		log.WithFields(log.Fields{
+			"method":  "LogMailer.Send",
+			"to":      m.To,
+			"subject": m.Subject,
+		}).Info(m.Body)
+		return nil
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	f, err := os.OpenFile(lm.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "can not open mail file")
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(render("noreply@localhost", m), '\n')); err != nil {
+		return errors.Wrap(err, "can not write mail file")
+	}
+
+	return nil
+}
+
+func render(from string, m *Message) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(m.Body)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -1,20 +1,29 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 
-	"golang.org/x/time/rate"
-
+	"github.com/go-redis/redis"
 	"github.com/gorilla/mux"
 	"github.com/jcftang/logentriesrus"
+	"github.com/pkg/errors"
 
-	"github.com/go-park-mail-ru/2019_1_HotCode/bots"
-	"github.com/go-park-mail-ru/2019_1_HotCode/database"
-	"github.com/go-park-mail-ru/2019_1_HotCode/games"
-	"github.com/go-park-mail-ru/2019_1_HotCode/storage"
+	"github.com/go-park-mail-ru/2019_1_HotCode/bruteforce"
+	"github.com/go-park-mail-ru/2019_1_HotCode/config"
+	"github.com/go-park-mail-ru/2019_1_HotCode/notify"
+	"github.com/go-park-mail-ru/2019_1_HotCode/oidc"
+	"github.com/go-park-mail-ru/2019_1_HotCode/password"
+	"github.com/go-park-mail-ru/2019_1_HotCode/ratelimit"
 	"github.com/go-park-mail-ru/2019_1_HotCode/users"
 
 	log "github.com/sirupsen/logrus"
@@ -31,86 +40,390 @@ type Handler struct {
 }
 
 // NewHandler creates new handler
-func NewHandler() *Handler {
+func NewHandler(app *App) *Handler {
 	h := &Handler{}
 
+	// пробы балансировщика приходят каждые пару секунд, в access log их не пишем
+	root := mux.NewRouter()
+	root.HandleFunc("/healthz", app.Health.Live).Methods("GET")
+	root.HandleFunc("/readyz", app.Health.Ready).Methods("GET")
+
 	// этот роутер будет отвечать за первую(и пока единственную) версию апишки
 	r := mux.NewRouter().PathPrefix("/v1").Subrouter()
+	auth, withRole := app.Users.WithAuthentication, app.Users.WithRole
+
+	// лимиты на клиента: залогиненного считаем по юзеру, остальных по IP
+	limiter := ratelimit.NewLimiter(ratelimit.NewRedisStore(app.Redis), rateLimitKey(app.ClientIP))
+	loginPolicy := ratelimit.Policy{Name: "login", Requests: 10, Per: time.Minute}
+	signupPolicy := ratelimit.Policy{Name: "signup", Requests: 10, Per: time.Hour, Burst: 3}
+	checkUsernamePolicy := ratelimit.Policy{Name: "check_username", Requests: 3, Per: time.Second, Burst: 5}
+	mailPolicy := ratelimit.Policy{Name: "mail", Requests: 5, Per: time.Hour}
+	uploadPolicy := ratelimit.Policy{Name: "upload", Requests: 30, Per: time.Hour, Burst: 10}
+	botsPolicy := ratelimit.Policy{Name: "bots", Requests: 20, Per: time.Hour, Burst: 5}
+	exportPolicy := ratelimit.Policy{Name: "export", Requests: 5, Per: time.Hour}
+	searchPolicy := ratelimit.Policy{Name: "search", Requests: 30, Per: time.Minute, Burst: 10}
+
+	r.HandleFunc("/sessions",
+		users.WithScope(auth(app.Users.GetSession), users.ScopeProfileRead)).Methods("GET")
+	r.HandleFunc("/sessions", limiter.Limit(app.Users.CreateSession, loginPolicy)).Methods("POST")
+	r.HandleFunc("/sessions", auth(app.Users.DeleteSession)).Methods("DELETE")
+	r.HandleFunc("/sessions/2fa", limiter.Limit(app.Users.CreateSessionTOTP, loginPolicy)).Methods("POST")
+	r.HandleFunc("/csrf", auth(app.Users.GetCSRFToken)).Methods("GET")
+
+	r.HandleFunc("/auth/{provider}/login", limiter.Limit(app.Users.OIDCLogin, loginPolicy)).Methods("GET")
+	r.HandleFunc("/auth/{provider}/link", auth(app.Users.OIDCLink)).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", limiter.Limit(app.Users.OIDCCallback, loginPolicy)).Methods("GET")
 
-	r.HandleFunc("/sessions", users.WithAuthentication(users.GetSession)).Methods("GET")
-	r.HandleFunc("/sessions", users.CreateSession).Methods("POST")
-	r.HandleFunc("/sessions", users.WithAuthentication(users.DeleteSession)).Methods("DELETE")
+	r.HandleFunc("/tokens", auth(app.Users.GetAPITokens)).Methods("GET")
+	r.HandleFunc("/tokens", auth(app.Users.CreateAPIToken)).Methods("POST")
+	r.HandleFunc("/tokens/{token_id:[0-9]+}", auth(app.Users.DeleteAPIToken)).Methods("DELETE")
 
-	r.HandleFunc("/users", users.CreateUser).Methods("POST")
-	r.HandleFunc("/users", users.WithAuthentication(users.UpdateUser)).Methods("PUT")
-	r.HandleFunc("/users/{user_id:[0-9]+}", users.GetUser).Methods("GET")
-	r.HandleFunc("/users/used", WithLimiter(users.CheckUsername, rate.NewLimiter(3, 5))).Methods("POST")
+	r.HandleFunc("/users", limiter.Limit(app.Users.CreateUser, signupPolicy)).Methods("POST")
+	r.HandleFunc("/users", auth(app.Users.UpdateUser)).Methods("PUT")
+	r.HandleFunc("/users", limiter.Limit(app.Users.SearchUsers, searchPolicy)).Methods("GET")
+	r.HandleFunc("/users/{user_id:[0-9]+}", app.Users.GetUser).Methods("GET")
+	r.HandleFunc("/users/me", auth(app.Account.DeleteAccount)).Methods("DELETE")
+	r.HandleFunc("/users/{user_id:[0-9]+}/follow", auth(app.Social.Follow)).Methods("POST")
+	r.HandleFunc("/users/{user_id:[0-9]+}/follow", auth(app.Social.Unfollow)).Methods("DELETE")
+	r.HandleFunc("/users/{user_id:[0-9]+}/followers", app.Social.GetFollowers).Methods("GET")
+	r.HandleFunc("/users/{user_id:[0-9]+}/following", app.Social.GetFollowing).Methods("GET")
+	r.HandleFunc("/feed", auth(app.Social.GetFeed)).Methods("GET")
+	r.HandleFunc("/users/me/export",
+		auth(limiter.Limit(app.Account.ExportAccount, exportPolicy))).Methods("GET")
+	r.HandleFunc("/users/2fa", auth(app.Users.EnrollTOTP)).Methods("POST")
+	r.HandleFunc("/users/2fa", auth(app.Users.DisableTOTP)).Methods("DELETE")
+	r.HandleFunc("/users/2fa/confirm", auth(app.Users.ConfirmTOTP)).Methods("POST")
+	r.HandleFunc("/users/2fa/recovery-codes",
+		auth(app.Users.RegenerateRecoveryCodes)).Methods("POST")
+	r.HandleFunc("/users/email/verify", app.Users.VerifyEmail).Methods("POST")
+	r.HandleFunc("/password-reset", limiter.Limit(app.Users.RequestPasswordReset, mailPolicy)).Methods("POST")
+	r.HandleFunc("/password-reset/confirm", app.Users.ConfirmPasswordReset).Methods("POST")
+	r.HandleFunc("/users/used", limiter.Limit(app.Users.CheckUsername, checkUsernamePolicy)).Methods("POST")
 
-	r.HandleFunc("/games", games.GetGameList).Methods("GET")
-	r.HandleFunc("/games/{game_slug}", games.GetGame).Methods("GET")
-	r.HandleFunc("/games/{game_slug}/leaderboard", games.GetGameLeaderboard).Methods("GET")
-	r.HandleFunc("/games/{game_slug}/leaderboard/count", games.GetGameTotalPlayers).Methods("GET")
+	r.HandleFunc("/games", app.Games.GetGameList).Methods("GET")
+	r.HandleFunc("/games",
+		auth(withRole(app.Games.CreateGame, users.RoleAdmin))).Methods("POST")
+	r.HandleFunc("/games/{game_slug}",
+		auth(withRole(app.Games.UpdateGame, users.RoleAdmin))).Methods("PUT")
+	r.HandleFunc("/games/{game_slug}",
+		auth(withRole(app.Games.DeleteGame, users.RoleAdmin))).Methods("DELETE")
+	r.HandleFunc("/games/{game_slug}", app.Games.GetGame).Methods("GET")
+	r.HandleFunc("/games/{game_slug}/leaderboard", app.Games.GetGameLeaderboard).Methods("GET")
+	r.HandleFunc("/games/{game_slug}/leaderboard/count", app.Games.GetGameTotalPlayers).Methods("GET")
 
-	r.HandleFunc("/bots", users.WithAuthentication(bots.CreateBot)).Methods("POST")
-	r.HandleFunc("/bots", users.WithAuthentication(bots.GetBotsList)).Methods("GET")
-	r.HandleFunc("/bots/verification", users.WithAuthentication(bots.OpenVerifyWS)).Methods("GET")
+	r.HandleFunc("/bots", users.WithScope(auth(limiter.Limit(app.Bots.CreateBot, botsPolicy)),
+		users.ScopeBotsWrite)).Methods("POST")
+	r.HandleFunc("/bots",
+		users.WithScope(auth(app.Bots.GetBotsList), users.ScopeBotsRead)).Methods("GET")
+	r.HandleFunc("/bots/verification", auth(app.Bots.OpenVerifyWS)).Methods("GET")
+	r.HandleFunc("/bots/verification/events", auth(app.Bots.OpenVerifySSE)).Methods("GET")
 	//r.HandleFunc("/bots/verification", bots.OpenVerifyWS).Methods("GET")
 
-	h.Router = RecoverMiddleware(AccessLogMiddleware(r))
+	r.HandleFunc("/ws", auth(app.Hub.OpenWS)).Methods("GET")
+	r.HandleFunc("/events", auth(app.Hub.OpenSSE)).Methods("GET")
+
+	r.HandleFunc("/admin/status",
+		auth(withRole(app.Health.Status, users.RoleAdmin))).Methods("GET")
+	r.HandleFunc("/admin/users/{user_id:[0-9]+}/role",
+		auth(withRole(app.Users.GrantRole, users.RoleAdmin))).Methods("PUT")
+	r.HandleFunc("/admin/users/{user_id:[0-9]+}/role",
+		auth(withRole(app.Users.RevokeRole, users.RoleAdmin))).Methods("DELETE")
+	r.HandleFunc("/admin/users/{user_id:[0-9]+}/role/audit",
+		auth(withRole(app.Users.GetRoleAudit, users.RoleAdmin))).Methods("GET")
+
+	r.HandleFunc("/moderation/users/{user_id:[0-9]+}/ban",
+		auth(withRole(app.Users.BanUser, users.RoleModerator))).Methods("PUT")
+	r.HandleFunc("/moderation/users/{user_id:[0-9]+}/ban",
+		auth(withRole(app.Users.UnbanUser, users.RoleModerator))).Methods("DELETE")
+
+	r.HandleFunc("/media", auth(limiter.Limit(app.Media.UploadMedia, uploadPolicy))).Methods("POST")
+	r.HandleFunc("/media/{media_uuid}", app.Media.GetMedia).Methods("GET")
+
+	root.PathPrefix("/v1").Handler(AccessLogMiddleware(r, app.ClientIP))
+	h.Router = RecoverMiddleware(root)
 	return h
 }
 
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
+}
 
-	// собираем логи в хранилище
-	le, err := logentriesrus.NewLogentriesrusHook(os.Getenv("LOGENTRIESRUS_TOKEN"))
+// setupLogging собираем логи в хранилище, если задан токен.
+// Без токена или при ошибке хука пишем только в stdout
+func setupLogging(cfg *config.Config) {
+	if cfg.LogentriesToken == "" {
+		return
+	}
+
+	le, err := logentriesrus.NewLogentriesrusHook(cfg.LogentriesToken)
 	if err != nil {
-		os.Exit(-1)
+		log.Warnf("logentries hook is not available; err: %s", err.Error())
+		return
 	}
 	log.AddHook(le)
 }
 
-func main() {
-	err := database.Connect(os.Getenv("DB_USER"), os.Getenv("DB_PASS"),
-		os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_NAME"))
+// loginGuardConfig настройки защиты от перебора, незаданные берутся по умолчанию
+func loginGuardConfig(c config.Login) (bruteforce.Config, error) {
+	cfg := bruteforce.DefaultConfig()
+	durations := map[string]struct {
+		dst   *time.Duration
+		value time.Duration
+	}{
+		"LOGIN_WINDOW":      {&cfg.Window, c.Window},
+		"LOGIN_LOCKOUT":     {&cfg.Lockout, c.Lockout},
+		"LOGIN_MAX_LOCKOUT": {&cfg.MaxLockout, c.MaxLockout},
+	}
+	for name, d := range durations {
+		if d.value < 0 {
+			return cfg, errors.Errorf("%s must be a positive duration, got %s", name, d.value)
+		}
+		if d.value != 0 {
+			*d.dst = d.value
+		}
+	}
+
+	limits := map[string]struct {
+		dst   *int64
+		value int64
+	}{
+		"LOGIN_MAX_ATTEMPTS":    {&cfg.MaxUsernameAttempts, c.MaxAttempts},
+		"LOGIN_MAX_ATTEMPTS_IP": {&cfg.MaxIPAttempts, c.MaxAttemptsIP},
+	}
+	for name, n := range limits {
+		if n.value < 0 {
+			return cfg, errors.Errorf("%s must be a positive number, got %d", name, n.value)
+		}
+		if n.value != 0 {
+			*n.dst = n.value
+		}
+	}
+
+	return cfg, nil
+}
+
+// passwordConfig параметры хеширования паролей, незаданные берутся по умолчанию
+func passwordConfig(c config.Password) (password.Config, error) {
+	cfg := password.DefaultConfig()
+	if c.Algorithm != "" {
+		cfg.Algorithm = c.Algorithm
+	}
+	if c.Argon2Time != 0 {
+		cfg.Time = c.Argon2Time
+	}
+	if c.Argon2Memory != 0 {
+		cfg.Memory = c.Argon2Memory
+	}
+	if c.Argon2Threads != 0 {
+		cfg.Threads = c.Argon2Threads
+	}
+	if c.BcryptCost != 0 {
+		cfg.BcryptCost = c.BcryptCost
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// configureHub буфер и политика для медленных клиентов шлюза уведомлений
+func configureHub(h *notify.Hub, c config.Notify) error {
+	if c.Buffer < 0 {
+		return errors.Errorf("NOTIFY_BUFFER must be a positive number, got %d", c.Buffer)
+	}
+	if c.Buffer != 0 {
+		h.BufferSize = c.Buffer
+	}
+
+	switch c.SlowPolicy {
+	case "", "drop":
+		h.Policy = notify.DropMessages
+	case "disconnect":
+		h.Policy = notify.Disconnect
+	default:
+		return errors.Errorf("NOTIFY_SLOW_POLICY must be drop or disconnect, got %q", c.SlowPolicy)
+	}
+
+	return nil
+}
+
+// oidcProviders провайдеры из конфига по имени
+func oidcProviders(c map[string]config.OIDCProvider) (map[string]*oidc.Provider, error) {
+	providers := make(map[string]*oidc.Provider)
+	for name, pc := range c {
+		p, err := oidc.NewProvider(oidc.Config{
+			Name:          name,
+			ClientID:      pc.ClientID,
+			ClientSecret:  pc.ClientSecret,
+			Issuer:        pc.Issuer,
+			AuthURL:       pc.AuthURL,
+			TokenURL:      pc.TokenURL,
+			UserInfoURL:   pc.UserInfoURL,
+			RedirectURL:   pc.RedirectURL,
+			Scopes:        pc.Scopes,
+			SubjectClaim:  pc.SubjectClaim,
+			UsernameClaim: pc.UsernameClaim,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "provider %s", name)
+		}
+		providers[name] = p
+	}
+
+	return providers, nil
+}
+
+// sessionCookieConfig атрибуты куки сессии: COOKIE_SECURE, COOKIE_SAMESITE, COOKIE_DOMAIN
+func sessionCookieConfig(c config.Cookie) (users.CookieConfig, error) {
+	cfg := users.CookieConfig{
+		Secure:   c.Secure,
+		SameSite: http.SameSiteLaxMode,
+		Domain:   c.Domain,
+	}
+
+	switch sameSite := strings.ToLower(c.SameSite); sameSite {
+	case "", "lax":
+	case "strict":
+		cfg.SameSite = http.SameSiteStrictMode
+	case "none":
+		// браузеры молча выкидывают SameSite=None куки без Secure
+		if !cfg.Secure {
+			return cfg, errors.New("COOKIE_SAMESITE=none requires COOKIE_SECURE=true")
+		}
+		cfg.SameSite = http.SameSiteNoneMode
+	default:
+		return cfg, errors.Errorf("unknown COOKIE_SAMESITE %q", sameSite)
+	}
+
+	return cfg, nil
+}
+
+// sessionBackend хранилище сессий: redis (по умолчанию) или подписанные токены
+// с ключами SESSION_KEYS=kid1:secret1,kid2:secret2 и текущим SESSION_KEY_ID
+func sessionBackend(client *redis.Client, c config.Session) (users.SessionAccessObject, error) {
+	switch c.Backend {
+	case "", "redis":
+		return &users.Conn{Redis: client}, nil
+	case "signed":
+		keys := make(map[string][]byte)
+		for _, pair := range strings.Split(c.Keys, ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+			if len(kv) != 2 || kv[0] == "" || len(kv[1]) < 32 {
+				return nil, errors.New("SESSION_KEYS must be kid:secret pairs with secrets of 32+ chars")
+			}
+			keys[kv[0]] = []byte(kv[1])
+		}
+
+		if _, ok := keys[c.KeyID]; !ok {
+			return nil, errors.Errorf("SESSION_KEY_ID %q is not in SESSION_KEYS", c.KeyID)
+		}
+
+		return &users.SignedSessions{
+			Keys:       keys,
+			CurrentKey: c.KeyID,
+			Denylist:   users.NewRedisDenylist(client),
+		}, nil
+	default:
+		return nil, errors.Errorf("unknown SESSION_BACKEND %q", c.Backend)
+	}
+}
+
+// loadConfig конфиг из флагов, окружения и файла. false -- запускать сервер не нужно:
+// конфиг кривой, спросили -h или только -print-config
+func loadConfig() (*config.Config, bool) {
+	cfg, opts, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return nil, false
+	}
 	if err != nil {
-		log.Errorf("failed to connect to db; err: %s", err.Error())
+		log.Errorf("can not load config; err: %s", err.Error())
+		return nil, false
+	}
+
+	if opts.PrintConfig {
+		fmt.Print(cfg)
+		if err = cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "config is invalid: %s\n", err.Error())
+		}
+		return nil, false
+	}
+
+	if err = cfg.Validate(); err != nil {
+		log.Errorf("invalid config; err: %s", err.Error())
+		return nil, false
+	}
+
+	return cfg, true
+}
+
+func main() {
+	cfg, ok := loadConfig()
+	if !ok {
 		return
 	}
-	defer database.Close()
+	setupLogging(cfg)
 
-	err = storage.Connect(os.Getenv("STORAGE_USER"), os.Getenv("STORAGE_PASS"),
-		os.Getenv("STORAGE_HOST"))
+	app, err := NewApp(cfg)
 	if err != nil {
-		log.Errorf("cant connect to session storage; err: %s", err.Error())
+		log.Errorf("can not start app; err: %s", err.Error())
 		return
 	}
-	defer storage.Close()
-
-	// err = queue.Connect(os.Getenv("QUEUE_USER"), os.Getenv("QUEUE_PASS"),
-	// 	os.Getenv("QUEUE_HOST"), os.Getenv("QUEUE_PORT"))
-	// if err != nil {
-	// 	log.Errorf("can not connect to queue processor: %s", err.Error())
-	// 	return
-	// }
-	// defer queue.Close()
+	defer app.Close()
+	// проверки, прерванные прошлой остановкой
+	app.Bots.ResumeVerifications()
 
-	h := NewHandler()
+	h := NewHandler(app)
 
 	corsMiddleware := handlers.CORS(
-		handlers.AllowedOrigins([]string{os.Getenv("CORS_HOST")}),
+		handlers.AllowedOrigins([]string{cfg.CORSHost}),
 		handlers.AllowedMethods([]string{"POST", "GET", "PUT", "DELETE"}),
-		handlers.AllowedHeaders([]string{"Content-Type"}),
+		handlers.AllowedHeaders([]string{"Content-Type", users.CSRFHeader}),
+		handlers.ExposedHeaders([]string{"Retry-After", "RateLimit-Limit", "RateLimit-Remaining",
+			"RateLimit-Reset", "RateLimit-Policy"}),
 		handlers.AllowCredentials(),
 	)
 
-	port := os.Getenv("PORT")
-	log.Printf("MainService successfully started at port %s", port)
-	err = http.ListenAndServe(":"+port, corsMiddleware(h.Router))
-	if err != nil {
+	srv := &http.Server{
+		Addr:              cfg.Addr(),
+		Handler:           corsMiddleware(h.Router),
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+	log.Printf("MainService successfully started at port %s", cfg.Port)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-serverErr:
 		log.Errorf("cant start main server. err: %s", err.Error())
 		return
+	case sig := <-stop:
+		log.Infof("got %s, shutting down", sig)
 	}
+
+	shutdown(srv, app, cfg.Server.ShutdownTimeout)
+}
+
+// shutdown перестаёт принимать запросы и ждёт текущие, сокетам уходят close фреймы,
+// идущие проверки ботов дописывают результат. Соединения App закрываются уже после
+func shutdown(srv *http.Server, app *App, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// SSE-потоки -- обычные запросы, без закрытия хаба Shutdown ждал бы их до таймаута
+	srv.RegisterOnShutdown(app.Hub.Close)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("server shutdown error: %s", err.Error())
+	}
+	if err := app.Hub.Wait(ctx); err != nil {
+		log.Errorf("notify clients are not closed: %s", err.Error())
+	}
+	if err := app.Bots.Drain(ctx); err != nil {
+		log.Errorf("bot verifications are interrupted: %s", err.Error())
+	}
+
+	log.Info("MainService stopped")
 }
@@ -0,0 +1,185 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	// регистрируем декодер gif для image.Decode
+	_ "image/gif"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxUploadSize максимальный размер загружаемого файла
+	MaxUploadSize = 5 << 20
+	// MaxDimension максимальная ширина/высота картинки,
+	// защищает от картинок, которые распаковываются в гигабайты
+	MaxDimension = 4096
+
+	jpegQuality = 85
+)
+
+// Variant вариант размера картинки, который отдаём клиенту
+type Variant string
+
+const (
+	// VariantLarge картинка, ужатая до 1024px по большей стороне
+	VariantLarge Variant = "large"
+	// VariantMedium превью 256px
+	VariantMedium Variant = "medium"
+	// VariantSmall превью 64px, например для лидерборда
+	VariantSmall Variant = "small"
+)
+
+// variants от большего к меньшему: каждое превью режем из предыдущего,
+// так дешевле, чем каждый раз проходить по исходнику
+var variants = []struct {
+	Name Variant
+	Box  int
+}{
+	{VariantLarge, 1024},
+	{VariantMedium, 256},
+	{VariantSmall, 64},
+}
+
+// ParseVariant проверяет, что такой вариант размера есть
+func ParseVariant(s string) (Variant, bool) {
+	if s == "" {
+		return VariantLarge, true
+	}
+
+	for _, v := range variants {
+		if string(v.Name) == s {
+			return v.Name, true
+		}
+	}
+
+	return "", false
+}
+
+var allowedContentTypes = map[string]struct{}{
+	"image/png":  {},
+	"image/jpeg": {},
+	"image/gif":  {},
+}
+
+// processImage проверяет картинку и нарезает из неё все варианты размеров
+func processImage(data []byte) (map[Variant][]byte, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := allowedContentTypes[contentType]; !ok {
+		return nil, &utils.ValidationError{
+			"file": utils.ErrInvalid.Error(),
+		}
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 ||
+		cfg.Width > MaxDimension || cfg.Height > MaxDimension {
+		return nil, &utils.ValidationError{
+			"file": utils.ErrInvalid.Error(),
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &utils.ValidationError{
+			"file": utils.ErrInvalid.Error(),
+		}
+	}
+
+	result := make(map[Variant][]byte, len(variants))
+	for _, v := range variants {
+		img = fit(img, v.Box)
+
+		buf := &bytes.Buffer{}
+		if contentType == "image/jpeg" {
+			err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(buf, img)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "can not encode %s variant", v.Name)
+		}
+
+		result[v.Name] = buf.Bytes()
+	}
+
+	return result, nil
+}
+
+// fit вписывает картинку в квадрат box x box с сохранением пропорций,
+// маленькие картинки не растягиваем
+func fit(src image.Image, box int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= box && h <= box {
+		return src
+	}
+
+	dw, dh := box, box
+	if w >= h {
+		dh = h * box / w
+	} else {
+		dw = w * box / h
+	}
+	if dw == 0 {
+		dw = 1
+	}
+	if dh == 0 {
+		dh = 1
+	}
+
+	return resize(src, dw, dh)
+}
+
+// resize уменьшает картинку усреднением по площади:
+// каждый пиксель результата -- среднее попавших в него пикселей исходника
+func resize(src image.Image, dw, dh int) image.Image {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0 := sb.Min.Y + y*sh/dh
+		y1 := sb.Min.Y + (y+1)*sh/dh
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < dw; x++ {
+			x0 := sb.Min.X + x*sw/dw
+			x1 := sb.Min.X + (x+1)*sw/dw
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
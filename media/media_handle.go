@@ -0,0 +1,129 @@
+package media
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Handler ручки картинок, собирается в main
+type Handler struct {
+	// Files хранилище картинок
+	Files Storage
+}
+
+// картинки по uuid никогда не меняются, поэтому кешируем их навсегда
+const cacheControl = "public, max-age=31536000, immutable"
+
+func objectName(id uuid.UUID, v Variant) string {
+	return id.String() + "_" + string(v)
+}
+
+// DeleteImage удаляет картинку во всех размерах
+func (h *Handler) DeleteImage(id uuid.UUID) error {
+	for _, v := range variants {
+		if err := h.Files.Delete(objectName(id, v.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UploadMedia загружает картинку и сохраняет её вместе с превью
+func (h *Handler) UploadMedia(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "UploadMedia")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := users.SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	if r.ContentLength > MaxUploadSize {
+		errWriter.WriteWarn(http.StatusRequestEntityTooLarge, errors.New("file is too large"))
+		return
+	}
+
+	// для запросов без Content-Length
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "can not read form file"))
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "can not read form file"))
+		return
+	}
+
+	images, err := processImage(data)
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "process image error"))
+		return
+	}
+
+	id := uuid.New()
+	for variant, img := range images {
+		if err = h.Files.Put(objectName(id, variant), img); err != nil {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "media put error"))
+			return
+		}
+	}
+
+	logger.Infof("user %d uploaded media %s", info.ID, id.String())
+	utils.WriteApplicationJSON(w, http.StatusOK, &Media{
+		UUID: id.String(),
+	})
+}
+
+// GetMedia отдаёт картинку нужного размера
+func (h *Handler) GetMedia(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GetMedia")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	vars := mux.Vars(r)
+
+	id, err := uuid.Parse(vars["media_uuid"])
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format media_uuid"))
+		return
+	}
+
+	variant, ok := ParseVariant(r.URL.Query().Get("size"))
+	if !ok {
+		errWriter.WriteValidationError(&utils.ValidationError{
+			"size": utils.ErrInvalid.Error(),
+		})
+		return
+	}
+
+	obj, err := h.Files.Open(objectName(id, variant))
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "media not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "media open error"))
+		}
+		return
+	}
+	defer obj.Close()
+
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", `"`+objectName(id, variant)+`"`)
+	// ServeContent сам выставит Content-Type и обработает If-None-Match/Range
+	http.ServeContent(w, r, "", obj.ModTime, obj)
+}
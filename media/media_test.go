@@ -0,0 +1,225 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// чтобы не заваливать всё логами
+	log.SetLevel(log.PanicLevel)
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+type StorageTest struct {
+	objects map[string][]byte
+}
+
+func (st *StorageTest) Put(name string, data []byte) error {
+	st.objects[name] = data
+	return nil
+}
+
+func (st *StorageTest) Open(name string) (*Object, error) {
+	data, ok := st.objects[name]
+	if !ok {
+		return nil, utils.ErrNotExists
+	}
+
+	return &Object{
+		ReadSeeker: bytes.NewReader(data),
+		Closer:     nopCloser{},
+		ModTime:    time.Unix(0, 0),
+	}, nil
+}
+
+func (st *StorageTest) Delete(name string) error {
+	delete(st.objects, name)
+	return nil
+}
+
+// newTestHandler хендлер на пустом хранилище, у каждого теста свой
+func newTestHandler() *Handler {
+	return &Handler{
+		Files: &StorageTest{
+			objects: make(map[string][]byte),
+		},
+	}
+}
+
+func makePNG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, x%h, color.RGBA{R: 255, A: 255})
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func makeUploadRequest(t *testing.T, data []byte) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", "avatar.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/media", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req.WithContext(context.WithValue(req.Context(),
+		users.SessionInfoKey, &users.SessionPayload{ID: 1, PwdVer: 1}))
+}
+
+func TestUploadMedia(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	// без сессии
+	resp := httptest.NewRecorder()
+	h.UploadMedia(resp, httptest.NewRequest("POST", "/media", nil))
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.Code)
+	}
+
+	// не картинка
+	resp = httptest.NewRecorder()
+	h.UploadMedia(resp, makeUploadRequest(t, []byte("#!/bin/sh\nrm -rf /")))
+	if resp.Code != http.StatusBadRequest || resp.Body.String() != `{"file":"invalid"}` {
+		t.Fatalf("expected invalid file, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	// всё ок
+	resp = httptest.NewRecorder()
+	h.UploadMedia(resp, makeUploadRequest(t, makePNG(t, 2000, 1000)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	m := &Media{}
+	if err := json.Unmarshal(resp.Body.Bytes(), m); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]image.Point{
+		"":       {1024, 512},
+		"medium": {256, 128},
+		"small":  {64, 32},
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/media/{media_uuid}", h.GetMedia).Methods("GET")
+	for size, dims := range expected {
+		resp = httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest("GET", "/media/"+m.UUID+"?size="+size, nil))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("[%s] expected 200, got %d", size, resp.Code)
+		}
+		if resp.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("[%s] expected image/png, got %s", size, resp.Header().Get("Content-Type"))
+		}
+		if resp.Header().Get("Cache-Control") != cacheControl {
+			t.Fatalf("[%s] wrong Cache-Control: %s", size, resp.Header().Get("Cache-Control"))
+		}
+
+		cfg, err := png.DecodeConfig(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != dims.X || cfg.Height != dims.Y {
+			t.Fatalf("[%s] expected %v, got %dx%d", size, dims, cfg.Width, cfg.Height)
+		}
+	}
+
+	// кеш на стороне клиента
+	req := httptest.NewRequest("GET", "/media/"+m.UUID, nil)
+	req.Header.Set("If-None-Match", `"`+m.UUID+`_large"`)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", resp.Code)
+	}
+
+	// нет такого размера
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest("GET", "/media/"+m.UUID+"?size=huge", nil))
+	if resp.Code != http.StatusBadRequest || resp.Body.String() != `{"size":"invalid"}` {
+		t.Fatalf("expected invalid size, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	// нет такой картинки
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest("GET", "/media/00010203-0405-0607-0809-0a0b0c0d0e0f", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.Code)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ls, err := NewLocalStorage(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "00010203-0405-0607-0809-0a0b0c0d0e0f_small"
+	if _, err = ls.Open(name); err != utils.ErrNotExists {
+		t.Fatalf("expected not_exists, got %v", err)
+	}
+
+	if err = ls.Put(name, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := ls.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil || string(data) != "data" {
+		t.Fatalf("expected data, got %s %v", data, err)
+	}
+
+	if err = ls.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if err = ls.Delete(name); err != nil {
+		t.Fatalf("delete of missing object must not fail: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package media
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+)
+
+// Storage хранилище бинарных объектов(картинок)
+type Storage interface {
+	Put(name string, data []byte) error
+	Open(name string) (*Object, error)
+	Delete(name string) error
+}
+
+// Object открытый на чтение объект из хранилища
+type Object struct {
+	io.ReadSeeker
+	io.Closer
+	ModTime time.Time
+}
+
+// LocalStorage implementation of Storage, хранит всё в директории на диске
+type LocalStorage struct {
+	Root string
+}
+
+// NewLocalStorage создаёт хранилище в директории root, если её ещё нет
+func NewLocalStorage(root string) (*LocalStorage, error) {
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, errors.Wrap(err, "can not create media root")
+	}
+
+	return &LocalStorage{
+		Root: root,
+	}, nil
+}
+
+// путь раскладываем по первым двум символам имени,
+// чтобы не держать все файлы в одной директории
+func (ls *LocalStorage) path(name string) string {
+	return filepath.Join(ls.Root, name[:2], name)
+}
+
+// Put сохраняет объект атомарно: пишем во временный файл и переименовываем
+func (ls *LocalStorage) Put(name string, data []byte) error {
+	dst := ls.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return errors.Wrap(err, "can not create object dir")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "can not create temp file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "can not write temp file")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "can not close temp file")
+	}
+
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return errors.Wrap(err, "can not rename temp file")
+	}
+
+	return nil
+}
+
+// Open открывает объект на чтение
+func (ls *LocalStorage) Open(name string) (*Object, error) {
+	f, err := os.Open(ls.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, utils.ErrNotExists
+		}
+
+		return nil, errors.Wrap(err, "can not open object")
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "can not stat object")
+	}
+
+	return &Object{
+		ReadSeeker: f,
+		Closer:     f,
+		ModTime:    stat.ModTime(),
+	}, nil
+}
+
+// Delete удаляет объект, отсутствие объекта ошибкой не считаем
+func (ls *LocalStorage) Delete(name string) error {
+	err := os.Remove(ls.path(name))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "can not delete object")
+	}
+
+	return nil
+}
@@ -0,0 +1,6 @@
+package media
+
+// Media ответ на загрузку картинки
+type Media struct {
+	UUID string `json:"uuid"`
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
 )
 
 // RecoverMiddleware ловит паники и кидает 500ки
@@ -28,7 +29,7 @@ func RecoverMiddleware(next http.Handler) http.Handler {
 }
 
 // AccessLogMiddleware логирование всех запросов
-func AccessLogMiddleware(next http.Handler) http.Handler {
+func AccessLogMiddleware(next http.Handler, ips utils.ClientIPResolver) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := uuid.NewV4()
 		ctx := context.WithValue(r.Context(), utils.RequestUUIDKey, token.String()[:8])
@@ -39,21 +40,19 @@ func AccessLogMiddleware(next http.Handler) http.Handler {
 			"token":       token.String()[:8],
 			"method":      r.Method,
 			"remote_addr": r.RemoteAddr,
+			"client_ip":   ips.IP(r),
 			"work_time":   time.Since(start).Seconds(),
 		}).Info(r.URL.Path)
 	})
 }
 
-// WithLimiter для запросов, у которых есть ограничение в секунду
-//nolint: interfacer
-func WithLimiter(next http.HandlerFunc, limiter *rate.Limiter) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
-			log.WithField("method", "WithLimiter").Warn("too many requests")
-			http.Error(w, "", http.StatusTooManyRequests)
-			return
+// rateLimitKey чей бюджет тратит запрос: юзера, если он вошёл, иначе его IP
+func rateLimitKey(ips utils.ClientIPResolver) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if info := users.SessionInfo(r); info != nil {
+			return "user:" + strconv.FormatInt(info.ID, 10)
 		}
 
-		next.ServeHTTP(w, r)
-	})
+		return "ip:" + ips.IP(r)
+	}
 }
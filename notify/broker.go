@@ -0,0 +1,149 @@
+package notify
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Broker шина между экземплярами сервера: сообщение, опубликованное на одном,
+// приходит в хабы всех, у кого есть клиенты получателя
+type Broker interface {
+	// Publish отдаёт сообщение в шину, в том числе своему хабу
+	Publish(message *Message) error
+	// Subscribe хаб начинает получать сообщения юзера, вызывается на первом его клиенте
+	Subscribe(userID int64) error
+	// Unsubscribe вызывается, когда у юзера не осталось клиентов
+	Unsubscribe(userID int64) error
+	// Messages сообщения из шины, закрывается после Close
+	Messages() <-chan *Message
+	Close() error
+}
+
+// LocalBroker шина внутри одного процесса, для одного экземпляра и тестов
+type LocalBroker struct {
+	messages chan *Message
+}
+
+// NewLocalBroker см. LocalBroker
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{
+		messages: make(chan *Message),
+	}
+}
+
+// Publish отдаёт сообщение своему хабу
+func (lb *LocalBroker) Publish(message *Message) error {
+	lb.messages <- message
+	return nil
+}
+
+// Subscribe все сообщения и так приходят в этот хаб
+func (lb *LocalBroker) Subscribe(userID int64) error {
+	return nil
+}
+
+// Unsubscribe см. Subscribe
+func (lb *LocalBroker) Unsubscribe(userID int64) error {
+	return nil
+}
+
+// Messages сообщения для хаба
+func (lb *LocalBroker) Messages() <-chan *Message {
+	return lb.messages
+}
+
+// Close закрывает канал сообщений, Publish после него паникует
+func (lb *LocalBroker) Close() error {
+	close(lb.messages)
+	return nil
+}
+
+// broadcastChannel канал для сообщений всем подписанным на topic
+const broadcastChannel = "notify:all"
+
+func userChannel(userID int64) string {
+	return "notify:user:" + strconv.FormatInt(userID, 10)
+}
+
+// RedisBroker шина через redis pub/sub: у каждого юзера свой канал, и экземпляр
+// слушает только каналы юзеров, которые к нему подключены
+type RedisBroker struct {
+	client   *redis.Client
+	ps       *redis.PubSub
+	messages chan *Message
+}
+
+// NewRedisBroker подписывается на общий канал и начинает слушать redis
+func NewRedisBroker(client *redis.Client) *RedisBroker {
+	rb := &RedisBroker{
+		client:   client,
+		ps:       client.Subscribe(broadcastChannel),
+		messages: make(chan *Message),
+	}
+	go rb.receive()
+
+	return rb
+}
+
+func (rb *RedisBroker) receive() {
+	defer close(rb.messages)
+	for raw := range rb.ps.Channel() {
+		message := &Message{}
+		if err := json.Unmarshal([]byte(raw.Payload), message); err != nil {
+			log.WithField("channel", raw.Channel).Error(errors.Wrap(err, "unmarshal broker message error"))
+			continue
+		}
+
+		rb.messages <- message
+	}
+}
+
+// Publish публикует сообщение в канал получателя
+func (rb *RedisBroker) Publish(message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return errors.Wrap(err, "marshal broker message error")
+	}
+
+	channel := broadcastChannel
+	if message.UserID != 0 {
+		channel = userChannel(message.UserID)
+	}
+	if err = rb.client.Publish(channel, data).Err(); err != nil {
+		return errors.Wrap(err, "redis publish error")
+	}
+
+	return nil
+}
+
+// Subscribe подписка на канал юзера
+func (rb *RedisBroker) Subscribe(userID int64) error {
+	if err := rb.ps.Subscribe(userChannel(userID)); err != nil {
+		return errors.Wrap(err, "redis subscribe error")
+	}
+
+	return nil
+}
+
+// Unsubscribe отписка от канала юзера
+func (rb *RedisBroker) Unsubscribe(userID int64) error {
+	if err := rb.ps.Unsubscribe(userChannel(userID)); err != nil {
+		return errors.Wrap(err, "redis unsubscribe error")
+	}
+
+	return nil
+}
+
+// Messages сообщения из redis
+func (rb *RedisBroker) Messages() <-chan *Message {
+	return rb.messages
+}
+
+// Close закрывает подписку, канал Messages закроется следом
+func (rb *RedisBroker) Close() error {
+	return rb.ps.Close()
+}
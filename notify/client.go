@@ -0,0 +1,245 @@
+package notify
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+
+	sendBuffer = 16
+)
+
+// goingAway close фрейм клиентам при остановке сервера
+var goingAway = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+
+// Client одно подключение к шлюзу
+type Client struct {
+	SessionID string
+	UserID    int64
+	// Legacy клиенту уходит только data без конверта, так работал старый /bots/verification
+	Legacy bool
+
+	mu sync.RWMutex
+	// topic -> фильтры по играм, пустой фильтр -- все игры
+	subs map[Topic]map[string]struct{}
+
+	h    *Hub
+	conn *websocket.Conn
+	// send закрывает только хаб
+	send chan *Envelope
+	// replies ответы на команды, их пишет читающая горутина, поэтому не через send
+	replies chan *Envelope
+	// done закрывается, когда пишущая горутина вышла и ответы больше никто не ждёт
+	done chan struct{}
+	// closeMessage тело close фрейма, хаб выставляет его до закрытия send
+	closeMessage []byte
+}
+
+// NewClient клиент с начальными подписками, ещё не зарегистрированный в хабе
+func NewClient(h *Hub, conn *websocket.Conn, sessionID string, userID int64, subs []Subscription) *Client {
+	c := &Client{
+		SessionID: sessionID,
+		UserID:    userID,
+		subs:      make(map[Topic]map[string]struct{}),
+		h:         h,
+		conn:      conn,
+		send:      make(chan *Envelope, h.BufferSize),
+		replies:   make(chan *Envelope),
+		done:      make(chan struct{}),
+	}
+	for _, s := range subs {
+		c.Subscribe(s)
+	}
+
+	return c
+}
+
+// Subscribe добавляет подписку
+func (c *Client) Subscribe(s Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.subs[s.Topic]; !ok {
+		c.subs[s.Topic] = make(map[string]struct{})
+	}
+	c.subs[s.Topic][s.GameSlug] = struct{}{}
+}
+
+// Unsubscribe убирает подписку, пустой GameSlug снимает все фильтры topic
+func (c *Client) Unsubscribe(s Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s.GameSlug == "" {
+		delete(c.subs, s.Topic)
+		return
+	}
+
+	delete(c.subs[s.Topic], s.GameSlug)
+	if len(c.subs[s.Topic]) == 0 {
+		delete(c.subs, s.Topic)
+	}
+}
+
+// Wants подписан ли клиент на message
+func (c *Client) Wants(message *Message) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	games, ok := c.subs[message.Topic]
+	if !ok {
+		return false
+	}
+
+	if _, ok = games[""]; ok {
+		return true
+	}
+	_, ok = games[message.GameSlug]
+
+	return ok
+}
+
+// handleCommand применяет команду и возвращает ответ клиенту
+func (c *Client) handleCommand(data []byte) *Envelope {
+	cmd := &Command{}
+	if err := json.Unmarshal(data, cmd); err != nil {
+		return errorEnvelope("command is not valid json")
+	}
+
+	if !cmd.Topic.Valid() {
+		return errorEnvelope("unknown topic " + string(cmd.Topic))
+	}
+
+	reply := TopicSubscribed
+	switch cmd.Action {
+	case "subscribe":
+		c.Subscribe(cmd.Subscription)
+	case "unsubscribe":
+		c.Unsubscribe(cmd.Subscription)
+		reply = TopicUnsubscribed
+	default:
+		return errorEnvelope("unknown action " + cmd.Action)
+	}
+
+	raw, _ := json.Marshal(&cmd.Subscription)
+	return &Envelope{Type: reply, Data: raw}
+}
+
+func errorEnvelope(message string) *Envelope {
+	raw, _ := json.Marshal(&ErrorData{Message: message})
+	return &Envelope{Type: TopicError, Data: raw}
+}
+
+// WaitForClose читает команды клиента, пока тот не отключится
+func (c *Client) WaitForClose() {
+	logger := log.WithFields(log.Fields{
+		"ws_session": c.SessionID,
+		"method":     "WaitForClose",
+	})
+
+	defer func() {
+		c.h.unregister <- c
+		c.conn.Close()
+	}()
+	c.conn.SetPongHandler(func(string) error { return c.conn.SetReadDeadline(time.Now().Add(pongWait)) })
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logger.Error(errors.Wrap(err, "unexpected close websocket error"))
+			}
+			break
+		}
+
+		// старые клиенты ничего не присылают, а конверт с ошибкой они бы не поняли
+		if c.Legacy {
+			continue
+		}
+
+		select {
+		case c.replies <- c.handleCommand(data):
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// WriteMessages пишет клиенту сначала replay, потом сообщения из хаба и пинги.
+// Клиент регистрируется в хабе до чтения истории, поэтому живые сообщения,
+// которые уже попали в replay, пропускаются по seq
+func (c *Client) WriteMessages(replay []*Envelope) {
+	logger := log.WithFields(log.Fields{
+		"ws_session": c.SessionID,
+		"method":     "WriteMessages",
+	})
+
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		close(c.done)
+		c.conn.Close()
+	}()
+
+	var lastSeq int64
+	for _, env := range replay {
+		if err := c.write(env); err != nil {
+			logger.Error(errors.Wrapf(err, "websocket write %s replay error", env.Type))
+			return
+		}
+		lastSeq = env.Seq
+	}
+
+	for {
+		select {
+		case env, ok := <-c.send:
+			if !ok {
+				// хаб закрыл канал
+				err := c.conn.WriteControl(websocket.CloseMessage, c.closeMessage, time.Now().Add(writeWait))
+				if err != nil {
+					logger.Error(errors.Wrap(err, "websocket write close message error"))
+				}
+				return
+			}
+
+			if skipReplayed(env, lastSeq) {
+				continue
+			}
+			if err := c.write(env); err != nil {
+				logger.Error(errors.Wrapf(err, "websocket write %s message error", env.Type))
+				return
+			}
+		case env := <-c.replies:
+			if err := c.write(env); err != nil {
+				logger.Error(errors.Wrapf(err, "websocket write %s reply error", env.Type))
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				logger.Error(errors.Wrap(err, "websocket write ping message error"))
+				return
+			}
+		}
+	}
+}
+
+// write без дедлайна мёртвое tcp соединение держало бы горутину вечно
+func (c *Client) write(env *Envelope) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+
+	if c.Legacy {
+		return c.conn.WriteMessage(websocket.TextMessage, env.Data)
+	}
+
+	return c.conn.WriteJSON(env)
+}
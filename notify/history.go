@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HistoryLimit сколько последних сообщений юзера хранится для повтора
+	HistoryLimit = 1000
+	// HistoryTTL через сколько после последнего сообщения история юзера удаляется
+	HistoryTTL = 24 * time.Hour
+)
+
+// History хранит сообщения юзеров, чтобы переподключившийся клиент получил пропущенное
+type History interface {
+	// NextSeq следующий номер сообщения юзера, номера растут и не повторяются
+	NextSeq(userID int64) (int64, error)
+	// Append сохраняет сообщение с уже выставленным Seq
+	Append(message *Message) error
+	// Since сообщения юзера с Seq больше since по возрастанию Seq
+	Since(userID, since int64) ([]*Message, error)
+}
+
+// Sequenced данные, в которые хаб сам проставляет номер сообщения,
+// для клиентов, которые видят только data без конверта
+type Sequenced interface {
+	SetSeq(seq int64)
+}
+
+// RedisHistory история в redis stream у каждого юзера, номера из отдельного счётчика
+type RedisHistory struct {
+	client *redis.Client
+}
+
+// NewRedisHistory см. RedisHistory
+func NewRedisHistory(client *redis.Client) *RedisHistory {
+	return &RedisHistory{
+		client: client,
+	}
+}
+
+func seqKey(userID int64) string {
+	return "notify:seq:" + strconv.FormatInt(userID, 10)
+}
+
+func streamKey(userID int64) string {
+	return "notify:stream:" + strconv.FormatInt(userID, 10)
+}
+
+// NextSeq INCR счётчика юзера, счётчик не протухает, чтобы номера не начались заново
+func (rh *RedisHistory) NextSeq(userID int64) (int64, error) {
+	seq, err := rh.client.Incr(seqKey(userID)).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "redis incr notify seq error")
+	}
+
+	return seq, nil
+}
+
+// Append XADD в stream юзера с обрезкой до HistoryLimit
+func (rh *RedisHistory) Append(message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return errors.Wrap(err, "marshal history message error")
+	}
+
+	key := streamKey(message.UserID)
+	pipe := rh.client.TxPipeline()
+	pipe.XAdd(&redis.XAddArgs{
+		Stream:       key,
+		MaxLenApprox: HistoryLimit,
+		Values: map[string]interface{}{
+			"message": data,
+		},
+	})
+	pipe.Expire(key, HistoryTTL)
+	if _, err = pipe.Exec(); err != nil {
+		return errors.Wrap(err, "redis xadd notify history error")
+	}
+
+	return nil
+}
+
+// Since читает stream с конца до since. Номера выдаются раньше, чем запись
+// попадает в stream, так что порядок в stream может отличаться от порядка номеров
+func (rh *RedisHistory) Since(userID, since int64) ([]*Message, error) {
+	entries, err := rh.client.XRevRangeN(streamKey(userID), "+", "-", HistoryLimit).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis xrevrange notify history error")
+	}
+
+	messages := make([]*Message, 0)
+	for _, entry := range entries {
+		raw, ok := entry.Values["message"].(string)
+		if !ok {
+			continue
+		}
+
+		message := &Message{}
+		if err = json.Unmarshal([]byte(raw), message); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal history entry %s error", entry.ID)
+		}
+		if message.Seq > since {
+			messages = append(messages, message)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Seq < messages[j].Seq
+	})
+
+	return messages, nil
+}
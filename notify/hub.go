@@ -0,0 +1,298 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Hub раздаёт сообщения подключённым клиентам по их подпискам.
+// Опубликованное сначала уходит в broker и только из него попадает к клиентам,
+// так что клиенты на других экземплярах получают его так же, как и на этом
+type Hub struct {
+	// UserID -> клиенты юзера, у одного юзера может быть много вкладок
+	users map[int64]map[*Client]struct{}
+
+	// BufferSize сколько сообщений ждут записи в сокет клиента, меняется до Run
+	BufferSize int
+	// Policy что делать, когда буфер клиента полон, меняется до Run
+	Policy SlowPolicy
+
+	// History история для повтора пропущенного, nil -- сообщения без номеров и без повтора
+	History History
+	// Heartbeat как часто в SSE-поток пишется комментарий, чтобы прокси не рвали тихое соединение
+	Heartbeat time.Duration
+
+	// пишет только цикл хаба, читает кто угодно через Stats
+	stats Stats
+
+	broker     Broker
+	register   chan *Client
+	unregister chan *Client
+
+	closeOnce sync.Once
+	// quit закрывает Close, closed -- цикл хаба, когда разослал close фреймы
+	quit   chan struct{}
+	closed chan struct{}
+	// writers пишущие горутины отключённых при закрытии сокетов,
+	// заполняется до closed и после не меняется
+	writers []chan struct{}
+}
+
+// NewHub хаб без клиентов, его надо запустить через Run
+func NewHub(broker Broker) *Hub {
+	return &Hub{
+		users:      make(map[int64]map[*Client]struct{}),
+		BufferSize: sendBuffer,
+		Policy:     DropMessages,
+		Heartbeat:  sseHeartbeat,
+		broker:     broker,
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		quit:       make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Close отключает всех клиентов: сокетам уходит close фрейм 1001 Going Away,
+// SSE-потоки завершаются. Новых клиентов закрытый хаб отключает сразу.
+// Публиковать можно и дальше, сообщения сохранятся в History
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.quit)
+	})
+}
+
+// Wait ждёт после Close, пока close фреймы уйдут клиентам
+func (h *Hub) Wait(ctx context.Context) error {
+	select {
+	case <-h.closed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, done := range h.writers {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Stats текущие счётчики хаба
+func (h *Hub) Stats() Stats {
+	return Stats{
+		Users:        atomic.LoadInt64(&h.stats.Users),
+		Clients:      atomic.LoadInt64(&h.stats.Clients),
+		Dropped:      atomic.LoadInt64(&h.stats.Dropped),
+		Disconnected: atomic.LoadInt64(&h.stats.Disconnected),
+	}
+}
+
+// Publish отдаёт data под видом topic юзеру userID (0 -- всем подписанным на topic).
+// gameSlug нужен для фильтра подписки, может быть пустым.
+// Сообщения конкретному юзеру получают номер и сохраняются в History, если она есть
+func (h *Hub) Publish(userID int64, topic Topic, gameSlug string, data interface{}) error {
+	message := &Message{
+		UserID:   userID,
+		Topic:    topic,
+		GameSlug: gameSlug,
+	}
+
+	// без номера сообщение всё равно дойдёт до тех, кто подключён сейчас
+	if h.History != nil && userID != 0 {
+		seq, err := h.History.NextSeq(userID)
+		if err != nil {
+			log.WithField("user_id", userID).Error(errors.Wrap(err, "notify next seq error"))
+		} else if sequenced, ok := data.(Sequenced); ok {
+			sequenced.SetSeq(seq)
+		}
+		message.Seq = seq
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %s message error", topic)
+	}
+	message.Data = raw
+
+	if message.Seq != 0 {
+		if err = h.History.Append(message); err != nil {
+			log.WithField("user_id", userID).Error(errors.Wrap(err, "notify history append error"))
+		}
+	}
+
+	return h.broker.Publish(message)
+}
+
+// Replay сохранённые сообщения юзера после since, которые хочет client
+func (h *Hub) Replay(client *Client, since int64) ([]*Envelope, error) {
+	if h.History == nil || since <= 0 {
+		return nil, nil
+	}
+
+	messages, err := h.History.Since(client.UserID, since)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := make([]*Envelope, 0, len(messages))
+	for _, message := range messages {
+		if client.Wants(message) {
+			replay = append(replay, envelope(message))
+		}
+	}
+
+	return replay, nil
+}
+
+func (h *Hub) registerClient(client *Client) {
+	if h.isClosed() {
+		client.closeMessage = goingAway
+		close(client.send)
+		return
+	}
+
+	if _, ok := h.users[client.UserID]; !ok {
+		h.users[client.UserID] = make(map[*Client]struct{})
+		atomic.AddInt64(&h.stats.Users, 1)
+		if err := h.broker.Subscribe(client.UserID); err != nil {
+			log.WithField("user_id", client.UserID).Error(errors.Wrap(err, "broker subscribe error"))
+		}
+	}
+
+	h.users[client.UserID][client] = struct{}{}
+	atomic.AddInt64(&h.stats.Clients, 1)
+}
+
+func (h *Hub) unregisterClient(client *Client) {
+	if _, ok := h.users[client.UserID][client]; !ok {
+		return
+	}
+
+	delete(h.users[client.UserID], client)
+	atomic.AddInt64(&h.stats.Clients, -1)
+	if len(h.users[client.UserID]) == 0 {
+		delete(h.users, client.UserID)
+		atomic.AddInt64(&h.stats.Users, -1)
+		if err := h.broker.Unsubscribe(client.UserID); err != nil {
+			log.WithField("user_id", client.UserID).Error(errors.Wrap(err, "broker unsubscribe error"))
+		}
+	}
+	close(client.send)
+}
+
+func envelope(message *Message) *Envelope {
+	return &Envelope{
+		Type:     message.Topic,
+		Seq:      message.Seq,
+		GameSlug: message.GameSlug,
+		Data:     message.Data,
+	}
+}
+
+func (h *Hub) deliver(message *Message) {
+	env := envelope(message)
+
+	if message.UserID != 0 {
+		for client := range h.users[message.UserID] {
+			if client.Wants(message) {
+				h.trySend(client, env)
+			}
+		}
+		return
+	}
+
+	for _, clients := range h.users {
+		for client := range clients {
+			if client.Wants(message) {
+				h.trySend(client, env)
+			}
+		}
+	}
+}
+
+// trySend никогда не блокирует цикл хаба: один зависший сокет
+// не должен задерживать сообщения и регистрацию всех остальных
+func (h *Hub) trySend(client *Client, env *Envelope) {
+	select {
+	case client.send <- env:
+		return
+	default:
+	}
+
+	logger := log.WithFields(log.Fields{
+		"ws_session": client.SessionID,
+		"user_id":    client.UserID,
+		"type":       env.Type,
+	})
+	atomic.AddInt64(&h.stats.Dropped, 1)
+	if h.Policy == Disconnect {
+		logger.Warn("slow notify client disconnected")
+		atomic.AddInt64(&h.stats.Disconnected, 1)
+		client.closeMessage = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+		h.unregisterClient(client)
+		return
+	}
+
+	logger.Warn("notify message dropped for slow client")
+}
+
+func (h *Hub) isClosed() bool {
+	select {
+	case <-h.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeClients отключает всех при Close, вызывается из цикла хаба
+func (h *Hub) closeClients() {
+	for _, clients := range h.users {
+		for client := range clients {
+			client.closeMessage = goingAway
+			// у SSE сокета нет, их запросы дождётся http.Server.Shutdown
+			if client.conn != nil {
+				h.writers = append(h.writers, client.done)
+			}
+			h.unregisterClient(client)
+		}
+	}
+	close(h.closed)
+}
+
+// Run цикл хаба, все изменения карты клиентов идут только через него
+func (h *Hub) Run() {
+	messages := h.broker.Messages()
+	quit := h.quit
+	for {
+		select {
+		case <-quit:
+			h.closeClients()
+			// дальше хаб только отпускает клиентов
+			quit = nil
+		case client := <-h.register:
+			h.registerClient(client)
+		case client := <-h.unregister:
+			h.unregisterClient(client)
+		case message, ok := <-messages:
+			if !ok {
+				// шину закрыли, новых сообщений не будет, но клиентов ещё надо отпускать
+				log.Warn("notify broker closed")
+				messages = nil
+				continue
+			}
+			h.deliver(message)
+		}
+	}
+}
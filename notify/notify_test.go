@@ -0,0 +1,853 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// чтобы не заваливать всё логами
+	log.SetLevel(log.PanicLevel)
+}
+
+func receive(t *testing.T, c *Client) *Envelope {
+	t.Helper()
+	select {
+	case env := <-c.send:
+		return env
+	case <-time.After(time.Second):
+		t.Fatalf("client %s: no message", c.SessionID)
+	}
+
+	return nil
+}
+
+// barrier ждёт, пока хаб разберёт всё, что получил до этого: цикл хаба
+// примет регистрацию только после того, как закончит раздавать сообщение
+func barrier(h *Hub) {
+	c := NewClient(h, nil, "barrier", -1, nil)
+	h.register <- c
+	h.unregister <- c
+	// канал закрывается последним, после него счётчики уже обновлены
+	<-c.send
+}
+
+func expectNothing(t *testing.T, h *Hub, c *Client) {
+	t.Helper()
+	barrier(h)
+	select {
+	case env := <-c.send:
+		t.Fatalf("client %s: unexpected %s message", c.SessionID, env.Type)
+	default:
+	}
+}
+
+func TestHubRouting(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	go h.Run()
+
+	allGames := NewClient(h, nil, "all", 1, []Subscription{{Topic: TopicBotStatus}})
+	pong := NewClient(h, nil, "pong", 1, []Subscription{{Topic: TopicBotStatus, GameSlug: "pong"}})
+	other := NewClient(h, nil, "other", 2, []Subscription{
+		{Topic: TopicBotStatus},
+		{Topic: TopicLeaderboardChange, GameSlug: "pong"},
+	})
+	for _, c := range []*Client{allGames, pong, other} {
+		h.register <- c
+	}
+
+	if err := h.Publish(1, TopicBotStatus, "chess", map[string]int{"bot_id": 3}); err != nil {
+		t.Fatalf("publish error: %s", err)
+	}
+	env := receive(t, allGames)
+	if env.Type != TopicBotStatus || env.GameSlug != "chess" || string(env.Data) != `{"bot_id":3}` {
+		t.Errorf("wrong envelope: %+v", env)
+	}
+	expectNothing(t, h, pong)
+	expectNothing(t, h, other)
+
+	if err := h.Publish(0, TopicLeaderboardChange, "pong", nil); err != nil {
+		t.Fatalf("publish error: %s", err)
+	}
+	if env = receive(t, other); env.Type != TopicLeaderboardChange {
+		t.Errorf("wrong type: %s", env.Type)
+	}
+	expectNothing(t, h, allGames)
+	expectNothing(t, h, pong)
+
+	pong.Unsubscribe(Subscription{Topic: TopicBotStatus})
+	if err := h.Publish(1, TopicBotStatus, "pong", nil); err != nil {
+		t.Fatalf("publish error: %s", err)
+	}
+	receive(t, allGames)
+	expectNothing(t, h, pong)
+
+	h.unregister <- pong
+	if _, ok := <-pong.send; ok {
+		t.Errorf("send channel of unregistered client is not closed")
+	}
+}
+
+func newSlowHub(policy SlowPolicy) (*Hub, *Client, *Client) {
+	h := NewHub(NewLocalBroker())
+	h.BufferSize = 2
+	h.Policy = policy
+	go h.Run()
+
+	subs := []Subscription{{Topic: TopicMatchFinished}}
+	slow := NewClient(h, nil, "slow", 1, subs)
+	fast := NewClient(h, nil, "fast", 1, subs)
+	h.register <- slow
+	h.register <- fast
+
+	return h, slow, fast
+}
+
+func TestSlowClientDrop(t *testing.T) {
+	t.Parallel()
+
+	h, slow, fast := newSlowHub(DropMessages)
+
+	for i := 0; i < 10; i++ {
+		if err := h.Publish(1, TopicMatchFinished, "", i); err != nil {
+			t.Fatalf("publish error: %s", err)
+		}
+		// медленный клиент не мешает быстрому получать всё
+		if env := receive(t, fast); string(env.Data) != strconv.Itoa(i) {
+			t.Errorf("fast client: wrong message %s, expected %d", env.Data, i)
+		}
+	}
+
+	// в буфере медленного первые сообщения, остальные выброшены
+	for i := 0; i < h.BufferSize; i++ {
+		if env := receive(t, slow); string(env.Data) != strconv.Itoa(i) {
+			t.Errorf("slow client: wrong message %s, expected %d", env.Data, i)
+		}
+	}
+	expectNothing(t, h, slow)
+
+	stats := h.Stats()
+	expected := Stats{Users: 1, Clients: 2, Dropped: 8}
+	if stats != expected {
+		t.Errorf("wrong stats: %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestSlowClientDisconnect(t *testing.T) {
+	t.Parallel()
+
+	h, slow, fast := newSlowHub(Disconnect)
+
+	for i := 0; i < 5; i++ {
+		if err := h.Publish(1, TopicMatchFinished, "", i); err != nil {
+			t.Fatalf("publish error: %s", err)
+		}
+		receive(t, fast)
+	}
+
+	// сначала дочитывается то, что успело попасть в буфер, потом канал закрыт
+	received := 0
+	for range slow.send {
+		received++
+	}
+	if received != h.BufferSize {
+		t.Errorf("slow client: received %d, expected %d", received, h.BufferSize)
+	}
+	if len(slow.closeMessage) == 0 {
+		t.Errorf("slow client: close message is not set")
+	}
+
+	// повторная отписка из читающей горутины ничего не ломает
+	h.unregister <- slow
+	barrier(h)
+
+	stats := h.Stats()
+	expected := Stats{Users: 1, Clients: 1, Dropped: 1, Disconnected: 1}
+	if stats != expected {
+		t.Errorf("wrong stats: %+v, expected %+v", stats, expected)
+	}
+}
+
+// TestHubConcurrent много публикующих, подключающихся и зависших клиентов сразу,
+// смысл в запуске с -race и в том, что хаб не встаёт
+func TestHubConcurrent(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []SlowPolicy{DropMessages, Disconnect} {
+		h := NewHub(NewLocalBroker())
+		h.BufferSize = 4
+		h.Policy = policy
+		go h.Run()
+
+		subs := []Subscription{{Topic: TopicBotStatus}, {Topic: TopicLeaderboardChange}}
+		wg := &sync.WaitGroup{}
+		for u := int64(1); u <= 8; u++ {
+			wg.Add(3)
+			// зависший клиент, никогда не читает
+			go func(userID int64) {
+				defer wg.Done()
+				h.register <- NewClient(h, nil, "stalled", userID, subs)
+			}(u)
+			// клиент, который читает и переподключается
+			go func(userID int64) {
+				defer wg.Done()
+				for i := 0; i < 10; i++ {
+					c := NewClient(h, nil, "reader", userID, subs)
+					h.register <- c
+					for j := 0; j < 3; j++ {
+						select {
+						case <-c.send:
+						case <-time.After(time.Millisecond):
+						}
+					}
+					h.unregister <- c
+				}
+			}(u)
+			go func(userID int64) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					topic, to := TopicBotStatus, userID
+					if i%5 == 0 {
+						topic, to = TopicLeaderboardChange, 0
+					}
+					if err := h.Publish(to, topic, "pong", i); err != nil {
+						t.Errorf("publish error: %s", err)
+					}
+					h.Stats()
+				}
+			}(u)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("policy %d: hub is stuck", policy)
+		}
+
+		if stats := h.Stats(); stats.Dropped == 0 {
+			t.Errorf("policy %d: stalled clients dropped nothing: %+v", policy, stats)
+		}
+	}
+}
+
+func TestPublishMarshalError(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	if err := h.Publish(1, TopicMatchFinished, "", make(chan int)); err == nil {
+		t.Errorf("expected marshal error")
+	}
+}
+
+func dial(t *testing.T, handler http.HandlerFunc, query string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), users.SessionInfoKey, &users.SessionPayload{ID: 10})
+		handler(w, r.WithContext(ctx))
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+query, nil)
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) *Envelope {
+	t.Helper()
+	env := &Envelope{}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("set deadline error: %s", err)
+	}
+	if err := conn.ReadJSON(env); err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	return env
+}
+
+func TestOpenWS(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	go h.Run()
+	conn := dial(t, h.OpenWS, "")
+
+	cases := []struct {
+		command  string
+		expected Topic
+	}{
+		{`{"action":"subscribe","topic":"challenge_received"}`, TopicSubscribed},
+		{`{"action":"subscribe","topic":"nope"}`, TopicError},
+		{`{"action":"listen","topic":"bot_status"}`, TopicError},
+		{`not json`, TopicError},
+	}
+	for i, c := range cases {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(c.command)); err != nil {
+			t.Fatalf("[%d] write error: %s", i, err)
+		}
+		if env := readEnvelope(t, conn); env.Type != c.expected {
+			t.Errorf("[%d] wrong reply: %s, expected %s", i, env.Type, c.expected)
+		}
+	}
+
+	// ответ на subscribe пришёл, значит клиент уже в хабе
+	if err := h.Publish(10, TopicChallengeReceived, "pong", map[string]string{"from": "bob"}); err != nil {
+		t.Fatalf("publish error: %s", err)
+	}
+	env := readEnvelope(t, conn)
+	if env.Type != TopicChallengeReceived || string(env.Data) != `{"from":"bob"}` {
+		t.Errorf("wrong envelope: %+v", env)
+	}
+}
+
+func TestOpenWSBadTopic(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	go h.Run()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ws?topic=nope", nil)
+	h.OpenWS(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong code: %d", rr.Code)
+	}
+}
+
+func TestServeLegacy(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	go h.Run()
+	conn := dial(t, func(w http.ResponseWriter, r *http.Request) {
+		h.Serve(w, r, []Subscription{{Topic: TopicBotStatus, GameSlug: "pong"}}, true)
+	}, "")
+
+	// подтверждений у старого протокола нет, так что публикуем, пока читатель не получит
+	received := make(chan map[string]int)
+	go func() {
+		var data map[string]int
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err == nil && conn.ReadJSON(&data) == nil {
+			received <- data
+		}
+		close(received)
+	}()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if err := h.Publish(10, TopicBotStatus, "pong", map[string]int{"bot_id": 1}); err != nil {
+			t.Fatalf("publish error: %s", err)
+		}
+
+		select {
+		case data, ok := <-received:
+			if !ok {
+				t.Fatalf("no legacy message")
+			}
+			if data["bot_id"] != 1 {
+				t.Errorf("wrong legacy message: %v", data)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TestHubClose при остановке сокет получает close фрейм, а новые клиенты сразу отключаются
+func TestHubClose(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	go h.Run()
+	conn := dial(t, h.OpenWS, "?topic=bot_status")
+	sse := NewClient(h, nil, "sse", 11, []Subscription{{Topic: TopicBotStatus}})
+	h.register <- sse
+
+	// ответ на команду пришёл, значит сокет уже в хабе
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"subscribe","topic":"bot_status"}`)); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+	readEnvelope(t, conn)
+
+	h.Close()
+	h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Wait(ctx); err != nil {
+		t.Fatalf("wait error: %s", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("set deadline error: %s", err)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected going away close frame, got %v", err)
+	}
+	if _, ok := <-sse.send; ok {
+		t.Error("sse client is not disconnected")
+	}
+
+	late := NewClient(h, nil, "late", 12, nil)
+	h.register <- late
+	if _, ok := <-late.send; ok {
+		t.Error("closed hub accepted a new client")
+	}
+	if stats := h.Stats(); stats.Clients != 0 || stats.Users != 0 {
+		t.Errorf("wrong stats after close: %+v", stats)
+	}
+}
+
+func TestEnvelopeJSON(t *testing.T) {
+	t.Parallel()
+
+	data, err := json.Marshal(&Envelope{Type: TopicBotStatus, Data: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if string(data) != `{"type":"bot_status","data":{}}` {
+		t.Errorf("wrong envelope json: %s", data)
+	}
+}
+
+type HistoryTest struct {
+	mu       sync.Mutex
+	seqs     map[int64]int64
+	messages []*Message
+	nextFail error
+}
+
+func newHistoryTest() *HistoryTest {
+	return &HistoryTest{
+		seqs: make(map[int64]int64),
+	}
+}
+
+func (ht *HistoryTest) NextSeq(userID int64) (int64, error) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	if err := ht.nextFail; err != nil {
+		ht.nextFail = nil
+		return 0, err
+	}
+
+	ht.seqs[userID]++
+	return ht.seqs[userID], nil
+}
+
+func (ht *HistoryTest) Append(message *Message) error {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	ht.messages = append(ht.messages, message)
+	return nil
+}
+
+func (ht *HistoryTest) Since(userID, since int64) ([]*Message, error) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	list := make([]*Message, 0)
+	for _, m := range ht.messages {
+		if m.UserID == userID && m.Seq > since {
+			list = append(list, m)
+		}
+	}
+
+	return list, nil
+}
+
+type seqData struct {
+	Seq  int64  `json:"seq"`
+	Text string `json:"text"`
+}
+
+func (sd *seqData) SetSeq(seq int64) {
+	sd.Seq = seq
+}
+
+func TestPublishSeq(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	hist := newHistoryTest()
+	h.History = hist
+	go h.Run()
+
+	c := NewClient(h, nil, "seq", 1, []Subscription{{Topic: TopicBotStatus}, {Topic: TopicLeaderboardChange}})
+	h.register <- c
+
+	cases := []struct {
+		userID   int64
+		topic    Topic
+		fail     error
+		expected int64
+		data     string
+	}{
+		{1, TopicBotStatus, nil, 1, `{"seq":1,"text":"a"}`},
+		{1, TopicBotStatus, nil, 2, `{"seq":2,"text":"a"}`},
+		// всем сразу -- без номера и без истории
+		{0, TopicLeaderboardChange, nil, 0, `{"seq":0,"text":"a"}`},
+		// счётчик недоступен -- сообщение всё равно доходит
+		{1, TopicBotStatus, errors.New("redis is down"), 0, `{"seq":0,"text":"a"}`},
+		{1, TopicBotStatus, nil, 3, `{"seq":3,"text":"a"}`},
+	}
+	for i, cs := range cases {
+		hist.nextFail = cs.fail
+		if err := h.Publish(cs.userID, cs.topic, "", &seqData{Text: "a"}); err != nil {
+			t.Fatalf("[%d] publish error: %s", i, err)
+		}
+
+		env := receive(t, c)
+		if env.Seq != cs.expected || string(env.Data) != cs.data {
+			t.Errorf("[%d] wrong envelope: seq %d data %s, expected %d %s", i, env.Seq, env.Data, cs.expected, cs.data)
+		}
+	}
+
+	if len(hist.messages) != 3 {
+		t.Errorf("wrong history length: %d, expected 3", len(hist.messages))
+	}
+}
+
+func TestOpenWSReplay(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	h.History = newHistoryTest()
+	go h.Run()
+
+	// юзер не подключён, сообщения только копятся в истории
+	for _, game := range []string{"pong", "chess", "pong"} {
+		if err := h.Publish(10, TopicBotStatus, game, game); err != nil {
+			t.Fatalf("publish error: %s", err)
+		}
+	}
+	if err := h.Publish(10, TopicMatchFinished, "pong", nil); err != nil {
+		t.Fatalf("publish error: %s", err)
+	}
+
+	conn := dial(t, h.OpenWS, "?topic=bot_status&game_slug=pong&since=1")
+
+	// из пропущенного подходит под подписку только seq 3
+	env := readEnvelope(t, conn)
+	if env.Type != TopicBotStatus || env.Seq != 3 {
+		t.Errorf("wrong replay: %+v", env)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"subscribe","topic":"bot_status"}`)); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+	if env = readEnvelope(t, conn); env.Type != TopicSubscribed {
+		t.Errorf("wrong reply: %s", env.Type)
+	}
+
+	if err := h.Publish(10, TopicBotStatus, "pong", "live"); err != nil {
+		t.Fatalf("publish error: %s", err)
+	}
+	if env = readEnvelope(t, conn); env.Seq != 5 || string(env.Data) != `"live"` {
+		t.Errorf("wrong live message: %+v", env)
+	}
+}
+
+func TestOpenWSBadSince(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	go h.Run()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ws?since=-1", nil)
+	req = req.WithContext(context.WithValue(req.Context(), users.SessionInfoKey, &users.SessionPayload{ID: 10}))
+	h.OpenWS(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong code: %d", rr.Code)
+	}
+}
+
+// TestWriteMessagesSkipsReplayed живые сообщения, которые уже ушли в replay, не дублируются
+func TestWriteMessagesSkipsReplayed(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	env := func(seq int64) *Envelope {
+		return &Envelope{Type: TopicBotStatus, Seq: seq, Data: json.RawMessage(strconv.FormatInt(seq, 10))}
+	}
+
+	upgrader := websocket.Upgrader{}
+	conn := dial(t, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := NewClient(h, ws, "replay", 1, nil)
+		// пока читалась история, хаб успел положить в буфер 2 и 4
+		c.send <- env(2)
+		c.send <- env(4)
+		close(c.send)
+		go c.WriteMessages([]*Envelope{env(1), env(2), env(3)})
+	}, "")
+
+	for _, expected := range []int64{1, 2, 3, 4} {
+		if got := readEnvelope(t, conn); got.Seq != expected {
+			t.Errorf("wrong seq: %d, expected %d", got.Seq, expected)
+		}
+	}
+}
+
+// readSSE читает одно событие или комментарий до пустой строки
+func readSSE(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	lines := make([]string, 0)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read sse error: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestOpenSSE(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	h.History = newHistoryTest()
+	h.Heartbeat = 20 * time.Millisecond
+	go h.Run()
+
+	for _, data := range []string{"pong", "chess", "pong"} {
+		if err := h.Publish(10, TopicBotStatus, data, data); err != nil {
+			t.Fatalf("publish error: %s", err)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), users.SessionInfoKey, &users.SessionPayload{ID: 10})
+		h.OpenSSE(w, r.WithContext(ctx))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest("GET", srv.URL+"?topic=bot_status&game_slug=pong", nil)
+	if err != nil {
+		t.Fatalf("new request error: %s", err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("wrong content type: %s", ct)
+	}
+	body := bufio.NewReader(resp.Body)
+
+	// заголовки пришли, значит клиент уже в хабе
+	if err = h.Publish(10, TopicBotStatus, "pong", "live"); err != nil {
+		t.Fatalf("publish error: %s", err)
+	}
+
+	expected := [][]string{
+		{"id: 3", "event: bot_status", `data: "pong"`},
+		{"id: 4", "event: bot_status", `data: "live"`},
+	}
+	for i, exp := range expected {
+		event := readSSE(t, body)
+		// между событиями может затесаться heartbeat
+		for len(event) == 1 && event[0] == ": ping" {
+			event = readSSE(t, body)
+		}
+		if strings.Join(event, "|") != strings.Join(exp, "|") {
+			t.Errorf("[%d] wrong event: %v, expected %v", i, event, exp)
+		}
+	}
+
+	if event := readSSE(t, body); len(event) != 1 || event[0] != ": ping" {
+		t.Errorf("wrong heartbeat: %v", event)
+	}
+}
+
+func TestOpenSSEBadRequest(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub(NewLocalBroker())
+	go h.Run()
+	cases := []struct {
+		query  string
+		cursor string
+	}{
+		{"?topic=nope", ""},
+		{"?topic=bot_status", "abc"},
+		{"?since=-5", ""},
+	}
+	for i, c := range cases {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/events"+c.query, nil)
+		req = req.WithContext(context.WithValue(req.Context(), users.SessionInfoKey, &users.SessionPayload{ID: 10}))
+		if c.cursor != "" {
+			req.Header.Set("Last-Event-ID", c.cursor)
+		}
+
+		h.OpenSSE(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("[%d] wrong code: %d", i, rr.Code)
+		}
+	}
+}
+
+func newRedisHub(t *testing.T, addr string) *Hub {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping().Err(); err != nil {
+		t.Fatalf("redis ping error: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	broker := NewRedisBroker(client)
+	t.Cleanup(func() { broker.Close() })
+
+	h := NewHub(broker)
+	go h.Run()
+
+	return h
+}
+
+// publishUntil публикует, пока c не получит сообщение: SUBSCRIBE в redis
+// асинхронный, и первые сообщения могут прийти раньше подписки
+func publishUntil(t *testing.T, h *Hub, c *Client, userID int64, topic Topic) *Envelope {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if err := h.Publish(userID, topic, "pong", map[string]int64{"user_id": userID}); err != nil {
+			t.Fatalf("publish error: %s", err)
+		}
+
+		select {
+		case env := <-c.send:
+			return env
+		case <-ticker.C:
+		case <-deadline:
+			t.Fatalf("client %s: no message through redis", c.SessionID)
+		}
+	}
+}
+
+// TestRedisBrokerTwoHubs два хаба как два экземпляра сервера, нужен redis в REDIS_ADDR
+func TestRedisBrokerTwoHubs(t *testing.T) {
+	t.Parallel()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+
+	a := newRedisHub(t, addr)
+	b := newRedisHub(t, addr)
+
+	// уникальные id, чтобы не пересекаться с другими запусками на том же redis
+	userID := time.Now().UnixNano()
+	onB := NewClient(b, nil, "on_b", userID, []Subscription{
+		{Topic: TopicBotStatus},
+		{Topic: TopicLeaderboardChange},
+	})
+	b.register <- onB
+	onA := NewClient(a, nil, "on_a", userID+1, []Subscription{{Topic: TopicBotStatus}})
+	a.register <- onA
+
+	env := publishUntil(t, a, onB, userID, TopicBotStatus)
+	if env.Type != TopicBotStatus || env.GameSlug != "pong" {
+		t.Errorf("wrong envelope: %+v", env)
+	}
+
+	if env = publishUntil(t, a, onB, 0, TopicLeaderboardChange); env.Type != TopicLeaderboardChange {
+		t.Errorf("wrong broadcast type: %s", env.Type)
+	}
+
+	// у onA свой канал, чужие сообщения туда не попадают
+	for len(onA.send) != 0 {
+		if env = <-onA.send; env.Type == TopicBotStatus {
+			t.Errorf("message for user %d reached user %d", userID, onA.UserID)
+		}
+	}
+
+	// после ухода последнего клиента b отписывается от канала юзера
+	b.unregister <- onB
+	if _, ok := <-onB.send; ok {
+		t.Errorf("send channel of unregistered client is not closed")
+	}
+}
+
+// TestRedisHistory нужен redis в REDIS_ADDR
+func TestRedisHistory(t *testing.T) {
+	t.Parallel()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	rh := NewRedisHistory(client)
+
+	userID := time.Now().UnixNano()
+	for i := 0; i < 3; i++ {
+		seq, err := rh.NextSeq(userID)
+		if err != nil {
+			t.Fatalf("next seq error: %s", err)
+		}
+		if seq != int64(i+1) {
+			t.Errorf("wrong seq: %d, expected %d", seq, i+1)
+		}
+
+		err = rh.Append(&Message{UserID: userID, Seq: seq, Topic: TopicBotStatus, Data: json.RawMessage(`{}`)})
+		if err != nil {
+			t.Fatalf("append error: %s", err)
+		}
+	}
+
+	messages, err := rh.Since(userID, 1)
+	if err != nil {
+		t.Fatalf("since error: %s", err)
+	}
+	if len(messages) != 2 || messages[0].Seq != 2 || messages[1].Seq != 3 {
+		t.Errorf("wrong replay: %+v", messages)
+	}
+}
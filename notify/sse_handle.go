@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// sseHeartbeat Hub.Heartbeat по умолчанию
+const sseHeartbeat = 15 * time.Second
+
+// OpenSSE те же уведомления, что и h.OpenWS, но через Server-Sent Events для тех,
+// у кого websocket режет прокси. Подписки только из query, менять их по ходу нельзя:
+// ?topic=bot_status&game_slug=pong. Курсор -- заголовок Last-Event-ID или ?since=
+func (h *Hub) OpenSSE(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "OpenSSE")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	subs, ok := parseSubscriptions(r)
+	if !ok {
+		errWriter.WriteValidationError(&utils.ValidationError{
+			"topic": utils.ErrInvalid.Error(),
+		})
+		return
+	}
+
+	h.ServeSSE(w, r, subs)
+}
+
+// ServeSSE регистрирует в хабе клиента без сокета и пишет его сообщения в поток:
+// event -- тип, data -- данные сообщения без конверта, id -- seq
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request, subs []Subscription) {
+	logger := utils.GetLogger(r, "ServeSSE")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := users.SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	// браузер при переподключении сам присылает Last-Event-ID
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("since")
+	}
+	since, ok := parseSeq(cursor)
+	if !ok {
+		errWriter.WriteValidationError(&utils.ValidationError{
+			"since": utils.ErrInvalid.Error(),
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errWriter.WriteError(http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	client := NewClient(h, nil, uuid.New().String(), info.ID, subs)
+	h.register <- client
+	defer func() {
+		h.unregister <- client
+	}()
+
+	replay, err := h.Replay(client, since)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "notify replay error"))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx иначе копит поток в буфере
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if err = h.streamSSE(w, flusher, r, client, replay); err != nil {
+		logger.Warn(errors.Wrap(err, "sse write error"))
+	}
+}
+
+func (h *Hub) streamSSE(w http.ResponseWriter, flusher http.Flusher, r *http.Request,
+	client *Client, replay []*Envelope) error {
+
+	var lastSeq int64
+	for _, env := range replay {
+		if err := writeEvent(w, env); err != nil {
+			return err
+		}
+		lastSeq = env.Seq
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(h.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case env, ok := <-client.send:
+			if !ok {
+				// хаб отключил клиента, браузер переподключится сам
+				return nil
+			}
+			if skipReplayed(env, lastSeq) {
+				continue
+			}
+			if err := writeEvent(w, env); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return err
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, env *Envelope) error {
+	if env.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", env.Seq); err != nil {
+			return err
+		}
+	}
+
+	// json.RawMessage из json.Marshal переводов строк не содержит
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", env.Type, env.Data)
+	return err
+}
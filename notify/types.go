@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"encoding/json"
+)
+
+// Topic тип уведомления, на него подписываются клиенты
+type Topic string
+
+const (
+	// TopicBotStatus смена статуса проверки бота, уходит автору
+	TopicBotStatus Topic = "bot_status"
+	// TopicMatchFinished матч с ботом юзера закончился
+	TopicMatchFinished Topic = "match_finished"
+	// TopicChallengeReceived юзера вызвали на матч
+	TopicChallengeReceived Topic = "challenge_received"
+	// TopicLeaderboardChange изменилась таблица лидеров игры, уходит всем подписанным
+	TopicLeaderboardChange Topic = "leaderboard_change"
+
+	// служебные ответы на команды клиента, на них не подписываются
+	TopicSubscribed   Topic = "subscribed"
+	TopicUnsubscribed Topic = "unsubscribed"
+	TopicError        Topic = "error"
+)
+
+var knownTopics = map[Topic]struct{}{
+	TopicBotStatus:         {},
+	TopicMatchFinished:     {},
+	TopicChallengeReceived: {},
+	TopicLeaderboardChange: {},
+}
+
+// Valid можно ли подписаться на topic
+func (t Topic) Valid() bool {
+	_, ok := knownTopics[t]
+	return ok
+}
+
+// Message сообщение от подсистемы, хаб решает, кому его отдать
+type Message struct {
+	// UserID получатель, 0 -- все, кто подписан на Topic
+	UserID int64 `json:"user_id"`
+	// Seq номер сообщения юзера, 0 -- сообщение не сохраняется в историю
+	Seq      int64           `json:"seq,omitempty"`
+	Topic    Topic           `json:"topic"`
+	GameSlug string          `json:"game_slug"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Envelope то, что уходит клиенту: по type клиент понимает, как разбирать data
+type Envelope struct {
+	Type Topic `json:"type"`
+	// Seq последний полученный seq клиент передаёт в since при переподключении
+	Seq      int64           `json:"seq,omitempty"`
+	GameSlug string          `json:"game_slug,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Subscription подписка на topic, пустой GameSlug -- по всем играм
+type Subscription struct {
+	Topic    Topic  `json:"topic"`
+	GameSlug string `json:"game_slug"`
+}
+
+// Command команда от клиента по сокету
+type Command struct {
+	// Action subscribe или unsubscribe
+	Action string `json:"action"`
+	Subscription
+}
+
+// ErrorData data у сообщения с type error
+type ErrorData struct {
+	Message string `json:"message"`
+}
+
+// SlowPolicy что делать с клиентом, который не успевает читать и у которого заполнен буфер
+type SlowPolicy int
+
+const (
+	// DropMessages сообщение, которое не влезло в буфер, выбрасывается, клиент остаётся
+	DropMessages SlowPolicy = iota
+	// Disconnect клиент отключается с кодом 1013 (try again later)
+	// и сам решает, переподключаться ли
+	Disconnect
+)
+
+// Stats счётчики хаба
+type Stats struct {
+	Users   int64 `json:"users"`
+	Clients int64 `json:"clients"`
+	// Dropped сообщения, выброшенные из-за полного буфера клиента
+	Dropped int64 `json:"dropped"`
+	// Disconnected клиенты, отключённые из-за полного буфера
+	Disconnected int64 `json:"disconnected"`
+}
@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// OpenWS подключение к шлюзу уведомлений. Начальные подписки можно передать
+// в query: ?topic=bot_status&topic=leaderboard_change&game_slug=pong,
+// дальше клиент присылает команды {"action":"subscribe","topic":"...","game_slug":"..."},
+// на каждую приходит subscribed/unsubscribed или error.
+// С ?since=<seq> сначала придут сохранённые сообщения после этого seq
+func (h *Hub) OpenWS(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "OpenWS")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	subs, ok := parseSubscriptions(r)
+	if !ok {
+		errWriter.WriteValidationError(&utils.ValidationError{
+			"topic": utils.ErrInvalid.Error(),
+		})
+		return
+	}
+
+	h.Serve(w, r, subs, false)
+}
+
+// parseSubscriptions подписки из ?topic=...&topic=...&game_slug=...
+func parseSubscriptions(r *http.Request) ([]Subscription, bool) {
+	query := r.URL.Query()
+	gameSlug := query.Get("game_slug")
+	subs := make([]Subscription, 0, len(query["topic"]))
+	for _, topic := range query["topic"] {
+		if !Topic(topic).Valid() {
+			return nil, false
+		}
+		subs = append(subs, Subscription{Topic: Topic(topic), GameSlug: gameSlug})
+	}
+
+	return subs, true
+}
+
+// skipReplayed живое сообщение уже ушло клиенту в replay
+func skipReplayed(env *Envelope, lastSeq int64) bool {
+	return env.Seq != 0 && env.Seq <= lastSeq
+}
+
+// parseSeq курсор since или Last-Event-ID, пустой -- 0
+func parseSeq(raw string) (int64, bool) {
+	if raw == "" {
+		return 0, true
+	}
+
+	seq, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false
+	}
+
+	return seq, true
+}
+
+// Serve поднимает websocket и регистрирует клиента в хабе, для хендлеров
+// других пакетов, которым нужен сокет с заранее известными подписками
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, subs []Subscription, legacy bool) {
+	logger := utils.GetLogger(r, "Serve")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := users.SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	since, ok := parseSeq(r.URL.Query().Get("since"))
+	if !ok {
+		errWriter.WriteValidationError(&utils.ValidationError{
+			"since": utils.ErrInvalid.Error(),
+		})
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true // мы уже прошли слой CORS
+		},
+	}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade сам ответил клиенту
+		logger.Warn(errors.Wrap(err, "upgrade to websocket error"))
+		return
+	}
+
+	client := NewClient(h, c, uuid.New().String(), info.ID, subs)
+	client.Legacy = legacy
+	h.register <- client
+
+	// историю читаем после регистрации, чтобы между ней и живыми сообщениями не было дыры
+	replay, err := h.Replay(client, since)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "notify replay error"))
+	}
+
+	go client.WriteMessages(replay)
+	go client.WaitForClose()
+}
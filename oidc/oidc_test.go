@@ -0,0 +1,116 @@
+package oidc_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/oidc"
+	"github.com/go-park-mail-ru/2019_1_HotCode/oidc/oidctest"
+)
+
+// authorize проходит /authorize как браузер и возвращает код из редиректа
+func authorize(t *testing.T, p *oidc.Provider, state, verifier string) string {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(p.AuthCodeURL(state, verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("state") != state {
+		t.Fatalf("state must be returned as is, got %s", location)
+	}
+
+	return location.Query().Get("code")
+}
+
+func TestFlow(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer("warscript", "secret")
+	defer idp.Close()
+	idp.SetUser(map[string]interface{}{
+		"sub":                "42",
+		"preferred_username": "student",
+		"email":              "student@bmstu.ru",
+		"email_verified":     true,
+	})
+
+	p, err := oidc.NewProvider(idp.Config("university", "http://localhost/v1/auth/university/callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// без верного verifier код не обменять, и второй раз он уже не сработает
+	code := authorize(t, p, "state", verifier)
+	if _, err = p.Exchange(code, "stolen"); err == nil {
+		t.Fatal("exchange without verifier must fail")
+	}
+	if _, err = p.Exchange(code, verifier); err == nil {
+		t.Fatal("code must be single use")
+	}
+
+	code = authorize(t, p, "state", verifier)
+	token, err := p.Exchange(code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := p.UserInfo(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := oidc.Identity{Subject: "42", Username: "student", Email: "student@bmstu.ru", EmailVerified: true}
+	if *identity != expected {
+		t.Fatalf("expected %+v, got %+v", expected, identity)
+	}
+}
+
+func TestClaimMapping(t *testing.T) {
+	t.Parallel()
+
+	idp := oidctest.NewServer("warscript", "secret")
+	defer idp.Close()
+	// так отвечает api.github.com/user
+	idp.SetUser(map[string]interface{}{
+		"id":    12345678901,
+		"login": "octocat",
+	})
+
+	cfg := idp.Config("github", "http://localhost/v1/auth/github/callback")
+	cfg.SubjectClaim = "id"
+	cfg.UsernameClaim = "login"
+	p, err := oidc.NewProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, _ := oidc.NewVerifier()
+	token, err := p.Exchange(authorize(t, p, "s", verifier), verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := p.UserInfo(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "12345678901" || identity.Username != "octocat" {
+		t.Fatalf("wrong identity %+v", identity)
+	}
+}
@@ -0,0 +1,162 @@
+// Package password хеширует и проверяет пароли.
+// Хеш сам описывает алгоритм и параметры, поэтому их можно менять,
+// не ломая старые хеши: они пересчитываются при следующем входе
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Argon2id алгоритм по умолчанию
+	Argon2id = "argon2id"
+	// Bcrypt старый алгоритм, поддерживается ради существующих хешей
+	Bcrypt = "bcrypt"
+)
+
+// Config параметры хеширования новых паролей
+type Config struct {
+	Algorithm string
+
+	// параметры argon2id, память в KiB
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+
+	BcryptCost int
+}
+
+// DefaultConfig параметры по умолчанию, рекомендованные RFC 9106 для ограниченной памяти
+func DefaultConfig() Config {
+	return Config{
+		Algorithm:  Argon2id,
+		Time:       3,
+		Memory:     64 * 1024,
+		Threads:    2,
+		KeyLen:     32,
+		SaltLen:    16,
+		BcryptCost: 12,
+	}
+}
+
+// Validate проверяет, что параметрами можно пользоваться
+func (c Config) Validate() error {
+	switch c.Algorithm {
+	case Argon2id:
+		if c.Time == 0 || c.Memory < 8*uint32(c.Threads) || c.Threads == 0 || c.KeyLen < 16 || c.SaltLen < 8 {
+			return errors.New("wrong argon2id params")
+		}
+	case Bcrypt:
+		if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+			return errors.Errorf("bcrypt cost must be in [%d, %d]", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return errors.Errorf("unknown algorithm %q", c.Algorithm)
+	}
+
+	return nil
+}
+
+// Hasher хеширует пароли с заданными параметрами
+type Hasher struct {
+	Config Config
+}
+
+var b64 = base64.RawStdEncoding
+
+// BcryptMaxBytes длиннее bcrypt пароль не принимает, причём в байтах, а не в символах
+const BcryptMaxBytes = 72
+
+// Hash хеширует пароль текущим алгоритмом.
+// Слишком длинный для bcrypt пароль -- utils.ErrTooLong, это ошибка валидации
+func (h *Hasher) Hash(password string) ([]byte, error) {
+	c := h.Config
+	if c.Algorithm == Bcrypt {
+		if len(password) > BcryptMaxBytes {
+			return nil, errors.Wrapf(utils.ErrTooLong, "bcrypt accepts up to %d bytes", BcryptMaxBytes)
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), c.BcryptCost)
+		if err != nil {
+			return nil, errors.Wrap(err, "bcrypt hash error")
+		}
+
+		return hash, nil
+	}
+
+	salt := make([]byte, c.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "salt generate error")
+	}
+
+	key := argon2.IDKey([]byte(password), salt, c.Time, c.Memory, c.Threads, c.KeyLen)
+	// формат PHC, как у reference-реализации argon2
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, c.Memory, c.Time, c.Threads, b64.EncodeToString(salt), b64.EncodeToString(key))), nil
+}
+
+// Verify проверяет пароль. needsRehash -- пароль верный,
+// но хеш посчитан со старыми параметрами и его стоит пересчитать
+func (h *Hasher) Verify(hash []byte, password string) (ok bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(string(hash), "$argon2id$"):
+		return h.verifyArgon2id(string(hash), password)
+	case strings.HasPrefix(string(hash), "$2"):
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			return false, false
+		}
+
+		cost, err := bcrypt.Cost(hash)
+		return true, err != nil || h.Config.Algorithm != Bcrypt || cost != h.Config.BcryptCost
+	}
+
+	return false, false
+}
+
+func (h *Hasher) verifyArgon2id(hash, password string) (bool, bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, false
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return false, false
+	}
+
+	c := h.Config
+	return true, c.Algorithm != Argon2id || memory != c.Memory || time != c.Time || threads != c.Threads ||
+		uint32(len(key)) != c.KeyLen || uint32(len(salt)) != c.SaltLen
+}
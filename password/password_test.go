@@ -0,0 +1,122 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// дешёвые параметры, чтобы тесты не тормозили
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Time = 1
+	cfg.Memory = 64
+	cfg.Threads = 1
+	cfg.BcryptCost = bcrypt.MinCost
+	return cfg
+}
+
+func TestArgon2id(t *testing.T) {
+	t.Parallel()
+
+	h := &Hasher{Config: testConfig()}
+	hash, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("unexpected hash format: %s", hash)
+	}
+
+	if ok, rehash := h.Verify(hash, "correct horse"); !ok || rehash {
+		t.Fatalf("expected ok without rehash, got %v %v", ok, rehash)
+	}
+	if ok, _ := h.Verify(hash, "battery staple"); ok {
+		t.Fatal("wrong password accepted")
+	}
+
+	// параметры подняли -- старый хеш надо пересчитать
+	stronger := &Hasher{Config: testConfig()}
+	stronger.Config.Time = 2
+	if ok, rehash := stronger.Verify(hash, "correct horse"); !ok || !rehash {
+		t.Fatalf("expected ok with rehash, got %v %v", ok, rehash)
+	}
+}
+
+func TestBcryptMigration(t *testing.T) {
+	t.Parallel()
+
+	// так хешировались пароли раньше
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Hasher{Config: testConfig()}
+	if ok, rehash := h.Verify(legacy, "correct horse"); !ok || !rehash {
+		t.Fatalf("legacy bcrypt must be accepted and rehashed, got %v %v", ok, rehash)
+	}
+	if ok, _ := h.Verify(legacy, "battery staple"); ok {
+		t.Fatal("wrong password accepted")
+	}
+
+	h.Config.Algorithm = Bcrypt
+	if ok, rehash := h.Verify(legacy, "correct horse"); !ok || rehash {
+		t.Fatalf("bcrypt with same cost must not be rehashed, got %v %v", ok, rehash)
+	}
+
+	for _, hash := range []string{"", "plain", "$argon2id$v=19$m=64,t=1,p=1$bad", "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5"} {
+		if ok, _ := h.Verify([]byte(hash), ""); ok {
+			t.Fatalf("broken hash %q accepted", hash)
+		}
+	}
+}
+
+// TestBcryptMaxBytes bcrypt считает байты: кириллический пароль упирается в предел раньше MaxLength
+func TestBcryptMaxBytes(t *testing.T) {
+	t.Parallel()
+
+	h := &Hasher{Config: testConfig()}
+	h.Config.Algorithm = Bcrypt
+	long := strings.Repeat("ж", BcryptMaxBytes/2+1)
+	if _, err := h.Hash(long); errors.Cause(err) != utils.ErrTooLong {
+		t.Fatalf("expected too long error, got %v", err)
+	}
+	if _, err := h.Hash(strings.Repeat("ж", BcryptMaxBytes/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// у argon2id такого предела нет
+	h.Config.Algorithm = Argon2id
+	if _, err := h.Hash(long); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckStrength(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		password string
+		username string
+		expected error
+	}{
+		{"short", "", utils.ErrTooShort},
+		{strings.Repeat("x", MaxLength) + "y", "", utils.ErrTooLong},
+		{"Password1", "", utils.ErrWeak},
+		{"zzzzzzzzzz", "", utils.ErrWeak},
+		{"golang_rulez", "Golang", utils.ErrWeak},
+		{"пароль на русском", "", nil},
+		{"correct horse", "golang", nil},
+	}
+
+	for _, c := range cases {
+		if err := CheckStrength(c.password, c.username); err != c.expected {
+			t.Fatalf("%q: expected %v, got %v", c.password, c.expected, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package password
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+)
+
+const (
+	// MinLength минимальная длина пароля в символах
+	MinLength = 8
+	// MaxLength ограничивает длину, чтобы хеширование не стало способом положить сервер.
+	// Для bcrypt предел ниже, см. BcryptMaxBytes
+	MaxLength = 128
+)
+
+// самые частые пароли из утечек, которые проходят по длине
+var common = map[string]struct{}{
+	"password":   {},
+	"password1":  {},
+	"12345678":   {},
+	"123456789":  {},
+	"1234567890": {},
+	"qwertyuiop": {},
+	"qwerty123":  {},
+	"1q2w3e4r":   {},
+	"1qaz2wsx":   {},
+	"iloveyou":   {},
+	"sunshine":   {},
+	"princess":   {},
+	"football":   {},
+	"baseball":   {},
+	"welcome1":   {},
+	"abc12345":   {},
+	"passw0rd":   {},
+	"qwertyui":   {},
+	"11111111":   {},
+	"00000000":   {},
+	"zaq12wsx":   {},
+	"warscript":  {},
+}
+
+// CheckStrength проверяет, что пароль не угадать по словарю.
+// Возвращает ошибку для ValidationError или nil
+func CheckStrength(password, username string) error {
+	length := utf8.RuneCountInString(password)
+	if length < MinLength {
+		return utils.ErrTooShort
+	}
+	if length > MaxLength {
+		return utils.ErrTooLong
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := common[lower]; ok {
+		return utils.ErrWeak
+	}
+
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return utils.ErrWeak
+	}
+
+	// aaaaaaaa и подобные
+	first, _ := utf8.DecodeRuneInString(password)
+	if strings.Count(password, string(first)) == length {
+		return utils.ErrWeak
+	}
+
+	return nil
+}
@@ -12,33 +12,58 @@ const (
 	amqpPattern = "amqp://%s:%s@%s:%s/"
 )
 
-var conn *amqp.Connection
-var Channel *amqp.Channel
+// Queue соединение с RabbitMQ и канал поверх него
+type Queue struct {
+	conn    *amqp.Connection
+	Channel *amqp.Channel
+}
 
-func Connect(dbUser, dbPass, dbHost, dbPort string) error {
-	var err error
-	_, err = strconv.ParseInt(dbPort, 10, 16)
+func Connect(dbUser, dbPass, dbHost, dbPort string) (*Queue, error) {
+	_, err := strconv.ParseInt(dbPort, 10, 16)
 	if err != nil {
-		return errors.Wrap(err, "port int parse error")
+		return nil, errors.Wrap(err, "port int parse error")
 	}
 
-	conn, err = amqp.Dial(fmt.Sprintf(amqpPattern, dbUser, dbPass, dbHost, dbPort))
+	q := &Queue{}
+	q.conn, err = amqp.Dial(fmt.Sprintf(amqpPattern, dbUser, dbPass, dbHost, dbPort))
 	if err != nil {
-		return errors.Wrap(err, "failed to connect to RabbitMQ")
+		return nil, errors.Wrap(err, "failed to connect to RabbitMQ")
 	}
 
-	Channel, err = conn.Channel()
+	q.Channel, err = q.conn.Channel()
 	if err != nil {
-		return errors.Wrap(err, "failed to open a channel")
+		q.conn.Close()
+		return nil, errors.Wrap(err, "failed to open a channel")
+	}
+
+	return q, nil
+}
+
+// Ping жив ли connection: amqp сам шлёт heartbeat и закрывает его, если сервер пропал
+func (q *Queue) Ping() error {
+	if q.conn.IsClosed() {
+		return errors.New("connection is closed")
 	}
 
 	return nil
 }
 
-func Close() error {
-	if err := Channel.Close(); err != nil {
+// Inspect сообщения и подписчики очереди name. Канал отдельный:
+// ошибка на несуществующей очереди закрывает канал, рабочий ломать нельзя
+func (q *Queue) Inspect(name string) (amqp.Queue, error) {
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return amqp.Queue{}, errors.Wrap(err, "failed to open a channel")
+	}
+	defer ch.Close()
+
+	return ch.QueueInspect(name)
+}
+
+func (q *Queue) Close() error {
+	if err := q.Channel.Close(); err != nil {
 		return err
 	}
 
-	return conn.Close()
+	return q.conn.Close()
 }
@@ -0,0 +1,100 @@
+// Package ratelimit ограничивает частоту запросов для каждого клиента отдельно.
+// Состояние лежит в redis, поэтому бюджет общий для всех реплик;
+// если redis недоступен, считаем в памяти процесса
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy лимит для ручки
+type Policy struct {
+	// Name отделяет бюджеты разных ручек друг от друга
+	Name string
+	// Requests сколько запросов можно сделать за Per
+	Requests int64
+	Per      time.Duration
+	// Burst сколько запросов можно сделать подряд, по умолчанию Requests
+	Burst int64
+}
+
+func (p Policy) interval() time.Duration {
+	return p.Per / time.Duration(p.Requests)
+}
+
+func (p Policy) burst() int64 {
+	if p.Burst > 0 {
+		return p.Burst
+	}
+
+	return p.Requests
+}
+
+// KeyFunc по запросу определяет, чей это бюджет
+type KeyFunc func(r *http.Request) string
+
+// Limiter раздаёт middleware с лимитами
+type Limiter struct {
+	Store    Store
+	Fallback Store
+	Key      KeyFunc
+}
+
+// NewLimiter лимитер, который при недоступности store считает в памяти
+func NewLimiter(store Store, key KeyFunc) *Limiter {
+	return &Limiter{
+		Store:    store,
+		Fallback: NewMemoryStore(),
+		Key:      key,
+	}
+}
+
+func (l *Limiter) allow(key string, p Policy) (*Result, error) {
+	result, err := l.Store.Allow(key, p)
+	if err == nil || l.Fallback == nil {
+		return result, err
+	}
+
+	log.WithField("method", "ratelimit.Limiter").
+		Warn(errors.Wrap(err, "rate limit store is unavailable, using fallback"))
+	return l.Fallback.Allow(key, p)
+}
+
+// Limit middleware с лимитом p на клиента.
+// Чтобы ключом был юзер, а не IP, оборачивать нужно внутри WithAuthentication
+//nolint: interfacer
+func (l *Limiter) Limit(next http.HandlerFunc, p Policy) http.HandlerFunc {
+	policyHeader := strconv.FormatInt(p.burst(), 10) + ";w=" + strconv.FormatInt(ceilSeconds(p.Per), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetLogger(r, "Limit")
+		key := p.Name + ":" + l.Key(r)
+
+		result, err := l.allow(key, p)
+		if err != nil {
+			utils.NewErrorResponseWriter(w, logger).
+				WriteError(http.StatusInternalServerError, errors.Wrap(err, "rate limit error"))
+			return
+		}
+
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.FormatInt(p.burst(), 10))
+		header.Set("RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+		header.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(result.ResetAfter), 10))
+		header.Set("RateLimit-Policy", policyHeader)
+		if !result.Allowed {
+			header.Set("Retry-After", strconv.FormatInt(ceilSeconds(result.RetryAfter), 10))
+			utils.NewErrorResponseWriter(w, logger).
+				WriteWarn(http.StatusTooManyRequests, errors.Errorf("too many requests for %s", key))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
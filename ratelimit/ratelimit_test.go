@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// чтобы не заваливать всё логами
+	log.SetLevel(log.PanicLevel)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+type brokenStore struct{}
+
+func (brokenStore) Allow(key string, p Policy) (*Result, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestGCRA(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	store := newMemoryStore(clock, memoryStoreSize)
+	p := Policy{Name: "test", Requests: 2, Per: time.Second, Burst: 3}
+
+	// сначала можно выбрать весь burst
+	for i := int64(2); i >= 0; i-- {
+		result, _ := store.Allow("client", p)
+		if !result.Allowed || result.Remaining != i {
+			t.Fatalf("expected allowed with %d remaining, got %+v", i, result)
+		}
+	}
+
+	result, _ := store.Allow("client", p)
+	if result.Allowed || result.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("expected denied for 500ms, got %+v", result)
+	}
+
+	// у другого клиента свой бюджет
+	if result, _ = store.Allow("other", p); !result.Allowed {
+		t.Fatalf("other client must be allowed, got %+v", result)
+	}
+
+	// дальше бюджет восстанавливается со скоростью Requests/Per
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	if result, _ = store.Allow("client", p); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected allowed with 0 remaining, got %+v", result)
+	}
+	if result, _ = store.Allow("client", p); result.Allowed {
+		t.Fatalf("expected denied, got %+v", result)
+	}
+
+	clock.now = clock.now.Add(10 * time.Second)
+	if result, _ = store.Allow("client", p); !result.Allowed || result.Remaining != 2 {
+		t.Fatalf("expected full budget, got %+v", result)
+	}
+
+	// в полном хранилище вытесняется давно не приходивший ключ, а не свежий
+	small := newMemoryStore(clock, 2)
+	small.Allow("old", p)
+	for i := 0; i < 3; i++ {
+		small.Allow("recent", p)
+	}
+	small.Allow("old", p)
+	small.Allow("new", p)
+	if small.lru.Len() != 2 {
+		t.Fatalf("expected 2 keys, got %d", small.lru.Len())
+	}
+	if result, _ = small.Allow("recent", p); result.Remaining != 2 {
+		t.Fatalf("evicted key must get full budget, got %+v", result)
+	}
+	if result, _ = small.Allow("new", p); result.Remaining != 1 {
+		t.Fatalf("recent key must keep its budget, got %+v", result)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	limiter := &Limiter{
+		Store:    brokenStore{},
+		Fallback: newMemoryStore(clock, memoryStoreSize),
+		Key: func(r *http.Request) string {
+			return r.Header.Get("X-Client")
+		},
+	}
+	h := limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, Policy{Name: "test", Requests: 1, Per: time.Minute})
+
+	request := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Client", client)
+		resp := httptest.NewRecorder()
+		h(resp, req)
+		return resp
+	}
+
+	resp := request("a")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+	expected := map[string]string{
+		"RateLimit-Limit":     "1",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "60",
+		"RateLimit-Policy":    "1;w=60",
+	}
+	for header, value := range expected {
+		if resp.Header().Get(header) != value {
+			t.Fatalf("expected %s: %s, got %q", header, value, resp.Header().Get(header))
+		}
+	}
+
+	resp = request("a")
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected 429 with Retry-After 60, got %d %q", resp.Code, resp.Header().Get("Retry-After"))
+	}
+
+	if resp = request("b"); resp.Code != http.StatusOK {
+		t.Fatalf("expected 200 for another client, got %d", resp.Code)
+	}
+}
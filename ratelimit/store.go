@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// Result решение по одному запросу
+type Result struct {
+	Allowed bool
+	// Remaining сколько запросов ещё можно сделать прямо сейчас
+	Remaining int64
+	// RetryAfter через сколько можно повторить отклонённый запрос
+	RetryAfter time.Duration
+	// ResetAfter через сколько бюджет восстановится полностью
+	ResetAfter time.Duration
+}
+
+// Store хранилище состояния лимитов
+type Store interface {
+	Allow(key string, p Policy) (*Result, error)
+}
+
+// gcra считает решение по generic cell rate algorithm.
+// tat -- theoretical arrival time: момент, к которому бюджет восстановится полностью
+func gcra(now, tat time.Time, p Policy) (*Result, time.Time) {
+	interval := p.interval()
+	tolerance := interval * time.Duration(p.burst())
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTAT := tat.Add(interval)
+	allowAt := newTAT.Add(-tolerance)
+	if now.Before(allowAt) {
+		return &Result{
+			Allowed:    false,
+			Remaining:  0,
+			RetryAfter: allowAt.Sub(now),
+			ResetAfter: tat.Sub(now),
+		}, tat
+	}
+
+	return &Result{
+		Allowed:    true,
+		Remaining:  int64((tolerance - newTAT.Sub(now)) / interval),
+		ResetAfter: newTAT.Sub(now),
+	}, newTAT
+}
+
+// gcraScript тот же алгоритм, что и gcra, но атомарно в redis.
+// Время берём у redis, чтобы у всех реплик оно было одно
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+local key = KEYS[1]
+local interval = tonumber(ARGV[1])
+local tolerance = interval * tonumber(ARGV[2])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call('GET', key))
+if tat == nil or tat < now then
+	tat = now
+end
+
+local new_tat = tat + interval
+local allow_at = new_tat - tolerance
+if now < allow_at then
+	return {0, 0, allow_at - now, tat - now}
+end
+
+redis.call('SET', key, new_tat, 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((tolerance - (new_tat - now)) / interval), 0, new_tat - now}
+`)
+
+// RedisStore общий для всех реплик лимит
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore см. RedisStore
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{
+		client: client,
+	}
+}
+
+// Allow решает, пропустить ли запрос
+func (rs *RedisStore) Allow(key string, p Policy) (*Result, error) {
+	reply, err := gcraScript.Run(rs.client, []string{"ratelimit:" + key},
+		int64(p.interval()/time.Microsecond), p.burst()).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis gcra error")
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return nil, errors.Errorf("unexpected gcra reply %v", reply)
+	}
+
+	nums := make([]int64, len(values))
+	for i, v := range values {
+		if nums[i], ok = v.(int64); !ok {
+			return nil, errors.Errorf("unexpected gcra reply %v", reply)
+		}
+	}
+
+	return &Result{
+		Allowed:    nums[0] == 1,
+		Remaining:  nums[1],
+		RetryAfter: time.Duration(nums[2]) * time.Microsecond,
+		ResetAfter: time.Duration(nums[3]) * time.Microsecond,
+	}, nil
+}
+
+// Clock источник времени, в тестах подменяется
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// memoryStoreSize сколько ключей держим, дальше вытесняем давно не приходивших
+const memoryStoreSize = 10000
+
+// MemoryStore лимит в памяти процесса: у каждой реплики свой бюджет.
+// Ключи лежат в LRU ограниченного размера, так что каждый запрос -- O(1).
+// Вытесненный ключ получает бюджет заново, это цена ограниченной памяти
+type MemoryStore struct {
+	Clock Clock
+
+	mu   sync.Mutex
+	size int
+	// lru от недавних к давним, значения -- *memoryEntry
+	lru  *list.List
+	tats map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key string
+	tat time.Time
+}
+
+// NewMemoryStore создаёт хранилище с настоящими часами
+func NewMemoryStore() *MemoryStore {
+	return newMemoryStore(realClock{}, memoryStoreSize)
+}
+
+func newMemoryStore(clock Clock, size int) *MemoryStore {
+	return &MemoryStore{
+		Clock: clock,
+		size:  size,
+		lru:   list.New(),
+		tats:  make(map[string]*list.Element),
+	}
+}
+
+// Allow решает, пропустить ли запрос
+func (ms *MemoryStore) Allow(key string, p Policy) (*Result, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.Clock.Now()
+	if elem, ok := ms.tats[key]; ok {
+		entry := elem.Value.(*memoryEntry)
+		result, tat := gcra(now, entry.tat, p)
+		entry.tat = tat
+		ms.lru.MoveToFront(elem)
+		return result, nil
+	}
+
+	result, tat := gcra(now, time.Time{}, p)
+	if ms.lru.Len() >= ms.size {
+		oldest := ms.lru.Back()
+		ms.lru.Remove(oldest)
+		delete(ms.tats, oldest.Value.(*memoryEntry).key)
+	}
+	ms.tats[key] = ms.lru.PushFront(&memoryEntry{key: key, tat: tat})
+	return result, nil
+}
+
+// ceilSeconds секунды для заголовков, с округлением вверх
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,84 @@
+package social
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// FeedCacheTTL сколько по умолчанию живёт закешированная страница ленты
+const FeedCacheTTL = 30 * time.Second
+
+// FeedCache кеш готовых страниц ленты
+type FeedCache interface {
+	// Get nil без ошибки, если страницы в кеше нет
+	Get(userID int64, page string) ([]byte, error)
+	Set(userID int64, page string, data []byte) error
+	// Invalidate сбрасывает все страницы юзера, например после подписки
+	Invalidate(userID int64) error
+}
+
+// RedisFeedCache implementation of FeedCache. Страницы лежат под ключами с версией юзера,
+// Invalidate увеличивает версию, а старые страницы просто дотухают по TTL
+type RedisFeedCache struct {
+	Redis *redis.Client
+	// TTL новые события появляются в ленте не позже чем через это время
+	TTL time.Duration
+}
+
+func feedVersionKey(userID int64) string {
+	return "feed_version:" + strconv.FormatInt(userID, 10)
+}
+
+func (fc *RedisFeedCache) pageKey(userID int64, page string) (string, error) {
+	version, err := fc.Redis.Get(feedVersionKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrap(err, "redis get feed version error")
+	}
+
+	return "feed:" + strconv.FormatInt(userID, 10) + ":" + version + ":" + page, nil
+}
+
+// Get страница из кеша
+func (fc *RedisFeedCache) Get(userID int64, page string) ([]byte, error) {
+	key, err := fc.pageKey(userID, page)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fc.Redis.Get(key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "redis get feed page error")
+	}
+
+	return data, nil
+}
+
+// Set кладёт страницу в кеш
+func (fc *RedisFeedCache) Set(userID int64, page string, data []byte) error {
+	key, err := fc.pageKey(userID, page)
+	if err != nil {
+		return err
+	}
+
+	if err = fc.Redis.Set(key, data, fc.TTL).Err(); err != nil {
+		return errors.Wrap(err, "redis set feed page error")
+	}
+
+	return nil
+}
+
+// Invalidate сбрасывает кеш ленты юзера
+func (fc *RedisFeedCache) Invalidate(userID int64) error {
+	if err := fc.Redis.Incr(feedVersionKey(userID)).Err(); err != nil {
+		return errors.Wrap(err, "redis incr feed version error")
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package social
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handler ручки подписок и ленты, собирается в main
+type Handler struct {
+	Follows FollowAccessObject
+	Feed    FeedCache
+}
+
+func infoUser(id pgtype.Int8, username pgtype.Varchar, photo pgtype.UUID, active bool) users.InfoUser {
+	photoUUID := ""
+	if photo.Status == pgtype.Present {
+		photoUUID = uuid.UUID(photo.Bytes).String()
+	}
+
+	return users.InfoUser{
+		BasicUser: users.BasicUser{
+			Username:  username.String,
+			PhotoUUID: photoUUID,
+		},
+		ID:     id.Int,
+		Active: active,
+	}
+}
+
+// Follow подписывает текущего юзера на user_id
+func (h *Handler) Follow(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "Follow")
+	h.changeFollow(w, r, logger, h.Follows.Follow)
+}
+
+// Unfollow отписывает текущего юзера от user_id
+func (h *Handler) Unfollow(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "Unfollow")
+	h.changeFollow(w, r, logger, h.Follows.Unfollow)
+}
+
+func (h *Handler) changeFollow(w http.ResponseWriter, r *http.Request, logger *log.Entry,
+	change func(int64, int64) error) {
+
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := users.SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format user_id"))
+		return
+	}
+
+	if userID == info.ID {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.New("can not follow yourself"))
+		return
+	}
+
+	if err = change(info.ID, userID); err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "user or follow not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "change follow method error"))
+		}
+		return
+	}
+
+	// иначе до конца TTL лента покажет старый набор подписок
+	if err = h.Feed.Invalidate(info.ID); err != nil {
+		logger.Errorf("feed cache invalidate error: %+v", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetFollowers кто подписан на юзера
+func (h *Handler) GetFollowers(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GetFollowers")
+	getFollowList(w, r, logger, h.Follows.GetFollowers)
+}
+
+// GetFollowing на кого подписан юзер
+func (h *Handler) GetFollowing(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GetFollowing")
+	getFollowList(w, r, logger, h.Follows.GetFollowing)
+}
+
+func getFollowList(w http.ResponseWriter, r *http.Request, logger *log.Entry,
+	list func(int64, int, int) ([]*users.UserModel, error)) {
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format user_id"))
+		return
+	}
+
+	limit, offset := PageLimitDefault, 0
+	valErr := utils.ValidationError{}
+	query := r.URL.Query()
+	if !utils.ParseIntParam(query, "limit", &limit, 1, PageLimitMax) {
+		valErr["limit"] = utils.ErrInvalid.Error()
+	}
+	if !utils.ParseIntParam(query, "offset", &offset, 0, math.MaxInt32) {
+		valErr["offset"] = utils.ErrInvalid.Error()
+	}
+	if len(valErr) != 0 {
+		errWriter.WriteValidationError(&valErr)
+		return
+	}
+
+	models, err := list(userID, limit, offset)
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get follow list method error"))
+		return
+	}
+
+	result := make([]*users.InfoUser, len(models))
+	for i, u := range models {
+		user := infoUser(u.ID, u.Username, u.PhotoUUID, u.Active.Bool)
+		result[i] = &user
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, result)
+}
+
+// GetFeed лента событий тех, на кого подписан текущий юзер
+func (h *Handler) GetFeed(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GetFeed")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := users.SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	before, limit, valErr := parseFeedParams(r.URL.Query())
+	if valErr != nil {
+		errWriter.WriteValidationError(valErr)
+		return
+	}
+
+	page := strconv.FormatInt(before, 10) + ":" + strconv.Itoa(limit)
+	// кеш только ускоряет: если redis недоступен, собираем ленту из базы
+	data, err := h.Feed.Get(info.ID, page)
+	if err != nil {
+		logger.Errorf("feed cache get error: %+v", err)
+	}
+
+	if data == nil {
+		feed, feedErr := h.buildFeedPage(info.ID, before, limit)
+		if feedErr != nil {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(feedErr, "get feed method error"))
+			return
+		}
+
+		if data, err = json.Marshal(feed); err != nil {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "feed marshal error"))
+			return
+		}
+
+		if err = h.Feed.Set(info.ID, page, data); err != nil {
+			logger.Errorf("feed cache set error: %+v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(data); err != nil {
+		logger.Warn(errors.Wrap(err, "write feed error"))
+	}
+}
+
+func parseFeedParams(query url.Values) (before int64, limit int, valErr *utils.ValidationError) {
+	limit = PageLimitDefault
+	errs := utils.ValidationError{}
+	if !utils.ParseIntParam(query, "limit", &limit, 1, PageLimitMax) {
+		errs["limit"] = utils.ErrInvalid.Error()
+	}
+
+	if raw := query.Get("before"); raw != "" {
+		var err error
+		if before, err = strconv.ParseInt(raw, 10, 64); err != nil || before <= 0 {
+			errs["before"] = utils.ErrInvalid.Error()
+		}
+	}
+
+	if len(errs) != 0 {
+		return 0, 0, &errs
+	}
+
+	return before, limit, nil
+}
+
+func (h *Handler) buildFeedPage(userID, before int64, limit int) (*FeedPage, error) {
+	models, err := h.Follows.GetFeed(userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &FeedPage{
+		Events: make([]*Event, len(models)),
+	}
+	for i, e := range models {
+		payload := json.RawMessage(`{}`)
+		if e.Payload.Status == pgtype.Present {
+			payload = e.Payload.Bytes
+		}
+
+		feed.Events[i] = &Event{
+			ID:       e.ID.Int,
+			Kind:     e.Kind.String,
+			User:     infoUser(e.UserID, e.Username, e.PhotoUUID, true),
+			GameSlug: e.GameSlug.String,
+			Payload:  payload,
+			Created:  e.Created.Time,
+		}
+	}
+
+	// полная страница -- возможно, есть ещё
+	if len(models) == limit {
+		feed.NextBefore = models[len(models)-1].ID.Int
+	}
+
+	return feed, nil
+}
@@ -0,0 +1,150 @@
+package social
+
+import (
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+)
+
+// FollowAccessObject DAO for follows and activity_events
+type FollowAccessObject interface {
+	// Follow подписка повторно ничего не меняет, на несуществующего юзера -- utils.ErrNotExists
+	Follow(followerID, followeeID int64) error
+	// Unfollow отписка, если подписки не было -- utils.ErrNotExists
+	Unfollow(followerID, followeeID int64) error
+	GetFollowers(userID int64, limit, offset int) ([]*users.UserModel, error)
+	GetFollowing(userID int64, limit, offset int) ([]*users.UserModel, error)
+
+	// GetFeed события тех, на кого подписан юзер, с id меньше before (0 -- с самого свежего)
+	GetFeed(userID, before int64, limit int) ([]*EventModel, error)
+	// AddEvent для событий, которые не пишут триггеры базы, например результатов турниров
+	AddEvent(e *EventModel) error
+}
+
+// AccessObject implementation of FollowAccessObject
+type AccessObject struct {
+	DB *pgx.ConnPool
+}
+
+// EventModel model for activity_events table
+type EventModel struct {
+	ID        pgtype.Int8
+	UserID    pgtype.Int8
+	Username  pgtype.Varchar
+	PhotoUUID pgtype.UUID
+	Kind      pgtype.Text
+	GameID    pgtype.Int8
+	GameSlug  pgtype.Text
+	Payload   pgtype.JSONB
+	Created   pgtype.Timestamptz
+}
+
+// Follow подписывает follower на followee
+func (so *AccessObject) Follow(followerID, followeeID int64) error {
+	_, err := so.DB.Exec(`INSERT INTO follows (follower_id, followee_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;`, followerID, followeeID)
+	if err != nil {
+		// foreign_key_violation
+		if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23503" {
+			return utils.ErrNotExists
+		}
+
+		return errors.Wrap(err, "follow error")
+	}
+
+	return nil
+}
+
+// Unfollow отписывает follower от followee
+func (so *AccessObject) Unfollow(followerID, followeeID int64) error {
+	tag, err := so.DB.Exec(`DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2;`,
+		followerID, followeeID)
+	if err != nil {
+		return errors.Wrap(err, "unfollow error")
+	}
+
+	if tag.RowsAffected() == 0 {
+		return utils.ErrNotExists
+	}
+
+	return nil
+}
+
+// GetFollowers кто подписан на юзера, свежие подписки первыми
+func (so *AccessObject) GetFollowers(userID int64, limit, offset int) ([]*users.UserModel, error) {
+	return so.getUsers(`SELECT u.id, u.username, u.photo_uuid, u.active FROM follows f
+		JOIN users u ON u.id = f.follower_id
+		WHERE f.followee_id = $1 AND (u.active OR u.banned_until <= now())
+		ORDER BY f.created DESC, u.id OFFSET $2 LIMIT $3;`, userID, offset, limit)
+}
+
+// GetFollowing на кого подписан юзер, свежие подписки первыми
+func (so *AccessObject) GetFollowing(userID int64, limit, offset int) ([]*users.UserModel, error) {
+	return so.getUsers(`SELECT u.id, u.username, u.photo_uuid, u.active FROM follows f
+		JOIN users u ON u.id = f.followee_id
+		WHERE f.follower_id = $1 AND (u.active OR u.banned_until <= now())
+		ORDER BY f.created DESC, u.id OFFSET $2 LIMIT $3;`, userID, offset, limit)
+}
+
+func (so *AccessObject) getUsers(query string, args ...interface{}) ([]*users.UserModel, error) {
+	rows, err := so.DB.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "get follows error")
+	}
+	defer rows.Close()
+
+	list := make([]*users.UserModel, 0)
+	for rows.Next() {
+		u := &users.UserModel{}
+		if err = rows.Scan(&u.ID, &u.Username, &u.PhotoUUID, &u.Active); err != nil {
+			return nil, errors.Wrap(err, "get follows scan error")
+		}
+		list = append(list, u)
+	}
+
+	return list, nil
+}
+
+// GetFeed собирает ленту при чтении: по индексу activity_events (user_id, id DESC)
+// для каждого, на кого подписан юзер
+func (so *AccessObject) GetFeed(userID, before int64, limit int) ([]*EventModel, error) {
+	rows, err := so.DB.Query(`SELECT e.id, e.user_id, u.username, u.photo_uuid,
+		e.kind, e.game_id, g.slug, e.payload, e.created
+		FROM follows f
+		JOIN activity_events e ON e.user_id = f.followee_id
+		JOIN users u ON u.id = e.user_id
+		LEFT JOIN games g ON g.id = e.game_id
+		WHERE f.follower_id = $1 AND ($2 = 0 OR e.id < $2) AND (u.active OR u.banned_until <= now())
+		ORDER BY e.id DESC LIMIT $3;`, userID, before, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "get feed error")
+	}
+	defer rows.Close()
+
+	events := make([]*EventModel, 0)
+	for rows.Next() {
+		e := &EventModel{}
+		err = rows.Scan(&e.ID, &e.UserID, &e.Username, &e.PhotoUUID,
+			&e.Kind, &e.GameID, &e.GameSlug, &e.Payload, &e.Created)
+		if err != nil {
+			return nil, errors.Wrap(err, "get feed scan error")
+		}
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// AddEvent пишет событие, заполняет ID и Created
+func (so *AccessObject) AddEvent(e *EventModel) error {
+	row := so.DB.QueryRow(`INSERT INTO activity_events (user_id, kind, game_id, payload)
+		VALUES ($1, $2, $3, $4) RETURNING id, created;`, &e.UserID, &e.Kind, &e.GameID, &e.Payload)
+	if err := row.Scan(&e.ID, &e.Created); err != nil {
+		return errors.Wrap(err, "add event error")
+	}
+
+	return nil
+}
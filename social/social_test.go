@@ -0,0 +1,397 @@
+package social
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/testutils"
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/jackc/pgx/pgtype"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// чтобы не заваливать всё логами
+	log.SetLevel(log.PanicLevel)
+}
+
+type FollowsTest struct {
+	users     map[int64]string
+	follows   map[int64][]int64 // follower -> followees по порядку подписки
+	events    []*EventModel
+	feedCalls int
+	nextFail  error
+}
+
+func (ft *FollowsTest) setFailure(err error) {
+	ft.nextFail = err
+}
+
+func (ft *FollowsTest) checkFailure() error {
+	err := ft.nextFail
+	ft.nextFail = nil
+	return err
+}
+
+func (ft *FollowsTest) indexOf(followerID, followeeID int64) int {
+	for i, id := range ft.follows[followerID] {
+		if id == followeeID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (ft *FollowsTest) Follow(followerID, followeeID int64) error {
+	if err := ft.checkFailure(); err != nil {
+		return err
+	}
+
+	if _, ok := ft.users[followeeID]; !ok {
+		return utils.ErrNotExists
+	}
+	if ft.indexOf(followerID, followeeID) < 0 {
+		ft.follows[followerID] = append(ft.follows[followerID], followeeID)
+	}
+	return nil
+}
+
+func (ft *FollowsTest) Unfollow(followerID, followeeID int64) error {
+	if err := ft.checkFailure(); err != nil {
+		return err
+	}
+
+	i := ft.indexOf(followerID, followeeID)
+	if i < 0 {
+		return utils.ErrNotExists
+	}
+	ft.follows[followerID] = append(ft.follows[followerID][:i], ft.follows[followerID][i+1:]...)
+	return nil
+}
+
+func (ft *FollowsTest) userModel(id int64) *users.UserModel {
+	return &users.UserModel{
+		ID:       pgtype.Int8{Int: id, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: ft.users[id], Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+}
+
+func page(list []*users.UserModel, limit, offset int) []*users.UserModel {
+	if offset >= len(list) {
+		return []*users.UserModel{}
+	}
+	list = list[offset:]
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+func (ft *FollowsTest) GetFollowers(userID int64, limit, offset int) ([]*users.UserModel, error) {
+	if err := ft.checkFailure(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*users.UserModel, 0)
+	for followerID := int64(1); followerID <= int64(len(ft.users)); followerID++ {
+		if ft.indexOf(followerID, userID) >= 0 {
+			list = append(list, ft.userModel(followerID))
+		}
+	}
+	return page(list, limit, offset), nil
+}
+
+func (ft *FollowsTest) GetFollowing(userID int64, limit, offset int) ([]*users.UserModel, error) {
+	if err := ft.checkFailure(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*users.UserModel, 0)
+	for _, id := range ft.follows[userID] {
+		list = append(list, ft.userModel(id))
+	}
+	return page(list, limit, offset), nil
+}
+
+func (ft *FollowsTest) GetFeed(userID, before int64, limit int) ([]*EventModel, error) {
+	if err := ft.checkFailure(); err != nil {
+		return nil, err
+	}
+	ft.feedCalls++
+
+	feed := make([]*EventModel, 0)
+	for i := len(ft.events) - 1; i >= 0 && len(feed) < limit; i-- {
+		e := ft.events[i]
+		if (before == 0 || e.ID.Int < before) && ft.indexOf(userID, e.UserID.Int) >= 0 {
+			e.Username = pgtype.Varchar{String: ft.users[e.UserID.Int], Status: pgtype.Present}
+			feed = append(feed, e)
+		}
+	}
+	return feed, nil
+}
+
+func (ft *FollowsTest) AddEvent(e *EventModel) error {
+	e.ID = pgtype.Int8{Int: int64(len(ft.events) + 1), Status: pgtype.Present}
+	ft.events = append(ft.events, e)
+	return nil
+}
+
+type FeedCacheTest struct {
+	pages    map[string][]byte
+	versions map[int64]int
+}
+
+func (fc *FeedCacheTest) key(userID int64, page string) string {
+	return strconv.FormatInt(userID, 10) + ":" + strconv.Itoa(fc.versions[userID]) + ":" + page
+}
+
+func (fc *FeedCacheTest) Get(userID int64, page string) ([]byte, error) {
+	return fc.pages[fc.key(userID, page)], nil
+}
+
+func (fc *FeedCacheTest) Set(userID int64, page string, data []byte) error {
+	fc.pages[fc.key(userID, page)] = data
+	return nil
+}
+
+func (fc *FeedCacheTest) Invalidate(userID int64) error {
+	fc.versions[userID]++
+	return nil
+}
+
+// newTestHandler хендлер на свежих заглушках, у каждого теста свой
+func newTestHandler() *Handler {
+	return &Handler{
+		Follows: &FollowsTest{
+			users:   map[int64]string{1: "GDVFox", 2: "Apakhov", 3: "IvanShport"},
+			follows: make(map[int64][]int64),
+		},
+		Feed: &FeedCacheTest{
+			pages:    make(map[string][]byte),
+			versions: make(map[int64]int),
+		},
+	}
+}
+
+func addEvent(h *Handler, userID int64, kind string, payload string) {
+	_ = h.Follows.AddEvent(&EventModel{
+		UserID:   pgtype.Int8{Int: userID, Status: pgtype.Present},
+		Kind:     pgtype.Text{String: kind, Status: pgtype.Present},
+		GameSlug: pgtype.Text{String: "pong", Status: pgtype.Present},
+		Payload:  pgtype.JSONB{Bytes: []byte(payload), Status: pgtype.Present},
+	})
+}
+
+func sessionContext(userID int64) context.Context {
+	return context.WithValue(context.Background(), users.SessionInfoKey, &users.SessionPayload{ID: userID})
+}
+
+func TestFollow(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	cases := []*testutils.Case{
+		{ // подписались
+			ExpectedCode: 200,
+			Method:       "POST",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/2/follow",
+			Function:     h.Follow,
+			Context:      sessionContext(1),
+		},
+		{ // повторно -- ничего не меняется
+			ExpectedCode: 200,
+			Method:       "POST",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/2/follow",
+			Function:     h.Follow,
+			Context:      sessionContext(1),
+		},
+		{
+			ExpectedCode: 200,
+			Method:       "POST",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/2/follow",
+			Function:     h.Follow,
+			Context:      sessionContext(3),
+		},
+		{ // на себя
+			ExpectedCode: 400,
+			ExpectedBody: `{"message":"can not follow yourself"}`,
+			Method:       "POST",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/1/follow",
+			Function:     h.Follow,
+			Context:      sessionContext(1),
+		},
+		{ // нет такого юзера
+			ExpectedCode: 404,
+			ExpectedBody: `{"message":"user or follow not exists: not_exists"}`,
+			Method:       "POST",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/100/follow",
+			Function:     h.Follow,
+			Context:      sessionContext(1),
+		},
+		{ // без сессии
+			ExpectedCode: 401,
+			ExpectedBody: `{"message":"session info is not presented"}`,
+			Method:       "POST",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/2/follow",
+			Function:     h.Follow,
+		},
+		{
+			ExpectedCode: 200,
+			ExpectedBody: `[{"username":"GDVFox","photo_uuid":"","id":1,"active":true},` +
+				`{"username":"IvanShport","photo_uuid":"","id":3,"active":true}]`,
+			Method:   "GET",
+			Pattern:  "/users/{user_id}/followers",
+			Endpoint: "/users/2/followers",
+			Function: h.GetFollowers,
+		},
+		{ // пагинация
+			ExpectedCode: 200,
+			ExpectedBody: `[{"username":"IvanShport","photo_uuid":"","id":3,"active":true}]`,
+			Method:       "GET",
+			Pattern:      "/users/{user_id}/followers",
+			Endpoint:     "/users/2/followers?limit=1&offset=1",
+			Function:     h.GetFollowers,
+		},
+		{
+			ExpectedCode: 400,
+			ExpectedBody: `{"limit":"invalid"}`,
+			Method:       "GET",
+			Pattern:      "/users/{user_id}/followers",
+			Endpoint:     "/users/2/followers?limit=1000",
+			Function:     h.GetFollowers,
+		},
+		{
+			ExpectedCode: 200,
+			ExpectedBody: `[{"username":"Apakhov","photo_uuid":"","id":2,"active":true}]`,
+			Method:       "GET",
+			Pattern:      "/users/{user_id}/following",
+			Endpoint:     "/users/1/following",
+			Function:     h.GetFollowing,
+		},
+		{
+			ExpectedCode: 200,
+			Method:       "DELETE",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/2/follow",
+			Function:     h.Unfollow,
+			Context:      sessionContext(1),
+		},
+		{ // уже отписались
+			ExpectedCode: 404,
+			ExpectedBody: `{"message":"user or follow not exists: not_exists"}`,
+			Method:       "DELETE",
+			Pattern:      "/users/{user_id}/follow",
+			Endpoint:     "/users/2/follow",
+			Function:     h.Unfollow,
+			Context:      sessionContext(1),
+		},
+		{
+			ExpectedCode: 200,
+			ExpectedBody: `[]`,
+			Method:       "GET",
+			Pattern:      "/users/{user_id}/following",
+			Endpoint:     "/users/1/following",
+			Function:     h.GetFollowing,
+		},
+	}
+
+	for i, c := range cases {
+		testutils.RunAPITest(t, i, c)
+	}
+}
+
+func getFeed(t *testing.T, h *Handler, userID int64, query string) *FeedPage {
+	resp := testutils.MakeRequest(sessionContext(userID), http.HandlerFunc(h.GetFeed), "GET", "/feed"+query, nil, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("feed: %d %s", resp.Code, resp.Body.String())
+	}
+
+	feed := &FeedPage{}
+	if err := json.Unmarshal(resp.Body.Bytes(), feed); err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func TestFeed(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+	ft := h.Follows.(*FollowsTest)
+
+	addEvent(h, 2, EventBotVerified, `{"bot_id":1}`)
+	addEvent(h, 3, EventRankChanged, `{"old_rank":5,"new_rank":2,"score":100}`)
+	addEvent(h, 2, EventRankChanged, `{"old_rank":null,"new_rank":1,"score":200}`)
+	addEvent(h, 2, EventTournamentResult, `{"tournament_id":1,"place":1}`)
+
+	if feed := getFeed(t, h, 1, ""); len(feed.Events) != 0 || feed.NextBefore != 0 {
+		t.Fatalf("feed without follows must be empty, got %+v", feed)
+	}
+
+	// подписка через ручку сбрасывает закешированную пустую ленту
+	if err := h.Follows.Follow(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	testutils.RunAPITest(t, 0, &testutils.Case{
+		ExpectedCode: 200,
+		Method:       "POST",
+		Pattern:      "/users/{user_id}/follow",
+		Endpoint:     "/users/3/follow",
+		Function:     h.Follow,
+		Context:      sessionContext(1),
+	})
+
+	first := getFeed(t, h, 1, "?limit=3")
+	if len(first.Events) != 3 || first.Events[0].Kind != EventTournamentResult ||
+		first.Events[0].User.Username != "Apakhov" || first.NextBefore != first.Events[2].ID {
+		t.Fatalf("unexpected first page %+v", first)
+	}
+
+	second := getFeed(t, h, 1, "?limit=3&before="+strconv.FormatInt(first.NextBefore, 10))
+	if len(second.Events) != 1 || second.Events[0].Kind != EventBotVerified || second.NextBefore != 0 {
+		t.Fatalf("unexpected second page %+v", second)
+	}
+	if string(second.Events[0].Payload) != `{"bot_id":1}` {
+		t.Fatalf("unexpected payload %s", second.Events[0].Payload)
+	}
+
+	// повторный запрос отдаётся из кеша
+	calls := ft.feedCalls
+	getFeed(t, h, 1, "?limit=3")
+	if ft.feedCalls != calls {
+		t.Fatal("feed page must be served from cache")
+	}
+
+	testutils.RunAPITest(t, 1, &testutils.Case{
+		ExpectedCode: 400,
+		ExpectedBody: `{"before":"invalid","limit":"invalid"}`,
+		Method:       "GET",
+		Pattern:      "/feed",
+		Endpoint:     "/feed?before=-1&limit=0",
+		Function:     h.GetFeed,
+		Context:      sessionContext(1),
+	})
+
+	ft.setFailure(utils.ErrInternal)
+	testutils.RunAPITest(t, 2, &testutils.Case{
+		ExpectedCode: 500,
+		ExpectedBody: `{"message":"get feed method error: internal server error"}`,
+		Method:       "GET",
+		Pattern:      "/feed",
+		Endpoint:     "/feed?limit=7",
+		Function:     h.GetFeed,
+		Context:      sessionContext(1),
+	})
+}
@@ -0,0 +1,57 @@
+-- события для ленты. Лента собирается при чтении из событий тех, на кого подписан юзер,
+-- поэтому каждое событие пишется один раз, а не в ленту каждого подписчика
+DROP TABLE IF EXISTS "activity_events";
+CREATE TABLE "activity_events"
+(
+	id BIGSERIAL NOT NULL
+		CONSTRAINT activity_events_pk PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	-- bot_verified, rank_changed, tournament_result
+	kind TEXT NOT NULL,
+	game_id BIGINT REFERENCES games (id) ON DELETE CASCADE,
+	payload JSONB NOT NULL DEFAULT '{}',
+	created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX activity_events_user_id_idx ON activity_events (user_id, id DESC);
+
+-- бот прошёл проверку против эталонного
+DROP FUNCTION IF EXISTS activity_bot_verified CASCADE;
+CREATE FUNCTION activity_bot_verified() RETURNS TRIGGER AS $_$
+BEGIN
+INSERT INTO activity_events (user_id, kind, game_id, payload)
+	VALUES (NEW.author_id, 'bot_verified', NEW.game_id, json_build_object('bot_id', NEW.id));
+RETURN NEW;
+END $_$ LANGUAGE 'plpgsql';
+
+CREATE TRIGGER bots_verified_trigger AFTER UPDATE OF is_verified ON bots
+	FOR EACH ROW WHEN (NEW.is_verified AND NOT OLD.is_verified)
+	EXECUTE PROCEDURE activity_bot_verified();
+
+-- очки в users_games пишет не только API, поэтому место считаем в триггере.
+-- Событие только для самого юзера: сдвиг остальных при этом в ленту не попадает
+DROP FUNCTION IF EXISTS activity_rank_changed CASCADE;
+CREATE FUNCTION activity_rank_changed() RETURNS TRIGGER AS $_$
+DECLARE
+	old_rank BIGINT := NULL;
+	new_rank BIGINT;
+BEGIN
+SELECT count(*) + 1 INTO new_rank FROM users_games
+	WHERE game_id = NEW.game_id AND user_id <> NEW.user_id AND score > NEW.score;
+IF TG_OP = 'UPDATE' THEN
+	SELECT count(*) + 1 INTO old_rank FROM users_games
+		WHERE game_id = NEW.game_id AND user_id <> NEW.user_id AND score > OLD.score;
+END IF;
+IF old_rank IS DISTINCT FROM new_rank THEN
+	INSERT INTO activity_events (user_id, kind, game_id, payload)
+		VALUES (NEW.user_id, 'rank_changed', NEW.game_id,
+			json_build_object('old_rank', old_rank, 'new_rank', new_rank, 'score', NEW.score));
+END IF;
+RETURN NEW;
+END $_$ LANGUAGE 'plpgsql';
+
+CREATE TRIGGER users_games_rank_trigger AFTER INSERT OR UPDATE OF score ON users_games
+	FOR EACH ROW EXECUTE PROCEDURE activity_rank_changed();
+
+-- tournament_result пишет тот, кто проводит турнир: user_id участник,
+-- payload {"tournament_id": ..., "place": ...}
@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS "follows";
+CREATE TABLE "follows"
+(
+	follower_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	followee_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	CONSTRAINT follows_pk PRIMARY KEY (follower_id, followee_id),
+	CONSTRAINT follows_self CHECK ( follower_id <> followee_id )
+);
+
+-- по первичному ключу ищем, на кого подписан юзер, по этому -- кто подписан на него
+CREATE INDEX follows_followee_idx ON follows (followee_id, created DESC);
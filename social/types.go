@@ -0,0 +1,40 @@
+package social
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/users"
+)
+
+const (
+	// EventBotVerified бот прошёл проверку, пишет триггер на bots
+	EventBotVerified = "bot_verified"
+	// EventRankChanged изменилось место в игре, пишет триггер на users_games
+	EventRankChanged = "rank_changed"
+	// EventTournamentResult итог турнира, пишется через AddEvent
+	EventTournamentResult = "tournament_result"
+)
+
+const (
+	// PageLimitDefault размер страницы, если limit не передан
+	PageLimitDefault = 20
+	// PageLimitMax больше за раз не отдаём
+	PageLimitMax = 50
+)
+
+// Event событие в ленте
+type Event struct {
+	ID       int64           `json:"id"`
+	Kind     string          `json:"kind"`
+	User     users.InfoUser  `json:"user"`
+	GameSlug string          `json:"game_slug,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+	Created  time.Time       `json:"created"`
+}
+
+// FeedPage страница ленты, следующая запрашивается с before=next_before
+type FeedPage struct {
+	Events     []*Event `json:"events"`
+	NextBefore int64    `json:"next_before,omitempty"`
+}
@@ -1,25 +1,27 @@
 package storage
 
-import "github.com/go-redis/redis"
+import (
+	"context"
 
-var Client *redis.Client
+	"github.com/go-redis/redis"
+)
 
-// Connect открывает соединение с хранилищем для sessions
-func Connect(storageUser, storagePass, storageHost string) error {
-	var err error
-	Client = redis.NewClient(&redis.Options{
+// Connect открывает соединение с хранилищем для sessions, закрывает его вызывающий
+func Connect(storageUser, storagePass, storageHost string) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
 		Addr:     storageHost,
 		Password: storagePass,
 		DB:       0,
 	})
-	_, err = Client.Ping().Result()
-	if err != nil {
-		return err
+	if _, err := client.Ping().Result(); err != nil {
+		client.Close()
+		return nil, err
 	}
 
-	return nil
+	return client, nil
 }
 
-func Close() error {
-	return Client.Close()
+// Ping для проверки готовности
+func Ping(ctx context.Context, client *redis.Client) error {
+	return client.WithContext(ctx).Ping().Err()
 }
@@ -19,6 +19,7 @@ type Case struct {
 	Endpoint     string
 	Pattern      string
 	Cookies      []*http.Cookie
+	Headers      map[string]string
 	Function     http.HandlerFunc
 	Context      context.Context
 }
@@ -26,6 +27,12 @@ type Case struct {
 func MakeRequest(ctx context.Context, handler http.Handler, method, endpoint string, cookies []*http.Cookie,
 	body io.Reader) *httptest.ResponseRecorder {
 
+	return MakeRequestWithHeaders(ctx, handler, method, endpoint, cookies, nil, body)
+}
+
+func MakeRequestWithHeaders(ctx context.Context, handler http.Handler, method, endpoint string,
+	cookies []*http.Cookie, headers map[string]string, body io.Reader) *httptest.ResponseRecorder {
+
 	req, _ := http.NewRequest(method, endpoint, body)
 	if ctx != nil {
 		req = req.WithContext(ctx)
@@ -35,6 +42,10 @@ func MakeRequest(ctx context.Context, handler http.Handler, method, endpoint str
 		req.AddCookie(cookie)
 	}
 
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
 	resp := httptest.NewRecorder()
 	handler.ServeHTTP(resp, req)
 	return resp
@@ -46,8 +57,8 @@ func RunAPITest(t *testing.T, i int, c *Case) {
 	if c.Endpoint == "" {
 		c.Endpoint = c.Pattern
 	}
-	resp := MakeRequest(c.Context, r, c.Method, c.Endpoint,
-		c.Cookies, bytes.NewBuffer(c.Payload))
+	resp := MakeRequestWithHeaders(c.Context, r, c.Method, c.Endpoint,
+		c.Cookies, c.Headers, bytes.NewBuffer(c.Payload))
 	if resp.Code != c.ExpectedCode {
 		t.Fatalf("\n[%d] Expected response code %d Got %d\n\n[%d] Expected response:\n %s\n Got:\n %s\n",
 			i, c.ExpectedCode, resp.Code, i, c.ExpectedBody, resp.Body.String())
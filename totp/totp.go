@@ -0,0 +1,107 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Digits количество цифр в коде
+	Digits = 6
+	// Period время жизни одного кода
+	Period = 30 * time.Second
+	// Skew сколько соседних периодов принимаем, чтобы пережить рассинхрон часов
+	Skew = 1
+
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret генерирует новый секрет(160 бит, как советует RFC 4226)
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "totp secret generate error")
+	}
+
+	return secret, nil
+}
+
+// EncodeSecret секрет в base32, как его ждут приложения-аутентификаторы
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URI otpauth:// ссылка для QR кода
+func URI(issuer, account string, secret []byte) string {
+	params := url.Values{}
+	params.Set("secret", EncodeSecret(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Code код для момента t
+func Code(secret []byte, t time.Time) string {
+	return hotp(secret, uint64(t.Unix()/int64(Period/time.Second)))
+}
+
+// Validate проверяет код с учётом Skew
+func Validate(secret []byte, code string, t time.Time) bool {
+	_, ok := Match(secret, code, t)
+	return ok
+}
+
+// Match как Validate, но ещё возвращает номер периода, которому соответствует код.
+// По нему отсекают повторное использование кода, пока он не истёк
+func Match(secret []byte, code string, t time.Time) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	counter := t.Unix() / int64(Period/time.Second)
+	var step int64
+	valid := 0
+	for i := -Skew; i <= Skew; i++ {
+		// проверяем все окна, чтобы время ответа не зависело от того, какое подошло
+		match := subtle.ConstantTimeCompare([]byte(hotp(secret, uint64(counter+int64(i)))), []byte(code))
+		step = int64(subtle.ConstantTimeSelect(match, int(counter+int64(i)), int(step)))
+		valid |= match
+	}
+
+	return step, valid == 1
+}
+
+// hotp RFC 4226
+func hotp(secret []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
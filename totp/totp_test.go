@@ -0,0 +1,66 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// тестовые векторы из RFC 6238, последние 6 цифр
+func TestCode(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, expected := range cases {
+		if code := Code(secret, time.Unix(unix, 0)); code != expected {
+			t.Fatalf("[%d] expected %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+
+	if !Validate(secret, "050471", now) {
+		t.Fatal("current code must be valid")
+	}
+	if !Validate(secret, Code(secret, now.Add(-Period)), now) {
+		t.Fatal("previous code must be valid")
+	}
+	if Validate(secret, Code(secret, now.Add(-3*Period)), now) {
+		t.Fatal("old code must be invalid")
+	}
+	if Validate(secret, "50471", now) {
+		t.Fatal("short code must be invalid")
+	}
+
+	counter := now.Unix() / int64(Period/time.Second)
+	if step, ok := Match(secret, Code(secret, now.Add(-Period)), now); !ok || step != counter-1 {
+		t.Fatalf("previous code must match step %d, got %d", counter-1, step)
+	}
+	if step, ok := Match(secret, Code(secret, now.Add(Period)), now); !ok || step != counter+1 {
+		t.Fatalf("next code must match step %d, got %d", counter+1, step)
+	}
+}
+
+func TestURI(t *testing.T) {
+	t.Parallel()
+
+	uri := URI("WarScript", "GDVFox", []byte("12345678901234567890"))
+	if !strings.HasPrefix(uri, "otpauth://totp/WarScript:GDVFox?") ||
+		!strings.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ") {
+		t.Fatalf("wrong uri: %s", uri)
+	}
+}
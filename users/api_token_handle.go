@@ -0,0 +1,221 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+)
+
+// APITokenPrefix по префиксу токен легко найти сканерами секретов в логах CI
+const APITokenPrefix = "wst_"
+
+// apiTokenTouchInterval чаще этого last_used не обновляем, чтобы не писать в базу на каждый запрос
+const apiTokenTouchInterval = time.Minute
+
+func newAPITokenSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return APITokenPrefix + b64.EncodeToString(raw), nil
+}
+
+// hashAPIToken в базе храним только хеш, секрет высокоэнтропийный, поэтому соль не нужна
+func hashAPIToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[len("Bearer "):]), true
+}
+
+// authenticateAPIToken проверяет токен и собирает по нему payload сессии
+func (h *Handler) authenticateAPIToken(token string) (*SessionPayload, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, utils.ErrNotExists
+	}
+
+	t, err := h.APITokens.GetTokenByHash(hashAPIToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if t.Expired(now) {
+		return nil, errors.Wrap(utils.ErrNotExists, "api token expired")
+	}
+
+	user, err := h.Users.GetUserByID(t.UserID.Int)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive(now) {
+		return nil, utils.ErrInactive
+	}
+
+	if t.LastUsed.Status != pgtype.Present || now.Sub(t.LastUsed.Time) > apiTokenTouchInterval {
+		if err = h.APITokens.Touch(t.ID.Int, now); err != nil {
+			return nil, err
+		}
+	}
+
+	scopes := make([]Scope, len(t.Scopes))
+	for i, s := range t.Scopes {
+		scopes[i] = Scope(s)
+	}
+
+	return &SessionPayload{
+		ID:      user.ID.Int,
+		PwdVer:  user.PwdVer.Int,
+		Role:    Role(user.Role.String),
+		TokenID: t.ID.Int,
+		Scopes:  scopes,
+	}, nil
+}
+
+func timePtr(t pgtype.Timestamptz) *time.Time {
+	if t.Status != pgtype.Present {
+		return nil
+	}
+
+	return &t.Time
+}
+
+// APITokenFromModel токен для ответа, без секрета
+func APITokenFromModel(t *APITokenModel) APIToken {
+	scopes := make([]Scope, len(t.Scopes))
+	for i, s := range t.Scopes {
+		scopes[i] = Scope(s)
+	}
+
+	return APIToken{
+		ID:        t.ID.Int,
+		Name:      t.Name.String,
+		Scopes:    scopes,
+		Created:   t.Created.Time,
+		ExpiresAt: timePtr(t.Expires),
+		LastUsed:  timePtr(t.LastUsed),
+	}
+}
+
+// CreateAPIToken выпускает API токен, секрет виден только в этом ответе
+func (h *Handler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "CreateAPIToken")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	form := &FormAPIToken{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	if valError := form.Validate(); valError != nil {
+		errWriter.WriteValidationError(valError)
+		return
+	}
+
+	secret, err := newAPITokenSecret()
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "api token generate error"))
+		return
+	}
+
+	scopes := make([]string, len(form.Scopes))
+	for i, s := range form.Scopes {
+		scopes[i] = string(s)
+	}
+	t := &APITokenModel{
+		UserID:  pgtype.Int8{Int: info.ID, Status: pgtype.Present},
+		Name:    pgtype.Text{String: form.Name, Status: pgtype.Present},
+		Hash:    pgtype.Bytea{Bytes: hashAPIToken(secret), Status: pgtype.Present},
+		Scopes:  scopes,
+		Expires: pgtype.Timestamptz{Status: pgtype.Null},
+	}
+	if form.ExpiresAt != nil {
+		t.Expires = pgtype.Timestamptz{Time: *form.ExpiresAt, Status: pgtype.Present}
+	}
+
+	if err = h.APITokens.Create(t); err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "api token create method error"))
+		return
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusCreated, &NewAPIToken{
+		APIToken: APITokenFromModel(t),
+		Token:    secret,
+	})
+}
+
+// GetAPITokens токены текущего юзера без секретов
+func (h *Handler) GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GetAPITokens")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	models, err := h.APITokens.GetTokensByUserID(info.ID)
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get api tokens method error"))
+		return
+	}
+
+	tokens := make([]APIToken, len(models))
+	for i, t := range models {
+		tokens[i] = APITokenFromModel(t)
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, tokens)
+}
+
+// DeleteAPIToken отзывает токен текущего юзера
+func (h *Handler) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "DeleteAPIToken")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	tokenID, err := strconv.ParseInt(mux.Vars(r)["token_id"], 10, 64)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format token_id"))
+		return
+	}
+
+	if err = h.APITokens.Delete(info.ID, tokenID); err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "api token not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "api token delete method error"))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,128 @@
+package users
+
+import (
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+)
+
+// APITokenAccessObject DAO for APIToken model
+type APITokenAccessObject interface {
+	// Create сохраняет токен, заполняет ID и Created
+	Create(t *APITokenModel) error
+	GetTokenByHash(hash []byte) (*APITokenModel, error)
+	GetTokensByUserID(userID int64) ([]*APITokenModel, error)
+	// Delete удаляет токен юзера, чужой токен для него не существует
+	Delete(userID, tokenID int64) error
+	// Touch отмечает использование токена
+	Touch(tokenID int64, at time.Time) error
+}
+
+// APITokensDB implementation of APITokenAccessObject
+type APITokensDB struct {
+	DB *pgx.ConnPool
+}
+
+// APITokenModel model for api_tokens table
+type APITokenModel struct {
+	ID       pgtype.Int8
+	UserID   pgtype.Int8
+	Name     pgtype.Text
+	Hash     pgtype.Bytea
+	Scopes   []string
+	Created  pgtype.Timestamptz
+	Expires  pgtype.Timestamptz
+	LastUsed pgtype.Timestamptz
+}
+
+// Expired истёк ли токен к моменту now
+func (t *APITokenModel) Expired(now time.Time) bool {
+	return t.Expires.Status == pgtype.Present && !now.Before(t.Expires.Time)
+}
+
+// Create сохраняет токен
+func (at *APITokensDB) Create(t *APITokenModel) error {
+	row := at.DB.QueryRow(`INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created;`,
+		&t.UserID, &t.Name, &t.Hash, t.Scopes, &t.Expires)
+	if err := row.Scan(&t.ID, &t.Created); err != nil {
+		return errors.Wrap(err, "api token create error")
+	}
+
+	return nil
+}
+
+const apiTokenFields = `t.id, t.user_id, t.name, t.token_hash, t.scopes, t.created, t.expires, t.last_used`
+
+func scanAPIToken(row interface {
+	Scan(dest ...interface{}) error
+}) (*APITokenModel, error) {
+	t := &APITokenModel{}
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Hash, &t.Scopes, &t.Created, &t.Expires, &t.LastUsed)
+	return t, err
+}
+
+// GetTokenByHash ищет токен по хешу
+func (at *APITokensDB) GetTokenByHash(hash []byte) (*APITokenModel, error) {
+	t, err := scanAPIToken(at.DB.QueryRow(`SELECT `+apiTokenFields+`
+		FROM api_tokens t WHERE t.token_hash = $1;`, hash))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, utils.ErrNotExists
+		}
+
+		return nil, errors.Wrap(err, "get api token error")
+	}
+
+	return t, nil
+}
+
+// GetTokensByUserID токены юзера, свежие первыми
+func (at *APITokensDB) GetTokensByUserID(userID int64) ([]*APITokenModel, error) {
+	rows, err := at.DB.Query(`SELECT `+apiTokenFields+`
+		FROM api_tokens t WHERE t.user_id = $1 ORDER BY t.created DESC, t.id DESC;`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get api tokens error")
+	}
+	defer rows.Close()
+
+	tokens := make([]*APITokenModel, 0)
+	for rows.Next() {
+		t, scanErr := scanAPIToken(rows)
+		if scanErr != nil {
+			return nil, errors.Wrap(scanErr, "get api tokens scan error")
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+// Delete удаляет токен юзера
+func (at *APITokensDB) Delete(userID, tokenID int64) error {
+	tag, err := at.DB.Exec(`DELETE FROM api_tokens WHERE id = $1 AND user_id = $2;`,
+		tokenID, userID)
+	if err != nil {
+		return errors.Wrap(err, "api token delete error")
+	}
+
+	if tag.RowsAffected() == 0 {
+		return utils.ErrNotExists
+	}
+
+	return nil
+}
+
+// Touch отмечает использование токена
+func (at *APITokensDB) Touch(tokenID int64, used time.Time) error {
+	_, err := at.DB.Exec(`UPDATE api_tokens SET last_used = $1 WHERE id = $2;`, used, tokenID)
+	if err != nil {
+		return errors.Wrap(err, "api token touch error")
+	}
+
+	return nil
+}
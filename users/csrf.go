@@ -0,0 +1,59 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+)
+
+// CSRFHeader заголовок, в котором фронтенд присылает CSRF-токен
+const CSRFHeader = "X-CSRF-Token"
+
+// CSRFToken токен привязан к сессии: чужой сайт не может ни прочитать куку,
+// ни получить токен, а без сессии токен бесполезен. Хранить ничего не нужно
+func (h *Handler) CSRFToken(sessionToken string) string {
+	mac := hmac.New(sha256.New, h.CSRFSecret)
+	mac.Write([]byte("csrf." + sessionToken))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// safeMethod методы, которые ничего не меняют и не требуют токена
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// checkCSRF сверяет заголовок с токеном сессии для меняющих запросов
+func (h *Handler) checkCSRF(r *http.Request, sessionToken string) bool {
+	if safeMethod(r.Method) {
+		return true
+	}
+
+	return hmac.Equal([]byte(r.Header.Get(CSRFHeader)), []byte(h.CSRFToken(sessionToken)))
+}
+
+// CSRF ответ с токеном
+type CSRF struct {
+	Token string `json:"csrf_token"`
+}
+
+// GetCSRFToken выдаёт токен для текущей сессии
+func (h *Handler) GetCSRFToken(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GetCSRFToken")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "get cookie error"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	utils.WriteApplicationJSON(w, http.StatusOK, &CSRF{
+		Token: h.CSRFToken(cookie.Value),
+	})
+}
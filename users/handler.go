@@ -0,0 +1,31 @@
+package users
+
+import (
+	"github.com/go-park-mail-ru/2019_1_HotCode/bruteforce"
+	"github.com/go-park-mail-ru/2019_1_HotCode/mailer"
+	"github.com/go-park-mail-ru/2019_1_HotCode/oidc"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+)
+
+// Handler ручки юзеров и сессий со всеми их зависимостями, собирается в main
+type Handler struct {
+	Users     UserAccessObject
+	Sessions  SessionAccessObject
+	Tokens    TokenAccessObject
+	APITokens APITokenAccessObject
+
+	// LoginGuard защита входа от перебора паролей
+	LoginGuard *bruteforce.Guard
+	Mail       mailer.Mailer
+	// ClientIP откуда брать адрес клиента для LoginGuard
+	ClientIP utils.ClientIPResolver
+
+	// Cookie настройки куки сессии
+	Cookie CookieConfig
+	// CSRFSecret ключ подписи CSRF-токенов, у всех реплик должен быть один
+	CSRFSecret []byte
+	// FrontendURL адрес фронтенда для ссылок в письмах
+	FrontendURL string
+	// OIDCProviders провайдеры внешнего входа по имени из урла
+	OIDCProviders map[string]*oidc.Provider
+}
@@ -12,18 +12,23 @@ import (
 
 // WithAuthentication проверка токена перед исполнением запроса
 //nolint: interfacer
-func WithAuthentication(next http.HandlerFunc) http.HandlerFunc {
+func (h *Handler) WithAuthentication(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		logger := utils.GetLogger(r, "CheckUsername")
 		errWriter := utils.NewErrorResponseWriter(w, logger)
 
+		if token, ok := bearerToken(r); ok {
+			h.withAPIToken(w, r, errWriter, next, token)
+			return
+		}
+
 		cookie, err := r.Cookie("JSESSIONID")
 		if err != nil || cookie == nil {
 			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "can not load cookie"))
 			return
 		}
 
-		session, err := Sessions.GetSession(cookie.Value)
+		session, err := h.Sessions.GetSession(cookie.Value)
 		if err != nil {
 			errWriter.WriteError(http.StatusUnauthorized, errors.Wrap(err, "get session error"))
 			return
@@ -37,7 +42,90 @@ func WithAuthentication(next http.HandlerFunc) http.HandlerFunc {
 
 		}
 
+		// кука уходит с любым запросом к нам, даже со страницы злоумышленника,
+		// а токен из заголовка может прислать только наш фронтенд
+		if !h.checkCSRF(r, cookie.Value) {
+			errWriter.WriteWarn(http.StatusForbidden, errors.New("csrf token mismatch"))
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), SessionInfoKey, payload)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// withAPIToken вход по API токену. CSRF не проверяем: заголовок Authorization браузер сам не подставит.
+// Пускаем только на ручки, обёрнутые в WithScope, и только со scope, выданным токену
+func (h *Handler) withAPIToken(w http.ResponseWriter, r *http.Request, errWriter *utils.ErrorResponseWriter,
+	next http.HandlerFunc, token string) {
+	scope, ok := r.Context().Value(AllowedScopeKey).(Scope)
+	if !ok {
+		errWriter.WriteWarn(http.StatusForbidden, errors.New("api tokens are not allowed here"))
+		return
+	}
+
+	payload, err := h.authenticateAPIToken(token)
+	if err != nil {
+		switch errors.Cause(err) {
+		case utils.ErrNotExists, utils.ErrInactive:
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "api token is not valid"))
+		default:
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "api token check error"))
+		}
+		return
+	}
+
+	if !payload.HasScope(scope) {
+		errWriter.WriteWarn(http.StatusForbidden, errors.Errorf("scope %s required", scope))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), SessionInfoKey, payload)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// WithScope разрешает прийти на ручку по API токену со scope, вызывается до WithAuthentication.
+// Без этой обёртки ручка доступна только по сессии
+func WithScope(next http.HandlerFunc, scope Scope) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), AllowedScopeKey, scope)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// WithRole пускает только пользователей с ролью не ниже role, вызывается после WithAuthentication.
+// Роль берём из базы, а не из сессии, чтобы отзыв роли действовал сразу
+//nolint: interfacer
+func (h *Handler) WithRole(next http.HandlerFunc, role Role) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetLogger(r, "WithRole")
+		errWriter := utils.NewErrorResponseWriter(w, logger)
+		info := SessionInfo(r)
+		if info == nil {
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+			return
+		}
+
+		user, err := h.Users.GetUserByID(info.ID)
+		if err != nil {
+			if errors.Cause(err) == utils.ErrNotExists {
+				errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
+			} else {
+				errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get user method error"))
+			}
+			return
+		}
+
+		userRole := Role(user.Role.String)
+		if !userRole.Includes(role) {
+			errWriter.WriteWarn(http.StatusForbidden, errors.Errorf("role %s required", role))
+			return
+		}
+
+		// в сессии могла остаться старая роль
+		payload := *info
+		payload.Role = userRole
+		ctx := context.WithValue(r.Context(), SessionInfoKey, &payload)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,104 @@
+package users
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+)
+
+// BanUser деактивирует аккаунт и убивает все его сессии
+func (h *Handler) BanUser(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "BanUser")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format user_id"))
+		return
+	}
+
+	form := &FormBan{}
+	err = utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	if valError := form.Validate(); valError != nil {
+		errWriter.WriteValidationError(valError)
+		return
+	}
+
+	user, err := h.Users.GetUserByID(userID)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get user method error"))
+		}
+		return
+	}
+
+	// модератор не может забанить модератора или админа, и себя тоже
+	if user.ID.Int == info.ID || Role(user.Role.String).Includes(info.Role) {
+		errWriter.WriteWarn(http.StatusForbidden, errors.New("can not ban user with same or higher role"))
+		return
+	}
+
+	until := pgtype.Timestamptz{Status: pgtype.Null}
+	if form.ExpiresAt != nil {
+		until = pgtype.Timestamptz{Time: *form.ExpiresAt, Status: pgtype.Present}
+	}
+
+	if err = h.Users.Ban(userID, form.Reason, until); err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "ban method error"))
+		return
+	}
+
+	if err = h.Sessions.DeleteUserSessions(userID); err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "delete user sessions error"))
+		return
+	}
+
+	logger.Infof("user %d banned by %d: %s", userID, info.ID, form.Reason)
+	w.WriteHeader(http.StatusOK)
+}
+
+// UnbanUser снимает бан
+func (h *Handler) UnbanUser(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "UnbanUser")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format user_id"))
+		return
+	}
+
+	if err = h.Users.Unban(userID); err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "unban method error"))
+		}
+		return
+	}
+
+	logger.Infof("user %d unbanned by %d", userID, info.ID)
+	w.WriteHeader(http.StatusOK)
+}
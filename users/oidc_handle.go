@@ -0,0 +1,351 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/oidc"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	// oidcNonceCookie привязывает state к браузеру, который начал вход
+	oidcNonceCookie = "OIDC_NONCE"
+	// сколько вариантов имени с номером пробуем, прежде чем добавить случайный суффикс
+	usernameAttempts = 10
+)
+
+// oidcState то, что нужно помнить между уходом к провайдеру и возвратом
+type oidcState struct {
+	Provider string `json:"provider"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	// Nonce копия куки oidcNonceCookie. Без неё можно подсунуть жертве
+	// ссылку возврата со своим state и кодом и войти ей в свой аккаунт
+	Nonce string `json:"nonce"`
+}
+
+// safeRedirect пускает только пути внутри фронтенда, иначе это open redirect
+func safeRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") ||
+		strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+
+	return redirect
+}
+
+// OIDCLogin отправляет юзера ко внешнему провайдеру
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	h.startOIDC(w, r, 0)
+}
+
+// OIDCLink то же, что OIDCLogin, но внешний аккаунт привяжется к текущему юзеру
+func (h *Handler) OIDCLink(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "OIDCLink")
+	info := SessionInfo(r)
+	if info == nil {
+		utils.NewErrorResponseWriter(w, logger).
+			WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	h.startOIDC(w, r, info.ID)
+}
+
+func (h *Handler) startOIDC(w http.ResponseWriter, r *http.Request, userID int64) {
+	logger := utils.GetLogger(r, "StartOIDC")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	name := mux.Vars(r)["provider"]
+	provider, ok := h.OIDCProviders[name]
+	if !ok {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Errorf("unknown provider %q", name))
+		return
+	}
+
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	nonce := make([]byte, 32)
+	if _, err = rand.Read(nonce); err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "nonce generate error"))
+		return
+	}
+
+	state := &oidcState{
+		Provider: name,
+		Verifier: verifier,
+		Redirect: safeRedirect(r.URL.Query().Get("redirect")),
+		Nonce:    base64.RawURLEncoding.EncodeToString(nonce),
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "state marshal error"))
+		return
+	}
+
+	// state одноразовый и живёт в том же хранилище, что и остальные токены
+	t := &OneTimeToken{
+		Kind:   TokenOIDCState,
+		UserID: userID,
+		Data:   string(data),
+		TTL:    oidcStateTTL,
+	}
+	if err = h.Tokens.Issue(t); err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "issue state error"))
+		return
+	}
+
+	http.SetCookie(w, h.newOIDCNonceCookie(state.Nonce, int(oidcStateTTL/time.Second)))
+	http.Redirect(w, r, provider.AuthCodeURL(t.Token, verifier), http.StatusFound)
+}
+
+// newOIDCNonceCookie кука живёт не дольше state. Path не задаём: по умолчанию
+// браузер отдаст её только на /auth/{provider}/, где и лежит callback.
+// Lax, а не Strict, потому что возврат от провайдера -- переход с чужого сайта
+func (h *Handler) newOIDCNonceCookie(nonce string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcNonceCookie,
+		Value:    nonce,
+		Domain:   h.Cookie.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.Cookie.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// OIDCCallback сюда провайдер возвращает юзера с кодом
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "OIDCCallback")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	q := r.URL.Query()
+	if providerErr := q.Get("error"); providerErr != "" {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Errorf("provider returned error %q", providerErr))
+		return
+	}
+
+	nonce := ""
+	if cookie, err := r.Cookie(oidcNonceCookie); err == nil {
+		nonce = cookie.Value
+	}
+	// кука одноразовая, как и сам state
+	http.SetCookie(w, h.newOIDCNonceCookie("", -1))
+
+	session, redirect, err := h.oidcCallbackImpl(logger, mux.Vars(r)["provider"], q.Get("state"), q.Get("code"), nonce)
+	if err != nil {
+		if challenge, ok := err.(*TOTPChallenge); ok {
+			http.Redirect(w, r, h.FrontendURL+"/login/2fa?challenge="+url.QueryEscape(challenge.Challenge),
+				http.StatusFound)
+			return
+		}
+
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// при привязке юзер уже вошёл, новая сессия не нужна
+	if session != nil {
+		h.SetSessionCookie(w, session)
+	}
+	http.Redirect(w, r, h.FrontendURL+redirect, http.StatusFound)
+}
+
+func (h *Handler) oidcCallbackImpl(logger *log.Entry, name, stateToken, code, nonce string) (*Session, string, error) {
+	invalidState := &utils.ValidationError{
+		"state": utils.ErrInvalid.Error(),
+	}
+
+	t, err := h.Tokens.Consume(TokenOIDCState, stateToken)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return nil, "", invalidState
+		}
+
+		return nil, "", errors.Wrap(err, "consume state error")
+	}
+
+	state := &oidcState{}
+	if err = json.Unmarshal([]byte(t.Data), state); err != nil || state.Provider != name {
+		return nil, "", invalidState
+	}
+	if state.Nonce == "" || subtle.ConstantTimeCompare([]byte(state.Nonce), []byte(nonce)) != 1 {
+		return nil, "", invalidState
+	}
+
+	provider, ok := h.OIDCProviders[name]
+	if !ok {
+		return nil, "", invalidState
+	}
+
+	identity, err := fetchIdentity(provider, code, state.Verifier)
+	if err != nil {
+		// чаще всего это протухший или поддельный код, но может лежать и провайдер
+		logger.Warn(errors.Wrapf(err, "provider %s", name))
+		return nil, "", &utils.ValidationError{
+			"code": utils.ErrInvalid.Error(),
+		}
+	}
+
+	if t.UserID != 0 {
+		if err = h.linkOIDCIdentity(t.UserID, name, identity); err != nil {
+			return nil, "", err
+		}
+
+		logger.Infof("user %d linked %s identity %s", t.UserID, name, identity.Subject)
+		return nil, state.Redirect, nil
+	}
+
+	user, err := h.Users.GetUserByIdentity(name, identity.Subject)
+	if errors.Cause(err) == utils.ErrNotExists {
+		user, err = h.createOIDCUser(name, identity)
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "get identity user error")
+	}
+
+	session, err := h.loginUser(user)
+	return session, state.Redirect, err
+}
+
+func (h *Handler) linkOIDCIdentity(userID int64, provider string, identity *oidc.Identity) error {
+	err := h.Users.LinkIdentity(userID, provider, identity.Subject)
+	if errors.Cause(err) == utils.ErrTaken {
+		return &utils.ValidationError{
+			"identity": utils.ErrTaken.Error(),
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "link identity error")
+	}
+
+	return nil
+}
+
+func fetchIdentity(provider *oidc.Provider, code, verifier string) (*oidc.Identity, error) {
+	accessToken, err := provider.Exchange(code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.UserInfo(accessToken)
+}
+
+// oidcSuffixLength длина случайного суффикса вместе с "_"
+const oidcSuffixLength = 7
+
+// usernameBase имя по правилам регистрации: без лишних символов и с запасом
+// длины под суффикс. Пустое, если от имени ничего не осталось
+func usernameBase(name string) string {
+	base := []rune(strings.Map(func(r rune) rune {
+		if usernameRune(r) {
+			return r
+		}
+		return -1
+	}, name))
+
+	if len(base) > UsernameMaxLength-oidcSuffixLength {
+		base = base[:UsernameMaxLength-oidcSuffixLength]
+	}
+
+	return string(base)
+}
+
+// oidcUsername i-й вариант имени: base, base_2, ..., дальше base_<случайный суффикс>
+func oidcUsername(base string, i int) (string, error) {
+	switch {
+	case i > usernameAttempts:
+		suffix := make([]byte, (oidcSuffixLength-1)/2)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", errors.Wrap(err, "username suffix generate error")
+		}
+		return base + "_" + hex.EncodeToString(suffix), nil
+	case i > 1:
+		return base + "_" + strconv.Itoa(i), nil
+	}
+
+	return base, nil
+}
+
+// newOIDCUser юзер со случайным паролем: пока юзер его не сбросит, войти можно только через провайдера.
+// Почту берём, только если провайдер её подтвердил
+func newOIDCUser(identity *oidc.Identity) (*UserModel, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, errors.Wrap(err, "password generate error")
+	}
+	pass := base64.RawURLEncoding.EncodeToString(buf)
+
+	user := &UserModel{
+		Password: &pass,
+	}
+	if identity.EmailVerified && validEmail(identity.Email) {
+		user.Email = pgtype.Varchar{String: identity.Email, Status: pgtype.Present}
+		user.EmailVerified = pgtype.Bool{Bool: true, Status: pgtype.Present}
+	}
+
+	return user, nil
+}
+
+// createOIDCUser создаёт юзера при первом входе через провайдера
+func (h *Handler) createOIDCUser(provider string, identity *oidc.Identity) (*UserModel, error) {
+	user, err := newOIDCUser(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	first := 1
+	base := usernameBase(identity.Username)
+	if base == "" {
+		// от имени ничего не осталось: имя провайдера со случайным суффиксом
+		base, first = usernameBase(provider), usernameAttempts+1
+	}
+	for i := first; ; i++ {
+		var username string
+		if username, err = oidcUsername(base, i); err != nil {
+			return nil, err
+		}
+		user.Username = pgtype.Varchar{String: username, Status: pgtype.Present}
+
+		err = h.Users.CreateWithIdentity(user, provider, identity.Subject)
+		if err == nil {
+			return h.Users.GetUserByID(user.ID.Int)
+		}
+
+		if _, ok := errors.Cause(err).(*utils.ValidationError); ok && user.Email.Status == pgtype.Present {
+			// почта уже у другого аккаунта, сливать их по почте не будем
+			user.Email, user.EmailVerified = pgtype.Varchar{Status: pgtype.Null}, pgtype.Bool{Status: pgtype.Null}
+			i--
+			continue
+		}
+
+		// случайный суффикс тоже может совпасть, но пробовать бесконечно не будем
+		if errors.Cause(err) != utils.ErrTaken || i > usernameAttempts+3 {
+			return nil, errors.Wrap(err, "create user error")
+		}
+	}
+}
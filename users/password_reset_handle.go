@@ -0,0 +1,271 @@
+package users
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/mailer"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/jackc/pgx/pgtype"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	passwordResetTTL = 30 * time.Minute
+	emailVerifyTTL   = 24 * time.Hour
+)
+
+func (h *Handler) frontendLink(path, token string) string {
+	return h.FrontendURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendMail отправляет письмо в фоне, чтобы время ответа
+// не выдавало, есть ли такой юзер и привязана ли почта
+func (h *Handler) sendMail(m *mailer.Message) {
+	go func() {
+		if err := h.Mail.Send(m); err != nil {
+			log.WithField("method", "sendMail").Error(errors.Wrap(err, "send mail error"))
+		}
+	}()
+}
+
+// sendEmailVerification выпускает токен подтверждения почты и отправляет его на неё
+func (h *Handler) sendEmailVerification(user *UserModel) error {
+	t := &OneTimeToken{
+		Kind:   TokenEmailVerify,
+		UserID: user.ID.Int,
+		Data:   user.Email.String,
+		TTL:    emailVerifyTTL,
+	}
+	if err := h.Tokens.Issue(t); err != nil {
+		return errors.Wrap(err, "issue email verify token error")
+	}
+
+	h.sendMail(&mailer.Message{
+		To:      user.Email.String,
+		Subject: "WarScript: подтверждение почты",
+		Body: "Чтобы подтвердить почту, перейдите по ссылке:\n" +
+			h.frontendLink("/verify-email", t.Token) + "\n\n" +
+			"Ссылка действует сутки.",
+	})
+
+	return nil
+}
+
+// RequestPasswordReset отправляет письмо со ссылкой для сброса пароля.
+// Отвечает 200 в любом случае, чтобы по ответу нельзя было перебирать юзеров
+func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "RequestPasswordReset")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	form := &FormPasswordReset{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	if valError := form.Validate(); valError != nil {
+		errWriter.WriteValidationError(valError)
+		return
+	}
+
+	if err = h.requestPasswordResetImpl(form); err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) requestPasswordResetImpl(form *FormPasswordReset) error {
+	var user *UserModel
+	var err error
+	if form.Email != "" {
+		user, err = h.Users.GetUserByEmail(form.Email)
+	} else {
+		user, err = h.Users.GetUserByUsername(form.Username)
+	}
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return nil
+		}
+
+		return errors.Wrap(err, "get user error")
+	}
+
+	// слать некуда или незачем
+	if user.Email.Status != pgtype.Present || !user.EmailVerified.Bool || !user.IsActive(time.Now()) {
+		return nil
+	}
+
+	// pwd_ver в токене: после смены пароля старые токены не сработают
+	t := &OneTimeToken{
+		Kind:   TokenPasswordReset,
+		UserID: user.ID.Int,
+		Data:   strconv.FormatInt(user.PwdVer.Int, 10),
+		TTL:    passwordResetTTL,
+	}
+	if err = h.Tokens.Issue(t); err != nil {
+		return errors.Wrap(err, "issue password reset token error")
+	}
+
+	h.sendMail(&mailer.Message{
+		To:      user.Email.String,
+		Subject: "WarScript: сброс пароля",
+		Body: "Кто-то, возможно вы, запросил сброс пароля для " + user.Username.String + ".\n" +
+			"Чтобы задать новый пароль, перейдите по ссылке:\n" +
+			h.frontendLink("/password-reset", t.Token) + "\n\n" +
+			"Ссылка действует 30 минут. Если вы ничего не запрашивали, просто проигнорируйте письмо.",
+	})
+
+	return nil
+}
+
+// ConfirmPasswordReset ставит новый пароль по токену из письма
+func (h *Handler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "ConfirmPasswordReset")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	form := &FormPasswordResetConfirm{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	err = h.confirmPasswordResetImpl(form)
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) confirmPasswordResetImpl(form *FormPasswordResetConfirm) error {
+	if err := form.Validate(); err != nil {
+		return err
+	}
+
+	invalidToken := &utils.ValidationError{
+		"token": utils.ErrInvalid.Error(),
+	}
+
+	// гасим только после смены пароля, иначе слишком длинный пароль сжёг бы ссылку.
+	// Повторно токен всё равно не пройдёт: он привязан к pwd_ver, а Save его меняет
+	t, err := h.Tokens.Peek(TokenPasswordReset, form.Token)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return invalidToken
+		}
+
+		return errors.Wrap(err, "peek token error")
+	}
+
+	user, err := h.Users.GetUserByID(t.UserID)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return invalidToken
+		}
+
+		return errors.Wrap(err, "get user error")
+	}
+
+	if strconv.FormatInt(user.PwdVer.Int, 10) != t.Data {
+		return invalidToken
+	}
+
+	user.Password = &form.Password
+	if err = h.Users.Save(user); err != nil {
+		if errors.Cause(err) == utils.ErrTooLong {
+			return &utils.ValidationError{
+				"password": utils.ErrTooLong.Error(),
+			}
+		}
+		return errors.Wrap(err, "user save error")
+	}
+
+	if _, err = h.Tokens.Consume(TokenPasswordReset, form.Token); err != nil &&
+		errors.Cause(err) != utils.ErrNotExists {
+		return errors.Wrap(err, "consume token error")
+	}
+
+	// старый пароль мог утечь вместе с сессиями
+	if err = h.Sessions.DeleteUserSessions(user.ID.Int); err != nil {
+		return errors.Wrap(err, "delete user sessions error")
+	}
+
+	return nil
+}
+
+// VerifyEmail подтверждает почту по токену из письма
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "VerifyEmail")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	form := &FormEmailVerify{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	err = h.verifyEmailImpl(form)
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) verifyEmailImpl(form *FormEmailVerify) error {
+	invalidToken := &utils.ValidationError{
+		"token": utils.ErrInvalid.Error(),
+	}
+
+	t, err := h.Tokens.Consume(TokenEmailVerify, form.Token)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return invalidToken
+		}
+
+		return errors.Wrap(err, "consume token error")
+	}
+
+	user, err := h.Users.GetUserByID(t.UserID)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return invalidToken
+		}
+
+		return errors.Wrap(err, "get user error")
+	}
+
+	// почту успели поменять после отправки письма
+	if user.Email.Status != pgtype.Present || user.Email.String != t.Data {
+		return invalidToken
+	}
+
+	user.EmailVerified = pgtype.Bool{Bool: true, Status: pgtype.Present}
+	if err = h.Users.Save(user); err != nil {
+		return errors.Wrap(err, "user save error")
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package users
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// GrantRole выдаёт юзеру роль
+func (h *Handler) GrantRole(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GrantRole")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	form := &FormRole{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	if valError := form.Validate(); valError != nil {
+		errWriter.WriteValidationError(valError)
+		return
+	}
+
+	h.setRole(w, r, errWriter, form.Role)
+}
+
+// RevokeRole отбирает у юзера роль, оставляя обычного пользователя
+func (h *Handler) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "RevokeRole")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	h.setRole(w, r, errWriter, RoleUser)
+}
+
+func (h *Handler) setRole(w http.ResponseWriter, r *http.Request, errWriter *utils.ErrorResponseWriter, role Role) {
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format user_id"))
+		return
+	}
+
+	// иначе последний админ может случайно остаться без прав
+	if userID == info.ID {
+		errWriter.WriteWarn(http.StatusForbidden, errors.New("can not change own role"))
+		return
+	}
+
+	if err = h.Users.SetRole(userID, info.ID, role); err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "set role method error"))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetRoleAudit история смены ролей юзера
+func (h *Handler) GetRoleAudit(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "GetRoleAudit")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "wrong format user_id"))
+		return
+	}
+
+	records, err := h.Users.GetRoleAudit(userID)
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get role audit method error"))
+		return
+	}
+
+	audit := make([]*RoleAudit, len(records))
+	for i, record := range records {
+		audit[i] = &RoleAudit{
+			UserID:  record.UserID.Int,
+			ActorID: record.ActorID.Int,
+			OldRole: Role(record.OldRole.String),
+			NewRole: Role(record.NewRole.String),
+			Created: record.Created.Time,
+		}
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, audit)
+}
@@ -0,0 +1,393 @@
+package users
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RedisDenylist отзывы хранятся в redis, а проверяются по копии в памяти, чтобы не ходить
+// в redis на каждый запрос. Копию загружаем при подписке на канал отзывов и дальше
+// обновляем из него же.
+//
+// Задержка отзыва: на экземпляре, который отозвал, -- сразу, на остальных -- доставка
+// pub/sub. Пока подписки нет (старт, обрыв, redis лежит), проверяем прямо в redis.
+// Молча оборвавшееся соединение заметим по неотвеченному ping, так что в худшем случае
+// отзыв с другого экземпляра опоздает на 2*denylistPingInterval.
+// RedisDenylist{Redis: client} без NewRedisDenylist всегда проверяет в redis
+type RedisDenylist struct {
+	Redis *redis.Client
+
+	mu     sync.RWMutex
+	ps     *redis.PubSub
+	closed bool
+	// synced копия в памяти полная, можно проверять по ней
+	synced bool
+	tokens map[string]time.Time
+	users  map[int64]userRevocation
+	pruned time.Time
+}
+
+type userRevocation struct {
+	before  time.Time
+	expires time.Time
+}
+
+// revocation сообщение в канале отзывов: либо токен, либо все токены юзера до Before
+type revocation struct {
+	Token   string `json:"token,omitempty"`
+	UserID  int64  `json:"user_id,omitempty"`
+	Before  int64  `json:"before,omitempty"`
+	Expires int64  `json:"expires"`
+}
+
+const (
+	revokedChannel = "session_revoked"
+	// denylistPingInterval как часто проверяем молчащую подписку и чистим истёкшие отзывы
+	denylistPingInterval  = time.Second * 30
+	denylistRetryInterval = time.Second
+)
+
+// NewRedisDenylist подписывается на канал отзывов, проверка по памяти включится
+// после загрузки отзывов из redis. Остановить -- Close
+func NewRedisDenylist(client *redis.Client) *RedisDenylist {
+	rd := &RedisDenylist{
+		Redis:  client,
+		ps:     client.Subscribe(revokedChannel),
+		tokens: make(map[string]time.Time),
+		users:  make(map[int64]userRevocation),
+	}
+	go rd.listen()
+
+	return rd
+}
+
+const (
+	revokedTokenPrefix = "session_revoked:"
+	revokedUserPrefix  = "session_revoked_user:"
+)
+
+func revokedTokenKey(id string) string {
+	return revokedTokenPrefix + id
+}
+
+func revokedUserKey(userID int64) string {
+	return revokedUserPrefix + strconv.FormatInt(userID, 10)
+}
+
+// Revoke отзывает один токен
+func (rd *RedisDenylist) Revoke(id string, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := rd.Redis.Set(revokedTokenKey(id), 1, ttl).Err(); err != nil {
+		return errors.Wrap(err, "redis revoke error")
+	}
+
+	return rd.publish(&revocation{Token: id, Expires: expires.UnixNano()})
+}
+
+// RevokeUser отзывает все токены юзера, выданные до at
+func (rd *RedisDenylist) RevokeUser(userID int64, at time.Time, ttl time.Duration) error {
+	if err := rd.Redis.Set(revokedUserKey(userID), at.UnixNano(), ttl).Err(); err != nil {
+		return errors.Wrap(err, "redis revoke user error")
+	}
+
+	return rd.publish(&revocation{UserID: userID, Before: at.UnixNano(), Expires: time.Now().Add(ttl).UnixNano()})
+}
+
+// publish рассылает отзыв остальным экземплярам, у себя применяет сразу
+func (rd *RedisDenylist) publish(rev *revocation) error {
+	rd.apply(rev)
+
+	data, err := json.Marshal(rev)
+	if err != nil {
+		return errors.Wrap(err, "marshal revocation error")
+	}
+	if err = rd.Redis.Publish(revokedChannel, data).Err(); err != nil {
+		return errors.Wrap(err, "redis publish revocation error")
+	}
+
+	return nil
+}
+
+// IsRevoked отозван ли токен
+func (rd *RedisDenylist) IsRevoked(id string, userID int64, issued time.Time) (bool, error) {
+	rd.mu.RLock()
+	if !rd.synced {
+		rd.mu.RUnlock()
+		return rd.isRevokedInRedis(id, userID, issued)
+	}
+	defer rd.mu.RUnlock()
+
+	now := time.Now()
+	if expires, ok := rd.tokens[id]; ok && now.Before(expires) {
+		return true, nil
+	}
+
+	user, ok := rd.users[userID]
+	return ok && now.Before(user.expires) && !issued.After(user.before), nil
+}
+
+// isRevokedInRedis проверка за один запрос в redis, пока копии в памяти нет
+func (rd *RedisDenylist) isRevokedInRedis(id string, userID int64, issued time.Time) (bool, error) {
+	values, err := rd.Redis.MGet(revokedTokenKey(id), revokedUserKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		return false, errors.Wrap(err, "redis denylist error")
+	}
+
+	if len(values) != 2 {
+		return false, errors.Errorf("unexpected denylist reply %v", values)
+	}
+
+	if values[0] != nil {
+		return true, nil
+	}
+
+	if before, ok := values[1].(string); ok {
+		revokedAt, parseErr := strconv.ParseInt(before, 10, 64)
+		if parseErr != nil {
+			return false, errors.Wrap(parseErr, "wrong revoke time")
+		}
+
+		return issued.UnixNano() <= revokedAt, nil
+	}
+
+	return false, nil
+}
+
+// apply добавляет отзыв в копию в памяти
+func (rd *RedisDenylist) apply(rev *revocation) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.tokens == nil {
+		return
+	}
+
+	expires := time.Unix(0, rev.Expires)
+	if rev.Token != "" {
+		rd.tokens[rev.Token] = expires
+		return
+	}
+
+	// отзывы одного юзера могут прийти не по порядку, действует самый поздний
+	before := time.Unix(0, rev.Before)
+	if current, ok := rd.users[rev.UserID]; !ok || current.before.Before(before) {
+		rd.users[rev.UserID] = userRevocation{before: before, expires: expires}
+	}
+}
+
+// listen держит подписку на канал отзывов, пока не вызван Close
+func (rd *RedisDenylist) listen() {
+	pingSent := false
+	for {
+		ps := rd.pubSub()
+		if ps == nil {
+			return
+		}
+
+		msg, err := ps.ReceiveTimeout(denylistPingInterval)
+		switch {
+		case err == nil:
+			pingSent = false
+			err = rd.handle(msg)
+		case isTimeout(err) && !pingSent:
+			pingSent = true
+			err = ps.Ping()
+		}
+
+		if err != nil {
+			pingSent = false
+			rd.resubscribe(err)
+		}
+		rd.prune(time.Now())
+	}
+}
+
+func (rd *RedisDenylist) pubSub() *redis.PubSub {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	if rd.closed {
+		return nil
+	}
+
+	return rd.ps
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (rd *RedisDenylist) handle(msg interface{}) error {
+	switch msg := msg.(type) {
+	case *redis.Subscription:
+		// подписались заново: всё, что отозвали, пока нас не было, есть только в redis
+		if msg.Kind == "subscribe" {
+			return rd.reload()
+		}
+	case *redis.Message:
+		rev := &revocation{}
+		if err := json.Unmarshal([]byte(msg.Payload), rev); err != nil {
+			log.Error(errors.Wrap(err, "unmarshal revocation error"))
+			return nil
+		}
+		rd.apply(rev)
+	}
+
+	return nil
+}
+
+// resubscribe заменяет оборвавшуюся подписку. До её подтверждения проверяем в redis
+func (rd *RedisDenylist) resubscribe(reason error) {
+	rd.mu.Lock()
+	rd.synced = false
+	if rd.closed {
+		rd.mu.Unlock()
+		return
+	}
+	rd.ps.Close()
+	rd.mu.Unlock()
+
+	log.Warn(errors.Wrap(reason, "session denylist subscription lost"))
+	time.Sleep(denylistRetryInterval)
+
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.closed {
+		rd.ps = rd.Redis.Subscribe(revokedChannel)
+	}
+}
+
+// reload загружает отзывы из redis в память и включает проверку по ней
+func (rd *RedisDenylist) reload() error {
+	var loaded []*revocation
+	err := rd.scan(revokedTokenPrefix+"*", func(key, _ string, expires time.Time) error {
+		id := strings.TrimPrefix(key, revokedTokenPrefix)
+		loaded = append(loaded, &revocation{Token: id, Expires: expires.UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = rd.scan(revokedUserPrefix+"*", func(key, value string, expires time.Time) error {
+		userID, err := strconv.ParseInt(strings.TrimPrefix(key, revokedUserPrefix), 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "wrong denylist key %s", key)
+		}
+		before, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "wrong revoke time")
+		}
+
+		loaded = append(loaded, &revocation{UserID: userID, Before: before, Expires: expires.UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rev := range loaded {
+		rd.apply(rev)
+	}
+
+	rd.mu.Lock()
+	rd.synced = true
+	rd.mu.Unlock()
+	return nil
+}
+
+// scan обходит ключи по маске и отдаёт fn значение и время истечения каждого
+func (rd *RedisDenylist) scan(match string, fn func(key, value string, expires time.Time) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := rd.Redis.Scan(cursor, match, 1000).Result()
+		if err != nil {
+			return errors.Wrap(err, "redis scan error")
+		}
+
+		if err = rd.load(keys, fn); err != nil {
+			return err
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (rd *RedisDenylist) load(keys []string, fn func(key, value string, expires time.Time) error) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	pipe := rd.Redis.Pipeline()
+	defer pipe.Close()
+	values := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		values[i] = pipe.Get(key)
+		ttls[i] = pipe.PTTL(key)
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return errors.Wrap(err, "redis denylist load error")
+	}
+
+	now := time.Now()
+	for i, key := range keys {
+		// ключ мог истечь между SCAN и GET
+		if values[i].Err() == redis.Nil || ttls[i].Val() <= 0 {
+			continue
+		}
+		if err := fn(key, values[i].Val(), now.Add(ttls[i].Val())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prune выкидывает из памяти истёкшие отзывы, не чаще раза в denylistPingInterval
+func (rd *RedisDenylist) prune(now time.Time) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if now.Sub(rd.pruned) < denylistPingInterval {
+		return
+	}
+	rd.pruned = now
+
+	for id, expires := range rd.tokens {
+		if !now.Before(expires) {
+			delete(rd.tokens, id)
+		}
+	}
+	for userID, user := range rd.users {
+		if !now.Before(user.expires) {
+			delete(rd.users, userID)
+		}
+	}
+}
+
+// Close останавливает подписку, дальше проверки идут в redis
+func (rd *RedisDenylist) Close() error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.closed = true
+	rd.synced = false
+	if rd.ps == nil {
+		return nil
+	}
+
+	return rd.ps.Close()
+}
@@ -3,6 +3,7 @@ package users
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,6 +12,7 @@ import (
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 // SessionInfo достаёт инфу о юзере из контекстаs
@@ -25,7 +27,7 @@ func SessionInfo(r *http.Request) *SessionPayload {
 }
 
 // CreateSession вход + кука
-func CreateSession(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) CreateSession(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "SignInUser")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 
@@ -36,8 +38,20 @@ func CreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := CreateSessionImpl(form)
+	ip := h.ClientIP.IP(r)
+	if !h.checkLoginGuard(w, errWriter, form.Username, ip) {
+		return
+	}
+
+	session, err := h.CreateSessionImpl(form)
+	h.trackLoginAttempt(logger, form.Username, ip, err)
 	if err != nil {
+		if challenge, ok := err.(*TOTPChallenge); ok {
+			// пароль верный, но нужен второй фактор
+			utils.WriteApplicationJSON(w, http.StatusAccepted, challenge)
+			return
+		}
+
 		if validErr, ok := err.(*utils.ValidationError); ok {
 			errWriter.WriteValidationError(validErr)
 			return
@@ -47,48 +61,145 @@ func CreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ставим куку
-	http.SetCookie(w, &http.Cookie{
+	h.SetSessionCookie(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkLoginGuard отвечает 429, пока вход для username или с ip заблокирован.
+// false -- ответ уже записан, дальше не идём
+func (h *Handler) checkLoginGuard(w http.ResponseWriter, errWriter *utils.ErrorResponseWriter,
+	username, ip string) bool {
+	retryAfter, err := h.LoginGuard.Check(username, ip)
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "login guard check error"))
+		return false
+	}
+	if retryAfter > 0 {
+		// округляем вверх, чтобы клиент не пришёл на секунду раньше
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+		errWriter.WriteWarn(http.StatusTooManyRequests,
+			errors.Errorf("too many login attempts for %s from %s", username, ip))
+		return false
+	}
+
+	return true
+}
+
+// trackLoginAttempt сообщает защите от перебора, угадан ли пароль или код второго фактора.
+// Верный пароль при включённой 2FA ещё не вход: счётчик сбросит только сам вход.
+// Ошибки хранилища не мешают входу, только логируются
+func (h *Handler) trackLoginAttempt(logger *log.Entry, username, ip string, err error) {
+	var guardErr error
+	switch e := err.(type) {
+	case nil:
+		guardErr = h.LoginGuard.Succeeded(username)
+	case *utils.ValidationError:
+		// неизвестный юзернейм тоже попытка: иначе перебирать можно по списку
+		if (*e)["password"] == utils.ErrInvalid.Error() || (*e)["username"] == utils.ErrNotExists.Error() ||
+			(*e)["code"] == utils.ErrInvalid.Error() || (*e)["recovery_code"] == utils.ErrInvalid.Error() {
+			guardErr = h.LoginGuard.Failed(username, ip)
+		}
+	}
+
+	if guardErr != nil {
+		logger.Error(errors.Wrap(guardErr, "login guard error"))
+	}
+}
+
+// CookieConfig атрибуты куки сессии, зависят от окружения
+type CookieConfig struct {
+	// Secure только по https, на проде обязательно
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+}
+
+func (h *Handler) newSessionCookie(token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
 		Name:     "JSESSIONID",
-		Value:    session.Token,
-		Expires:  time.Now().Add(2628000 * time.Second),
+		Value:    token,
+		Domain:   h.Cookie.Domain,
+		Expires:  expires,
 		HttpOnly: true,
-	})
+		Secure:   h.Cookie.Secure,
+		SameSite: h.Cookie.SameSite,
+	}
+}
 
-	w.WriteHeader(http.StatusOK)
+// SetSessionCookie ставит куку сессии
+func (h *Handler) SetSessionCookie(w http.ResponseWriter, session *Session) {
+	http.SetCookie(w, h.newSessionCookie(session.Token, time.Now().Add(2628000*time.Second)))
 }
 
-func CreateSessionImpl(form *FormUser) (*Session, error) {
-	if err := form.Validate(); err != nil {
+// ClearSessionCookie удаляет куку сессии в браузере. Чтобы браузер её удалил,
+// атрибуты должны совпасть с теми, что ставили
+func (h *Handler) ClearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, h.newSessionCookie("", time.Unix(0, 0)))
+}
+
+// CreateSessionImpl проверяет логин и пароль и создаёт сессию.
+// Если у юзера включена 2FA, вместо сессии возвращает *TOTPChallenge
+func (h *Handler) CreateSessionImpl(form *FormUser) (*Session, error) {
+	if err := form.ValidateCredentials(); err != nil {
 		return nil, err
 	}
 
-	user, err := Users.GetUserByUsername(form.Username)
+	user, err := h.Users.GetUserByUsername(form.Username)
 	if err != nil {
 		return nil, &utils.ValidationError{
 			"username": utils.ErrNotExists.Error(),
 		}
 	}
 
-	if !Users.CheckPassword(user, form.Password) {
+	if !h.Users.CheckPassword(user, form.Password) {
 		return nil, &utils.ValidationError{
 			"password": utils.ErrInvalid.Error(),
 		}
 	}
 
+	return h.loginUser(user)
+}
+
+// loginUser пускает юзера, личность которого уже подтверждена паролем или провайдером.
+// Если у юзера включена 2FA, вместо сессии возвращает *TOTPChallenge
+func (h *Handler) loginUser(user *UserModel) (*Session, error) {
+	if !user.IsActive(time.Now()) {
+		return nil, &utils.ValidationError{
+			"username": utils.ErrInactive.Error(),
+		}
+	}
+
+	// срок бана вышел, снимаем его
+	if !user.Active.Bool && user.Active.Status == pgtype.Present {
+		if err := h.Users.Unban(user.ID.Int); err != nil {
+			return nil, errors.Wrap(err, "lift expired ban error")
+		}
+	}
+
+	if user.TOTPEnabled.Bool {
+		return nil, h.newTOTPChallenge(user)
+	}
+
+	return h.StartSession(user)
+}
+
+// StartSession создаёт сессию юзеру, который уже доказал, что это он
+func (h *Handler) StartSession(user *UserModel) (*Session, error) {
 	data, err := json.Marshal(&SessionPayload{
 		ID:     user.ID.Int,
 		PwdVer: user.PwdVer.Int,
+		Role:   Role(user.Role.String),
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "info marshal error")
 	}
 
 	session := &Session{
+		UserID:       user.ID.Int,
 		Payload:      data,
 		ExpiresAfter: time.Hour * 24 * 30,
 	}
-	err = Sessions.Set(session)
+	err = h.Sessions.Set(session)
 	if err != nil {
 		return nil, errors.Wrap(err, "set session error")
 	}
@@ -97,7 +208,7 @@ func CreateSessionImpl(form *FormUser) (*Session, error) {
 }
 
 // DeleteSession выход + удаление куки
-func DeleteSession(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) DeleteSession(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "SignOutUser")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 
@@ -110,20 +221,21 @@ func DeleteSession(w http.ResponseWriter, r *http.Request) {
 	session := &Session{
 		Token: cookie.Value,
 	}
-	err = Sessions.Delete(session)
+	if info := SessionInfo(r); info != nil {
+		session.UserID = info.ID
+	}
+	err = h.Sessions.Delete(session)
 	if err != nil {
 		errWriter.WriteWarn(http.StatusInternalServerError, errors.Wrap(err, "session delete error"))
 		return
 	}
 
-	cookie.Expires = time.Unix(0, 0)
-	http.SetCookie(w, cookie)
-
+	h.ClearSessionCookie(w)
 	w.WriteHeader(http.StatusOK)
 }
 
 // GetSession возвращает сессмю
-func GetSession(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetSession(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "GetSession")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	info := SessionInfo(r)
@@ -132,7 +244,7 @@ func GetSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := Users.GetUserByID(info.ID)
+	user, err := h.Users.GetUserByID(info.ID)
 	if err != nil {
 		if errors.Cause(err) == utils.ErrNotExists {
 			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
@@ -1,10 +1,10 @@
 package users
 
 import (
+	"strconv"
 	"time"
 
-	"github.com/go-park-mail-ru/2019_1_HotCode/storage"
-
+	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
@@ -14,30 +14,44 @@ type SessionAccessObject interface {
 	Set(s *Session) error
 	Delete(s *Session) error
 	GetSession(token string) (*Session, error)
+	DeleteUserSessions(userID int64) error
 }
 
-// SessionsDB implementation of SessionAccessObject
-type Conn struct{}
-
-var Sessions SessionAccessObject
+// SessionLister хранилище, которое умеет перечислить сессии юзера.
+// Подписанные сессии нигде не хранятся, поэтому их так не получить
+type SessionLister interface {
+	GetUserSessions(userID int64) ([]*Session, error)
+}
 
-func init() {
-	Sessions = &Conn{}
+// SessionsDB implementation of SessionAccessObject
+type Conn struct {
+	Redis *redis.Client
 }
 
 // Session модель для работы с сессиями
 type Session struct {
 	Token        string
+	UserID       int64 // по нему сессии юзера можно удалить разом
 	Payload      []byte
 	ExpiresAfter time.Duration
 }
 
+func userSessionsKey(userID int64) string {
+	return "user_sessions:" + strconv.FormatInt(userID, 10)
+}
+
 // Set валидирует и сохраняет сессию в хранилище по сгенерированному токену
 // Токен сохраняется в s.Token
 func (ss *Conn) Set(s *Session) error {
 	sessionToken := uuid.NewV4()
-	err := storage.Client.Set(sessionToken.String(), s.Payload, s.ExpiresAfter).Err()
-	if err != nil {
+	pipe := ss.Redis.TxPipeline()
+	pipe.Set(sessionToken.String(), s.Payload, s.ExpiresAfter)
+	if s.UserID != 0 {
+		// индекс живёт не меньше самой свежей сессии
+		pipe.SAdd(userSessionsKey(s.UserID), sessionToken.String())
+		pipe.Expire(userSessionsKey(s.UserID), s.ExpiresAfter)
+	}
+	if _, err := pipe.Exec(); err != nil {
 		return errors.Wrap(err, "redis save error")
 	}
 
@@ -47,17 +61,73 @@ func (ss *Conn) Set(s *Session) error {
 
 // Delete удаляет сессию с токен s.Token из хранилища
 func (ss *Conn) Delete(s *Session) error {
-	err := storage.Client.Del(s.Token).Err()
-	if err != nil {
+	pipe := ss.Redis.TxPipeline()
+	pipe.Del(s.Token)
+	if s.UserID != 0 {
+		pipe.SRem(userSessionsKey(s.UserID), s.Token)
+	}
+	if _, err := pipe.Exec(); err != nil {
 		return errors.Wrap(err, "redis delete error")
 	}
 
 	return nil
 }
 
+// DeleteUserSessions удаляет все сессии юзера, например при бане
+func (ss *Conn) DeleteUserSessions(userID int64) error {
+	tokens, err := ss.Redis.SMembers(userSessionsKey(userID)).Result()
+	if err != nil {
+		return errors.Wrap(err, "redis get user sessions error")
+	}
+
+	keys := append(tokens, userSessionsKey(userID))
+	if err = ss.Redis.Del(keys...).Err(); err != nil {
+		return errors.Wrap(err, "redis delete user sessions error")
+	}
+
+	return nil
+}
+
+// GetUserSessions живые сессии юзера, ExpiresAfter -- сколько им осталось
+func (ss *Conn) GetUserSessions(userID int64) ([]*Session, error) {
+	tokens, err := ss.Redis.SMembers(userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis get user sessions error")
+	}
+
+	pipe := ss.Redis.Pipeline()
+	payloads := make([]*redis.StringCmd, len(tokens))
+	ttls := make([]*redis.DurationCmd, len(tokens))
+	for i, token := range tokens {
+		payloads[i] = pipe.Get(token)
+		ttls[i] = pipe.TTL(token)
+	}
+	// redis.Nil для протухших сессий, которые ещё числятся в индексе
+	if _, err = pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "redis get sessions error")
+	}
+
+	sessions := make([]*Session, 0, len(tokens))
+	for i, token := range tokens {
+		data, getErr := payloads[i].Bytes()
+		if getErr != nil {
+			continue
+		}
+
+		sessions = append(sessions, &Session{
+			Token:        token,
+			UserID:       userID,
+			Payload:      data,
+			ExpiresAfter: ttls[i].Val(),
+		})
+	}
+
+	return sessions, nil
+}
+
 // GetSession получает сессию из хранилища по токену
 func (ss *Conn) GetSession(token string) (*Session, error) {
-	data, err := storage.Client.Get(token).Bytes()
+	data, err := ss.Redis.Get(token).Bytes()
 	if err != nil {
 		return nil, errors.Wrap(err, "redis get error")
 	}
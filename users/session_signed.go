@@ -0,0 +1,209 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+)
+
+// SignedSessions сессии в подписанных токенах (JWT, HS256): payload лежит в самом токене,
+// в redis хранятся только отозванные токены. Ключи можно ротировать: подписываем
+// текущим, а проверяем всеми, пока старые токены не истекут
+type SignedSessions struct {
+	// Keys ключи подписи по kid
+	Keys map[string][]byte
+	// CurrentKey kid ключа, которым подписываем новые токены
+	CurrentKey string
+	Denylist   Denylist
+}
+
+// Denylist отозванные до истечения токены
+type Denylist interface {
+	// Revoke отзывает один токен, помнить о нём нужно только до его истечения
+	Revoke(id string, expires time.Time) error
+	// RevokeUser отзывает все токены юзера, выданные до at
+	RevokeUser(userID int64, at time.Time, ttl time.Duration) error
+	// IsRevoked отозван ли токен id юзера userID, выданный в issued
+	IsRevoked(id string, userID int64, issued time.Time) (bool, error)
+}
+
+// maxSessionAge сколько живёт сессия, столько же помним об отзыве всех сессий юзера
+const maxSessionAge = time.Hour * 24 * 30
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	ID      string `json:"jti"`
+	Subject string `json:"sub,omitempty"`
+	// время с дробной частью: отзыв и новый вход могут случиться в одну секунду
+	IssuedAt  float64         `json:"iat"`
+	ExpiresAt int64           `json:"exp"`
+	Payload   json.RawMessage `json:"sp"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func (ss *SignedSessions) sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Set подписывает токен с payload сессии, токен сохраняется в s.Token
+func (ss *SignedSessions) Set(s *Session) error {
+	key, ok := ss.Keys[ss.CurrentKey]
+	if !ok {
+		return errors.Errorf("signing key %q is not configured", ss.CurrentKey)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return errors.Wrap(err, "token id generate error")
+	}
+
+	now := time.Now()
+	claims := &jwtClaims{
+		ID:        b64.EncodeToString(id),
+		IssuedAt:  float64(now.UnixNano()) / float64(time.Second),
+		ExpiresAt: now.Add(s.ExpiresAfter).Unix(),
+		Payload:   s.Payload,
+	}
+	if s.UserID != 0 {
+		claims.Subject = strconv.FormatInt(s.UserID, 10)
+	}
+
+	header, err := json.Marshal(&jwtHeader{Alg: "HS256", Typ: "JWT", Kid: ss.CurrentKey})
+	if err != nil {
+		return errors.Wrap(err, "token header marshal error")
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return errors.Wrap(err, "token claims marshal error")
+	}
+
+	unsigned := b64.EncodeToString(header) + "." + b64.EncodeToString(body)
+	s.Token = unsigned + "." + b64.EncodeToString(ss.sign(key, unsigned))
+	return nil
+}
+
+// parse проверяет подпись и срок, но не отзыв
+func (ss *SignedSessions) parse(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, utils.ErrNotExists
+	}
+
+	headerJSON, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, utils.ErrNotExists
+	}
+	header := &jwtHeader{}
+	// alg проверяем явно, иначе возможна подмена на none
+	if err = json.Unmarshal(headerJSON, header); err != nil || header.Alg != "HS256" {
+		return nil, utils.ErrNotExists
+	}
+
+	key, ok := ss.Keys[header.Kid]
+	if !ok {
+		return nil, utils.ErrNotExists
+	}
+
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, ss.sign(key, parts[0]+"."+parts[1])) {
+		return nil, utils.ErrNotExists
+	}
+
+	body, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, utils.ErrNotExists
+	}
+	claims := &jwtClaims{}
+	if err = json.Unmarshal(body, claims); err != nil {
+		return nil, utils.ErrNotExists
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, utils.ErrNotExists
+	}
+
+	return claims, nil
+}
+
+func (c *jwtClaims) issued() time.Time {
+	return time.Unix(0, int64(c.IssuedAt*float64(time.Second)))
+}
+
+func (c *jwtClaims) userID() int64 {
+	// у сессий без юзера sub нет, для них 0
+	id, _ := strconv.ParseInt(c.Subject, 10, 64)
+	return id
+}
+
+// GetSession проверяет токен и достаёт из него payload
+func (ss *SignedSessions) GetSession(token string) (*Session, error) {
+	claims, err := ss.parse(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "token parse error")
+	}
+
+	revoked, err := ss.Denylist.IsRevoked(claims.ID, claims.userID(), claims.issued())
+	if err != nil {
+		return nil, errors.Wrap(err, "denylist check error")
+	}
+	if revoked {
+		return nil, errors.Wrap(utils.ErrNotExists, "token revoked")
+	}
+
+	return &Session{
+		Token:   token,
+		UserID:  claims.userID(),
+		Payload: claims.Payload,
+	}, nil
+}
+
+// Delete отзывает токен до его истечения
+func (ss *SignedSessions) Delete(s *Session) error {
+	claims, err := ss.parse(s.Token)
+	if err != nil {
+		// поддельный или истёкший токен отзывать незачем
+		return nil
+	}
+
+	if err = ss.Denylist.Revoke(claims.ID, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		return errors.Wrap(err, "revoke token error")
+	}
+
+	return nil
+}
+
+// DeleteUserSessions отзывает все выданные юзеру токены
+func (ss *SignedSessions) DeleteUserSessions(userID int64) error {
+	if err := ss.Denylist.RevokeUser(userID, time.Now(), maxSessionAge); err != nil {
+		return errors.Wrap(err, "revoke user tokens error")
+	}
+
+	return nil
+}
+
+// Close останавливает фоновую синхронизацию denylist, если она есть
+func (ss *SignedSessions) Close() error {
+	if closer, ok := ss.Denylist.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS "api_tokens";
+CREATE TABLE "api_tokens"
+(
+	id BIGSERIAL NOT NULL
+		CONSTRAINT api_tokens_pk PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name TEXT NOT NULL CHECK ( name <> '' ),
+	token_hash BYTEA NOT NULL,
+	scopes TEXT[] NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	expires TIMESTAMPTZ DEFAULT NULL, -- NULL -- бессрочный
+	last_used TIMESTAMPTZ DEFAULT NULL,
+	CONSTRAINT unique_token_hash UNIQUE(token_hash)
+);
+
+CREATE INDEX api_tokens_user_id_idx ON api_tokens (user_id);
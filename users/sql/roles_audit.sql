@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS "roles_audit";
+CREATE TABLE "roles_audit"
+(
+	id BIGSERIAL NOT NULL
+		CONSTRAINT roles_audit_pk
+			PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	actor_id BIGINT REFERENCES users (id) ON DELETE SET NULL,
+	old_role USER_ROLE NOT NULL,
+	new_role USER_ROLE NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX roles_audit_user_id_idx ON roles_audit (user_id);
@@ -1,3 +1,6 @@
+DROP TYPE IF EXISTS USER_ROLE CASCADE;
+CREATE TYPE USER_ROLE AS ENUM ('user', 'moderator', 'admin');
+
 DROP TABLE IF EXISTS "users" CASCADE;
 create table "users"
 (
@@ -8,17 +11,30 @@ create table "users"
 	password BYTEA NOT NULL,
 	active boolean default true not null,
 	photo_uuid UUID DEFAULT NULL,
-  CONSTRAINT unique_username UNIQUE(username)
+	email CITEXT DEFAULT NULL CHECK ( email <> '' ),
+	email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	totp_secret BYTEA DEFAULT NULL,
+	totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	totp_last_step BIGINT NOT NULL DEFAULT 0, -- период последнего принятого кода, старше не принимаем
+	pwd_ver BIGINT NOT NULL DEFAULT 1,
+	role USER_ROLE NOT NULL DEFAULT 'user',
+	ban_reason TEXT DEFAULT NULL,
+	banned_until TIMESTAMPTZ DEFAULT NULL, -- NULL при active = false значит бессрочно
+  CONSTRAINT unique_username UNIQUE(username),
+  CONSTRAINT unique_email UNIQUE(email)
 );
 
 DROP FUNCTION IF EXISTS users_count_increment CASCADE;
 CREATE FUNCTION users_count_increment() RETURNS TRIGGER AS $_$
 BEGIN
-IF NEW.password != OLD.password THEN
+-- пересчёт хеша с новыми параметрами (CheckPassword) пароль не меняет,
+-- поэтому ни сессии, ни ссылки сброса пароля не сбрасываем
+IF NEW.password != OLD.password
+	AND current_setting('warscript.password_rehash', TRUE) IS DISTINCT FROM 'on' THEN
 	UPDATE users SET pwd_ver = pwd_ver + 1 WHERE id = NEW.id;
 end if;
 RETURN NEW;
 END $_$ LANGUAGE 'plpgsql';
 
 CREATE TRIGGER users_insert_trigger AFTER UPDATE ON users
-  FOR EACH ROW EXECUTE PROCEDURE users_count_increment();
\ No newline at end of file
+  FOR EACH ROW EXECUTE PROCEDURE users_count_increment();
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS "users_identities";
+CREATE TABLE "users_identities"
+(
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	CONSTRAINT users_identities_pk PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX users_identities_user_id_idx ON users_identities (user_id);
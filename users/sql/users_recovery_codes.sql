@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS "users_recovery_codes";
+CREATE TABLE "users_recovery_codes"
+(
+	user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	code_hash BYTEA NOT NULL,
+	CONSTRAINT users_recovery_codes_pk PRIMARY KEY (user_id, code_hash)
+);
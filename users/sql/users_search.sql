@@ -0,0 +1,5 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- один GIN индекс обслуживает и префиксный LIKE, и нечёткий поиск по триграммам
+DROP INDEX IF EXISTS users_username_trgm_idx;
+CREATE INDEX users_username_trgm_idx ON users USING gin (lower(username::text) gin_trgm_ops);
@@ -0,0 +1,146 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TokenPasswordReset токен сброса пароля
+	TokenPasswordReset = "password_reset"
+	// TokenEmailVerify токен подтверждения почты
+	TokenEmailVerify = "email_verify"
+	// TokenTOTPChallenge токен между вводом пароля и кода 2FA
+	TokenTOTPChallenge = "totp_challenge"
+	// TokenOIDCState state входа через внешнего провайдера
+	TokenOIDCState = "oidc_state"
+)
+
+// OneTimeToken одноразовый короткоживущий токен
+type OneTimeToken struct {
+	Kind   string        `json:"-"`
+	UserID int64         `json:"user_id"`
+	Data   string        `json:"data"` // например почта, которую подтверждаем
+	TTL    time.Duration `json:"-"`
+	Token  string        `json:"-"` // заполняется при выпуске
+}
+
+// TokenAccessObject DAO for OneTimeToken
+type TokenAccessObject interface {
+	Issue(t *OneTimeToken) error
+	// Consume возвращает токен и сразу его удаляет,
+	// на невалидный, истёкший или уже использованный токен отдаёт utils.ErrNotExists
+	Consume(kind, token string) (*OneTimeToken, error)
+	// Peek как Consume, но токен не гасит
+	Peek(kind, token string) (*OneTimeToken, error)
+}
+
+// TokenStore implementation of TokenAccessObject.
+// Токен имеет вид random.signature: подпись позволяет отбросить мусор не ходя в redis,
+// а в redis по хешу random лежит сам токен, что и делает его одноразовым
+type TokenStore struct {
+	Secret []byte
+	Redis  *redis.Client
+}
+
+func (ts *TokenStore) sign(kind, random string) string {
+	mac := hmac.New(sha256.New, ts.Secret)
+	mac.Write([]byte(kind + "." + random))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func tokenKey(kind, random string) string {
+	sum := sha256.Sum256([]byte(random))
+	return "token:" + kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// Issue выпускает токен, сам токен сохраняется в t.Token
+func (ts *TokenStore) Issue(t *OneTimeToken) error {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return errors.Wrap(err, "token generate error")
+	}
+	random := base64.RawURLEncoding.EncodeToString(buf)
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrap(err, "token marshal error")
+	}
+
+	err = ts.Redis.Set(tokenKey(t.Kind, random), data, t.TTL).Err()
+	if err != nil {
+		return errors.Wrap(err, "redis save error")
+	}
+
+	t.Token = random + "." + ts.sign(t.Kind, random)
+	return nil
+}
+
+// key проверяет подпись токена и возвращает его ключ в redis
+func (ts *TokenStore) key(kind, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(ts.sign(kind, parts[0]))) {
+		return "", utils.ErrNotExists
+	}
+
+	return tokenKey(kind, parts[0]), nil
+}
+
+// Consume проверяет и гасит токен
+func (ts *TokenStore) Consume(kind, token string) (*OneTimeToken, error) {
+	key, err := ts.key(kind, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// GET и DEL в одной транзакции: второй Consume уже ничего не найдёт
+	pipe := ts.Redis.TxPipeline()
+	get := pipe.Get(key)
+	pipe.Del(key)
+	if _, err = pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "redis consume error")
+	}
+
+	return decodeToken(get, kind, token)
+}
+
+// Peek проверяет токен, не гася его
+func (ts *TokenStore) Peek(kind, token string) (*OneTimeToken, error) {
+	key, err := ts.key(kind, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeToken(ts.Redis.Get(key), kind, token)
+}
+
+func decodeToken(get *redis.StringCmd, kind, token string) (*OneTimeToken, error) {
+	data, err := get.Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, utils.ErrNotExists
+		}
+
+		return nil, errors.Wrap(err, "redis get error")
+	}
+
+	t := &OneTimeToken{}
+	if err = json.Unmarshal(data, t); err != nil {
+		return nil, errors.Wrap(err, "token unmarshal error")
+	}
+	t.Kind = kind
+	t.Token = token
+
+	return t, nil
+}
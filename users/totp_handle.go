@@ -0,0 +1,438 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/totp"
+	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	totpIssuer         = "WarScript"
+	totpChallengeTTL   = 5 * time.Minute
+	recoveryCodesCount = 10
+)
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// newTOTPChallenge выпускает токен для второго шага входа.
+// Токен одноразовый: на каждую попытку ввести код нужно заново ввести пароль
+func (h *Handler) newTOTPChallenge(user *UserModel) error {
+	t := &OneTimeToken{
+		Kind:   TokenTOTPChallenge,
+		UserID: user.ID.Int,
+		Data:   strconv.FormatInt(user.PwdVer.Int, 10),
+		TTL:    totpChallengeTTL,
+	}
+	if err := h.Tokens.Issue(t); err != nil {
+		return errors.Wrap(err, "issue totp challenge error")
+	}
+
+	return &TOTPChallenge{
+		Challenge: t.Token,
+	}
+}
+
+// normalizeRecoveryCode коды показываем как xxxxx-xxxxx, а принимаем в любом виде
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) []byte {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return sum[:]
+}
+
+// newRecoveryCodes генерирует и сохраняет новые коды восстановления взамен старых
+func (h *Handler) newRecoveryCodes(userID int64) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = h.Users.SetRecoveryCodes(userID, hashes); err != nil {
+		return nil, errors.Wrap(err, "set recovery codes error")
+	}
+
+	return codes, nil
+}
+
+// generateRecoveryCodes коды для юзера и их хеши для базы
+func generateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodesCount)
+	hashes := make([][]byte, recoveryCodesCount)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, errors.Wrap(err, "recovery code generate error")
+		}
+
+		code := recoveryEncoding.EncodeToString(buf)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// EnrollTOTP генерирует секрет 2FA, включится она после ConfirmTOTP
+func (h *Handler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "EnrollTOTP")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	user, err := h.Users.GetUserByID(info.ID)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get user method error"))
+		}
+		return
+	}
+
+	// иначе можно было бы перезаписать секрет, не зная пароля
+	if user.TOTPEnabled.Bool {
+		errWriter.WriteValidationError(&utils.ValidationError{
+			"totp": utils.ErrTaken.Error(),
+		})
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if err = h.Users.SaveTOTP(info.ID, secret, false); err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "save totp error"))
+		return
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, &TOTPEnrollment{
+		Secret: totp.EncodeSecret(secret),
+		URI:    totp.URI(totpIssuer, user.Username.String, secret),
+	})
+}
+
+// ConfirmTOTP включает 2FA, если юзер смог ввести код, и выдаёт коды восстановления
+func (h *Handler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "ConfirmTOTP")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	form := &FormTOTPCode{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	codes, err := h.confirmTOTPImpl(info, form)
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, &RecoveryCodes{
+		Codes: codes,
+	})
+}
+
+func (h *Handler) confirmTOTPImpl(info *SessionPayload, form *FormTOTPCode) ([]string, error) {
+	if err := form.Validate(); err != nil {
+		return nil, err
+	}
+
+	user, err := h.Users.GetUserByID(info.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get user error")
+	}
+
+	if user.TOTPEnabled.Bool {
+		return nil, &utils.ValidationError{
+			"totp": utils.ErrTaken.Error(),
+		}
+	}
+
+	if len(user.TOTPSecret.Bytes) == 0 {
+		return nil, &utils.ValidationError{
+			"totp": utils.ErrNotExists.Error(),
+		}
+	}
+
+	step, ok := totp.Match(user.TOTPSecret.Bytes, form.Code, time.Now())
+	if !ok {
+		return nil, &utils.ValidationError{
+			"code": utils.ErrInvalid.Error(),
+		}
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	// период кода запоминаем, чтобы им же нельзя было сразу войти
+	if err = h.Users.EnableTOTP(info.ID, step, hashes); err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			// параллельный запрос успел включить или сменить секрет
+			return nil, &utils.ValidationError{
+				"totp": utils.ErrInvalid.Error(),
+			}
+		}
+
+		return nil, errors.Wrap(err, "enable totp error")
+	}
+
+	return codes, nil
+}
+
+// CheckCurrentPassword общая часть действий, которые требуют текущий пароль
+func (h *Handler) CheckCurrentPassword(info *SessionPayload, r *http.Request) (*UserModel, error) {
+	form := &FormPassword{}
+	if err := utils.DecodeBodyJSON(r.Body, form); err != nil {
+		return nil, &utils.ValidationError{
+			"password": utils.ErrRequired.Error(),
+		}
+	}
+
+	if err := form.Validate(); err != nil {
+		return nil, err
+	}
+
+	user, err := h.Users.GetUserByID(info.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get user error")
+	}
+
+	if !h.Users.CheckPassword(user, form.Password) {
+		return nil, &utils.ValidationError{
+			"password": utils.ErrInvalid.Error(),
+		}
+	}
+
+	return user, nil
+}
+
+// DisableTOTP выключает 2FA, требует текущий пароль
+func (h *Handler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "DisableTOTP")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	_, err := h.CheckCurrentPassword(info, r)
+	if err == nil {
+		err = h.Users.SaveTOTP(info.ID, nil, false)
+	}
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "disable totp error"))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// RegenerateRecoveryCodes выдаёт новые коды восстановления, старые перестают работать
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "RegenerateRecoveryCodes")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+	info := SessionInfo(r)
+	if info == nil {
+		errWriter.WriteWarn(http.StatusUnauthorized, errors.New("session info is not presented"))
+		return
+	}
+
+	var codes []string
+	user, err := h.CheckCurrentPassword(info, r)
+	if err == nil {
+		if !user.TOTPEnabled.Bool {
+			err = &utils.ValidationError{
+				"totp": utils.ErrNotExists.Error(),
+			}
+		} else {
+			codes, err = h.newRecoveryCodes(info.ID)
+		}
+	}
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		if errors.Cause(err) == utils.ErrNotExists {
+			errWriter.WriteWarn(http.StatusUnauthorized, errors.Wrap(err, "user not exists"))
+		} else {
+			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "regenerate recovery codes error"))
+		}
+		return
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, &RecoveryCodes{
+		Codes: codes,
+	})
+}
+
+// CreateSessionTOTP второй шаг входа: проверяет код и ставит куку
+func (h *Handler) CreateSessionTOTP(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "CreateSessionTOTP")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	form := &FormTOTPLogin{}
+	err := utils.DecodeBodyJSON(r.Body, form)
+	if err != nil {
+		errWriter.WriteWarn(http.StatusBadRequest, errors.Wrap(err, "decode body error"))
+		return
+	}
+
+	user, err := h.challengeUser(form)
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// подбор кода считаем так же, как подбор пароля: на юзера из challenge и на IP
+	ip := h.ClientIP.IP(r)
+	if !h.checkLoginGuard(w, errWriter, user.Username.String, ip) {
+		return
+	}
+
+	session, err := h.secondFactorSession(user, form)
+	h.trackLoginAttempt(logger, user.Username.String, ip, err)
+	if err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			errWriter.WriteValidationError(validErr)
+			return
+		}
+
+		errWriter.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+
+	h.SetSessionCookie(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) secondFactorSession(user *UserModel, form *FormTOTPLogin) (*Session, error) {
+	if err := h.checkSecondFactor(user, form); err != nil {
+		return nil, err
+	}
+
+	return h.StartSession(user)
+}
+
+// challengeUser гасит challenge и возвращает юзера, для которого он выдан
+func (h *Handler) challengeUser(form *FormTOTPLogin) (*UserModel, error) {
+	if err := form.Validate(); err != nil {
+		return nil, err
+	}
+
+	invalidChallenge := &utils.ValidationError{
+		"challenge": utils.ErrInvalid.Error(),
+	}
+
+	t, err := h.Tokens.Consume(TokenTOTPChallenge, form.Challenge)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return nil, invalidChallenge
+		}
+
+		return nil, errors.Wrap(err, "consume challenge error")
+	}
+
+	user, err := h.Users.GetUserByID(t.UserID)
+	if err != nil {
+		if errors.Cause(err) == utils.ErrNotExists {
+			return nil, invalidChallenge
+		}
+
+		return nil, errors.Wrap(err, "get user error")
+	}
+
+	// пароль успели сменить, юзера успели забанить или 2FA успели выключить
+	if strconv.FormatInt(user.PwdVer.Int, 10) != t.Data || !user.IsActive(time.Now()) || !user.TOTPEnabled.Bool {
+		return nil, invalidChallenge
+	}
+
+	return user, nil
+}
+
+// checkSecondFactor проверяет код из приложения или одноразовый код восстановления
+func (h *Handler) checkSecondFactor(user *UserModel, form *FormTOTPLogin) error {
+	if form.RecoveryCode != "" {
+		used, err := h.Users.UseRecoveryCode(user.ID.Int, hashRecoveryCode(form.RecoveryCode))
+		if err != nil {
+			return errors.Wrap(err, "use recovery code error")
+		}
+		if !used {
+			return &utils.ValidationError{
+				"recovery_code": utils.ErrInvalid.Error(),
+			}
+		}
+		return nil
+	}
+
+	step, ok := totp.Match(user.TOTPSecret.Bytes, form.Code, time.Now())
+	if !ok {
+		return &utils.ValidationError{
+			"code": utils.ErrInvalid.Error(),
+		}
+	}
+
+	// код живёт несколько периодов, подсмотренный или перехваченный код второй раз не пройдёт
+	used, err := h.Users.UseTOTPStep(user.ID.Int, step)
+	if err != nil {
+		return errors.Wrap(err, "use totp step error")
+	}
+	if !used {
+		return &utils.ValidationError{
+			"code": utils.ErrInvalid.Error(),
+		}
+	}
+
+	return nil
+}
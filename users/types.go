@@ -1,6 +1,15 @@
 package users
 
 import (
+	"math"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-park-mail-ru/2019_1_HotCode/password"
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
 	"github.com/google/uuid"
@@ -20,14 +29,38 @@ type InfoUser struct {
 	Active bool  `json:"active"`
 }
 
+// UsernameMaxLength максимальная длина имени в символах
+const UsernameMaxLength = 32
+
+// usernameRune символы, из которых можно собрать имя
+func usernameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+// checkUsername правила для нового имени. Возвращает ошибку для ValidationError или nil
+func checkUsername(username string) error {
+	if username == "" {
+		return utils.ErrRequired
+	}
+	if utf8.RuneCountInString(username) > UsernameMaxLength {
+		return utils.ErrTooLong
+	}
+	if strings.IndexFunc(username, func(r rune) bool { return !usernameRune(r) }) != -1 {
+		return utils.ErrInvalid
+	}
+
+	return nil
+}
+
 // FormUser BasicUser, расширенный паролем, используется для входа и регистрации
 type FormUser struct {
 	BasicUser
 	Password string `json:"password"`
 }
 
-// Validate валидация полей
-func (fu *FormUser) Validate() *utils.ValidationError {
+// ValidateCredentials валидация при входе: старые пароли могли
+// не проходить по нынешним требованиям, но войти с ними надо дать
+func (fu *FormUser) ValidateCredentials() *utils.ValidationError {
 	err := utils.ValidationError{}
 	if fu.Username == "" {
 		err["username"] = utils.ErrRequired.Error()
@@ -44,23 +77,60 @@ func (fu *FormUser) Validate() *utils.ValidationError {
 	return &err
 }
 
+// Validate валидация полей при регистрации
+func (fu *FormUser) Validate() *utils.ValidationError {
+	err := fu.ValidateCredentials()
+	if err != nil {
+		return err
+	}
+
+	if usernameErr := checkUsername(fu.Username); usernameErr != nil {
+		return &utils.ValidationError{
+			"username": usernameErr.Error(),
+		}
+	}
+
+	if strengthErr := password.CheckStrength(fu.Password, fu.Username); strengthErr != nil {
+		return &utils.ValidationError{
+			"password": strengthErr.Error(),
+		}
+	}
+
+	return nil
+}
+
 // FormUserUpdate форма для обновления полей
 type FormUserUpdate struct {
 	Username    opt.String `json:"username"`
 	PhotoUUID   opt.String `json:"photo_uuid"`
+	Email       opt.String `json:"email"`
 	OldPassword opt.String `json:"oldPassword"`
 	NewPassword opt.String `json:"newPassword"`
 }
 
+// validEmail проверяет, что это голый адрес, без имени и <>
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
 // Validate валидация формы
 func (fu *FormUserUpdate) Validate() error {
 	err := utils.ValidationError{}
-	if fu.Username.IsDefined() && fu.Username.V == "" {
-		err["username"] = utils.ErrInvalid.Error()
+	if fu.Username.IsDefined() {
+		if fu.Username.V == "" {
+			err["username"] = utils.ErrInvalid.Error()
+		} else if usernameErr := checkUsername(fu.Username.V); usernameErr != nil {
+			err["username"] = usernameErr.Error()
+		}
 	}
 
-	if fu.NewPassword.IsDefined() && fu.NewPassword.V == "" {
-		err["newPassword"] = utils.ErrInvalid.Error()
+	if fu.NewPassword.IsDefined() {
+		if fu.NewPassword.V == "" {
+			err["newPassword"] = utils.ErrInvalid.Error()
+		} else if strengthErr := password.CheckStrength(fu.NewPassword.V, fu.Username.V); strengthErr != nil {
+			err["newPassword"] = strengthErr.Error()
+		}
 	}
 
 	if fu.PhotoUUID.IsDefined() && fu.PhotoUUID.V != "" {
@@ -69,6 +139,11 @@ func (fu *FormUserUpdate) Validate() error {
 		}
 	}
 
+	// пустая строка -- отвязать почту
+	if fu.Email.IsDefined() && fu.Email.V != "" && !validEmail(fu.Email.V) {
+		err["email"] = utils.ErrInvalid.Error()
+	}
+
 	if len(err) == 0 {
 		return nil
 	}
@@ -80,10 +155,369 @@ const (
 	// SessionInfoKey ключ, по которому в контексте
 	// реквеста хранится структура юзера после валидации
 	SessionInfoKey utils.ContextKey = 1
+	// AllowedScopeKey ключ, по которому в контексте лежит scope,
+	// с которым на ручку можно прийти по API токену, 2 занят utils.RequestUUIDKey
+	AllowedScopeKey utils.ContextKey = 3
 )
 
 // SessionPayload структура, которая хранится в session storage
 type SessionPayload struct {
 	ID     int64 `json:"id"`
 	PwdVer int64 `json:"pwd_ver"`
+	Role   Role  `json:"role"`
+	// TokenID и Scopes заполняются, только если запрос пришёл с API токеном
+	TokenID int64   `json:"token_id,omitempty"`
+	Scopes  []Scope `json:"scopes,omitempty"`
+}
+
+// Role роль пользователя, каждая следующая включает права предыдущей
+type Role string
+
+const (
+	// RoleUser обычный пользователь
+	RoleUser Role = "user"
+	// RoleModerator может модерировать пользователей
+	RoleModerator Role = "moderator"
+	// RoleAdmin может всё, в том числе раздавать роли
+	RoleAdmin Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// Valid есть ли такая роль
+func (r Role) Valid() bool {
+	_, ok := roleLevels[r]
+	return ok
+}
+
+// Includes есть ли у роли r все права роли other
+func (r Role) Includes(other Role) bool {
+	level, ok := roleLevels[r]
+	if !ok {
+		return false
+	}
+
+	return level >= roleLevels[other]
+}
+
+// FormRole форма выдачи роли
+type FormRole struct {
+	Role Role `json:"role"`
+}
+
+// Validate валидация формы
+func (fr *FormRole) Validate() *utils.ValidationError {
+	if fr.Role == "" {
+		return &utils.ValidationError{
+			"role": utils.ErrRequired.Error(),
+		}
+	}
+
+	if !fr.Role.Valid() {
+		return &utils.ValidationError{
+			"role": utils.ErrInvalid.Error(),
+		}
+	}
+
+	return nil
+}
+
+// FormPasswordReset запрос на сброс пароля по имени или по почте
+type FormPasswordReset struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// Validate валидация формы
+func (fr *FormPasswordReset) Validate() *utils.ValidationError {
+	if fr.Username == "" && fr.Email == "" {
+		return &utils.ValidationError{
+			"username": utils.ErrRequired.Error(),
+		}
+	}
+
+	return nil
+}
+
+// FormPasswordResetConfirm установка нового пароля по токену из письма
+type FormPasswordResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// Validate валидация формы
+func (fr *FormPasswordResetConfirm) Validate() *utils.ValidationError {
+	err := utils.ValidationError{}
+	if fr.Token == "" {
+		err["token"] = utils.ErrRequired.Error()
+	}
+
+	if fr.Password == "" {
+		err["password"] = utils.ErrRequired.Error()
+	} else if strengthErr := password.CheckStrength(fr.Password, ""); strengthErr != nil {
+		err["password"] = strengthErr.Error()
+	}
+
+	if len(err) == 0 {
+		return nil
+	}
+
+	return &err
+}
+
+// FormEmailVerify подтверждение почты по токену из письма
+type FormEmailVerify struct {
+	Token string `json:"token"`
+}
+
+// TOTPChallenge ответ на вход с включённой 2FA: пароль верный, осталось ввести код
+type TOTPChallenge struct {
+	Challenge string `json:"challenge"`
+}
+
+func (tc *TOTPChallenge) Error() string {
+	return "totp code required"
+}
+
+// TOTPEnrollment секрет для приложения-аутентификатора
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// RecoveryCodes коды восстановления, показываются один раз
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// FormTOTPCode код из приложения-аутентификатора
+type FormTOTPCode struct {
+	Code string `json:"code"`
+}
+
+// Validate валидация формы
+func (fc *FormTOTPCode) Validate() *utils.ValidationError {
+	if fc.Code == "" {
+		return &utils.ValidationError{
+			"code": utils.ErrRequired.Error(),
+		}
+	}
+
+	return nil
+}
+
+// FormPassword подтверждение опасного действия текущим паролем
+type FormPassword struct {
+	Password string `json:"password"`
+}
+
+// Validate валидация формы
+func (fp *FormPassword) Validate() *utils.ValidationError {
+	if fp.Password == "" {
+		return &utils.ValidationError{
+			"password": utils.ErrRequired.Error(),
+		}
+	}
+
+	return nil
+}
+
+// FormTOTPLogin второй шаг входа: код или код восстановления
+type FormTOTPLogin struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// Validate валидация формы
+func (fl *FormTOTPLogin) Validate() *utils.ValidationError {
+	err := utils.ValidationError{}
+	if fl.Challenge == "" {
+		err["challenge"] = utils.ErrRequired.Error()
+	}
+
+	if fl.Code == "" && fl.RecoveryCode == "" {
+		err["code"] = utils.ErrRequired.Error()
+	}
+
+	if len(err) == 0 {
+		return nil
+	}
+
+	return &err
+}
+
+// FormBan форма бана юзера, без expires_at бан бессрочный
+type FormBan struct {
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Validate валидация формы
+func (fb *FormBan) Validate() *utils.ValidationError {
+	err := utils.ValidationError{}
+	if fb.Reason == "" {
+		err["reason"] = utils.ErrRequired.Error()
+	}
+
+	if fb.ExpiresAt != nil && !fb.ExpiresAt.After(time.Now()) {
+		err["expires_at"] = utils.ErrInvalid.Error()
+	}
+
+	if len(err) == 0 {
+		return nil
+	}
+
+	return &err
+}
+
+// RoleAudit запись о смене роли
+type RoleAudit struct {
+	UserID  int64     `json:"user_id"`
+	ActorID int64     `json:"actor_id"`
+	OldRole Role      `json:"old_role"`
+	NewRole Role      `json:"new_role"`
+	Created time.Time `json:"created"`
+}
+
+// Scope право, которое выдаётся API токену
+type Scope string
+
+const (
+	// ScopeBotsWrite загрузка ботов
+	ScopeBotsWrite Scope = "bots:write"
+	// ScopeBotsRead просмотр своих ботов
+	ScopeBotsRead Scope = "bots:read"
+	// ScopeProfileRead просмотр своего профиля
+	ScopeProfileRead Scope = "profile:read"
+)
+
+// Valid известен ли такой scope
+func (s Scope) Valid() bool {
+	switch s {
+	case ScopeBotsWrite, ScopeBotsRead, ScopeProfileRead:
+		return true
+	}
+
+	return false
+}
+
+// HasScope выдан ли сессии scope. Обычная сессия по куке может всё,
+// ограничены только запросы с API токеном
+func (sp *SessionPayload) HasScope(scope Scope) bool {
+	if sp.TokenID == 0 {
+		return true
+	}
+
+	for _, s := range sp.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FormAPIToken форма выпуска API токена, без expires_at токен бессрочный
+type FormAPIToken struct {
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Validate валидация формы
+func (fa *FormAPIToken) Validate() *utils.ValidationError {
+	err := utils.ValidationError{}
+	if fa.Name == "" {
+		err["name"] = utils.ErrRequired.Error()
+	} else if len(fa.Name) > 64 {
+		err["name"] = utils.ErrTooLong.Error()
+	}
+
+	if len(fa.Scopes) == 0 {
+		err["scopes"] = utils.ErrRequired.Error()
+	}
+	for _, s := range fa.Scopes {
+		if !s.Valid() {
+			err["scopes"] = utils.ErrInvalid.Error()
+		}
+	}
+
+	if fa.ExpiresAt != nil && !fa.ExpiresAt.After(time.Now()) {
+		err["expires_at"] = utils.ErrInvalid.Error()
+	}
+
+	if len(err) == 0 {
+		return nil
+	}
+
+	return &err
+}
+
+// APIToken токен без секрета, сам секрет показывается только при выпуске
+type APIToken struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	Created   time.Time  `json:"created"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	LastUsed  *time.Time `json:"last_used"`
+}
+
+// NewAPIToken токен с секретом, отдаётся один раз
+type NewAPIToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+const (
+	// SearchLimitDefault сколько юзеров отдаём, если limit не передан
+	SearchLimitDefault = 10
+	// SearchLimitMax больше за раз не отдаём
+	SearchLimitMax = 50
+	// SearchQueryMinLength по одной букве поиск слишком похож на перебор всех юзеров
+	SearchQueryMinLength = 2
+	// SearchQueryMaxLength длиннее ников не бывает
+	SearchQueryMaxLength = 64
+)
+
+// FormUserSearch параметры поиска юзеров из query string
+type FormUserSearch struct {
+	Query  string
+	Limit  int
+	Offset int
+}
+
+// NewFormUserSearch разбирает ?query=&limit=&offset=
+func NewFormUserSearch(values url.Values) (*FormUserSearch, *utils.ValidationError) {
+	form := &FormUserSearch{
+		Query: strings.TrimSpace(values.Get("query")),
+		Limit: SearchLimitDefault,
+	}
+	err := utils.ValidationError{}
+	if !utils.ParseIntParam(values, "limit", &form.Limit, 1, SearchLimitMax) {
+		err["limit"] = utils.ErrInvalid.Error()
+	}
+	if !utils.ParseIntParam(values, "offset", &form.Offset, 0, math.MaxInt32) {
+		err["offset"] = utils.ErrInvalid.Error()
+	}
+
+	switch length := utf8.RuneCountInString(form.Query); {
+	case length == 0:
+		err["query"] = utils.ErrRequired.Error()
+	case length < SearchQueryMinLength:
+		err["query"] = utils.ErrTooShort.Error()
+	case length > SearchQueryMaxLength:
+		err["query"] = utils.ErrTooLong.Error()
+	}
+
+	if len(err) == 0 {
+		return form, nil
+	}
+
+	return nil, &err
 }
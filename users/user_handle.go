@@ -3,11 +3,11 @@ package users
 import (
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/pgtype"
 
+	"github.com/go-park-mail-ru/2019_1_HotCode/password"
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
 	"github.com/gorilla/mux"
@@ -15,7 +15,7 @@ import (
 )
 
 // CheckUsername checks if username already used
-func CheckUsername(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) CheckUsername(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "CheckUsername")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 
@@ -26,7 +26,7 @@ func CheckUsername(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = Users.GetUserByUsername(bUser.Username) // если база лежит
+	_, err = h.Users.GetUserByUsername(bUser.Username) // если база лежит
 	if err != nil && errors.Cause(err) != utils.ErrNotExists {
 		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "get user method error"))
 		return
@@ -43,8 +43,45 @@ func CheckUsername(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// SearchUsers ищет активных юзеров по нику для автодополнения
+func (h *Handler) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger(r, "SearchUsers")
+	errWriter := utils.NewErrorResponseWriter(w, logger)
+
+	form, valError := NewFormUserSearch(r.URL.Query())
+	if valError != nil {
+		errWriter.WriteValidationError(valError)
+		return
+	}
+
+	found, err := h.Users.SearchUsers(form.Query, form.Limit, form.Offset)
+	if err != nil {
+		errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "search users method error"))
+		return
+	}
+
+	result := make([]*InfoUser, len(found))
+	for i, user := range found {
+		photoUUID := ""
+		if user.PhotoUUID.Status == pgtype.Present {
+			photoUUID = uuid.UUID(user.PhotoUUID.Bytes).String()
+		}
+
+		result[i] = &InfoUser{
+			ID:     user.ID.Int,
+			Active: user.Active.Bool,
+			BasicUser: BasicUser{
+				Username:  user.Username.String,
+				PhotoUUID: photoUUID,
+			},
+		}
+	}
+
+	utils.WriteApplicationJSON(w, http.StatusOK, result)
+}
+
 // GetUser get user info by ID
-func GetUser(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "GetUser")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	vars := mux.Vars(r)
@@ -55,7 +92,7 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := Users.GetUserByID(userID)
+	user, err := h.Users.GetUserByID(userID)
 	if err != nil {
 		if errors.Cause(err) == utils.ErrNotExists {
 			errWriter.WriteWarn(http.StatusNotFound, errors.Wrap(err, "user not exists"))
@@ -81,7 +118,7 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 }
 
 // UpdateUser обновляет данные пользователя
-func UpdateUser(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "UpdateUser")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 	info := SessionInfo(r)
@@ -97,7 +134,7 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = updateUserImpl(info, updateForm)
+	err = h.updateUserImpl(info, updateForm)
 	if err != nil {
 		if validErr, ok := err.(*utils.ValidationError); ok {
 			errWriter.WriteValidationError(validErr)
@@ -117,7 +154,7 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 }
 
 //nolint: gocyclo
-func updateUserImpl(info *SessionPayload, updateForm *FormUserUpdate) error {
+func (h *Handler) updateUserImpl(info *SessionPayload, updateForm *FormUserUpdate) error {
 	if err := updateForm.Validate(); err != nil {
 		return err
 	}
@@ -125,15 +162,17 @@ func updateUserImpl(info *SessionPayload, updateForm *FormUserUpdate) error {
 	// нечего обновлять
 	if !updateForm.Username.IsDefined() &&
 		!updateForm.NewPassword.IsDefined() &&
-		!updateForm.PhotoUUID.IsDefined() {
+		!updateForm.PhotoUUID.IsDefined() &&
+		!updateForm.Email.IsDefined() {
 		return nil
 	}
 
 	// взяли юзера
-	user, err := Users.GetUserByID(info.ID)
+	user, err := h.Users.GetUserByID(info.ID)
 	if err != nil {
 		return errors.Wrap(err, "get user error")
 	}
+	storedUsername := user.Username.String
 
 	// хотим обновить username
 	if updateForm.Username.IsDefined() {
@@ -157,16 +196,33 @@ func updateUserImpl(info *SessionPayload, updateForm *FormUserUpdate) error {
 		}
 	}
 
+	// новую почту нужно подтвердить заново
+	emailChanged := updateForm.Email.IsDefined() && updateForm.Email.V != user.Email.String
+	if emailChanged {
+		user.Email = pgtype.Varchar{Status: pgtype.Null}
+		if updateForm.Email.V != "" {
+			user.Email = pgtype.Varchar{String: updateForm.Email.V, Status: pgtype.Present}
+		}
+		user.EmailVerified = pgtype.Bool{Bool: false, Status: pgtype.Present}
+	}
+
 	// Если обновляется пароль, нужно проверить,
 	// что пользователь знает старый
 	if updateForm.NewPassword.IsDefined() {
+		// Validate сверил пароль только с username из формы, а его могут и не менять
+		if strengthErr := password.CheckStrength(updateForm.NewPassword.V, storedUsername); strengthErr != nil {
+			return &utils.ValidationError{
+				"newPassword": strengthErr.Error(),
+			}
+		}
+
 		if !updateForm.OldPassword.IsDefined() {
 			return &utils.ValidationError{
 				"oldPassword": utils.ErrRequired.Error(),
 			}
 		}
 
-		if !Users.CheckPassword(user, updateForm.OldPassword.V) {
+		if !h.Users.CheckPassword(user, updateForm.OldPassword.V) {
 			return &utils.ValidationError{
 				"oldPassword": utils.ErrInvalid.Error(),
 			}
@@ -176,21 +232,34 @@ func updateUserImpl(info *SessionPayload, updateForm *FormUserUpdate) error {
 	}
 
 	// пытаемся сохранить
-	if err := Users.Save(user); err != nil {
-		if errors.Cause(err) == utils.ErrTaken {
+	if err := h.Users.Save(user); err != nil {
+		if validErr, ok := err.(*utils.ValidationError); ok {
+			return validErr
+		}
+
+		switch errors.Cause(err) {
+		case utils.ErrTaken:
 			return &utils.ValidationError{
 				"username": utils.ErrTaken.Error(),
 			}
+		case utils.ErrTooLong:
+			return &utils.ValidationError{
+				"newPassword": utils.ErrTooLong.Error(),
+			}
 		}
 
 		return errors.Wrap(err, "user save error")
 	}
 
+	if emailChanged && user.Email.Status == pgtype.Present {
+		return h.sendEmailVerification(user)
+	}
+
 	return nil
 }
 
 // CreateUser creates new user
-func CreateUser(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	logger := utils.GetLogger(r, "CreateUser")
 	errWriter := utils.NewErrorResponseWriter(w, logger)
 
@@ -214,19 +283,24 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		Password: &form.Password,
 	}
 
-	if err = Users.Create(user); err != nil {
-		if errors.Cause(err) == utils.ErrTaken {
+	if err = h.Users.Create(user); err != nil {
+		switch errors.Cause(err) {
+		case utils.ErrTaken:
 			errWriter.WriteValidationError(&utils.ValidationError{
 				"username": utils.ErrTaken.Error(),
 			})
-		} else {
+		case utils.ErrTooLong:
+			errWriter.WriteValidationError(&utils.ValidationError{
+				"password": utils.ErrTooLong.Error(),
+			})
+		default:
 			errWriter.WriteError(http.StatusInternalServerError, errors.Wrap(err, "user create error"))
 		}
 		return
 	}
 
 	// сразу же логиним юзера
-	session, err := CreateSessionImpl(form)
+	session, err := h.CreateSessionImpl(form)
 	if err != nil {
 		if validErr, ok := err.(*utils.ValidationError); ok {
 			errWriter.WriteValidationError(validErr)
@@ -237,14 +311,6 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ставим куку
-	http.SetCookie(w, &http.Cookie{
-		Name:     "JSESSIONID",
-		Value:    session.Token,
-		Expires:  time.Now().Add(2628000 * time.Second),
-		HttpOnly: true,
-	})
-
+	h.SetSessionCookie(w, session)
 	w.WriteHeader(http.StatusOK)
-
 }
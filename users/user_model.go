@@ -2,35 +2,64 @@ package users
 
 import (
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
 	"github.com/go-park-mail-ru/2019_1_HotCode/database"
+	"github.com/go-park-mail-ru/2019_1_HotCode/password"
 
 	"github.com/jackc/pgx"
 	"github.com/jackc/pgx/pgtype"
 
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
+	log "github.com/sirupsen/logrus"
 )
 
 // UserAccessObject DAO for User model
 type UserAccessObject interface {
 	GetUserByID(id int64) (*UserModel, error)
 	GetUserByUsername(username string) (*UserModel, error)
+	GetUserByEmail(email string) (*UserModel, error)
+	// SearchUsers активные юзеры, чей ник начинается с query или похож на него
+	SearchUsers(query string, limit, offset int) ([]*UserModel, error)
 
 	Create(u *UserModel) error
 	Save(u *UserModel) error
 	CheckPassword(u *UserModel, password string) bool
+
+	Ban(userID int64, reason string, until pgtype.Timestamptz) error
+	Unban(userID int64) error
+
+	// SaveTOTP сохраняет секрет 2FA, nil секрет выключает 2FA и удаляет коды восстановления
+	SaveTOTP(userID int64, secret []byte, enabled bool) error
+	SetRecoveryCodes(userID int64, hashes [][]byte) error
+	// EnableTOTP включает 2FA с уже сохранённым секретом и выдаёт коды восстановления,
+	// step -- период кода, которым подтвердили. utils.ErrNotExists, если включать нечего
+	EnableTOTP(userID, step int64, hashes [][]byte) error
+	// UseTOTPStep запоминает период принятого кода, false -- код этого или более
+	// позднего периода уже использован
+	UseTOTPStep(userID, step int64) (bool, error)
+	UseRecoveryCode(userID int64, hash []byte) (bool, error)
+
+	SetRole(userID, actorID int64, role Role) error
+	GetRoleAudit(userID int64) ([]*RoleAuditModel, error)
+
+	// GetUserByIdentity юзер, привязанный к аккаунту у внешнего провайдера
+	GetUserByIdentity(provider, subject string) (*UserModel, error)
+	// CreateWithIdentity создаёт юзера сразу с привязкой, u.ID заполняется
+	CreateWithIdentity(u *UserModel, provider, subject string) error
+	LinkIdentity(userID int64, provider, subject string) error
+
+	// Delete удаляет юзера, всё его остальное удаляется каскадом
+	Delete(userID int64) error
 }
 
 // AccessObject implementation of UserAccessObject
-type AccessObject struct{}
-
-var Users UserAccessObject
-
-func init() {
-	Users = &AccessObject{}
+type AccessObject struct {
+	DB     *pgx.ConnPool
+	Hasher *password.Hasher
 }
 
 // User model for users table
@@ -42,12 +71,38 @@ type UserModel struct {
 	Active        pgtype.Bool
 	PasswordCrypt pgtype.Bytea // внутренний хеш для проверки
 	PwdVer        pgtype.Int8
+	Role          pgtype.Varchar
+	BanReason     pgtype.Text
+	BannedUntil   pgtype.Timestamptz
+	Email         pgtype.Varchar
+	EmailVerified pgtype.Bool
+	TOTPSecret    pgtype.Bytea
+	TOTPEnabled   pgtype.Bool
+}
+
+// IsActive можно ли юзеру пользоваться аккаунтом в момент now.
+// Бан с истёкшим сроком уже не действует, даже если его ещё не сняли в базе
+func (u *UserModel) IsActive(now time.Time) bool {
+	if u.Active.Status != pgtype.Present || u.Active.Bool {
+		return true
+	}
+
+	return u.BannedUntil.Status == pgtype.Present && !u.BannedUntil.Time.After(now)
+}
+
+// RoleAuditModel model for roles_audit table
+type RoleAuditModel struct {
+	UserID  pgtype.Int8
+	ActorID pgtype.Int8
+	OldRole pgtype.Varchar
+	NewRole pgtype.Varchar
+	Created pgtype.Timestamptz
 }
 
 // Create создаёт запись в базе с новыми полями
 func (us *AccessObject) Create(u *UserModel) error {
 	var err error
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(*u.Password), bcrypt.MinCost)
+	hashedPass, err := us.Hasher.Hash(*u.Password)
 	if err != nil {
 		return errors.Wrap(err, "password generate error")
 	}
@@ -56,7 +111,7 @@ func (us *AccessObject) Create(u *UserModel) error {
 		Status: pgtype.Present,
 	}
 
-	tx, err := database.Conn.Begin()
+	tx, err := us.DB.Begin()
 	if err != nil {
 		return errors.Wrap(err, "can not open user create transaction")
 	}
@@ -86,7 +141,7 @@ func (us *AccessObject) Create(u *UserModel) error {
 // Save сохраняет юзера в базу
 func (us *AccessObject) Save(u *UserModel) error {
 	if u.Password != nil {
-		newPass, err := bcrypt.GenerateFromPassword([]byte(*u.Password), bcrypt.MinCost)
+		newPass, err := us.Hasher.Hash(*u.Password)
 		if err != nil {
 			return errors.Wrap(err, "password generate error")
 		}
@@ -96,7 +151,7 @@ func (us *AccessObject) Save(u *UserModel) error {
 		}
 	}
 
-	tx, err := database.Conn.Begin()
+	tx, err := us.DB.Begin()
 	if err != nil {
 		return errors.Wrap(err, "can not open 'user Save' transaction")
 	}
@@ -109,14 +164,27 @@ func (us *AccessObject) Save(u *UserModel) error {
 		return errors.Wrap(err, "get user save error")
 	}
 
-	_, err = tx.Exec(`UPDATE users SET (username, password, photo_uuid, active) = (
+	if u.Email.Status == pgtype.Present {
+		du, err = us.getUserImpl(tx, "email", u.Email.String)
+		if err == nil && u.ID != du.ID {
+			return &utils.ValidationError{
+				"email": utils.ErrTaken.Error(),
+			}
+		} else if err != nil && err != pgx.ErrNoRows {
+			return errors.Wrap(err, "get user save error")
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE users SET (username, password, photo_uuid, active, email, email_verified) = (
 		COALESCE($1, username),
 		COALESCE($2, password),
 		$3,
-		COALESCE($4, active)
+		COALESCE($4, active),
+		$5,
+		COALESCE($6, email_verified)
 		)
-		WHERE id = $5;`,
-		&u.Username, &u.PasswordCrypt, &u.PhotoUUID, &u.Active, &u.ID)
+		WHERE id = $7;`,
+		&u.Username, &u.PasswordCrypt, &u.PhotoUUID, &u.Active, &u.Email, &u.EmailVerified, &u.ID)
 	if err != nil {
 		return errors.Wrap(err, "user save error")
 	}
@@ -129,15 +197,465 @@ func (us *AccessObject) Save(u *UserModel) error {
 	return nil
 }
 
-// CheckPassword проверяет пароль у юзера и сохранённый в модели
-func (us *AccessObject) CheckPassword(u *UserModel, password string) bool {
-	err := bcrypt.CompareHashAndPassword(u.PasswordCrypt.Bytes, []byte(password))
-	return err == nil
+// CheckPassword проверяет пароль у юзера и сохранённый в модели.
+// Если хеш посчитан со старыми параметрами, заодно пересчитывает его
+func (us *AccessObject) CheckPassword(u *UserModel, pass string) bool {
+	ok, needsRehash := us.Hasher.Verify(u.PasswordCrypt.Bytes, pass)
+	if !ok || !needsRehash {
+		return ok
+	}
+
+	// слишком длинный для bcrypt пароль просто остаётся со старым хешем
+	if err := us.rehashPassword(u, pass); err != nil && errors.Cause(err) != utils.ErrTooLong {
+		log.WithField("method", "CheckPassword").Error(err)
+	}
+	return true
+}
+
+// rehashPassword сохраняет хеш с текущими параметрами. Пароль при этом
+// не меняется, так что pwd_ver триггер не трогает
+func (us *AccessObject) rehashPassword(u *UserModel, pass string) error {
+	newPass, err := us.Hasher.Hash(pass)
+	if err != nil {
+		return errors.Wrap(err, "password rehash error")
+	}
+
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can not open 'password rehash' transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SET LOCAL warscript.password_rehash = 'on';`)
+	if err != nil {
+		return errors.Wrap(err, "password rehash setting error")
+	}
+
+	// пароль могли сменить, пока мы его проверяли: тогда новый хеш не нужен
+	var pwdVer pgtype.Int8
+	row := tx.QueryRow(`UPDATE users SET password = $1 WHERE id = $2 AND password = $3 RETURNING pwd_ver;`,
+		newPass, &u.ID, u.PasswordCrypt.Bytes)
+	if err = row.Scan(&pwdVer); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		return errors.Wrap(err, "password rehash save error")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "password rehash transaction commit error")
+	}
+
+	u.PasswordCrypt = pgtype.Bytea{
+		Bytes:  newPass,
+		Status: pgtype.Present,
+	}
+	u.PwdVer = pwdVer
+	return nil
+}
+
+// Ban деактивирует юзера до until(бессрочно, если until не задан)
+// и снимает его ботов с игр
+func (us *AccessObject) Ban(userID int64, reason string, until pgtype.Timestamptz) error {
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can not open 'user Ban' transaction")
+	}
+	defer tx.Rollback()
+
+	var id int64
+	row := tx.QueryRow(`UPDATE users SET (active, ban_reason, banned_until) = (FALSE, $1, $2)
+		WHERE id = $3 RETURNING id;`, reason, &until, userID)
+	if err = row.Scan(&id); err != nil {
+		if err == pgx.ErrNoRows {
+			return utils.ErrNotExists
+		}
+
+		return errors.Wrap(err, "user ban error")
+	}
+
+	_, err = tx.Exec(`UPDATE bots SET is_active = FALSE WHERE author_id = $1;`, userID)
+	if err != nil {
+		return errors.Wrap(err, "user bots deactivate error")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "user ban transaction commit error")
+	}
+
+	return nil
+}
+
+// Unban снимает бан, ботов юзер активирует сам
+func (us *AccessObject) Unban(userID int64) error {
+	var id int64
+	row := us.DB.QueryRow(`UPDATE users SET (active, ban_reason, banned_until) = (TRUE, NULL, NULL)
+		WHERE id = $1 RETURNING id;`, userID)
+	if err := row.Scan(&id); err != nil {
+		if err == pgx.ErrNoRows {
+			return utils.ErrNotExists
+		}
+
+		return errors.Wrap(err, "user unban error")
+	}
+
+	return nil
+}
+
+// likeEscaper экранирует спецсимволы LIKE, чтобы "_" в запросе искал подчёркивание
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers сначала совпадения по префиксу, потом по похожести.
+// Выражение lower(username::text) должно совпадать с индексом users_username_trgm_idx
+func (us *AccessObject) SearchUsers(query string, limit, offset int) ([]*UserModel, error) {
+	query = strings.ToLower(query)
+	rows, err := us.DB.Query(`SELECT u.id, u.username, u.photo_uuid, u.active FROM users u
+		WHERE (u.active OR u.banned_until <= now())
+			AND (lower(u.username::text) LIKE $1 OR lower(u.username::text) % $2)
+		ORDER BY lower(u.username::text) LIKE $1 DESC, similarity(lower(u.username::text), $2) DESC,
+			u.username, u.id
+		OFFSET $3 LIMIT $4;`, likeEscaper.Replace(query)+"%", query, offset, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "search users error")
+	}
+	defer rows.Close()
+
+	found := make([]*UserModel, 0)
+	for rows.Next() {
+		u := &UserModel{}
+		if err = rows.Scan(&u.ID, &u.Username, &u.PhotoUUID, &u.Active); err != nil {
+			return nil, errors.Wrap(err, "search users scan error")
+		}
+		found = append(found, u)
+	}
+
+	return found, nil
+}
+
+// Delete удаляет юзера. Боты, очки в играх, токены и привязки удаляются
+// по ON DELETE CASCADE, в аудите ролей он остаётся только как actor_id = NULL
+func (us *AccessObject) Delete(userID int64) error {
+	tag, err := us.DB.Exec(`DELETE FROM users WHERE id = $1;`, userID)
+	if err != nil {
+		return errors.Wrap(err, "user delete error")
+	}
+
+	if tag.RowsAffected() == 0 {
+		return utils.ErrNotExists
+	}
+
+	return nil
+}
+
+// SaveTOTP сохраняет секрет 2FA
+func (us *AccessObject) SaveTOTP(userID int64, secret []byte, enabled bool) error {
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can not open 'user SaveTOTP' transaction")
+	}
+	defer tx.Rollback()
+
+	totpSecret := pgtype.Bytea{Bytes: secret, Status: pgtype.Present}
+	if secret == nil {
+		totpSecret.Status = pgtype.Null
+		enabled = false
+
+		_, err = tx.Exec(`DELETE FROM users_recovery_codes WHERE user_id = $1;`, userID)
+		if err != nil {
+			return errors.Wrap(err, "delete recovery codes error")
+		}
+	}
+
+	var id int64
+	row := tx.QueryRow(`UPDATE users SET (totp_secret, totp_enabled) = ($1, $2)
+		WHERE id = $3 RETURNING id;`, &totpSecret, enabled, userID)
+	if err = row.Scan(&id); err != nil {
+		if err == pgx.ErrNoRows {
+			return utils.ErrNotExists
+		}
+
+		return errors.Wrap(err, "user save totp error")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "user save totp transaction commit error")
+	}
+
+	return nil
+}
+
+// SetRecoveryCodes заменяет коды восстановления юзера
+func (us *AccessObject) SetRecoveryCodes(userID int64, hashes [][]byte) error {
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can not open 'user SetRecoveryCodes' transaction")
+	}
+	defer tx.Rollback()
+
+	if err = replaceRecoveryCodes(tx, userID, hashes); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "user set recovery codes transaction commit error")
+	}
+
+	return nil
+}
+
+func replaceRecoveryCodes(tx *pgx.Tx, userID int64, hashes [][]byte) error {
+	_, err := tx.Exec(`DELETE FROM users_recovery_codes WHERE user_id = $1;`, userID)
+	if err != nil {
+		return errors.Wrap(err, "delete recovery codes error")
+	}
+
+	for _, hash := range hashes {
+		_, err = tx.Exec(`INSERT INTO users_recovery_codes (user_id, code_hash) VALUES ($1, $2);`,
+			userID, hash)
+		if err != nil {
+			return errors.Wrap(err, "insert recovery code error")
+		}
+	}
+
+	return nil
+}
+
+// EnableTOTP включение 2FA и коды восстановления в одной транзакции:
+// без кодов юзер, потерявший телефон, не войдёт
+func (us *AccessObject) EnableTOTP(userID, step int64, hashes [][]byte) error {
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can not open 'user EnableTOTP' transaction")
+	}
+	defer tx.Rollback()
+
+	var id int64
+	row := tx.QueryRow(`UPDATE users SET (totp_enabled, totp_last_step) = (TRUE, $2)
+		WHERE id = $1 AND totp_secret IS NOT NULL AND NOT totp_enabled RETURNING id;`, userID, step)
+	if err = row.Scan(&id); err != nil {
+		if err == pgx.ErrNoRows {
+			return utils.ErrNotExists
+		}
+
+		return errors.Wrap(err, "user enable totp error")
+	}
+
+	if err = replaceRecoveryCodes(tx, userID, hashes); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "user enable totp transaction commit error")
+	}
+
+	return nil
+}
+
+// UseTOTPStep сравнение и запись одним запросом, чтобы два параллельных входа
+// с одним кодом не прошли оба
+func (us *AccessObject) UseTOTPStep(userID, step int64) (bool, error) {
+	tag, err := us.DB.Exec(`UPDATE users SET totp_last_step = $2
+		WHERE id = $1 AND totp_last_step < $2;`, userID, step)
+	if err != nil {
+		return false, errors.Wrap(err, "use totp step error")
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// UseRecoveryCode гасит код восстановления, false -- такого кода нет
+func (us *AccessObject) UseRecoveryCode(userID int64, hash []byte) (bool, error) {
+	tag, err := us.DB.Exec(`DELETE FROM users_recovery_codes
+		WHERE user_id = $1 AND code_hash = $2;`, userID, hash)
+	if err != nil {
+		return false, errors.Wrap(err, "use recovery code error")
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// GetUserByIdentity юзер, привязанный к аккаунту у внешнего провайдера
+func (us *AccessObject) GetUserByIdentity(provider, subject string) (*UserModel, error) {
+	var userID int64
+	row := us.DB.QueryRow(`SELECT user_id FROM users_identities
+		WHERE provider = $1 AND subject = $2;`, provider, subject)
+	if err := row.Scan(&userID); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, utils.ErrNotExists
+		}
+
+		return nil, errors.Wrap(err, "get identity error")
+	}
+
+	return us.GetUserByID(userID)
+}
+
+// CreateWithIdentity создаёт юзера сразу с привязкой к внешнему аккаунту.
+// Если почта уже у другого юзера -- ValidationError
+func (us *AccessObject) CreateWithIdentity(u *UserModel, provider, subject string) error {
+	hashedPass, err := us.Hasher.Hash(*u.Password)
+	if err != nil {
+		return errors.Wrap(err, "password generate error")
+	}
+	u.PasswordCrypt = pgtype.Bytea{
+		Bytes:  hashedPass,
+		Status: pgtype.Present,
+	}
+
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can not open 'user CreateWithIdentity' transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = us.getUserImpl(tx, "username", u.Username.String)
+	if err != pgx.ErrNoRows {
+		if err == nil {
+			return utils.ErrTaken
+		}
+		return errors.Wrap(err, "select duplicate errors")
+	}
+
+	if u.Email.Status == pgtype.Present {
+		_, err = us.getUserImpl(tx, "email", u.Email.String)
+		if err == nil {
+			return &utils.ValidationError{
+				"email": utils.ErrTaken.Error(),
+			}
+		} else if err != pgx.ErrNoRows {
+			return errors.Wrap(err, "select duplicate errors")
+		}
+	}
+
+	row := tx.QueryRow(`INSERT INTO users (username, password, email, email_verified)
+		VALUES($1, $2, $3, COALESCE($4, FALSE)) RETURNING id;`,
+		&u.Username, &u.PasswordCrypt, &u.Email, &u.EmailVerified)
+	if err = row.Scan(&u.ID); err != nil {
+		return createIdentityError(err)
+	}
+
+	if err = linkIdentityImpl(tx, u.ID.Int, provider, subject); err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "user create transaction commit error")
+	}
+
+	return nil
+}
+
+// createIdentityError кто-то успел занять имя или почту между проверкой и вставкой
+func createIdentityError(err error) error {
+	pgErr, ok := err.(pgx.PgError)
+	if !ok || pgErr.Code != "23505" {
+		return errors.Wrap(err, "user create error")
+	}
+
+	if pgErr.ConstraintName == "unique_email" {
+		return &utils.ValidationError{
+			"email": utils.ErrTaken.Error(),
+		}
+	}
+	return utils.ErrTaken
+}
+
+// LinkIdentity привязывает внешний аккаунт к существующему юзеру
+func (us *AccessObject) LinkIdentity(userID int64, provider, subject string) error {
+	return linkIdentityImpl(us.DB, userID, provider, subject)
+}
+
+func linkIdentityImpl(q database.Queryer, userID int64, provider, subject string) error {
+	var id int64
+	// привязка к этому же юзеру уже есть -- ничего не делаем, к другому -- ErrTaken
+	row := q.QueryRow(`INSERT INTO users_identities (provider, subject, user_id) VALUES ($1, $2, $3)
+		ON CONFLICT (provider, subject) DO UPDATE SET user_id = users_identities.user_id
+		RETURNING user_id;`, provider, subject, userID)
+	if err := row.Scan(&id); err != nil {
+		return errors.Wrap(err, "link identity error")
+	}
+
+	if id != userID {
+		return utils.ErrTaken
+	}
+
+	return nil
+}
+
+// SetRole меняет роль юзера и записывает это в аудит
+func (us *AccessObject) SetRole(userID, actorID int64, role Role) error {
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "can not open 'user SetRole' transaction")
+	}
+	defer tx.Rollback()
+
+	var oldRole string
+	row := tx.QueryRow(`SELECT role::text FROM users WHERE id = $1 FOR UPDATE;`, userID)
+	if err = row.Scan(&oldRole); err != nil {
+		if err == pgx.ErrNoRows {
+			return utils.ErrNotExists
+		}
+
+		return errors.Wrap(err, "get user role error")
+	}
+
+	// роль не поменялась, в аудит писать нечего
+	if oldRole == string(role) {
+		return nil
+	}
+
+	_, err = tx.Exec(`UPDATE users SET role = $1::text::USER_ROLE WHERE id = $2;`, string(role), userID)
+	if err != nil {
+		return errors.Wrap(err, "user set role error")
+	}
+
+	_, err = tx.Exec(`INSERT INTO roles_audit (user_id, actor_id, old_role, new_role)
+		VALUES ($1, $2, $3::text::USER_ROLE, $4::text::USER_ROLE);`, userID, actorID, oldRole, string(role))
+	if err != nil {
+		return errors.Wrap(err, "role audit insert error")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "user set role transaction commit error")
+	}
+
+	return nil
+}
+
+// GetRoleAudit история смены ролей юзера, свежие записи первыми
+func (us *AccessObject) GetRoleAudit(userID int64) ([]*RoleAuditModel, error) {
+	rows, err := us.DB.Query(`SELECT ra.user_id, ra.actor_id, ra.old_role::text,
+		ra.new_role::text, ra.created FROM roles_audit ra
+		WHERE ra.user_id = $1 ORDER BY ra.created DESC, ra.id DESC;`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get role audit error")
+	}
+	defer rows.Close()
+
+	audit := make([]*RoleAuditModel, 0)
+	for rows.Next() {
+		record := &RoleAuditModel{}
+		err = rows.Scan(&record.UserID, &record.ActorID, &record.OldRole,
+			&record.NewRole, &record.Created)
+		if err != nil {
+			return nil, errors.Wrap(err, "get role audit scan error")
+		}
+		audit = append(audit, record)
+	}
+
+	return audit, nil
 }
 
 // GetUserByID получает юзера по id
 func (us *AccessObject) GetUserByID(id int64) (*UserModel, error) {
-	u, err := us.getUserImpl(database.Conn, "id", strconv.FormatInt(id, 10))
+	u, err := us.getUserImpl(us.DB, "id", strconv.FormatInt(id, 10))
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, utils.ErrNotExists
@@ -151,7 +669,7 @@ func (us *AccessObject) GetUserByID(id int64) (*UserModel, error) {
 
 // GetUserByUsername получает юзера по имени
 func (us *AccessObject) GetUserByUsername(username string) (*UserModel, error) {
-	u, err := us.getUserImpl(database.Conn, "username", username)
+	u, err := us.getUserImpl(us.DB, "username", username)
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -164,12 +682,30 @@ func (us *AccessObject) GetUserByUsername(username string) (*UserModel, error) {
 	return u, nil
 }
 
+// GetUserByEmail получает юзера по почте
+func (us *AccessObject) GetUserByEmail(email string) (*UserModel, error) {
+	u, err := us.getUserImpl(us.DB, "email", email)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, utils.ErrNotExists
+		}
+
+		return nil, errors.Wrap(err, "get user by email error")
+	}
+
+	return u, nil
+}
+
 func (us *AccessObject) getUserImpl(q database.Queryer, field, value string) (*UserModel, error) {
 	u := &UserModel{}
 
 	row := q.QueryRow(`SELECT u.id, u.username, u.password,
-	 					u.active, u.photo_uuid, u.pwd_ver FROM users u WHERE `+field+` = $1;`, value)
-	if err := row.Scan(&u.ID, &u.Username, &u.PasswordCrypt, &u.Active, &u.PhotoUUID, &u.PwdVer); err != nil {
+	 					u.active, u.photo_uuid, u.pwd_ver, u.role::text, u.ban_reason, u.banned_until,
+						u.email, u.email_verified, u.totp_secret, u.totp_enabled
+						FROM users u WHERE `+field+` = $1;`, value)
+	if err := row.Scan(&u.ID, &u.Username, &u.PasswordCrypt, &u.Active, &u.PhotoUUID,
+		&u.PwdVer, &u.Role, &u.BanReason, &u.BannedUntil, &u.Email, &u.EmailVerified,
+		&u.TOTPSecret, &u.TOTPEnabled); err != nil {
 		return nil, err
 	}
 
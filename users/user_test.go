@@ -1,13 +1,28 @@
 package users
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-park-mail-ru/2019_1_HotCode/bruteforce"
+	"github.com/go-park-mail-ru/2019_1_HotCode/mailer"
+	"github.com/go-park-mail-ru/2019_1_HotCode/oidc"
+	"github.com/go-park-mail-ru/2019_1_HotCode/oidc/oidctest"
 	"github.com/go-park-mail-ru/2019_1_HotCode/testutils"
+	"github.com/go-park-mail-ru/2019_1_HotCode/totp"
 	"github.com/go-park-mail-ru/2019_1_HotCode/utils"
 
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/pgtype"
 
 	"github.com/pkg/errors"
@@ -21,9 +36,15 @@ func init() {
 }
 
 type UsersTest struct {
-	ids      int64
-	users    map[int64]UserModel
-	nextFail error
+	ids           int64
+	users         map[int64]UserModel
+	audit         []*RoleAuditModel
+	recoveryCodes map[int64][][]byte
+	totpSteps     map[int64]int64
+	identities    map[string]int64
+	// staleHashes юзеры, чей хеш посчитан со старыми параметрами
+	staleHashes map[int64]bool
+	nextFail    error
 }
 
 func (ut *UsersTest) newID() int64 {
@@ -31,26 +52,24 @@ func (ut *UsersTest) newID() int64 {
 	return ut.ids - 1
 }
 
-// setFailureUser fails next request
-func setFailureUser(err error) {
-	us := Users.(*UsersTest)
-	us.nextFail = err
+// setFailure fails next request
+func (ut *UsersTest) setFailure(err error) {
+	ut.nextFail = err
 }
 
-func checkFailureUser() error {
-	us := Users.(*UsersTest)
-	if us.nextFail != nil {
+func (ut *UsersTest) checkFailure() error {
+	if ut.nextFail != nil {
 		defer func() {
-			us.nextFail = nil
+			ut.nextFail = nil
 		}()
-		return us.nextFail
+		return ut.nextFail
 	}
 	return nil
 }
 
 // Create создаёт запись в базе с новыми полями
 func (ut *UsersTest) Create(u *UserModel) error {
-	if err := checkFailureUser(); err != nil {
+	if err := ut.checkFailure(); err != nil {
 		return err
 	}
 	u.Active = pgtype.Bool{Bool: true, Status: pgtype.Present}
@@ -61,7 +80,7 @@ func (ut *UsersTest) Create(u *UserModel) error {
 
 // Save сохраняет юзера в базу
 func (ut *UsersTest) Save(u *UserModel) error {
-	if err := checkFailureUser(); err != nil {
+	if err := ut.checkFailure(); err != nil {
 		return err
 	}
 
@@ -71,12 +90,24 @@ func (ut *UsersTest) Save(u *UserModel) error {
 
 // CheckPassword проверяет пароль у юзера и сохранённый в модели
 func (ut *UsersTest) CheckPassword(u *UserModel, password string) bool {
-	return *u.Password == password
+	if *u.Password != password {
+		return false
+	}
+	if ut.staleHashes[u.ID.Int] {
+		// как в базе: хеш пересчитан, pwd_ver прежний
+		delete(ut.staleHashes, u.ID.Int)
+		stored := ut.users[u.ID.Int]
+		stored.PasswordCrypt = pgtype.Bytea{Bytes: []byte("rehashed"), Status: pgtype.Present}
+		ut.users[u.ID.Int] = stored
+		u.PasswordCrypt = stored.PasswordCrypt
+		u.PwdVer = stored.PwdVer
+	}
+	return true
 }
 
 // GetUserByID получает юзера по id
 func (ut *UsersTest) GetUserByID(id int64) (*UserModel, error) {
-	if err := checkFailureUser(); err != nil {
+	if err := ut.checkFailure(); err != nil {
 		return nil, err
 	}
 	var u UserModel
@@ -90,7 +121,7 @@ func (ut *UsersTest) GetUserByID(id int64) (*UserModel, error) {
 
 // GetUserByUsername получает юзера по имени
 func (ut *UsersTest) GetUserByUsername(username string) (*UserModel, error) {
-	if err := checkFailureUser(); err != nil {
+	if err := ut.checkFailure(); err != nil {
 		return nil, err
 	}
 	var u UserModel
@@ -109,18 +140,400 @@ func (ut *UsersTest) GetUserByUsername(username string) (*UserModel, error) {
 	return &u, nil
 }
 
+// Ban деактивирует юзера
+func (ut *UsersTest) Ban(userID int64, reason string, until pgtype.Timestamptz) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	u, ok := ut.users[userID]
+	if !ok {
+		return utils.ErrNotExists
+	}
+
+	u.Active = pgtype.Bool{Bool: false, Status: pgtype.Present}
+	u.BanReason = pgtype.Text{String: reason, Status: pgtype.Present}
+	u.BannedUntil = until
+	ut.users[userID] = u
+	return nil
+}
+
+// Unban снимает бан
+func (ut *UsersTest) Unban(userID int64) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	u, ok := ut.users[userID]
+	if !ok {
+		return utils.ErrNotExists
+	}
+
+	u.Active = pgtype.Bool{Bool: true, Status: pgtype.Present}
+	u.BanReason = pgtype.Text{Status: pgtype.Null}
+	u.BannedUntil = pgtype.Timestamptz{Status: pgtype.Null}
+	ut.users[userID] = u
+	return nil
+}
+
+func (ut *UsersTest) Delete(userID int64) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	if _, ok := ut.users[userID]; !ok {
+		return utils.ErrNotExists
+	}
+
+	delete(ut.users, userID)
+	return nil
+}
+
+// SetRole меняет роль юзера и записывает это в аудит
+func (ut *UsersTest) SetRole(userID, actorID int64, role Role) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	u, ok := ut.users[userID]
+	if !ok {
+		return utils.ErrNotExists
+	}
+
+	ut.audit = append(ut.audit, &RoleAuditModel{
+		UserID:  pgtype.Int8{Int: userID, Status: pgtype.Present},
+		ActorID: pgtype.Int8{Int: actorID, Status: pgtype.Present},
+		OldRole: u.Role,
+		NewRole: pgtype.Varchar{String: string(role), Status: pgtype.Present},
+		Created: pgtype.Timestamptz{Time: time.Unix(0, 0).UTC(), Status: pgtype.Present},
+	})
+	u.Role = pgtype.Varchar{String: string(role), Status: pgtype.Present}
+	ut.users[userID] = u
+	return nil
+}
+
+// GetRoleAudit история смены ролей юзера
+func (ut *UsersTest) GetRoleAudit(userID int64) ([]*RoleAuditModel, error) {
+	if err := ut.checkFailure(); err != nil {
+		return nil, err
+	}
+
+	audit := make([]*RoleAuditModel, 0)
+	for _, record := range ut.audit {
+		if record.UserID.Int == userID {
+			audit = append(audit, record)
+		}
+	}
+
+	return audit, nil
+}
+
+// GetUserByEmail получает юзера по почте
+func (ut *UsersTest) GetUserByEmail(email string) (*UserModel, error) {
+	if err := ut.checkFailure(); err != nil {
+		return nil, err
+	}
+
+	for _, user := range ut.users {
+		if user.Email.Status == pgtype.Present && user.Email.String == email {
+			u := user
+			return &u, nil
+		}
+	}
+
+	return nil, utils.ErrNotExists
+}
+
+func (ut *UsersTest) SearchUsers(query string, limit, offset int) ([]*UserModel, error) {
+	if err := ut.checkFailure(); err != nil {
+		return nil, err
+	}
+
+	// в моке только префикс, триграммы умеет лишь postgres
+	found := make([]*UserModel, 0)
+	for id := int64(1); id < ut.ids; id++ {
+		user, ok := ut.users[id]
+		if ok && user.IsActive(time.Now()) &&
+			strings.HasPrefix(strings.ToLower(user.Username.String), strings.ToLower(query)) {
+			found = append(found, &user)
+		}
+	}
+
+	if offset >= len(found) {
+		return []*UserModel{}, nil
+	}
+	found = found[offset:]
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	return found, nil
+}
+
+// SaveTOTP сохраняет секрет 2FA
+func (ut *UsersTest) SaveTOTP(userID int64, secret []byte, enabled bool) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	u, ok := ut.users[userID]
+	if !ok {
+		return utils.ErrNotExists
+	}
+
+	u.TOTPSecret = pgtype.Bytea{Bytes: secret, Status: pgtype.Present}
+	if secret == nil {
+		u.TOTPSecret.Status = pgtype.Null
+		enabled = false
+		delete(ut.recoveryCodes, userID)
+	}
+	u.TOTPEnabled = pgtype.Bool{Bool: enabled, Status: pgtype.Present}
+	ut.users[userID] = u
+	return nil
+}
+
+// SetRecoveryCodes заменяет коды восстановления
+func (ut *UsersTest) SetRecoveryCodes(userID int64, hashes [][]byte) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	ut.recoveryCodes[userID] = hashes
+	return nil
+}
+
+// EnableTOTP включает 2FA вместе с кодами восстановления
+func (ut *UsersTest) EnableTOTP(userID, step int64, hashes [][]byte) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	u, ok := ut.users[userID]
+	if !ok || len(u.TOTPSecret.Bytes) == 0 || u.TOTPEnabled.Bool {
+		return utils.ErrNotExists
+	}
+
+	u.TOTPEnabled = pgtype.Bool{Bool: true, Status: pgtype.Present}
+	ut.users[userID] = u
+	ut.totpSteps[userID] = step
+	ut.recoveryCodes[userID] = hashes
+	return nil
+}
+
+// UseTOTPStep запоминает период принятого кода
+func (ut *UsersTest) UseTOTPStep(userID, step int64) (bool, error) {
+	if err := ut.checkFailure(); err != nil {
+		return false, err
+	}
+
+	if ut.totpSteps[userID] >= step {
+		return false, nil
+	}
+	ut.totpSteps[userID] = step
+	return true, nil
+}
+
+// UseRecoveryCode гасит код восстановления
+func (ut *UsersTest) UseRecoveryCode(userID int64, hash []byte) (bool, error) {
+	if err := ut.checkFailure(); err != nil {
+		return false, err
+	}
+
+	codes := ut.recoveryCodes[userID]
+	for i, code := range codes {
+		if bytes.Equal(code, hash) {
+			ut.recoveryCodes[userID] = append(codes[:i:i], codes[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GetUserByIdentity юзер, привязанный к внешнему аккаунту
+func (ut *UsersTest) GetUserByIdentity(provider, subject string) (*UserModel, error) {
+	if err := ut.checkFailure(); err != nil {
+		return nil, err
+	}
+
+	userID, ok := ut.identities[provider+":"+subject]
+	if !ok {
+		return nil, utils.ErrNotExists
+	}
+
+	return ut.GetUserByID(userID)
+}
+
+// CreateWithIdentity создаёт юзера с привязкой
+func (ut *UsersTest) CreateWithIdentity(u *UserModel, provider, subject string) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	for _, user := range ut.users {
+		if strings.EqualFold(user.Username.String, u.Username.String) {
+			return utils.ErrTaken
+		}
+		if u.Email.Status == pgtype.Present && strings.EqualFold(user.Email.String, u.Email.String) {
+			return &utils.ValidationError{
+				"email": utils.ErrTaken.Error(),
+			}
+		}
+	}
+
+	if err := ut.Create(u); err != nil {
+		return err
+	}
+	ut.identities[provider+":"+subject] = u.ID.Int
+	return nil
+}
+
+// LinkIdentity привязывает внешний аккаунт
+func (ut *UsersTest) LinkIdentity(userID int64, provider, subject string) error {
+	if err := ut.checkFailure(); err != nil {
+		return err
+	}
+
+	key := provider + ":" + subject
+	if linked, ok := ut.identities[key]; ok && linked != userID {
+		return utils.ErrTaken
+	}
+	ut.identities[key] = userID
+	return nil
+}
+
+// tooLongSaveTest хешер, не принимающий пароль
+type tooLongSaveTest struct {
+	*UsersTest
+}
+
+func (ut *tooLongSaveTest) Save(u *UserModel) error {
+	return errors.Wrap(utils.ErrTooLong, "bcrypt accepts up to 72 bytes")
+}
+
+type DenylistTest struct {
+	tokens map[string]time.Time
+	users  map[int64]time.Time
+}
+
+func (dt *DenylistTest) Revoke(id string, expires time.Time) error {
+	dt.tokens[id] = expires
+	return nil
+}
+
+func (dt *DenylistTest) RevokeUser(userID int64, at time.Time, ttl time.Duration) error {
+	dt.users[userID] = at
+	return nil
+}
+
+func (dt *DenylistTest) IsRevoked(id string, userID int64, issued time.Time) (bool, error) {
+	if _, ok := dt.tokens[id]; ok {
+		return true, nil
+	}
+
+	at, ok := dt.users[userID]
+	return ok && !issued.After(at), nil
+}
+
+type TokensTest struct {
+	tokens map[string]OneTimeToken
+}
+
+func (tt *TokensTest) Issue(t *OneTimeToken) error {
+	t.Token = "tok" + strconv.Itoa(len(tt.tokens))
+	tt.tokens[t.Kind+t.Token] = *t
+	return nil
+}
+
+func (tt *TokensTest) Consume(kind, token string) (*OneTimeToken, error) {
+	t, ok := tt.tokens[kind+token]
+	if !ok {
+		return nil, utils.ErrNotExists
+	}
+	delete(tt.tokens, kind+token)
+	return &t, nil
+}
+
+func (tt *TokensTest) Peek(kind, token string) (*OneTimeToken, error) {
+	t, ok := tt.tokens[kind+token]
+	if !ok {
+		return nil, utils.ErrNotExists
+	}
+	return &t, nil
+}
+
+type APITokensTest struct {
+	ids     int64
+	tokens  map[int64]APITokenModel
+	touched int
+}
+
+func (at *APITokensTest) Create(t *APITokenModel) error {
+	t.ID = pgtype.Int8{Int: at.ids, Status: pgtype.Present}
+	t.Created = pgtype.Timestamptz{Time: time.Now(), Status: pgtype.Present}
+	at.tokens[at.ids] = *t
+	at.ids++
+	return nil
+}
+
+func (at *APITokensTest) GetTokenByHash(hash []byte) (*APITokenModel, error) {
+	for _, t := range at.tokens {
+		if bytes.Equal(t.Hash.Bytes, hash) {
+			return &t, nil
+		}
+	}
+
+	return nil, utils.ErrNotExists
+}
+
+func (at *APITokensTest) GetTokensByUserID(userID int64) ([]*APITokenModel, error) {
+	tokens := make([]*APITokenModel, 0)
+	for id := int64(1); id < at.ids; id++ {
+		if t, ok := at.tokens[id]; ok && t.UserID.Int == userID {
+			tokens = append(tokens, &t)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (at *APITokensTest) Delete(userID, tokenID int64) error {
+	t, ok := at.tokens[tokenID]
+	if !ok || t.UserID.Int != userID {
+		return utils.ErrNotExists
+	}
+	delete(at.tokens, tokenID)
+	return nil
+}
+
+func (at *APITokensTest) Touch(tokenID int64, used time.Time) error {
+	t := at.tokens[tokenID]
+	t.LastUsed = pgtype.Timestamptz{Time: used, Status: pgtype.Present}
+	at.tokens[tokenID] = t
+	at.touched++
+	return nil
+}
+
+type MailerTest struct {
+	sent chan *mailer.Message
+}
+
+func (mt *MailerTest) Send(m *mailer.Message) error {
+	mt.sent <- m
+	return nil
+}
+
 type SessionsTest struct {
-	sessions map[string][]byte
-	nextFail error
+	sessions     map[string][]byte
+	userSessions map[int64][]string
+	nextFail     error
 }
 
-func setFailureSession(err error) {
-	ss := Sessions.(*SessionsTest)
+func (ss *SessionsTest) setFailure(err error) {
 	ss.nextFail = err
 }
 
-func checkFailureSession() error {
-	ss := Sessions.(*SessionsTest)
+func (ss *SessionsTest) checkFailure() error {
 	if ss.nextFail != nil {
 		defer func() {
 			ss.nextFail = nil
@@ -133,17 +546,34 @@ func checkFailureSession() error {
 // Set валидирует и сохраняет сессию в хранилище по сгенерированному токену
 // Токен сохраняется в s.Token
 func (ss *SessionsTest) Set(s *Session) error {
-	if err := checkFailureSession(); err != nil {
+	if err := ss.checkFailure(); err != nil {
 		return err
 	}
 
+	if s.Token == "" {
+		s.Token = "token" + strconv.Itoa(len(ss.sessions))
+	}
 	ss.sessions[s.Token] = s.Payload
+	ss.userSessions[s.UserID] = append(ss.userSessions[s.UserID], s.Token)
+	return nil
+}
+
+// DeleteUserSessions удаляет все сессии юзера
+func (ss *SessionsTest) DeleteUserSessions(userID int64) error {
+	if err := ss.checkFailure(); err != nil {
+		return err
+	}
+
+	for _, token := range ss.userSessions[userID] {
+		delete(ss.sessions, token)
+	}
+	delete(ss.userSessions, userID)
 	return nil
 }
 
 // Delete удаляет сессию с токен s.Token из хранилища
 func (ss *SessionsTest) Delete(s *Session) error {
-	if err := checkFailureSession(); err != nil {
+	if err := ss.checkFailure(); err != nil {
 		return err
 	}
 	delete(ss.sessions, s.Token)
@@ -153,7 +583,7 @@ func (ss *SessionsTest) Delete(s *Session) error {
 
 // GetSession получает сессию из хранилища по токену
 func (ss *SessionsTest) GetSession(token string) (*Session, error) {
-	if err := checkFailureSession(); err != nil {
+	if err := ss.checkFailure(); err != nil {
 		return nil, err
 	}
 	data, ok := ss.sessions[token]
@@ -167,16 +597,38 @@ func (ss *SessionsTest) GetSession(token string) (*Session, error) {
 	}, nil
 }
 
-func initTests() {
-	Users = &UsersTest{
-		ids:      1,
-		users:    make(map[int64]UserModel),
-		nextFail: nil,
-	}
-
-	Sessions = &SessionsTest{
-		sessions: make(map[string][]byte),
-		nextFail: nil,
+// newTestHandler хендлер на свежих заглушках, у каждого теста свой
+func newTestHandler() *Handler {
+	return &Handler{
+		Users: &UsersTest{
+			ids:           1,
+			users:         make(map[int64]UserModel),
+			recoveryCodes: make(map[int64][][]byte),
+			totpSteps:     make(map[int64]int64),
+			identities:    make(map[string]int64),
+			nextFail:      nil,
+		},
+		Sessions: &SessionsTest{
+			sessions:     make(map[string][]byte),
+			userSessions: make(map[int64][]string),
+			nextFail:     nil,
+		},
+		Tokens: &TokensTest{
+			tokens: make(map[string]OneTimeToken),
+		},
+		APITokens: &APITokensTest{
+			ids:    1,
+			tokens: make(map[int64]APITokenModel),
+		},
+		LoginGuard: bruteforce.NewGuard(bruteforce.NewMemoryStore(), bruteforce.DefaultConfig()),
+		Mail: &MailerTest{
+			sent: make(chan *mailer.Message, 10),
+		},
+		Cookie: CookieConfig{
+			SameSite: http.SameSiteLaxMode,
+		},
+		CSRFSecret:    []byte("csrf-secret"),
+		OIDCProviders: map[string]*oidc.Provider{},
 	}
 }
 
@@ -186,57 +638,89 @@ type UserTestCase struct {
 	FailureSession error
 }
 
-func runTableAPITests(t *testing.T, cases []*UserTestCase) {
+func runTableAPITests(t *testing.T, h *Handler, cases []*UserTestCase) {
 	for i, c := range cases {
-		runAPITest(t, i, c)
+		runAPITest(t, h, i, c)
 	}
 }
 
-func runAPITest(t *testing.T, i int, c *UserTestCase) {
+func runAPITest(t *testing.T, h *Handler, i int, c *UserTestCase) {
 	if c.FailureUser != nil {
-		setFailureUser(c.FailureUser)
+		h.Users.(*UsersTest).setFailure(c.FailureUser)
 	}
 
 	if c.FailureSession != nil {
-		setFailureSession(c.FailureSession)
+		h.Sessions.(*SessionsTest).setFailure(c.FailureSession)
 	}
 
 	testutils.RunAPITest(t, i, &c.Case)
 }
 
 func TestCreateUser(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*UserTestCase{
 		{ // Всё ок
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"sdas","password":"dsadasd"}`),
+				Payload:      []byte(`{"username":"sdas","password":"dsadasd_dsa"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 		},
 		{ // На используемый username
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"sdas","password":"dsadasd"}`),
+				Payload:      []byte(`{"username":"sdas","password":"dsadasd_dsa"}`),
 				ExpectedCode: 400,
 				ExpectedBody: `{"username":"taken"}`,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 			FailureUser: utils.ErrTaken,
 		},
+		{ // пароль длиннее, чем принимает bcrypt
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"long","password":"dsadasd_dsa"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"password":"too_long"}`,
+				Method:       "POST",
+				Pattern:      "/users",
+				Function:     h.CreateUser,
+			},
+			FailureUser: errors.Wrap(utils.ErrTooLong, "bcrypt accepts up to 72 bytes"),
+		},
 		{ // Пустой юзернейм
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"","password":"dsadasd"}`),
+				Payload:      []byte(`{"username":"","password":"dsadasd_dsa"}`),
 				ExpectedCode: 400,
 				ExpectedBody: `{"username":"required"}`,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
+			},
+		},
+		{ // Юзернейм с пробелами
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"kek kek","password":"dsadasd_dsa"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"username":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/users",
+				Function:     h.CreateUser,
+			},
+		},
+		{ // Длинный юзернейм
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"` + strings.Repeat("k", UsernameMaxLength+1) + `","password":"dsadasd_dsa"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"username":"too_long"}`,
+				Method:       "POST",
+				Pattern:      "/users",
+				Function:     h.CreateUser,
 			},
 		},
 		{ // Пустой пароль теперь нас очень смущает
@@ -246,7 +730,37 @@ func TestCreateUser(t *testing.T) {
 				ExpectedBody: `{"password":"required"}`,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
+			},
+		},
+		{ // Короткий пароль
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"kek","password":"lol"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"password":"too_short"}`,
+				Method:       "POST",
+				Pattern:      "/users",
+				Function:     h.CreateUser,
+			},
+		},
+		{ // Пароль из словаря
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"kek","password":"qwerty123"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"password":"weak"}`,
+				Method:       "POST",
+				Pattern:      "/users",
+				Function:     h.CreateUser,
+			},
+		},
+		{ // Пароль с ником внутри
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"kek","password":"my_kek_pass"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"password":"weak"}`,
+				Method:       "POST",
+				Pattern:      "/users",
+				Function:     h.CreateUser,
 			},
 		},
 		{ // Неправильный формат JSON
@@ -256,70 +770,71 @@ func TestCreateUser(t *testing.T) {
 				ExpectedBody: `{"message":"decode body error: invalid character '\"' after object key:value pair"}`,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 		},
 		{ // Упала база
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"sdas","password":"dsadasd"}`),
+				Payload:      []byte(`{"username":"sdas","password":"dsadasd_dsa"}`),
 				ExpectedCode: 500,
 				ExpectedBody: `{"message":"user create error: internal server error"}`,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 			FailureUser: utils.ErrInternal,
 		},
 		{ // По какой-то невообразимой причине только что созданный юзер не существует в базе
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"sdas","password":"dsadasd"}`),
+				Payload:      []byte(`{"username":"sdas","password":"dsadasd_dsa"}`),
 				ExpectedCode: 500,
 				ExpectedBody: `{"message":"set session error: map[lol:kek]"}`,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 			FailureSession: &utils.ValidationError{"lol": "kek"},
 		},
 		{ // Редис упал
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"sdas","password":"dsadasd"}`),
+				Payload:      []byte(`{"username":"sdas","password":"dsadasd_dsa"}`),
 				ExpectedCode: 500,
 				ExpectedBody: `{"message":"set session error: internal server error"}`,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 			FailureSession: utils.ErrInternal,
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestUpdateUser(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*UserTestCase{
 		{ // Такого юзера пока нет
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"kek","password":"lol"}`),
+				Payload:      []byte(`{"username":"kek","password":"lol_cheburek"}`),
 				ExpectedCode: 401,
 				ExpectedBody: `{"message":"user not exists: get user error: not_exists"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
+				Function:     h.UpdateUser,
 				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{}),
 			},
 		},
 		{ // Создадим юзера
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"kek","password":"lol"}`),
+				Payload:      []byte(`{"username":"kek","password":"lol_cheburek"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 				Context:      context.Background(),
 			},
 		},
@@ -330,8 +845,8 @@ func TestUpdateUser(t *testing.T) {
 				ExpectedBody: `{"username":"invalid"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{ // Неправильный формат JSON
@@ -341,8 +856,8 @@ func TestUpdateUser(t *testing.T) {
 				ExpectedBody: `{"message":"decode body error: invalid character '\"' after object key:value pair"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{ // Нет контекста
@@ -352,7 +867,7 @@ func TestUpdateUser(t *testing.T) {
 				ExpectedBody: `{"message":"session info is not presented"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
+				Function:     h.UpdateUser,
 				Context:      context.Background(),
 			},
 		},
@@ -363,30 +878,41 @@ func TestUpdateUser(t *testing.T) {
 				ExpectedBody: `{"newPassword":"invalid"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
+			},
+		},
+		{ // username не меняется, но пароль всё равно не должен его содержать
+			Case: testutils.Case{
+				Payload:      []byte(`{"oldPassword":"lol_cheburek", "newPassword":"kek_forever"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"newPassword":"weak"}`,
+				Method:       "PUT",
+				Pattern:      "/users",
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"kek", "newPassword":"lol"}`),
+				Payload:      []byte(`{"username":"kek", "newPassword":"cheburek_lol"}`),
 				ExpectedCode: 400,
 				ExpectedBody: `{"oldPassword":"required"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"kek", "oldPassword":"hh", "newPassword":"lol"}`),
+				Payload:      []byte(`{"username":"kek", "oldPassword":"hh", "newPassword":"cheburek_lol"}`),
 				ExpectedCode: 400,
 				ExpectedBody: `{"oldPassword":"invalid"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{
@@ -396,32 +922,32 @@ func TestUpdateUser(t *testing.T) {
 				ExpectedBody: `{"photo_uuid":"invalid"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{
 			Case: testutils.Case{
-				Payload: []byte(`{"username":"kek", "oldPassword":"lol", "newPassword":"lol1",
+				Payload: []byte(`{"username":"kek", "oldPassword":"lol_cheburek", "newPassword":"cheburek_lol",
 			 					"photo_uuid":"2eb4a823-3a6d-4cba-8767-4d4946890f4f"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{ // отвалилась база
 			Case: testutils.Case{
-				Payload: []byte(`{"username":"kek", "oldPassword":"lol", "newPassword":"lol1",
+				Payload: []byte(`{"username":"kek", "oldPassword":"lol_cheburek", "newPassword":"cheburek_lol",
 			 					"photo_uuid":"2eb4a823-3a6d-4cba-8767-4d4946890f4f"}`),
 				ExpectedCode: 500,
 				ExpectedBody: `{"message":"get user error: upala basa"}`,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 			FailureUser: errors.New("upala basa"),
 		},
@@ -432,17 +958,18 @@ func TestUpdateUser(t *testing.T) {
 				ExpectedBody: ``,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestCheckUsername(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*UserTestCase{
 		{ // Всё ок
@@ -452,17 +979,17 @@ func TestCheckUsername(t *testing.T) {
 				ExpectedBody: `{"used":false}`,
 				Method:       "POST",
 				Pattern:      "/users/username_check",
-				Function:     CheckUsername,
+				Function:     h.CheckUsername,
 			},
 		},
 		{ // Создадим юзера
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"sdas","password":"dsadasd"}`),
+				Payload:      []byte(`{"username":"sdas","password":"dsadasd_dsa"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 		},
 		{ // Теперь уже имя занято
@@ -472,7 +999,7 @@ func TestCheckUsername(t *testing.T) {
 				ExpectedBody: `{"used":true}`,
 				Method:       "POST",
 				Pattern:      "/users/used",
-				Function:     CheckUsername,
+				Function:     h.CheckUsername,
 			},
 		},
 		{ // Пустой никнейм, очевидно, свободен, но зарегать его всё равно нельзя
@@ -482,7 +1009,7 @@ func TestCheckUsername(t *testing.T) {
 				ExpectedBody: `{"used":false}`,
 				Method:       "POST",
 				Pattern:      "/users/used",
-				Function:     CheckUsername,
+				Function:     h.CheckUsername,
 			},
 		},
 		{ // Неправильный формат JSON
@@ -492,7 +1019,7 @@ func TestCheckUsername(t *testing.T) {
 				ExpectedBody: `{"message":"decode body error: invalid character '\"' after object key:value pair"}`,
 				Method:       "POST",
 				Pattern:      "/users/used",
-				Function:     CheckUsername,
+				Function:     h.CheckUsername,
 			},
 		},
 		{ // Отвалилась база
@@ -502,17 +1029,18 @@ func TestCheckUsername(t *testing.T) {
 				ExpectedBody: `{"message":"get user method error: upala basa"}`,
 				Method:       "POST",
 				Pattern:      "/users/used",
-				Function:     CheckUsername,
+				Function:     h.CheckUsername,
 			},
 			FailureUser: errors.New("upala basa"),
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestGetUser(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*UserTestCase{
 		{ // Такого юзера пока нет
@@ -522,7 +1050,7 @@ func TestGetUser(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/users/{user_id:[0-9]+}",
 				Endpoint:     "/users/1",
-				Function:     GetUser,
+				Function:     h.GetUser,
 			},
 		},
 		{ // user_id в неверном формате(выключаем встроенную фильтрацию от gorilla)
@@ -532,17 +1060,17 @@ func TestGetUser(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/users/{user_id}",
 				Endpoint:     "/users/keks",
-				Function:     GetUser,
+				Function:     h.GetUser,
 			},
 		},
 		{ // Создадим юзера
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"golang","password":"4ever"}`),
+				Payload:      []byte(`{"username":"golang","password":"4ever_and_ever"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 		},
 		{ // добавили авку
@@ -552,8 +1080,8 @@ func TestGetUser(t *testing.T) {
 				ExpectedBody: ``,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{ // Всё ок
@@ -563,7 +1091,7 @@ func TestGetUser(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/users/{user_id:[0-9]+}",
 				Endpoint:     "/users/1",
-				Function:     GetUser,
+				Function:     h.GetUser,
 			},
 		},
 		{ // Упала база
@@ -573,27 +1101,28 @@ func TestGetUser(t *testing.T) {
 				Method:       "GET",
 				Pattern:      "/users/{user_id:[0-9]+}",
 				Endpoint:     "/users/1",
-				Function:     GetUser,
+				Function:     h.GetUser,
 			},
 			FailureUser: errors.New("upala basa"),
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestCreateSession(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*UserTestCase{
 		{ // кривой JSON(без запятой)
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"golang" "password":"4ever"}`),
+				Payload:      []byte(`{"username":"golang" "password":"4ever_and_ever"}`),
 				ExpectedCode: 400,
 				ExpectedBody: `{"message":"decode body error: invalid character '\"' after object key:value pair"}`,
 				Method:       "POST",
 				Pattern:      "/sessions",
-				Function:     CreateSession,
+				Function:     h.CreateSession,
 			},
 		},
 		{ // без пароля
@@ -603,28 +1132,28 @@ func TestCreateSession(t *testing.T) {
 				ExpectedBody: `{"password":"required"}`,
 				Method:       "POST",
 				Pattern:      "/sessions",
-				Function:     CreateSession,
+				Function:     h.CreateSession,
 			},
 		},
 		{ // незареганный юзер
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"golang", "password":"4ever"}`),
+				Payload:      []byte(`{"username":"golang", "password":"4ever_and_ever"}`),
 				ExpectedCode: 400,
 				ExpectedBody: `{"username":"not_exists"}`,
 				Method:       "POST",
 				Pattern:      "/sessions",
-				Function:     CreateSession,
+				Function:     h.CreateSession,
 			},
 		},
 		// зарегали юзера
 		{
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"golang","password":"4ever"}`),
+				Payload:      []byte(`{"username":"golang","password":"4ever_and_ever"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 		},
 		{ // неправильный пароль
@@ -634,37 +1163,38 @@ func TestCreateSession(t *testing.T) {
 				ExpectedBody: `{"password":"invalid"}`,
 				Method:       "POST",
 				Pattern:      "/sessions",
-				Function:     CreateSession,
+				Function:     h.CreateSession,
 			},
 		},
 		{ // Отломалось хранилище сессий
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"golang","password":"4ever"}`),
+				Payload:      []byte(`{"username":"golang","password":"4ever_and_ever"}`),
 				ExpectedCode: 500,
 				ExpectedBody: `{"message":"set session error: vse slomalos"}`,
 				Method:       "POST",
 				Pattern:      "/sessions",
-				Function:     CreateSession,
+				Function:     h.CreateSession,
 			},
 			FailureSession: errors.New("vse slomalos"),
 		},
 		{ // Всё ок
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"golang","password":"4ever"}`),
+				Payload:      []byte(`{"username":"golang","password":"4ever_and_ever"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "POST",
 				Pattern:      "/sessions",
-				Function:     CreateSession,
+				Function:     h.CreateSession,
 			},
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestDeleteSession(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*UserTestCase{
 		{ // без куки совсем
@@ -673,7 +1203,7 @@ func TestDeleteSession(t *testing.T) {
 				ExpectedBody: `{"message":"get cookie error: http: named cookie not present"}`,
 				Method:       "DELETE",
 				Pattern:      "/sessions",
-				Function:     DeleteSession,
+				Function:     h.DeleteSession,
 			},
 		},
 		{ // Отвалился storage
@@ -688,7 +1218,7 @@ func TestDeleteSession(t *testing.T) {
 						Value: "12345",
 					},
 				},
-				Function: DeleteSession,
+				Function: h.DeleteSession,
 			},
 			FailureSession: errors.New("storage upal"),
 		},
@@ -704,16 +1234,17 @@ func TestDeleteSession(t *testing.T) {
 						Value: "12345",
 					},
 				},
-				Function: DeleteSession,
+				Function: h.DeleteSession,
 			},
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestGetSession(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	cases := []*UserTestCase{
 		{ // без куки совсем
@@ -722,7 +1253,7 @@ func TestGetSession(t *testing.T) {
 				ExpectedBody: `{"message":"session info is not presented"}`,
 				Method:       "DELETE",
 				Pattern:      "/sessions",
-				Function:     GetSession,
+				Function:     h.GetSession,
 			},
 		},
 		{ // несуществующий юзер
@@ -731,8 +1262,8 @@ func TestGetSession(t *testing.T) {
 				ExpectedBody: `{"message":"user not exists: not_exists"}`,
 				Method:       "DELETE",
 				Pattern:      "/sessions",
-				Function:     GetSession,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.GetSession,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{ // упала база
@@ -741,19 +1272,19 @@ func TestGetSession(t *testing.T) {
 				ExpectedBody: `{"message":"basa upala"}`,
 				Method:       "DELETE",
 				Pattern:      "/sessions",
-				Function:     GetSession,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.GetSession,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 			FailureUser: errors.New("basa upala"),
 		},
 		{ // зарегали юзера
 			Case: testutils.Case{
-				Payload:      []byte(`{"username":"golang","password":"4ever"}`),
+				Payload:      []byte(`{"username":"golang","password":"4ever_and_ever"}`),
 				ExpectedCode: 200,
 				ExpectedBody: ``,
 				Method:       "POST",
 				Pattern:      "/users",
-				Function:     CreateUser,
+				Function:     h.CreateUser,
 			},
 		},
 		{ // добавили авку
@@ -763,8 +1294,8 @@ func TestGetSession(t *testing.T) {
 				ExpectedBody: ``,
 				Method:       "PUT",
 				Pattern:      "/users",
-				Function:     UpdateUser,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.UpdateUser,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 		{ // теперь всё ок
@@ -773,17 +1304,18 @@ func TestGetSession(t *testing.T) {
 				ExpectedBody: `{"username":"golang","photo_uuid":"2eb4a823-3a6d-4cba-8767-4d4946890f4f","id":1,"active":true}`,
 				Method:       "DELETE",
 				Pattern:      "/sessions",
-				Function:     GetSession,
-				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{1, 1}),
+				Function:     h.GetSession,
+				Context:      context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1}),
 			},
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 }
 
 func TestMiddleware(t *testing.T) {
-	initTests()
+	t.Parallel()
+	h := newTestHandler()
 
 	testFunction := func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte("kek"))
@@ -799,7 +1331,7 @@ func TestMiddleware(t *testing.T) {
 				ExpectedBody: `{"message":"can not load cookie: http: named cookie not present"}`,
 				Method:       "GET",
 				Pattern:      "/test",
-				Function:     WithAuthentication(testFunction),
+				Function:     h.WithAuthentication(testFunction),
 			},
 		},
 		{ // неверный куки
@@ -814,14 +1346,14 @@ func TestMiddleware(t *testing.T) {
 						Value: "12345",
 					},
 				},
-				Function: WithAuthentication(testFunction),
+				Function: h.WithAuthentication(testFunction),
 			},
 		},
 	}
 
-	runTableAPITests(t, cases)
+	runTableAPITests(t, h, cases)
 
-	err := Sessions.Set(&Session{
+	err := h.Sessions.Set(&Session{
 		Token:   "kek",
 		Payload: []byte("kek"),
 	})
@@ -829,9 +1361,16 @@ func TestMiddleware(t *testing.T) {
 		t.Fatalf("%+v", err)
 	}
 
-	err = Sessions.Set(&Session{
+	us := h.Users.(*UsersTest)
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "golang", Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	err = h.Sessions.Set(&Session{
 		Token:   "kek1",
-		Payload: []byte(`{"kek": "kek"}`),
+		UserID:  1,
+		Payload: []byte(`{"id": 1}`),
 	})
 	if err != nil {
 		t.Fatalf("%+v", err)
@@ -850,7 +1389,7 @@ func TestMiddleware(t *testing.T) {
 						Value: "kek",
 					},
 				},
-				Function: WithAuthentication(testFunction),
+				Function: h.WithAuthentication(testFunction),
 			},
 		},
 		{ // Всё ок
@@ -865,10 +1404,1567 @@ func TestMiddleware(t *testing.T) {
 						Value: "kek1",
 					},
 				},
-				Function: WithAuthentication(testFunction),
+				Function: h.WithAuthentication(testFunction),
 			},
 		},
+		{ // меняющий запрос без CSRF-токена
+			Case: testutils.Case{
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"csrf token mismatch"}`,
+				Method:       "POST",
+				Pattern:      "/test",
+				Cookies: []*http.Cookie{
+					{
+						Name:  "JSESSIONID",
+						Value: "kek1",
+					},
+				},
+				Function: h.WithAuthentication(testFunction),
+			},
+		},
+		{ // токен от другой сессии
+			Case: testutils.Case{
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"csrf token mismatch"}`,
+				Method:       "DELETE",
+				Pattern:      "/test",
+				Cookies: []*http.Cookie{
+					{
+						Name:  "JSESSIONID",
+						Value: "kek1",
+					},
+				},
+				Headers:  map[string]string{CSRFHeader: h.CSRFToken("kek")},
+				Function: h.WithAuthentication(testFunction),
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: `kek`,
+				Method:       "POST",
+				Pattern:      "/test",
+				Cookies: []*http.Cookie{
+					{
+						Name:  "JSESSIONID",
+						Value: "kek1",
+					},
+				},
+				Headers:  map[string]string{CSRFHeader: h.CSRFToken("kek1")},
+				Function: h.WithAuthentication(testFunction),
+			},
+		},
+		{ // токен выдаётся для текущей сессии
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: `{"csrf_token":"` + h.CSRFToken("kek1") + `"}`,
+				Method:       "GET",
+				Pattern:      "/csrf",
+				Cookies: []*http.Cookie{
+					{
+						Name:  "JSESSIONID",
+						Value: "kek1",
+					},
+				},
+				Function: h.WithAuthentication(h.GetCSRFToken),
+			},
+		},
+	}
+
+	runTableAPITests(t, h, cases1)
+
+	// бан действует через отзыв сессий, как в BanUser: в базу на каждый запрос не ходим
+	if err = us.Ban(1, "cheater", pgtype.Timestamptz{Status: pgtype.Null}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = h.Sessions.DeleteUserSessions(1); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cases2 := []*UserTestCase{
+		{
+			Case: testutils.Case{
+				ExpectedCode: 401,
+				ExpectedBody: `{"message":"get session error: redis get error: not found"}`,
+				Method:       "GET",
+				Pattern:      "/test",
+				Cookies: []*http.Cookie{
+					{
+						Name:  "JSESSIONID",
+						Value: "kek1",
+					},
+				},
+				Function: h.WithAuthentication(testFunction),
+			},
+		},
+	}
+
+	runTableAPITests(t, h, cases2)
+}
+
+func TestRoles(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "admin", Status: pgtype.Present},
+		Role:     pgtype.Varchar{String: string(RoleAdmin), Status: pgtype.Present},
+	}
+	us.users[2] = UserModel{
+		ID:       pgtype.Int8{Int: 2, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "user", Status: pgtype.Present},
+		Role:     pgtype.Varchar{String: string(RoleUser), Status: pgtype.Present},
+	}
+
+	adminCtx := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1})
+	userCtx := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 2, PwdVer: 1})
+
+	cases := []*UserTestCase{
+		{ // обычному юзеру нельзя
+			Case: testutils.Case{
+				Payload:      []byte(`{"role":"moderator"}`),
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"role admin required"}`,
+				Method:       "PUT",
+				Pattern:      "/admin/users/{user_id:[0-9]+}/role",
+				Endpoint:     "/admin/users/1/role",
+				Function:     h.WithRole(h.GrantRole, RoleAdmin),
+				Context:      userCtx,
+			},
+		},
+		{ // нет такой роли
+			Case: testutils.Case{
+				Payload:      []byte(`{"role":"god"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"role":"invalid"}`,
+				Method:       "PUT",
+				Pattern:      "/admin/users/{user_id:[0-9]+}/role",
+				Endpoint:     "/admin/users/2/role",
+				Function:     h.WithRole(h.GrantRole, RoleAdmin),
+				Context:      adminCtx,
+			},
+		},
+		{ // себе менять нельзя
+			Case: testutils.Case{
+				Payload:      []byte(`{"role":"user"}`),
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"can not change own role"}`,
+				Method:       "PUT",
+				Pattern:      "/admin/users/{user_id:[0-9]+}/role",
+				Endpoint:     "/admin/users/1/role",
+				Function:     h.WithRole(h.GrantRole, RoleAdmin),
+				Context:      adminCtx,
+			},
+		},
+		{ // нет такого юзера
+			Case: testutils.Case{
+				Payload:      []byte(`{"role":"moderator"}`),
+				ExpectedCode: 404,
+				ExpectedBody: `{"message":"user not exists: not_exists"}`,
+				Method:       "PUT",
+				Pattern:      "/admin/users/{user_id:[0-9]+}/role",
+				Endpoint:     "/admin/users/42/role",
+				Function:     h.WithRole(h.GrantRole, RoleAdmin),
+				Context:      adminCtx,
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(`{"role":"moderator"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "PUT",
+				Pattern:      "/admin/users/{user_id:[0-9]+}/role",
+				Endpoint:     "/admin/users/2/role",
+				Function:     h.WithRole(h.GrantRole, RoleAdmin),
+				Context:      adminCtx,
+			},
+		},
+		{ // модератору всё ещё нельзя
+			Case: testutils.Case{
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"role admin required"}`,
+				Method:       "DELETE",
+				Pattern:      "/admin/users/{user_id:[0-9]+}/role",
+				Endpoint:     "/admin/users/1/role",
+				Function:     h.WithRole(h.RevokeRole, RoleAdmin),
+				Context:      userCtx,
+			},
+		},
+		{ // отобрали
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "DELETE",
+				Pattern:      "/admin/users/{user_id:[0-9]+}/role",
+				Endpoint:     "/admin/users/2/role",
+				Function:     h.WithRole(h.RevokeRole, RoleAdmin),
+				Context:      adminCtx,
+			},
+		},
+		{ // аудит
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: `[{"user_id":2,"actor_id":1,"old_role":"user","new_role":"moderator",` +
+					`"created":"1970-01-01T00:00:00Z"},{"user_id":2,"actor_id":1,"old_role":"moderator",` +
+					`"new_role":"user","created":"1970-01-01T00:00:00Z"}]`,
+				Method:   "GET",
+				Pattern:  "/admin/users/{user_id:[0-9]+}/role/audit",
+				Endpoint: "/admin/users/2/role/audit",
+				Function: h.WithRole(h.GetRoleAudit, RoleAdmin),
+				Context:  adminCtx,
+			},
+		},
+	}
+
+	runTableAPITests(t, h, cases)
+}
+
+func TestBanUser(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	ss := h.Sessions.(*SessionsTest)
+	password := "4ever_and_ever"
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "moder", Status: pgtype.Present},
+		Role:     pgtype.Varchar{String: string(RoleModerator), Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.users[2] = UserModel{
+		ID:       pgtype.Int8{Int: 2, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "cheater", Status: pgtype.Present},
+		Password: &password,
+		Role:     pgtype.Varchar{String: string(RoleUser), Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 3
+
+	form := &FormUser{BasicUser: BasicUser{Username: "cheater"}, Password: password}
+	if _, err := h.CreateSessionImpl(form); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(ss.userSessions[2]) != 1 {
+		t.Fatalf("expected one session, got %v", ss.userSessions[2])
+	}
+
+	moderCtx := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1})
+	cases := []*UserTestCase{
+		{ // без причины
+			Case: testutils.Case{
+				Payload:      []byte(`{"expires_at":"2000-01-01T00:00:00Z"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"expires_at":"invalid","reason":"required"}`,
+				Method:       "PUT",
+				Pattern:      "/moderation/users/{user_id:[0-9]+}/ban",
+				Endpoint:     "/moderation/users/2/ban",
+				Function:     h.WithRole(h.BanUser, RoleModerator),
+				Context:      moderCtx,
+			},
+		},
+		{ // себя нельзя
+			Case: testutils.Case{
+				Payload:      []byte(`{"reason":"tired"}`),
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"can not ban user with same or higher role"}`,
+				Method:       "PUT",
+				Pattern:      "/moderation/users/{user_id:[0-9]+}/ban",
+				Endpoint:     "/moderation/users/1/ban",
+				Function:     h.WithRole(h.BanUser, RoleModerator),
+				Context:      moderCtx,
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(`{"reason":"cheating"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "PUT",
+				Pattern:      "/moderation/users/{user_id:[0-9]+}/ban",
+				Endpoint:     "/moderation/users/2/ban",
+				Function:     h.WithRole(h.BanUser, RoleModerator),
+				Context:      moderCtx,
+			},
+		},
+		{ // забаненный не может войти
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"cheater","password":"4ever_and_ever"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"username":"inactive"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+	}
+
+	runTableAPITests(t, h, cases)
+
+	if len(ss.userSessions[2]) != 0 {
+		t.Fatalf("banned user sessions must be deleted, got %v", ss.userSessions[2])
+	}
+
+	// бан истёк -- пускаем и снимаем бан
+	u := us.users[2]
+	u.BannedUntil = pgtype.Timestamptz{Time: time.Now().Add(-time.Minute), Status: pgtype.Present}
+	us.users[2] = u
+	form = &FormUser{BasicUser: BasicUser{Username: "cheater"}, Password: password}
+	if _, err := h.CreateSessionImpl(form); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !us.users[2].Active.Bool {
+		t.Fatal("expired ban must be lifted")
+	}
+
+	runAPITest(t, h, 0, &UserTestCase{
+		Case: testutils.Case{
+			ExpectedCode: 200,
+			ExpectedBody: ``,
+			Method:       "DELETE",
+			Pattern:      "/moderation/users/{user_id:[0-9]+}/ban",
+			Endpoint:     "/moderation/users/2/ban",
+			Function:     h.WithRole(h.UnbanUser, RoleModerator),
+			Context:      moderCtx,
+		},
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	ss := h.Sessions.(*SessionsTest)
+	sent := h.Mail.(*MailerTest).sent
+	password := "4ever_and_ever"
+	us.users[1] = UserModel{
+		ID:            pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username:      pgtype.Varchar{String: "forgetful", Status: pgtype.Present},
+		Password:      &password,
+		PwdVer:        pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Active:        pgtype.Bool{Bool: true, Status: pgtype.Present},
+		Email:         pgtype.Varchar{String: "forgetful@mail.ru", Status: pgtype.Present},
+		EmailVerified: pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+	ss.userSessions[1] = []string{"old"}
+
+	cases := []*UserTestCase{
+		{ // пустая форма
+			Case: testutils.Case{
+				Payload:      []byte(`{}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"username":"required"}`,
+				Method:       "POST",
+				Pattern:      "/password-reset",
+				Function:     h.RequestPasswordReset,
+			},
+		},
+		{ // нет такого юзера, но мы об этом не говорим
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"nobody"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/password-reset",
+				Function:     h.RequestPasswordReset,
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(`{"email":"forgetful@mail.ru"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/password-reset",
+				Function:     h.RequestPasswordReset,
+			},
+		},
+	}
+	runTableAPITests(t, h, cases)
+
+	msg := <-sent
+	if msg.To != "forgetful@mail.ru" || !strings.Contains(msg.Body, "/password-reset?token=tok0") {
+		t.Fatalf("wrong mail: %+v", msg)
+	}
+
+	// хешер не принял пароль: ссылка из письма должна остаться рабочей
+	h.Users = &tooLongSaveTest{us}
+	runAPITest(t, h, 0, &UserTestCase{
+		Case: testutils.Case{
+			Payload:      []byte(`{"token":"tok0","password":"remember"}`),
+			ExpectedCode: 400,
+			ExpectedBody: `{"password":"too_long"}`,
+			Method:       "POST",
+			Pattern:      "/password-reset/confirm",
+			Function:     h.ConfirmPasswordReset,
+		},
+	})
+	h.Users = us
+
+	cases = []*UserTestCase{
+		{ // чужой токен
+			Case: testutils.Case{
+				Payload:      []byte(`{"token":"tok42","password":"remember"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"token":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/password-reset/confirm",
+				Function:     h.ConfirmPasswordReset,
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(`{"token":"tok0","password":"remember"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/password-reset/confirm",
+				Function:     h.ConfirmPasswordReset,
+			},
+		},
+		{ // второй раз токен не работает
+			Case: testutils.Case{
+				Payload:      []byte(`{"token":"tok0","password":"remember2"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"token":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/password-reset/confirm",
+				Function:     h.ConfirmPasswordReset,
+			},
+		},
+	}
+	runTableAPITests(t, h, cases)
+
+	if *us.users[1].Password != "remember" {
+		t.Fatalf("password was not changed: %s", *us.users[1].Password)
+	}
+	if len(ss.userSessions[1]) != 0 {
+		t.Fatalf("sessions must be deleted after reset, got %v", ss.userSessions[1])
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	sent := h.Mail.(*MailerTest).sent
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "mailman", Status: pgtype.Present},
+	}
+	us.ids = 2
+	ctx := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1})
+
+	cases := []*UserTestCase{
+		{ // кривая почта
+			Case: testutils.Case{
+				Payload:      []byte(`{"email":"Mailman <mailman@mail.ru>"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"email":"invalid"}`,
+				Method:       "PUT",
+				Pattern:      "/users",
+				Function:     h.UpdateUser,
+				Context:      ctx,
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(`{"email":"mailman@mail.ru"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "PUT",
+				Pattern:      "/users",
+				Function:     h.UpdateUser,
+				Context:      ctx,
+			},
+		},
+	}
+	runTableAPITests(t, h, cases)
+
+	msg := <-sent
+	if msg.To != "mailman@mail.ru" || !strings.Contains(msg.Body, "/verify-email?token=tok0") {
+		t.Fatalf("wrong mail: %+v", msg)
+	}
+	if us.users[1].EmailVerified.Bool {
+		t.Fatal("email must not be verified before confirmation")
+	}
+
+	runAPITest(t, h, 0, &UserTestCase{
+		Case: testutils.Case{
+			Payload:      []byte(`{"token":"tok0"}`),
+			ExpectedCode: 200,
+			ExpectedBody: ``,
+			Method:       "POST",
+			Pattern:      "/users/email/verify",
+			Function:     h.VerifyEmail,
+		},
+	})
+	if !us.users[1].EmailVerified.Bool {
+		t.Fatal("email must be verified")
+	}
+}
+
+func TestTokenStoreSignature(t *testing.T) {
+	t.Parallel()
+
+	ts := &TokenStore{Secret: []byte("secret")}
+	random := "c29tZSByYW5kb20gYnl0ZXM"
+
+	// подделанный токен отбрасывается без похода в redis
+	for _, token := range []string{"", "garbage", random + ".forged", random + "." + ts.sign(TokenEmailVerify, random)} {
+		if _, err := ts.Consume(TokenPasswordReset, token); err != utils.ErrNotExists {
+			t.Fatalf("token %q must be rejected, got %v", token, err)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	password := "second_factor"
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "paranoid", Status: pgtype.Present},
+		Password: &password,
+		PwdVer:   pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+	ctx := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1})
+
+	resp := testutils.MakeRequest(ctx, http.HandlerFunc(h.EnrollTOTP), "POST", "/users/2fa", nil, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("enroll: expected 200, got %d", resp.Code)
+	}
+	enrollment := &TOTPEnrollment{}
+	if err := json.Unmarshal(resp.Body.Bytes(), enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/WarScript:paranoid?") {
+		t.Fatalf("wrong uri: %s", enrollment.URI)
+	}
+
+	secret := us.users[1].TOTPSecret.Bytes
+	code := totp.Code(secret, time.Now())
+	// следующий период ещё принимается из-за totp.Skew
+	nextCode := totp.Code(secret, time.Now().Add(totp.Period))
+
+	cases := []*UserTestCase{
+		{ // неверный код
+			Case: testutils.Case{
+				Payload:      []byte(`{"code":"000000x"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"code":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/users/2fa/confirm",
+				Function:     h.ConfirmTOTP,
+				Context:      ctx,
+			},
+		},
+		{ // пока 2FA не включена, входим как обычно
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+	}
+	runTableAPITests(t, h, cases)
+
+	resp = testutils.MakeRequest(ctx, http.HandlerFunc(h.ConfirmTOTP), "POST", "/users/2fa/confirm",
+		nil, strings.NewReader(`{"code":"`+code+`"}`))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("confirm: expected 200, got %d %s", resp.Code, resp.Body.String())
+	}
+	codes := &RecoveryCodes{}
+	if err := json.Unmarshal(resp.Body.Bytes(), codes); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes.Codes) != recoveryCodesCount || !us.users[1].TOTPEnabled.Bool {
+		t.Fatalf("totp must be enabled with %d codes, got %v", recoveryCodesCount, codes.Codes)
+	}
+
+	cases = []*UserTestCase{
+		{ // повторно включить нельзя
+			Case: testutils.Case{
+				Payload:      nil,
+				ExpectedCode: 400,
+				ExpectedBody: `{"totp":"taken"}`,
+				Method:       "POST",
+				Pattern:      "/users/2fa",
+				Function:     h.EnrollTOTP,
+				Context:      ctx,
+			},
+		},
+		{ // пароль верный, ждём код
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{ // неверный код, challenge сгорает
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"123"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"code":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{ // повторно тот же challenge не принимается
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"` + code + `"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"challenge":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{ // кодом, которым включали 2FA, войти нельзя
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"` + code + `"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"code":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"` + nextCode + `"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{ // тот же код второй раз не принимается
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"` + nextCode + `"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"code":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{ // код восстановления в любом регистре
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","recovery_code":"` + strings.ToUpper(codes.Codes[0]) + `"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{ // код восстановления одноразовый
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","recovery_code":"` + codes.Codes[0] + `"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"recovery_code":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{ // без пароля не перевыпустить коды
+			Case: testutils.Case{
+				Payload:      []byte(`{"password":"wrong"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"password":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/users/2fa/recovery-codes",
+				Function:     h.RegenerateRecoveryCodes,
+				Context:      ctx,
+			},
+		},
+		{ // без пароля не выключить
+			Case: testutils.Case{
+				Payload:      []byte(`{}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"password":"required"}`,
+				Method:       "DELETE",
+				Pattern:      "/users/2fa",
+				Function:     h.DisableTOTP,
+				Context:      ctx,
+			},
+		},
+		{ // challenge выдан, пока 2FA ещё включена
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{ // Всё ок
+			Case: testutils.Case{
+				Payload:      []byte(`{"password":"second_factor"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "DELETE",
+				Pattern:      "/users/2fa",
+				Function:     h.DisableTOTP,
+				Context:      ctx,
+			},
+		},
+		{ // после выключения 2FA старый challenge не принимается
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"` + code + `"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"challenge":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+		{ // снова обычный вход
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"paranoid","password":"second_factor"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+	}
+	runTableAPITests(t, h, cases)
+
+	if len(us.recoveryCodes[1]) != 0 {
+		t.Fatalf("recovery codes must be deleted, got %d", len(us.recoveryCodes[1]))
+	}
+}
+
+// TestTOTPAfterRehash пересчёт хеша при входе не сбивает challenge второго фактора
+func TestTOTPAfterRehash(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	password := "old_params"
+	secret := []byte("12345678901234567890")
+	us.users[1] = UserModel{
+		ID:          pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username:    pgtype.Varchar{String: "legacy", Status: pgtype.Present},
+		Password:    &password,
+		PwdVer:      pgtype.Int8{Int: 3, Status: pgtype.Present},
+		Active:      pgtype.Bool{Bool: true, Status: pgtype.Present},
+		TOTPSecret:  pgtype.Bytea{Bytes: secret, Status: pgtype.Present},
+		TOTPEnabled: pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+	us.staleHashes = map[int64]bool{1: true}
+
+	cases := []*UserTestCase{
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"legacy","password":"old_params"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"` + totp.Code(secret, time.Now()) + `"}`),
+				ExpectedCode: 200,
+				ExpectedBody: ``,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+	}
+	runTableAPITests(t, h, cases)
+
+	if u := us.users[1]; u.PwdVer.Int != 3 || string(u.PasswordCrypt.Bytes) != "rehashed" {
+		t.Fatalf("expected rehash without pwd_ver bump, got %+v", u)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	password := "correct"
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "victim", Status: pgtype.Present},
+		Password: &password,
+		PwdVer:   pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+
+	wrong := &UserTestCase{
+		Case: testutils.Case{
+			Payload:      []byte(`{"username":"victim","password":"guess"}`),
+			ExpectedCode: 400,
+			ExpectedBody: `{"password":"invalid"}`,
+			Method:       "POST",
+			Pattern:      "/sessions",
+			Function:     h.CreateSession,
+		},
+	}
+	for i := int64(0); i < h.LoginGuard.Config.MaxUsernameAttempts; i++ {
+		runAPITest(t, h, int(i), wrong)
+	}
+
+	// даже верный пароль не проверяем, пока действует блокировка
+	resp := testutils.MakeRequest(nil, http.HandlerFunc(h.CreateSession), "POST", "/sessions", nil,
+		strings.NewReader(`{"username":"Victim","password":"correct"}`))
+	if resp.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d %s", resp.Code, resp.Body.String())
+	}
+	if resp.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected Retry-After 60, got %q", resp.Header().Get("Retry-After"))
+	}
+
+	// другого юзера блокировка не касается
+	runAPITest(t, h, 0, &UserTestCase{
+		Case: testutils.Case{
+			Payload:      []byte(`{"username":"somebody","password":"guess"}`),
+			ExpectedCode: 400,
+			ExpectedBody: `{"username":"not_exists"}`,
+			Method:       "POST",
+			Pattern:      "/sessions",
+			Function:     h.CreateSession,
+		},
+	})
+}
+
+// TestTOTPLockout знающий пароль не может перебирать коды, каждый раз заново вводя пароль
+func TestTOTPLockout(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	password := "correct"
+	us.users[1] = UserModel{
+		ID:          pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username:    pgtype.Varchar{String: "victim", Status: pgtype.Present},
+		Password:    &password,
+		PwdVer:      pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Active:      pgtype.Bool{Bool: true, Status: pgtype.Present},
+		TOTPSecret:  pgtype.Bytea{Bytes: []byte("12345678901234567890"), Status: pgtype.Present},
+		TOTPEnabled: pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+
+	cases := []*UserTestCase{
+		{ // пароль верный, но это ещё не вход
+			Case: testutils.Case{
+				Payload:      []byte(`{"username":"victim","password":"correct"}`),
+				ExpectedCode: 202,
+				ExpectedBody: `{"challenge":"tok0"}`,
+				Method:       "POST",
+				Pattern:      "/sessions",
+				Function:     h.CreateSession,
+			},
+		},
+		{
+			Case: testutils.Case{
+				Payload:      []byte(`{"challenge":"tok0","code":"000000"}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"code":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/sessions/2fa",
+				Function:     h.CreateSessionTOTP,
+			},
+		},
+	}
+	for i := int64(0); i < h.LoginGuard.Config.MaxUsernameAttempts; i++ {
+		runTableAPITests(t, h, cases)
+	}
+
+	retryAfter, err := h.LoginGuard.Check("victim", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retryAfter <= 0 {
+		t.Fatal("wrong second factor codes must lock the account")
+	}
+
+	resp := testutils.MakeRequest(nil, http.HandlerFunc(h.CreateSession), "POST", "/sessions", nil,
+		strings.NewReader(`{"username":"victim","password":"correct"}`))
+	if resp.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+// oidcRoundTrip проходит вход через заглушку провайдера так же, как браузер:
+// start -> провайдер -> callback. Возвращает ответ callback
+func oidcRouter(h *Handler, start http.HandlerFunc) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/auth/{provider}/login", start)
+	r.HandleFunc("/auth/{provider}/callback", h.OIDCCallback)
+	return r
+}
+
+func oidcRoundTrip(ctx context.Context, t *testing.T, h *Handler, start http.HandlerFunc) *httptest.ResponseRecorder {
+	r := oidcRouter(h, start)
+	callback, cookies := oidcAuthorize(ctx, t, r)
+	return testutils.MakeRequest(nil, r, "GET", callback, cookies, nil)
+}
+
+// oidcAuthorize проходит вход у провайдера, возвращает ссылку возврата и куки браузера
+func oidcAuthorize(ctx context.Context, t *testing.T, r http.Handler) (string, []*http.Cookie) {
+	resp := testutils.MakeRequest(ctx, r, "GET", "/auth/university/login?redirect=/games", nil, nil)
+	if resp.Code != http.StatusFound {
+		t.Fatalf("expected redirect to provider, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	idpResp, err := client.Get(resp.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpResp.Body.Close()
+
+	callback, err := url.Parse(idpResp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return callback.RequestURI(), resp.Result().Cookies()
+}
+
+func TestOIDC(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	idp := oidctest.NewServer("warscript", "secret")
+	defer idp.Close()
+	provider, err := oidc.NewProvider(idp.Config("university", "http://localhost/auth/university/callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.OIDCProviders = map[string]*oidc.Provider{"university": provider}
+	h.FrontendURL = "https://warscript.ru"
+
+	us := h.Users.(*UsersTest)
+	password := "student_password"
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "Student", Status: pgtype.Present},
+		Password: &password,
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+	idp.SetUser(map[string]interface{}{
+		"sub":                "s1",
+		"preferred_username": "student",
+	})
+
+	// первый вход: имя занято, создаём с суффиксом
+	resp := oidcRoundTrip(nil, t, h, h.OIDCLogin)
+	if resp.Code != http.StatusFound || resp.Header().Get("Location") != "https://warscript.ru/games" {
+		t.Fatalf("expected redirect to frontend, got %d %q", resp.Code, resp.Header().Get("Location"))
+	}
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != oidcNonceCookie || cookies[0].MaxAge >= 0 ||
+		cookies[1].Name != "JSESSIONID" {
+		t.Fatal("session cookie must be set and nonce cookie cleared")
+	}
+	if us.users[2].Username.String != "student_2" || us.identities["university:s1"] != 2 {
+		t.Fatalf("expected user student_2 linked to s1, got %+v", us.users[2].Username)
+	}
+
+	// второй вход: тот же юзер
+	if resp = oidcRoundTrip(nil, t, h, h.OIDCLogin); resp.Code != http.StatusFound || len(us.users) != 2 {
+		t.Fatalf("expected login into the same user, got %d, %d users", resp.Code, len(us.users))
+	}
+
+	// подтверждённую почту сохраняем, имя подгоняем под правила регистрации
+	idp.SetUser(map[string]interface{}{
+		"sub":                "s3",
+		"preferred_username": "Очень Длинное Имя Студента Из Университета",
+		"email":              "long@warscript.ru",
+		"email_verified":     true,
+	})
+	if resp = oidcRoundTrip(nil, t, h, h.OIDCLogin); resp.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d %s", resp.Code, resp.Body.String())
+	}
+	created := us.users[us.identities["university:s3"]]
+	if checkUsername(created.Username.String) != nil ||
+		created.Username.String != "ОченьДлинноеИмяСтудентаИз" ||
+		created.Email.String != "long@warscript.ru" || !created.EmailVerified.Bool {
+		t.Fatalf("expected truncated name with verified email, got %+v", created)
+	}
+
+	// занятую почту и неподтверждённую не берём, от пустого имени остаётся суффикс
+	for sub, claims := range map[string]map[string]interface{}{
+		"s4": {"preferred_username": "!!!", "email": "long@warscript.ru", "email_verified": true},
+		"s5": {"preferred_username": "!!!", "email": "fresh@warscript.ru"},
+	} {
+		claims["sub"] = sub
+		idp.SetUser(claims)
+		if resp = oidcRoundTrip(nil, t, h, h.OIDCLogin); resp.Code != http.StatusFound {
+			t.Fatalf("%s: expected redirect, got %d %s", sub, resp.Code, resp.Body.String())
+		}
+		created = us.users[us.identities["university:"+sub]]
+		if !regexp.MustCompile(`^university_[0-9a-f]{6}$`).MatchString(created.Username.String) ||
+			created.Email.Status == pgtype.Present {
+			t.Fatalf("%s: expected generated name without email, got %+v", sub, created)
+		}
+	}
+
+	// привязка чужого внешнего аккаунта
+	ctx := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1})
+	resp = oidcRoundTrip(ctx, t, h, h.OIDCLink)
+	if resp.Code != http.StatusBadRequest || resp.Body.String() != `{"identity":"taken"}` {
+		t.Fatalf("expected identity taken, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	idp.SetUser(map[string]interface{}{
+		"sub":                "s2",
+		"preferred_username": "student",
+	})
+	if resp = oidcRoundTrip(ctx, t, h, h.OIDCLink); resp.Code != http.StatusFound || us.identities["university:s2"] != 1 {
+		t.Fatalf("expected identity linked to user 1, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	// теперь у первого юзера включим 2FA: провайдер её не отменяет
+	u := us.users[1]
+	u.TOTPEnabled = pgtype.Bool{Bool: true, Status: pgtype.Present}
+	us.users[1] = u
+	resp = oidcRoundTrip(nil, t, h, h.OIDCLogin)
+	if resp.Code != http.StatusFound ||
+		!strings.HasPrefix(resp.Header().Get("Location"), "https://warscript.ru/login/2fa?challenge=") {
+		t.Fatalf("expected redirect to 2fa, got %d %q", resp.Code, resp.Header().Get("Location"))
+	}
+
+	// ссылку возврата с чужим state подсунули браузеру, который вход не начинал
+	r := oidcRouter(h, h.OIDCLogin)
+	callback, _ := oidcAuthorize(nil, t, r)
+	resp = testutils.MakeRequest(nil, r, "GET", callback, []*http.Cookie{{Name: oidcNonceCookie, Value: "mine"}}, nil)
+	if resp.Code != http.StatusBadRequest || resp.Body.String() != `{"state":"invalid"}` {
+		t.Fatalf("expected foreign state rejected, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	cases := []*UserTestCase{
+		{ // state не наш
+			Case: testutils.Case{
+				ExpectedCode: 400,
+				ExpectedBody: `{"state":"invalid"}`,
+				Method:       "GET",
+				Endpoint:     "/auth/university/callback?state=forged&code=code",
+				Pattern:      "/auth/{provider}/callback",
+				Function:     h.OIDCCallback,
+			},
+		},
+		{ // нет такого провайдера
+			Case: testutils.Case{
+				ExpectedCode: 404,
+				ExpectedBody: `{"message":"unknown provider \"gitlab\""}`,
+				Method:       "GET",
+				Endpoint:     "/auth/gitlab/login",
+				Pattern:      "/auth/{provider}/login",
+				Function:     h.OIDCLogin,
+			},
+		},
+	}
+	runTableAPITests(t, h, cases)
+}
+
+func TestSafeRedirect(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"":                  "/",
+		"/games/pong":       "/games/pong",
+		"//evil.com":        "/",
+		"/\\evil.com":     "/",
+		"https://evil.com/": "/",
+	}
+
+	for redirect, expected := range cases {
+		if actual := safeRedirect(redirect); actual != expected {
+			t.Fatalf("%q: expected %q, got %q", redirect, expected, actual)
+		}
+	}
+}
+
+func TestSignedSessions(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	denylist := &DenylistTest{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int64]time.Time),
+	}
+	oldKeys := &SignedSessions{
+		Keys:       map[string][]byte{"2019": []byte("old secret")},
+		CurrentKey: "2019",
+		Denylist:   denylist,
+	}
+	signed := &SignedSessions{
+		Keys:       map[string][]byte{"2019": []byte("old secret"), "2020": []byte("new secret")},
+		CurrentKey: "2020",
+		Denylist:   denylist,
+	}
+	h.Sessions = signed
+
+	us := h.Users.(*UsersTest)
+	password := "stateless"
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "jwt", Status: pgtype.Present},
+		Password: &password,
+		PwdVer:   pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+
+	session, err := h.StartSession(&UserModel{
+		ID:     pgtype.Int8{Int: 1, Status: pgtype.Present},
+		PwdVer: pgtype.Int8{Int: 1, Status: pgtype.Present},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// хендлеры работают как с redis-сессиями
+	cookies := []*http.Cookie{{Name: "JSESSIONID", Value: session.Token}}
+	runAPITest(t, h, 0, &UserTestCase{
+		Case: testutils.Case{
+			ExpectedCode: 200,
+			ExpectedBody: `{"username":"jwt","photo_uuid":"","id":1,"active":true}`,
+			Method:       "GET",
+			Pattern:      "/sessions",
+			Cookies:      cookies,
+			Function:     h.WithAuthentication(h.GetSession),
+		},
+	})
+
+	// токен, подписанный до ротации, ещё действует
+	old := &Session{UserID: 1, Payload: []byte(`{"id":1,"pwd_ver":1}`), ExpiresAfter: time.Hour}
+	if err = oldKeys.Set(old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signed.GetSession(old.Token); err != nil {
+		t.Fatalf("token signed with old key must be valid: %v", err)
+	}
+
+	parts := strings.Split(session.Token, ".")
+	forged := []string{
+		parts[0] + "." + parts[1] + ".",
+		// подменили payload, подпись старая
+		parts[0] + "." + b64.EncodeToString([]byte(`{"jti":"x","iat":0,"exp":9999999999,"sp":{"id":2}}`)) +
+			"." + parts[2],
+		// alg none
+		b64.EncodeToString([]byte(`{"alg":"none","kid":"2020"}`)) + "." + parts[1] + ".",
+		"garbage",
+	}
+	for _, token := range forged {
+		if _, err = signed.GetSession(token); errors.Cause(err) != utils.ErrNotExists {
+			t.Fatalf("forged token %q must be rejected, got %v", token, err)
+		}
+	}
+
+	expired := &Session{UserID: 1, Payload: []byte(`{}`), ExpiresAfter: -time.Second}
+	if err = signed.Set(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signed.GetSession(expired.Token); errors.Cause(err) != utils.ErrNotExists {
+		t.Fatalf("expired token must be rejected, got %v", err)
+	}
+
+	// выход отзывает только этот токен
+	if err = signed.Delete(session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signed.GetSession(session.Token); errors.Cause(err) != utils.ErrNotExists {
+		t.Fatalf("deleted token must be rejected, got %v", err)
+	}
+	if _, err = signed.GetSession(old.Token); err != nil {
+		t.Fatalf("other token must stay valid: %v", err)
+	}
+
+	// бан или сброс пароля -- все
+	if err = signed.DeleteUserSessions(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signed.GetSession(old.Token); errors.Cause(err) != utils.ErrNotExists {
+		t.Fatalf("user tokens must be revoked, got %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+	fresh := &Session{UserID: 1, Payload: []byte(`{}`), ExpiresAfter: time.Hour}
+	if err = signed.Set(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = signed.GetSession(fresh.Token); err != nil {
+		t.Fatalf("token issued after revocation must be valid: %v", err)
+	}
+}
+
+// TestRedisDenylistCache после загрузки отзывы проверяются по памяти, в redis не ходим
+func TestRedisDenylistCache(t *testing.T) {
+	t.Parallel()
+	// Redis нет: любое обращение к нему упадёт
+	rd := &RedisDenylist{
+		synced: true,
+		tokens: make(map[string]time.Time),
+		users:  make(map[int64]userRevocation),
+	}
+
+	now := time.Now()
+	publish := func(rev *revocation) {
+		data, err := json.Marshal(rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = rd.handle(&redis.Message{Channel: revokedChannel, Payload: string(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(&revocation{Token: "logged_out", Expires: now.Add(time.Hour).UnixNano()})
+	publish(&revocation{Token: "expired", Expires: now.Add(-time.Second).UnixNano()})
+	publish(&revocation{UserID: 1, Before: now.UnixNano(), Expires: now.Add(time.Hour).UnixNano()})
+	// более ранний отзыв пришёл позже, но не отменяет поздний
+	publish(&revocation{UserID: 1, Before: now.Add(-time.Hour).UnixNano(), Expires: now.Add(time.Hour).UnixNano()})
+
+	cases := []struct {
+		id       string
+		userID   int64
+		issued   time.Time
+		expected bool
+	}{
+		{"logged_out", 2, now, true},
+		{"expired", 2, now.Add(-time.Hour), false},
+		{"other", 1, now.Add(-time.Minute), true},
+		{"other", 1, now, true},
+		{"other", 1, now.Add(time.Millisecond), false},
+		{"other", 2, now.Add(-time.Minute), false},
+	}
+	for _, c := range cases {
+		revoked, err := rd.IsRevoked(c.id, c.userID, c.issued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != c.expected {
+			t.Fatalf("%s of user %d issued at %v: expected revoked=%v", c.id, c.userID, c.issued, c.expected)
+		}
+	}
+
+	rd.prune(now.Add(2 * time.Hour))
+	if len(rd.tokens) != 0 || len(rd.users) != 0 {
+		t.Fatalf("expired revocations must be pruned, got %v %v", rd.tokens, rd.users)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	password := "ci_pipeline"
+	us.users[1] = UserModel{
+		ID:       pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Username: pgtype.Varchar{String: "ci", Status: pgtype.Present},
+		Password: &password,
+		PwdVer:   pgtype.Int8{Int: 1, Status: pgtype.Present},
+		Active:   pgtype.Bool{Bool: true, Status: pgtype.Present},
+	}
+	us.ids = 2
+
+	ctx := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 1, PwdVer: 1})
+	runTableAPITests(t, h, []*UserTestCase{
+		{ // неизвестный scope
+			Case: testutils.Case{
+				Payload:      []byte(`{"name":"ci","scopes":["bots:delete"]}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"scopes":"invalid"}`,
+				Method:       "POST",
+				Pattern:      "/tokens",
+				Function:     h.CreateAPIToken,
+				Context:      ctx,
+			},
+		},
+		{ // без имени и scope
+			Case: testutils.Case{
+				Payload:      []byte(`{}`),
+				ExpectedCode: 400,
+				ExpectedBody: `{"name":"required","scopes":"required"}`,
+				Method:       "POST",
+				Pattern:      "/tokens",
+				Function:     h.CreateAPIToken,
+				Context:      ctx,
+			},
+		},
+	})
+
+	resp := testutils.MakeRequest(ctx, http.HandlerFunc(h.CreateAPIToken), "POST", "/tokens", nil,
+		strings.NewReader(`{"name":"ci","scopes":["bots:write"]}`))
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("create token: %d %s", resp.Code, resp.Body.String())
+	}
+	created := &NewAPIToken{}
+	if err := json.Unmarshal(resp.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Token, APITokenPrefix) {
+		t.Fatalf("unexpected token format %q", created.Token)
+	}
+
+	// секрет больше нигде не показывается
+	resp = testutils.MakeRequest(ctx, http.HandlerFunc(h.GetAPITokens), "GET", "/tokens", nil, nil)
+	if resp.Code != http.StatusOK || strings.Contains(resp.Body.String(), created.Token) ||
+		!strings.Contains(resp.Body.String(), `"scopes":["bots:write"]`) {
+		t.Fatalf("list tokens: %d %s", resp.Code, resp.Body.String())
+	}
+
+	protected := func(scope Scope) http.HandlerFunc {
+		return WithScope(h.WithAuthentication(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(strconv.FormatInt(SessionInfo(r).ID, 10)))
+		}), scope)
+	}
+	bearer := map[string]string{"Authorization": "Bearer " + created.Token}
+	runTableAPITests(t, h, []*UserTestCase{
+		{ // токен с нужным scope, CSRF не нужен
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: `1`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Headers:      bearer,
+				Function:     protected(ScopeBotsWrite),
+			},
+		},
+		{ // scope не выдан
+			Case: testutils.Case{
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"scope bots:read required"}`,
+				Method:       "GET",
+				Pattern:      "/bots",
+				Headers:      bearer,
+				Function:     protected(ScopeBotsRead),
+			},
+		},
+		{ // ручка без WithScope доступна только по сессии
+			Case: testutils.Case{
+				ExpectedCode: 403,
+				ExpectedBody: `{"message":"api tokens are not allowed here"}`,
+				Method:       "POST",
+				Pattern:      "/tokens",
+				Headers:      bearer,
+				Function:     h.WithAuthentication(h.CreateAPIToken),
+			},
+		},
+		{ // чужой токен
+			Case: testutils.Case{
+				ExpectedCode: 401,
+				ExpectedBody: `{"message":"api token is not valid: not_exists"}`,
+				Method:       "POST",
+				Pattern:      "/bots",
+				Headers:      map[string]string{"Authorization": "Bearer wst_forged"},
+				Function:     protected(ScopeBotsWrite),
+			},
+		},
+	})
+
+	at := h.APITokens.(*APITokensTest)
+	if at.touched != 1 {
+		t.Fatalf("last_used must be updated once per interval, touched %d times", at.touched)
+	}
+
+	// истёкший токен не пускает
+	token := at.tokens[created.ID]
+	token.Expires = pgtype.Timestamptz{Time: time.Now().Add(-time.Second), Status: pgtype.Present}
+	at.tokens[created.ID] = token
+	resp = testutils.MakeRequestWithHeaders(context.Background(), protected(ScopeBotsWrite), "POST", "/bots", nil, bearer, nil)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expired token must be rejected, got %d", resp.Code)
+	}
+
+	// отзыв чужого токена не проходит
+	other := context.WithValue(context.Background(), SessionInfoKey, &SessionPayload{ID: 2})
+	runTableAPITests(t, h, []*UserTestCase{
+		{
+			Case: testutils.Case{
+				ExpectedCode: 404,
+				ExpectedBody: `{"message":"api token not exists: not_exists"}`,
+				Method:       "DELETE",
+				Pattern:      "/tokens/{token_id}",
+				Endpoint:     "/tokens/" + strconv.FormatInt(created.ID, 10),
+				Function:     h.DeleteAPIToken,
+				Context:      other,
+			},
+		},
+		{
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				Method:       "DELETE",
+				Pattern:      "/tokens/{token_id}",
+				Endpoint:     "/tokens/" + strconv.FormatInt(created.ID, 10),
+				Function:     h.DeleteAPIToken,
+				Context:      ctx,
+			},
+		},
+	})
+	if len(at.tokens) != 0 {
+		t.Fatal("token must be deleted")
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler()
+
+	us := h.Users.(*UsersTest)
+	for i, name := range []string{"GDVFox", "gdv_second", "Apakhov", "gdvbanned"} {
+		id := int64(i + 1)
+		us.users[id] = UserModel{
+			ID:       pgtype.Int8{Int: id, Status: pgtype.Present},
+			Username: pgtype.Varchar{String: name, Status: pgtype.Present},
+			Active:   pgtype.Bool{Bool: name != "gdvbanned", Status: pgtype.Present},
+		}
+	}
+	us.ids = 5
+
+	cases := []*UserTestCase{
+		{ // по префиксу без учёта регистра, забаненных не видно
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: `[{"username":"GDVFox","photo_uuid":"","id":1,"active":true},` +
+					`{"username":"gdv_second","photo_uuid":"","id":2,"active":true}]`,
+				Method:   "GET",
+				Pattern:  "/users",
+				Endpoint: "/users?query=gdv",
+				Function: h.SearchUsers,
+			},
+		},
+		{ // пагинация
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: `[{"username":"gdv_second","photo_uuid":"","id":2,"active":true}]`,
+				Method:       "GET",
+				Pattern:      "/users",
+				Endpoint:     "/users?query=gdv&limit=1&offset=1",
+				Function:     h.SearchUsers,
+			},
+		},
+		{ // ничего не нашли
+			Case: testutils.Case{
+				ExpectedCode: 200,
+				ExpectedBody: `[]`,
+				Method:       "GET",
+				Pattern:      "/users",
+				Endpoint:     "/users?query=nobody",
+				Function:     h.SearchUsers,
+			},
+		},
+		{ // без запроса
+			Case: testutils.Case{
+				ExpectedCode: 400,
+				ExpectedBody: `{"query":"required"}`,
+				Method:       "GET",
+				Pattern:      "/users",
+				Function:     h.SearchUsers,
+			},
+		},
+		{ // одна буква и слишком большой limit
+			Case: testutils.Case{
+				ExpectedCode: 400,
+				ExpectedBody: `{"limit":"invalid","offset":"invalid","query":"too_short"}`,
+				Method:       "GET",
+				Pattern:      "/users",
+				Endpoint:     "/users?query=g&limit=1000&offset=-1",
+				Function:     h.SearchUsers,
+			},
+		},
+		{ // ошибка базы
+			Case: testutils.Case{
+				ExpectedCode: 500,
+				ExpectedBody: `{"message":"search users method error: internal server error"}`,
+				Method:       "GET",
+				Pattern:      "/users",
+				Endpoint:     "/users?query=gdv",
+				Function:     h.SearchUsers,
+			},
+			FailureUser: utils.ErrInternal,
+		},
 	}
 
-	runTableAPITests(t, cases1)
+	runTableAPITests(t, h, cases)
 }
@@ -21,6 +21,14 @@ var (
 	ErrTaken = errors.New("taken")
 	// ErrNotExists такой записи нет
 	ErrNotExists = errors.New("not_exists")
+	// ErrTooShort значение короче допустимого
+	ErrTooShort = errors.New("too_short")
+	// ErrTooLong значение длиннее допустимого
+	ErrTooLong = errors.New("too_long")
+	// ErrWeak пароль легко угадать
+	ErrWeak = errors.New("weak")
+	// ErrInactive аккаунт заблокирован или деактивирован
+	ErrInactive = errors.New("inactive")
 	// ErrInternal всё очень плохо
 	ErrInternal = errors.New("internal server error")
 )
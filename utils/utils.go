@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -57,3 +61,48 @@ func WriteApplicationJSON(w http.ResponseWriter, code int, v interface{}) {
 		logger.Error(err)
 	}
 }
+
+// ClientIPResolver откуда брать адрес клиента, собирается из конфига в main
+type ClientIPResolver struct {
+	// TrustProxy брать ли адрес клиента из X-Forwarded-For.
+	// Включать только за своим прокси, иначе заголовок подделывается
+	TrustProxy bool
+}
+
+// IP адрес клиента без порта. Из X-Forwarded-For берётся последний
+// адрес: его дописал наш прокси, всё левее клиент мог прислать сам
+func (res ClientIPResolver) IP(r *http.Request) string {
+	if res.TrustProxy {
+		forwarded := r.Header["X-Forwarded-For"]
+		if len(forwarded) != 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// ParseIntParam читает необязательный числовой параметр запроса в пределах [min, max],
+// если параметра нет, dst не меняется
+func ParseIntParam(values url.Values, name string, dst *int, min, max int) bool {
+	raw := values.Get(name)
+	if raw == "" {
+		return true
+	}
+
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < min || v > max {
+		return false
+	}
+
+	*dst = v
+	return true
+}
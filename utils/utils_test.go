@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIPSpoofedHeader(t *testing.T) {
+	t.Parallel()
+	ips := ClientIPResolver{TrustProxy: true}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "10.0.0.2:41000"
+
+	// первый адрес прислал клиент, последний дописал прокси
+	r.Header.Add("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	if ip := ips.IP(r); ip != "203.0.113.7" {
+		t.Fatalf("expected address appended by proxy, got %s", ip)
+	}
+
+	// клиент прислал свой заголовок, прокси добавил ещё один
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.Header.Add("X-Forwarded-For", "203.0.113.7")
+	if ip := ips.IP(r); ip != "203.0.113.7" {
+		t.Fatalf("expected address from the last header, got %s", ip)
+	}
+
+	r.Header.Del("X-Forwarded-For")
+	if ip := ips.IP(r); ip != "10.0.0.2" {
+		t.Fatalf("expected remote address, got %s", ip)
+	}
+}
+
+func TestClientIPUntrusted(t *testing.T) {
+	t.Parallel()
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "10.0.0.2:41000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	// без своего прокси заголовку не верим вовсе
+	if ip := (ClientIPResolver{}).IP(r); ip != "10.0.0.2" {
+		t.Fatalf("expected remote address, got %s", ip)
+	}
+}